@@ -0,0 +1,206 @@
+// Copyright 2013 M-Lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !appengine
+// +build !appengine
+
+// mlab-ns2 runs the mlab-ns2 lookup service as a standalone server, outside of
+// App Engine.
+//
+// Public endpoints such as /rtt/ and /geo are served on -addr. Admin endpoints
+// under /admin/ are only served on -admin_addr, which defaults to localhost.
+// Task queue tasks are run synchronously in-process. RTT data is imported from
+// row files in -import_dir, as BigQuery is only available on App Engine.
+//
+// Example usage:
+//
+//	mlab-ns2 -addr=:8080 -store=file -store_dir=/var/lib/mlab-ns2 -cache=memory
+package main
+
+import (
+	"code.google.com/p/mlab-ns2/gae/ns"
+	"code.google.com/p/mlab-ns2/gae/ns/data"
+	"code.google.com/p/mlab-ns2/gae/ns/handlers"
+	"code.google.com/p/mlab-ns2/gae/ns/rtt"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	backendMemory = "memory"
+	backendFile   = "file"
+)
+
+var (
+	addr      = flag.String("addr", ":8080", "Address on which to serve public endpoints.")
+	adminAddr = flag.String("admin_addr", "localhost:8081", "Address on which to serve all endpoints including /admin/. Empty to disable.")
+	storeKind = flag.String("store", backendMemory, "Storage backend: memory or file.")
+	storeDir  = flag.String("store_dir", "mlab-ns2-data", "Directory for the file storage backend.")
+	cacheKind = flag.String("cache", backendMemory, "Cache backend: memory or file.")
+	cacheDir  = flag.String("cache_dir", "mlab-ns2-cache", "Directory for the file cache backend.")
+
+	importDir = flag.String("import_dir", "", "Directory of RTT row files named by date, e.g., 2013-08-18.csv.gz, to import instead of BigQuery.")
+
+	importParallelism = flag.Int("import_parallelism", rtt.ImportParallelism, "Number of pages of RTT rows read ahead during an import.")
+	putStaging        = flag.String("put_staging", rtt.ImportPutStaging.Name(), "Where imports stage ClientGroups until they are put: auto, store, payload or cache.")
+
+	toolPolicies toolPolicyFlag
+
+	rttTolerance    = flag.Float64("rtt_tolerance", handlers.DefaultLoadBalancer.RTTTolerance, "RTT in ms within which Sites are load balanced as equivalent.")
+	rttHalfLife     = flag.Duration("rtt_half_life", rtt.RTTHalfLife, "Age at which RTT samples count half as much against newer samples, and beyond which their minimum RTT is replaced. 0 to disable.")
+	rttEWMAHalfLife = flag.Duration("rtt_ewma_half_life", rtt.EWMAHalfLife, "Age at which RTT samples count half as much in the ewma RTT metric.")
+	rttHorizon      = flag.Duration("rtt_horizon", rtt.SiteRTTHorizon, "Age beyond the latest sample of a ClientGroup at which SiteRTTs are dropped. 0 to disable.")
+	v4PrefixSize    = flag.Int("v4_prefix_size", rtt.V4PrefixSize, "Size of the IPv4 prefixes by which clients are grouped.")
+	v6PrefixSize    = flag.Int("v6_prefix_size", rtt.V6PrefixSize, "Size of the IPv6 prefixes by which clients are grouped.")
+	rttMetric       = flag.String("rtt_metric", string(rtt.RankingMetric), "Statistic of RTT samples by which Sites are ranked: min, median, mean or ewma.")
+	pfx2as          = flag.String("pfx2as", "", "RouteViews prefix-to-AS file, optionally gzipped, by whose announced prefixes clients are grouped instead of fixed prefix sizes.")
+	groupByASN      = flag.Bool("group_by_asn", false, "Group clients by the origin AS of their announced prefix. Requires -pfx2as.")
+
+	rttMin         = flag.Float64("rtt_min", rtt.ImportRowFilter.MinRTT, "RTT in ms at or below which imported rows are rejected.")
+	rttMax         = flag.Float64("rtt_max", rtt.ImportRowFilter.MaxRTT, "RTT in ms above which imported rows are rejected. 0 for no limit.")
+	rttMaxSpeed    = flag.Float64("rtt_max_speed", rtt.ImportRowFilter.MaxSpeed, "Speed in km/ms faster than which imported rows are rejected, between the Site and the geolocated client. 0 to disable.")
+	rttOutlierMADs = flag.Float64("rtt_outlier_mads", rtt.ImportRowFilter.OutlierMADs, "Median absolute deviations beyond which imported rows are rejected as outliers of their ClientGroup and Site. 0 to disable.")
+)
+
+func init() {
+	flag.Var(&toolPolicies, "tool_policy", "Server selection policy for a tool as tool_id:policy[,policy...], e.g., ndt:rtt,geo. May be repeated.")
+}
+
+// toolPolicyFlag is a repeatable flag of tool_id:policy values.
+type toolPolicyFlag []string
+
+func (f *toolPolicyFlag) String() string {
+	return strings.Join(*f, " ")
+}
+
+func (f *toolPolicyFlag) Set(value string) error {
+	if !strings.Contains(value, ":") {
+		return fmt.Errorf("tool policy %q is not of the form tool_id:policy", value)
+	}
+	*f = append(*f, value)
+	return nil
+}
+
+// newStore returns the data.Store selected by flags.
+func newStore() (data.Store, error) {
+	switch *storeKind {
+	case backendMemory:
+		return data.NewMemoryStore(), nil
+	case backendFile:
+		return data.NewFileStore(*storeDir)
+	}
+	return nil, fmt.Errorf("unknown storage backend %q", *storeKind)
+}
+
+// newCache returns the data.Cache selected by flags.
+func newCache() (data.Cache, error) {
+	switch *cacheKind {
+	case backendMemory:
+		return data.NewMemoryCache(), nil
+	case backendFile:
+		return data.NewFileCache(*cacheDir)
+	}
+	return nil, fmt.Errorf("unknown cache backend %q", *cacheKind)
+}
+
+// publicHandler serves h but hides the admin and App Engine internal
+// endpoints, which are protected by login: admin in app.yaml on App Engine.
+func publicHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/admin/") || strings.HasPrefix(r.URL.Path, "/_ah/") {
+			http.NotFound(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func main() {
+	flag.Parse()
+	logger := log.New(os.Stderr, "mlab-ns2: ", log.LstdFlags)
+	handlers.DefaultLoadBalancer.RTTTolerance = *rttTolerance
+	rtt.ImportParallelism = *importParallelism
+	staging, err := rtt.GetPutStaging(*putStaging)
+	if err != nil {
+		logger.Fatalf("%s: %s", *putStaging, err)
+	}
+	rtt.ImportPutStaging = staging
+	metric, err := rtt.ParseRTTMetric(*rttMetric)
+	if err != nil {
+		logger.Fatalf("%s: %s", *rttMetric, err)
+	}
+	rtt.RankingMetric = metric
+	rtt.RTTHalfLife = *rttHalfLife
+	rtt.EWMAHalfLife = *rttEWMAHalfLife
+	rtt.SiteRTTHorizon = *rttHorizon
+	rtt.ImportRowFilter.MinRTT, rtt.ImportRowFilter.MaxRTT = *rttMin, *rttMax
+	rtt.ImportRowFilter.MaxSpeed = *rttMaxSpeed
+	rtt.ImportRowFilter.OutlierMADs = *rttOutlierMADs
+	if err := rtt.CheckPrefixSizes(*v4PrefixSize, *v6PrefixSize); err != nil {
+		logger.Fatalf("/%d, /%d: %s", *v4PrefixSize, *v6PrefixSize, err)
+	}
+	rtt.V4PrefixSize, rtt.V6PrefixSize = *v4PrefixSize, *v6PrefixSize
+	if *pfx2as != "" {
+		table, err := rtt.LoadPfx2as(*pfx2as)
+		if err != nil {
+			logger.Fatalf("%s: %s", *pfx2as, err)
+		}
+		rtt.ClientGrouping = &rtt.PrefixGrouper{Table: table, ByASN: *groupByASN}
+		logger.Printf("Grouping clients by %d announced prefixes of %s", table.Len, *pfx2as)
+	} else if *groupByASN {
+		logger.Fatalf("-group_by_asn requires -pfx2as")
+	}
+	for _, tp := range toolPolicies {
+		p := strings.SplitN(tp, ":", 2)
+		if err := handlers.SetToolPolicy(p[0], p[1]); err != nil {
+			logger.Fatalf("%s: %s", tp, err)
+		}
+	}
+
+	store, err := newStore()
+	if err != nil {
+		logger.Fatal(err)
+	}
+	cache, err := newCache()
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	// The queue dispatches tasks to the mux, which is populated below.
+	var mux *http.ServeMux
+	queue := data.NewLocalQueue(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.ServeHTTP(w, r)
+	}))
+	c := data.NewContext(store, cache, queue, logger)
+	newContext := func(r *http.Request) data.Context {
+		return c
+	}
+	mux = ns.NewServeMux(newContext)
+	if *importDir != "" {
+		handlers.RegisterFileImport(mux, newContext, *importDir)
+	}
+
+	if *adminAddr != "" {
+		go func() {
+			logger.Printf("Serving admin endpoints on %s", *adminAddr)
+			logger.Fatal(http.ListenAndServe(*adminAddr, mux))
+		}()
+	}
+	logger.Printf("Serving public endpoints on %s", *addr)
+	logger.Fatal(http.ListenAndServe(*addr, publicHandler(mux)))
+}
@@ -0,0 +1,138 @@
+// Copyright 2013 M-Lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// standaloneContext is a Context for use outside of App Engine.
+type standaloneContext struct {
+	store  Store
+	cache  Cache
+	queue  Queue
+	logger *log.Logger
+}
+
+// NewContext returns a Context which uses the provided Store, Cache and Queue.
+// Log messages are written to logger, prefixed with their severity.
+func NewContext(store Store, cache Cache, queue Queue, logger *log.Logger) Context {
+	return &standaloneContext{
+		store:  store,
+		cache:  cache,
+		queue:  queue,
+		logger: logger,
+	}
+}
+
+func (c *standaloneContext) logf(level, format string, args ...interface{}) {
+	c.logger.Printf("%s: %s", level, fmt.Sprintf(format, args...))
+}
+
+func (c *standaloneContext) Debugf(format string, args ...interface{}) {
+	c.logf("DEBUG", format, args...)
+}
+
+func (c *standaloneContext) Infof(format string, args ...interface{}) {
+	c.logf("INFO", format, args...)
+}
+
+func (c *standaloneContext) Warningf(format string, args ...interface{}) {
+	c.logf("WARNING", format, args...)
+}
+
+func (c *standaloneContext) Errorf(format string, args ...interface{}) {
+	c.logf("ERROR", format, args...)
+}
+
+func (c *standaloneContext) Store() Store {
+	return c.store
+}
+
+func (c *standaloneContext) Cache() Cache {
+	return c.cache
+}
+
+func (c *standaloneContext) Queue() Queue {
+	return c.queue
+}
+
+func (c *standaloneContext) HTTPClient() *http.Client {
+	return http.DefaultClient
+}
+
+// RemoteIP returns the IP address string of the client which made r. Unlike
+// on App Engine, r.RemoteAddr includes a port number when served by net/http.
+func RemoteIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// localQueue is a Queue which runs tasks in-process.
+type localQueue struct {
+	handler http.Handler
+}
+
+// NewLocalQueue returns a Queue which runs each task synchronously by sending
+// it as a POST request to handler. Queue names are ignored and failed tasks
+// are not retried; instead Add returns an error.
+func NewLocalQueue(handler http.Handler) Queue {
+	return &localQueue{handler}
+}
+
+func (q *localQueue) Add(queueName, path string, values url.Values) error {
+	r, err := http.NewRequest("POST", path, strings.NewReader(values.Encode()))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("X-AppEngine-QueueName", queueName)
+
+	w := &taskResponseWriter{header: make(http.Header), status: http.StatusOK}
+	q.handler.ServeHTTP(w, r)
+	if w.status < 200 || w.status >= 300 {
+		return fmt.Errorf("data: task %s on queue %s failed with status %d: %s",
+			path, queueName, w.status, strings.TrimSpace(w.body.String()))
+	}
+	return nil
+}
+
+// taskResponseWriter is an http.ResponseWriter which records the result of a
+// task run by localQueue.
+type taskResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *taskResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *taskResponseWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+func (w *taskResponseWriter) WriteHeader(status int) {
+	w.status = status
+}
@@ -0,0 +1,217 @@
+// Copyright 2013 M-Lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build appengine
+
+package data
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+	"appengine/taskqueue"
+	"appengine/urlfetch"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// gaeContext is a Context backed by the App Engine datastore, memcache and
+// taskqueue services.
+type gaeContext struct {
+	appengine.Context
+}
+
+// NewGAEContext returns a Context which uses the App Engine services available
+// to c.
+func NewGAEContext(c appengine.Context) Context {
+	return &gaeContext{c}
+}
+
+func (c *gaeContext) Store() Store {
+	return &gaeStore{c.Context}
+}
+
+func (c *gaeContext) Cache() Cache {
+	return &gaeCache{c.Context}
+}
+
+func (c *gaeContext) Queue() Queue {
+	return &gaeQueue{c.Context}
+}
+
+func (c *gaeContext) HTTPClient() *http.Client {
+	return urlfetch.Client(c.Context)
+}
+
+// GAERequestContext returns a Context for the App Engine request r. It is a
+// ContextFunc.
+func GAERequestContext(r *http.Request) Context {
+	return NewGAEContext(appengine.NewContext(r))
+}
+
+// gaeStore implements Store using the App Engine datastore.
+type gaeStore struct {
+	c appengine.Context
+}
+
+// dsKey converts a *Key into a *datastore.Key.
+func (s *gaeStore) dsKey(k *Key) *datastore.Key {
+	if k == nil {
+		return nil
+	}
+	return datastore.NewKey(s.c, k.Kind, k.StringID, 0, s.dsKey(k.Parent))
+}
+
+func (s *gaeStore) dsKeys(keys []*Key) []*datastore.Key {
+	dsKeys := make([]*datastore.Key, len(keys))
+	for i, k := range keys {
+		dsKeys[i] = s.dsKey(k)
+	}
+	return dsKeys
+}
+
+// fromDSKey converts a *datastore.Key into a *Key.
+func fromDSKey(k *datastore.Key) *Key {
+	if k == nil {
+		return nil
+	}
+	return NewKey(k.Kind(), k.StringID(), fromDSKey(k.Parent()))
+}
+
+// fromDSError converts datastore and appengine errors into their data package
+// equivalents.
+func fromDSError(err error) error {
+	switch e := err.(type) {
+	case appengine.MultiError:
+		merr := make(MultiError, len(e))
+		for i, err := range e {
+			merr[i] = fromDSError(err)
+		}
+		return merr
+	}
+	switch err {
+	case datastore.ErrNoSuchEntity:
+		return ErrNoSuchEntity
+	case datastore.ErrConcurrentTransaction:
+		return ErrConcurrentTransaction
+	}
+	return err
+}
+
+func (s *gaeStore) Get(key *Key, dst interface{}) error {
+	return fromDSError(datastore.Get(s.c, s.dsKey(key), dst))
+}
+
+func (s *gaeStore) GetMulti(keys []*Key, dst interface{}) error {
+	return fromDSError(datastore.GetMulti(s.c, s.dsKeys(keys), dst))
+}
+
+func (s *gaeStore) Put(key *Key, src interface{}) error {
+	_, err := datastore.Put(s.c, s.dsKey(key), src)
+	return fromDSError(err)
+}
+
+func (s *gaeStore) PutMulti(keys []*Key, src interface{}) error {
+	_, err := datastore.PutMulti(s.c, s.dsKeys(keys), src)
+	return fromDSError(err)
+}
+
+func (s *gaeStore) Delete(key *Key) error {
+	return fromDSError(datastore.Delete(s.c, s.dsKey(key)))
+}
+
+func (s *gaeStore) DeleteMulti(keys []*Key) error {
+	return fromDSError(datastore.DeleteMulti(s.c, s.dsKeys(keys)))
+}
+
+func (s *gaeStore) GetAll(q *Query, dst interface{}) ([]*Key, error) {
+	if q.err != nil {
+		return nil, q.err
+	}
+	dsq := datastore.NewQuery(q.kind)
+	if q.ancestor != nil {
+		dsq = dsq.Ancestor(s.dsKey(q.ancestor))
+	}
+	for _, f := range q.filters {
+		value := f.value
+		if k, ok := value.(*Key); ok && f.field == KeyField {
+			value = s.dsKey(k)
+		}
+		dsq = dsq.Filter(strings.Join([]string{f.field, f.op}, " "), value)
+	}
+	for _, o := range q.order {
+		dsq = dsq.Order(o)
+	}
+	if q.limit > 0 {
+		dsq = dsq.Limit(q.limit)
+	}
+	if dst == nil {
+		dsq = dsq.KeysOnly()
+	}
+
+	dsKeys, err := dsq.GetAll(s.c, dst)
+	keys := make([]*Key, len(dsKeys))
+	for i, k := range dsKeys {
+		keys[i] = fromDSKey(k)
+	}
+	return keys, fromDSError(err)
+}
+
+func (s *gaeStore) RunInTransaction(f func(tx Store) error) error {
+	err := datastore.RunInTransaction(s.c, func(tc appengine.Context) error {
+		return f(&gaeStore{tc})
+	}, nil)
+	return fromDSError(err)
+}
+
+// gaeCache implements Cache using memcache and gob encoding.
+type gaeCache struct {
+	c appengine.Context
+}
+
+func fromMCError(err error) error {
+	if err == memcache.ErrCacheMiss {
+		return ErrCacheMiss
+	}
+	return err
+}
+
+func (mc *gaeCache) Get(key string, dst interface{}) error {
+	_, err := memcache.Gob.Get(mc.c, key, dst)
+	return fromMCError(err)
+}
+
+func (mc *gaeCache) Set(key string, src interface{}) error {
+	item := &memcache.Item{
+		Key:    key,
+		Object: src,
+	}
+	return fromMCError(memcache.Gob.Set(mc.c, item))
+}
+
+func (mc *gaeCache) Delete(key string) error {
+	return fromMCError(memcache.Delete(mc.c, key))
+}
+
+// gaeQueue implements Queue using taskqueue.
+type gaeQueue struct {
+	c appengine.Context
+}
+
+func (q *gaeQueue) Add(queueName, path string, values url.Values) error {
+	task := taskqueue.NewPOSTTask(path, values)
+	_, err := taskqueue.Add(q.c, task, queueName)
+	return err
+}
@@ -23,6 +23,11 @@ import (
 const (
 	SliverStatusOnline  = "online"
 	SliverStatusOffline = "offline"
+
+	SliverIPOff = "off" // Value of SliverIPv4 and SliverIPv6 if there is no address
+
+	AddressFamilyIPv4 = "ipv4"
+	AddressFamilyIPv6 = "ipv6"
 )
 
 //TODO: Data interface and Get,Put,Cache,Rm functions?
@@ -46,6 +51,8 @@ type SliverTool struct {
 	Longitude              float64   `datastore:"longitude"`                // To avoid an additional lookup in the datastore
 	City                   string    `datastore:"city"`                     // To avoid an additional lookup in the datastore
 	Country                string    `datastore:"country"`                  // To avoid an additional lookup in the datastore
+	Capacity               float64   `datastore:"capacity"`                 // Relative capacity used to weight selection. 0 is treated as 1.
+	Load                   float64   `datastore:"load"`                     // Current load as a fraction of capacity, from 0 to 1.
 	When                   time.Time `datastore:"when"`                     // Date representing the last modification time of this entity.
 }
 
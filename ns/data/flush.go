@@ -12,28 +12,21 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-// +build appengine
-
 package data
 
-import (
-	"appengine"
-	"appengine/memcache"
-)
-
 //
-func FlushSite(c appengine.Context, siteID string) error {
+func FlushSite(c Context, siteID string) error {
 	return mcFlushKey(c, siteID)
 }
 
 //
-func FlushSliverToolsWithToolID(c appengine.Context, toolID string) error {
+func FlushSliverToolsWithToolID(c Context, toolID string) error {
 	return mcFlushKey(c, toolID)
 }
 
-func mcFlushKey(c appengine.Context, key string) error {
-	err := memcache.Delete(c, key)
-	if err != memcache.ErrCacheMiss {
+func mcFlushKey(c Context, key string) error {
+	err := c.Cache().Delete(key)
+	if err != ErrCacheMiss {
 		return err
 	}
 	return nil
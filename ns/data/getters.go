@@ -12,15 +12,10 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-// +build appengine
-
 package data
 
 import (
-	"appengine"
-	"appengine/datastore"
 	"errors"
-	"math/rand"
 )
 
 var (
@@ -29,8 +24,8 @@ var (
 )
 
 // GetSliverTools returns a list of all SliverTools.
-func GetSliverTools(c appengine.Context) ([]*SliverTool, error) {
-	q := datastore.NewQuery("SliverTool")
+func GetSliverTools(c Context) ([]*SliverTool, error) {
+	q := NewQuery("SliverTool")
 	var slivers []*SliverTool
 	if err := QueryData(c, "SliverTools", q, &slivers); err != nil {
 		return nil, err
@@ -40,8 +35,8 @@ func GetSliverTools(c appengine.Context) ([]*SliverTool, error) {
 
 // GetSliverToolsWithToolID returns a list of SliverTools which run an M-Lab
 // tool with ID, toolID.
-func GetSliverToolsWithToolID(c appengine.Context, toolID string) ([]*SliverTool, error) {
-	q := datastore.NewQuery("SliverTool").Filter("tool_id =", toolID)
+func GetSliverToolsWithToolID(c Context, toolID string) ([]*SliverTool, error) {
+	q := NewQuery("SliverTool").Filter("tool_id =", toolID)
 	var slivers []*SliverTool
 	if err := QueryData(c, toolID, q, &slivers); err != nil {
 		return nil, err
@@ -51,8 +46,8 @@ func GetSliverToolsWithToolID(c appengine.Context, toolID string) ([]*SliverTool
 
 // GetRandomSliverFromSite returns a randomly selected online SliverTool from a
 // list of SliverTools which run an M-Lab tool with ID toolID on an M-Lab site
-// with ID siteID.
-func GetRandomSliverFromSite(c appengine.Context, toolID, siteID string) (*SliverTool, error) {
+// with ID siteID. SliverTools are weighted by their spare capacity.
+func GetRandomSliverFromSite(c Context, toolID, siteID string) (*SliverTool, error) {
 	slivers, err := GetSliverToolsWithToolID(c, toolID)
 	if err != nil {
 		return nil, err
@@ -70,13 +65,12 @@ func GetRandomSliverFromSite(c appengine.Context, toolID, siteID string) (*Slive
 		return nil, ErrNoMatchingSliverTool
 	}
 
-	idx := rand.Int() % len(siteslivers) // Get random index
-	return siteslivers[idx], nil
+	return WeightedRandomSliver(siteslivers, (*SliverTool).Weight), nil
 }
 
 // GetSiteWithSiteID returns a Site which matches a provided site ID.
-func GetSiteWithSiteID(c appengine.Context, siteID string) (*Site, error) {
-	q := datastore.NewQuery("Site").Filter("site_id =", siteID)
+func GetSiteWithSiteID(c Context, siteID string) (*Site, error) {
+	q := NewQuery("Site").Filter("site_id =", siteID)
 	var sites []*Site
 	if err := QueryData(c, siteID, q, &sites); err != nil {
 		return nil, err
@@ -88,9 +82,9 @@ func GetSiteWithSiteID(c appengine.Context, siteID string) (*Site, error) {
 }
 
 // GetAllSites returns an array of all the Sites in the datastore
-func GetAllSites(c appengine.Context) ([]*Site, []*datastore.Key, error) {
-	q := datastore.NewQuery("Site")
+func GetAllSites(c Context) ([]*Site, []*Key, error) {
+	q := NewQuery("Site")
 	var sites []*Site
-	sk, err := q.GetAll(c, &sites)
+	sk, err := c.Store().GetAll(q, &sites)
 	return sites, sk, err
 }
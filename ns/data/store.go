@@ -0,0 +1,320 @@
+// Copyright 2013 M-Lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var (
+	ErrNoSuchEntity   = errors.New("data: no such entity")
+	ErrCacheMiss      = errors.New("data: cache miss")
+	ErrInvalidDst     = errors.New("data: invalid destination, must be a non-nil pointer")
+	ErrInvalidFilter  = errors.New("data: invalid query filter")
+	ErrKeyDstMismatch = errors.New("data: number of keys and values do not match")
+
+	// ErrConcurrentTransaction is returned by Store.RunInTransaction if the
+	// transaction could not be committed because of concurrent ones.
+	ErrConcurrentTransaction = errors.New("data: concurrent transaction")
+)
+
+// Context provides the storage, caching, task queue and logging facilities
+// required by mlab-ns2. It allows the same code to run on App Engine, where it
+// is backed by appengine.Context (see NewGAEContext), and as a standalone
+// binary (see NewContext).
+type Context interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warningf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+
+	Store() Store
+	Cache() Cache
+	Queue() Queue
+	// HTTPClient returns a client with which to make outgoing requests.
+	HTTPClient() *http.Client
+}
+
+// ContextFunc returns the Context with which to serve an HTTP request.
+type ContextFunc func(r *http.Request) Context
+
+// HandlerFunc is an HTTP handler which is passed the Context of the request.
+type HandlerFunc func(c Context, w http.ResponseWriter, r *http.Request)
+
+// Handler returns an http.HandlerFunc which calls h with the Context returned
+// by newContext.
+func Handler(newContext ContextFunc, h HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h(newContext(r), w, r)
+	}
+}
+
+// Store is a persistent entity store with an API modelled on the App Engine
+// datastore.
+type Store interface {
+	// Get loads the entity stored for key into dst, which must be a pointer
+	// to a struct. ErrNoSuchEntity is returned if no entity exists.
+	Get(key *Key, dst interface{}) error
+	// GetMulti is a batch version of Get. dst must be a slice of structs or
+	// of struct pointers with the same length as keys. If an entity could
+	// not be loaded, a MultiError is returned.
+	GetMulti(keys []*Key, dst interface{}) error
+	// Put saves the entity src, a pointer to a struct, under key.
+	Put(key *Key, src interface{}) error
+	// PutMulti is a batch version of Put.
+	PutMulti(keys []*Key, src interface{}) error
+	// Delete removes the entity stored for key.
+	Delete(key *Key) error
+	// DeleteMulti is a batch version of Delete.
+	DeleteMulti(keys []*Key) error
+	// GetAll runs q and appends all matching entities to dst, which must be
+	// a pointer to a slice of structs or of struct pointers. It returns the
+	// keys of the matching entities. dst may be nil for keys-only queries.
+	GetAll(q *Query, dst interface{}) ([]*Key, error)
+	// RunInTransaction runs f in a transaction, passing it a Store whose
+	// reads and writes are part of the transaction, which is committed if
+	// f returns nil. Like datastore.RunInTransaction, f may be called again
+	// if the transaction conflicts with another, and
+	// ErrConcurrentTransaction is returned if it could not be committed.
+	// Queries of a transaction must have an ancestor, and don't see its
+	// writes.
+	RunInTransaction(f func(tx Store) error) error
+}
+
+// RunInTransaction runs f in a transaction of the Store of c, passing it a
+// Context whose Store is that of the transaction. See Store.RunInTransaction.
+func RunInTransaction(c Context, f func(tc Context) error) error {
+	return c.Store().RunInTransaction(func(tx Store) error {
+		return f(&txContext{c, tx})
+	})
+}
+
+// txContext is a Context whose Store is that of a transaction.
+type txContext struct {
+	Context
+	tx Store
+}
+
+func (c *txContext) Store() Store {
+	return c.tx
+}
+
+// Cache is a best-effort key-value cache with an API modelled on App Engine's
+// memcache.
+type Cache interface {
+	// Get loads the value cached for key into dst. ErrCacheMiss is returned
+	// if the key is not cached.
+	Get(key string, dst interface{}) error
+	// Set caches src under key.
+	Set(key string, src interface{}) error
+	// Delete removes key from the cache. ErrCacheMiss is returned if the key
+	// is not cached.
+	Delete(key string) error
+}
+
+// Queue is a push task queue with an API modelled on App Engine's taskqueue.
+type Queue interface {
+	// Add submits a POST task with form values to the handler at path using
+	// the named queue.
+	Add(queueName, path string, values url.Values) error
+}
+
+// MultiError is returned by batch operations when one or more entities could
+// not be processed. Each element corresponds to the entity at the same index.
+type MultiError []error
+
+func (m MultiError) Error() string {
+	n, first := 0, error(nil)
+	for _, err := range m {
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			n++
+		}
+	}
+	switch n {
+	case 0:
+		return "data: no error"
+	case 1:
+		return first.Error()
+	}
+	return fmt.Sprintf("%s (and %d other errors)", first, n-1)
+}
+
+// A Key identifies an entity in a Store. Like datastore keys, Keys have a
+// Kind, a string ID and an optional parent Key.
+type Key struct {
+	Kind     string
+	StringID string
+	Parent   *Key
+}
+
+// NewKey returns a new *Key.
+func NewKey(kind, stringID string, parent *Key) *Key {
+	return &Key{
+		Kind:     kind,
+		StringID: stringID,
+		Parent:   parent,
+	}
+}
+
+// Encode returns a string which uniquely represents a Key including its
+// ancestors.
+func (k *Key) Encode() string {
+	elem := fmt.Sprintf("%s,%s", url.QueryEscape(k.Kind), url.QueryEscape(k.StringID))
+	if k.Parent == nil {
+		return elem
+	}
+	return k.Parent.Encode() + "/" + elem
+}
+
+// String returns a human-readable representation of a Key.
+func (k *Key) String() string {
+	elem := fmt.Sprintf("%s,%s", k.Kind, k.StringID)
+	if k.Parent == nil {
+		return elem
+	}
+	return k.Parent.String() + "/" + elem
+}
+
+// Equal reports whether two Keys refer to the same entity.
+func (k *Key) Equal(o *Key) bool {
+	for k != nil && o != nil {
+		if k.Kind != o.Kind || k.StringID != o.StringID {
+			return false
+		}
+		k, o = k.Parent, o.Parent
+	}
+	return k == o
+}
+
+// HasAncestor reports whether a is k or one of k's ancestors.
+func (k *Key) HasAncestor(a *Key) bool {
+	for ; k != nil; k = k.Parent {
+		if k.Equal(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// KeyField is the property name by which a Query filters by key. Keys are
+// compared in the order in which a Store returns them.
+const KeyField = "__key__"
+
+// queryFilter is a single property filter of a Query.
+type queryFilter struct {
+	field string
+	op    string
+	value interface{}
+}
+
+// Query represents a query over the entities of a single Kind. Like
+// datastore.Query, its methods return modified copies so that queries can be
+// built up by chaining.
+type Query struct {
+	kind     string
+	ancestor *Key
+	filters  []queryFilter
+	order    []string
+	limit    int
+	err      error
+}
+
+// NewQuery returns a new *Query for entities of a given kind.
+func NewQuery(kind string) *Query {
+	return &Query{kind: kind}
+}
+
+func (q *Query) clone() *Query {
+	x := *q
+	x.filters = append([]queryFilter(nil), q.filters...)
+	x.order = append([]string(nil), q.order...)
+	return &x
+}
+
+// Filter returns a derivative query with a property filter. filterStr must be
+// a property name followed by one of the operators =, <, <=, > or >=, e.g.
+// "tool_id =". Filters on KeyField, e.g. "__key__ >", take a *Key value and
+// may be used by keys-only queries.
+func (q *Query) Filter(filterStr string, value interface{}) *Query {
+	q = q.clone()
+	f := strings.Fields(filterStr)
+	if len(f) != 2 {
+		q.err = ErrInvalidFilter
+		return q
+	}
+	switch f[1] {
+	case "=", "<", "<=", ">", ">=":
+	default:
+		q.err = ErrInvalidFilter
+		return q
+	}
+	q.filters = append(q.filters, queryFilter{f[0], f[1], value})
+	return q
+}
+
+// Order returns a derivative query with a sort order. A field name prefixed
+// with "-" sorts in descending order.
+func (q *Query) Order(fieldName string) *Query {
+	q = q.clone()
+	q.order = append(q.order, fieldName)
+	return q
+}
+
+// Limit returns a derivative query which returns at most limit results.
+func (q *Query) Limit(limit int) *Query {
+	q = q.clone()
+	q.limit = limit
+	return q
+}
+
+// Ancestor returns a derivative query restricted to entities with ancestor a.
+func (q *Query) Ancestor(a *Key) *Query {
+	q = q.clone()
+	q.ancestor = a
+	return q
+}
+
+// Kind returns the kind of entities q queries for.
+func (q *Query) Kind() string {
+	return q.kind
+}
+
+// DecodeKey parses a string produced by Key.Encode.
+func DecodeKey(s string) (*Key, error) {
+	var k *Key
+	for _, elem := range strings.Split(s, "/") {
+		p := strings.Split(elem, ",")
+		if len(p) != 2 {
+			return nil, fmt.Errorf("data: invalid encoded key %q", s)
+		}
+		kind, err := url.QueryUnescape(p[0])
+		if err != nil {
+			return nil, err
+		}
+		id, err := url.QueryUnescape(p[1])
+		if err != nil {
+			return nil, err
+		}
+		k = NewKey(kind, id, k)
+	}
+	return k, nil
+}
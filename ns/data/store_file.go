@@ -0,0 +1,111 @@
+// Copyright 2013 M-Lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const tmpFileSuffix = ".tmp"
+
+// fileBucket is a bucket which keeps each value in its own file in a
+// directory.
+type fileBucket struct {
+	dir string
+}
+
+func newFileBucket(dir string) (*fileBucket, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &fileBucket{dir}, nil
+}
+
+func (b *fileBucket) path(name string) string {
+	return filepath.Join(b.dir, url.QueryEscape(name))
+}
+
+func (b *fileBucket) get(name string) ([]byte, error) {
+	v, err := ioutil.ReadFile(b.path(name))
+	if os.IsNotExist(err) {
+		return nil, errBlobNotFound
+	}
+	return v, err
+}
+
+// put writes to a temporary file first so that readers never see partially
+// written values.
+func (b *fileBucket) put(name string, v []byte) error {
+	p := b.path(name)
+	if err := ioutil.WriteFile(p+tmpFileSuffix, v, 0644); err != nil {
+		return err
+	}
+	return os.Rename(p+tmpFileSuffix, p)
+}
+
+func (b *fileBucket) delete(name string) error {
+	err := os.Remove(b.path(name))
+	if os.IsNotExist(err) {
+		return errBlobNotFound
+	}
+	return err
+}
+
+func (b *fileBucket) names() ([]string, error) {
+	infos, err := ioutil.ReadDir(b.dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(infos))
+	for _, fi := range infos {
+		if fi.IsDir() || strings.HasSuffix(fi.Name(), tmpFileSuffix) {
+			continue
+		}
+		name, err := url.QueryUnescape(fi.Name())
+		if err != nil {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// NewFileStore returns a Store which persists entities below dir, with one
+// subdirectory per entity kind and one file per entity.
+func NewFileStore(dir string) (Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &entityStore{
+		buckets: make(map[string]bucket),
+		newBucket: func(kind string) (bucket, error) {
+			return newFileBucket(filepath.Join(dir, url.QueryEscape(kind)))
+		},
+	}, nil
+}
+
+// NewFileCache returns a Cache which persists values as files in dir. Unlike
+// memcache, values are never evicted.
+func NewFileCache(dir string) (Cache, error) {
+	b, err := newFileBucket(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &bucketCache{b}, nil
+}
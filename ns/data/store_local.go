@@ -0,0 +1,694 @@
+// Copyright 2013 M-Lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errBlobNotFound      = errors.New("data: blob not found")
+	errNestedTransaction = errors.New("data: nested transactions are not supported")
+	errTxQueryAncestor   = errors.New("data: queries in transactions must have an ancestor")
+)
+
+// bucket is a flat collection of gob-encoded values. It is the storage layer
+// shared by the in-memory and file-backed Store and Cache implementations.
+type bucket interface {
+	get(name string) ([]byte, error)
+	put(name string, b []byte) error
+	delete(name string) error
+	names() ([]string, error)
+}
+
+// memBucket is a bucket which keeps values in memory.
+type memBucket struct {
+	mu sync.RWMutex
+	m  map[string][]byte
+}
+
+func newMemBucket() *memBucket {
+	return &memBucket{m: make(map[string][]byte)}
+}
+
+func (b *memBucket) get(name string) ([]byte, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	v, ok := b.m[name]
+	if !ok {
+		return nil, errBlobNotFound
+	}
+	return v, nil
+}
+
+func (b *memBucket) put(name string, v []byte) error {
+	b.mu.Lock()
+	b.m[name] = v
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *memBucket) delete(name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.m[name]; !ok {
+		return errBlobNotFound
+	}
+	delete(b.m, name)
+	return nil
+}
+
+func (b *memBucket) names() ([]string, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	names := make([]string, 0, len(b.m))
+	for name := range b.m {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// entityStore implements Store on top of one bucket per entity kind.
+type entityStore struct {
+	mu        sync.Mutex
+	buckets   map[string]bucket
+	newBucket func(kind string) (bucket, error)
+	txMu      sync.Mutex // Held by a running transaction
+}
+
+// NewMemoryStore returns a Store which keeps all entities in memory. It is
+// intended for tests and for short-lived standalone instances.
+func NewMemoryStore() Store {
+	return &entityStore{
+		buckets: make(map[string]bucket),
+		newBucket: func(kind string) (bucket, error) {
+			return newMemBucket(), nil
+		},
+	}
+}
+
+func (s *entityStore) bucket(kind string) (bucket, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.buckets[kind]
+	if !ok {
+		var err error
+		if b, err = s.newBucket(kind); err != nil {
+			return nil, err
+		}
+		s.buckets[kind] = b
+	}
+	return b, nil
+}
+
+func (s *entityStore) Get(key *Key, dst interface{}) error {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return ErrInvalidDst
+	}
+	b, err := s.bucket(key.Kind)
+	if err != nil {
+		return err
+	}
+	blob, err := b.get(key.Encode())
+	if err == errBlobNotFound {
+		return ErrNoSuchEntity
+	} else if err != nil {
+		return err
+	}
+	return gobDecode(blob, dst)
+}
+
+func (s *entityStore) GetMulti(keys []*Key, dst interface{}) error {
+	return getMulti(s.Get, keys, dst)
+}
+
+// getMulti implements Store.GetMulti by calling get for each key.
+func getMulti(get func(key *Key, dst interface{}) error, keys []*Key, dst interface{}) error {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Slice {
+		return ErrInvalidDst
+	}
+	if v.Len() != len(keys) {
+		return ErrKeyDstMismatch
+	}
+	merr := make(MultiError, len(keys))
+	var failed bool
+	for i, k := range keys {
+		if merr[i] = get(k, elemPtr(v.Index(i))); merr[i] != nil {
+			failed = true
+		}
+	}
+	if failed {
+		return merr
+	}
+	return nil
+}
+
+func (s *entityStore) Put(key *Key, src interface{}) error {
+	b, err := s.bucket(key.Kind)
+	if err != nil {
+		return err
+	}
+	blob, err := gobEncode(src)
+	if err != nil {
+		return err
+	}
+	return b.put(key.Encode(), blob)
+}
+
+func (s *entityStore) PutMulti(keys []*Key, src interface{}) error {
+	return putMulti(s.Put, keys, src)
+}
+
+// putMulti implements Store.PutMulti by calling put for each key.
+func putMulti(put func(key *Key, src interface{}) error, keys []*Key, src interface{}) error {
+	v := reflect.ValueOf(src)
+	if v.Kind() != reflect.Slice {
+		return ErrInvalidDst
+	}
+	if v.Len() != len(keys) {
+		return ErrKeyDstMismatch
+	}
+	for i, k := range keys {
+		if err := put(k, elemPtr(v.Index(i))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *entityStore) Delete(key *Key) error {
+	b, err := s.bucket(key.Kind)
+	if err != nil {
+		return err
+	}
+	// Like datastore.Delete, deleting a missing entity is not an error.
+	if err := b.delete(key.Encode()); err != nil && err != errBlobNotFound {
+		return err
+	}
+	return nil
+}
+
+func (s *entityStore) DeleteMulti(keys []*Key) error {
+	for _, k := range keys {
+		if err := s.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *entityStore) GetAll(q *Query, dst interface{}) ([]*Key, error) {
+	if q.err != nil {
+		return nil, q.err
+	}
+
+	// Work out which type to decode entities into.
+	var dstv reflect.Value
+	var elemType reflect.Type
+	var isPtr bool
+	if dst != nil {
+		dstv = reflect.ValueOf(dst)
+		if dstv.Kind() != reflect.Ptr || dstv.Elem().Kind() != reflect.Slice {
+			return nil, ErrInvalidDst
+		}
+		dstv = dstv.Elem()
+		elemType = dstv.Type().Elem()
+		if elemType.Kind() == reflect.Ptr {
+			elemType, isPtr = elemType.Elem(), true
+		}
+		if elemType.Kind() != reflect.Struct {
+			return nil, ErrInvalidDst
+		}
+	} else if len(q.order) > 0 {
+		return nil, ErrInvalidDst
+	}
+	for _, f := range q.filters {
+		if f.field != KeyField && dst == nil {
+			return nil, ErrInvalidDst
+		}
+	}
+
+	b, err := s.bucket(q.kind)
+	if err != nil {
+		return nil, err
+	}
+	names, err := b.names()
+	if err != nil {
+		return nil, err
+	}
+
+	results := &queryResults{order: q.order}
+	for _, name := range names {
+		key, err := DecodeKey(name)
+		if err != nil {
+			return nil, err
+		}
+		if q.ancestor != nil && !key.HasAncestor(q.ancestor) {
+			continue
+		}
+		if ok, err := matchKeyFilters(key, q.filters); err != nil {
+			return nil, err
+		} else if !ok {
+			continue
+		}
+		if dst == nil {
+			results.add(key, reflect.Value{})
+			continue
+		}
+		blob, err := b.get(name)
+		if err == errBlobNotFound { // Deleted since listing
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		ev := reflect.New(elemType)
+		if err := gobDecode(blob, ev.Interface()); err != nil {
+			return nil, err
+		}
+		ok, err := matchFilters(ev.Elem(), q.filters)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			results.add(key, ev)
+		}
+	}
+
+	sort.Sort(results)
+	if q.limit > 0 && results.Len() > q.limit {
+		results.keys = results.keys[:q.limit]
+		results.vals = results.vals[:q.limit]
+	}
+
+	if dst != nil {
+		for _, ev := range results.vals {
+			if isPtr {
+				dstv.Set(reflect.Append(dstv, ev))
+			} else {
+				dstv.Set(reflect.Append(dstv, ev.Elem()))
+			}
+		}
+	}
+	return results.keys, nil
+}
+
+// RunInTransaction runs f with a Store which buffers its writes until f
+// returns nil. Transactions of an entityStore are run one at a time, so they
+// never conflict with each other, but not with writes outside transactions.
+func (s *entityStore) RunInTransaction(f func(tx Store) error) error {
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+	tx := &localTx{s: s, writes: make(map[string]*txWrite)}
+	if err := f(tx); err != nil {
+		return err
+	}
+	return tx.commit()
+}
+
+// txWrite is a write buffered by a localTx. A nil blob deletes the entity.
+type txWrite struct {
+	key  *Key
+	blob []byte
+}
+
+// localTx is the Store of a transaction of an entityStore. Reads see its
+// buffered writes, except for queries, as in datastore.
+type localTx struct {
+	s      *entityStore
+	writes map[string]*txWrite // By encoded key
+	order  []string            // Encoded keys in order of their first write
+}
+
+func (tx *localTx) write(key *Key, blob []byte) {
+	name := key.Encode()
+	if _, ok := tx.writes[name]; !ok {
+		tx.order = append(tx.order, name)
+	}
+	tx.writes[name] = &txWrite{key, blob}
+}
+
+func (tx *localTx) Get(key *Key, dst interface{}) error {
+	w, ok := tx.writes[key.Encode()]
+	if !ok {
+		return tx.s.Get(key, dst)
+	}
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return ErrInvalidDst
+	}
+	if w.blob == nil {
+		return ErrNoSuchEntity
+	}
+	return gobDecode(w.blob, dst)
+}
+
+func (tx *localTx) GetMulti(keys []*Key, dst interface{}) error {
+	return getMulti(tx.Get, keys, dst)
+}
+
+func (tx *localTx) Put(key *Key, src interface{}) error {
+	blob, err := gobEncode(src)
+	if err != nil {
+		return err
+	}
+	tx.write(key, blob)
+	return nil
+}
+
+func (tx *localTx) PutMulti(keys []*Key, src interface{}) error {
+	return putMulti(tx.Put, keys, src)
+}
+
+func (tx *localTx) Delete(key *Key) error {
+	tx.write(key, nil)
+	return nil
+}
+
+func (tx *localTx) DeleteMulti(keys []*Key) error {
+	for _, k := range keys {
+		tx.write(k, nil)
+	}
+	return nil
+}
+
+func (tx *localTx) GetAll(q *Query, dst interface{}) ([]*Key, error) {
+	if q.ancestor == nil {
+		return nil, errTxQueryAncestor
+	}
+	return tx.s.GetAll(q, dst)
+}
+
+func (tx *localTx) RunInTransaction(f func(tx Store) error) error {
+	return errNestedTransaction
+}
+
+// commit applies the buffered writes of tx to its entityStore.
+func (tx *localTx) commit() error {
+	for _, name := range tx.order {
+		w := tx.writes[name]
+		b, err := tx.s.bucket(w.key.Kind)
+		if err != nil {
+			return err
+		}
+		if w.blob == nil {
+			err = b.delete(name)
+		} else {
+			err = b.put(name, w.blob)
+		}
+		if err != nil && err != errBlobNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// queryResults holds the results of a query so that they can be sorted.
+type queryResults struct {
+	keys  []*Key
+	vals  []reflect.Value
+	order []string
+}
+
+func (r *queryResults) add(k *Key, v reflect.Value) {
+	r.keys = append(r.keys, k)
+	r.vals = append(r.vals, v)
+}
+
+func (r *queryResults) Len() int {
+	return len(r.keys)
+}
+
+func (r *queryResults) Swap(i, j int) {
+	r.keys[i], r.keys[j] = r.keys[j], r.keys[i]
+	r.vals[i], r.vals[j] = r.vals[j], r.vals[i]
+}
+
+// Less orders results by the query's sort orders, falling back to key order
+// so that results are deterministic.
+func (r *queryResults) Less(i, j int) bool {
+	for _, o := range r.order {
+		desc := strings.HasPrefix(o, "-")
+		field := strings.TrimPrefix(o, "-")
+		a, _ := fieldByName(r.vals[i].Elem(), field)
+		b, _ := fieldByName(r.vals[j].Elem(), field)
+		cmp, err := compareValues(a, b)
+		if err != nil || cmp == 0 {
+			continue
+		}
+		if desc {
+			return cmp > 0
+		}
+		return cmp < 0
+	}
+	return r.keys[i].Encode() < r.keys[j].Encode()
+}
+
+// matchKeyFilters reports whether key satisfies all filters on KeyField. Keys
+// are compared by Encode, the order in which results are sorted.
+func matchKeyFilters(key *Key, filters []queryFilter) (bool, error) {
+	for _, f := range filters {
+		if f.field != KeyField {
+			continue
+		}
+		k, ok := f.value.(*Key)
+		if !ok {
+			return false, ErrInvalidFilter
+		}
+		a, b := key.Encode(), k.Encode()
+		var match bool
+		switch f.op {
+		case "=":
+			match = a == b
+		case "<":
+			match = a < b
+		case "<=":
+			match = a <= b
+		case ">":
+			match = a > b
+		case ">=":
+			match = a >= b
+		}
+		if !match {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// matchFilters reports whether the struct v satisfies all filters other than
+// those on KeyField.
+func matchFilters(v reflect.Value, filters []queryFilter) (bool, error) {
+	for _, f := range filters {
+		if f.field == KeyField {
+			continue
+		}
+		fv, ok := fieldByName(v, f.field)
+		if !ok {
+			return false, nil
+		}
+		cmp, err := compareValues(fv, reflect.ValueOf(f.value))
+		if err != nil {
+			return false, err
+		}
+		var match bool
+		switch f.op {
+		case "=":
+			match = cmp == 0
+		case "<":
+			match = cmp < 0
+		case "<=":
+			match = cmp <= 0
+		case ">":
+			match = cmp > 0
+		case ">=":
+			match = cmp >= 0
+		}
+		if !match {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// fieldByName returns the field of struct v with a matching datastore tag
+// name, or with a matching Go field name if the field is not tagged.
+func fieldByName(v reflect.Value, name string) (reflect.Value, bool) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := strings.Split(f.Tag.Get("datastore"), ",")[0]
+		if tag == name || (tag == "" && f.Name == name) {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// compareValues compares two values of compatible types, returning -1, 0 or 1.
+func compareValues(a, b reflect.Value) (int, error) {
+	if !a.IsValid() || !b.IsValid() {
+		return 0, fmt.Errorf("data: cannot compare %v with %v", a, b)
+	}
+	switch {
+	case a.Type() == timeType && b.Type() == timeType:
+		ta, tb := a.Interface().(time.Time), b.Interface().(time.Time)
+		switch {
+		case ta.Before(tb):
+			return -1, nil
+		case ta.After(tb):
+			return 1, nil
+		}
+		return 0, nil
+	case isInt(a) && isInt(b):
+		x, y := a.Int(), b.Int()
+		switch {
+		case x < y:
+			return -1, nil
+		case x > y:
+			return 1, nil
+		}
+		return 0, nil
+	case isNumber(a) && isNumber(b):
+		x, y := toFloat(a), toFloat(b)
+		switch {
+		case x < y:
+			return -1, nil
+		case x > y:
+			return 1, nil
+		}
+		return 0, nil
+	case a.Kind() == reflect.String && b.Kind() == reflect.String:
+		x, y := a.String(), b.String()
+		switch {
+		case x < y:
+			return -1, nil
+		case x > y:
+			return 1, nil
+		}
+		return 0, nil
+	case a.Kind() == reflect.Bool && b.Kind() == reflect.Bool:
+		if a.Bool() == b.Bool() {
+			return 0, nil
+		} else if b.Bool() {
+			return -1, nil
+		}
+		return 1, nil
+	}
+	return 0, fmt.Errorf("data: cannot compare %s with %s", a.Type(), b.Type())
+}
+
+func isInt(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return true
+	}
+	return false
+}
+
+func isNumber(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return true
+	}
+	return isInt(v)
+}
+
+func toFloat(v reflect.Value) float64 {
+	if isInt(v) {
+		return float64(v.Int())
+	}
+	return v.Float()
+}
+
+// elemPtr returns an interface{} holding a pointer to slice element v, which
+// may be a struct or a struct pointer. nil struct pointers are allocated.
+func elemPtr(v reflect.Value) interface{} {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return v.Interface()
+	}
+	return v.Addr().Interface()
+}
+
+// gobEncode encodes src with encoding/gob.
+func gobEncode(src interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(src); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// gobDecode decodes b into dst, a non-nil pointer, after resetting dst to its
+// zero value. This is needed since gob does not transmit zero-valued fields.
+func gobDecode(b []byte, dst interface{}) error {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return ErrInvalidDst
+	}
+	v.Elem().Set(reflect.Zero(v.Elem().Type()))
+	return gob.NewDecoder(bytes.NewReader(b)).Decode(dst)
+}
+
+// bucketCache implements Cache on top of a bucket.
+type bucketCache struct {
+	b bucket
+}
+
+// NewMemoryCache returns a Cache which keeps values in memory. Values are
+// gob-encoded like they are with memcache.Gob, so cached values are copies.
+func NewMemoryCache() Cache {
+	return &bucketCache{newMemBucket()}
+}
+
+func (c *bucketCache) Get(key string, dst interface{}) error {
+	blob, err := c.b.get(key)
+	if err == errBlobNotFound {
+		return ErrCacheMiss
+	} else if err != nil {
+		return err
+	}
+	return gobDecode(blob, dst)
+}
+
+func (c *bucketCache) Set(key string, src interface{}) error {
+	blob, err := gobEncode(src)
+	if err != nil {
+		return err
+	}
+	return c.b.put(key, blob)
+}
+
+func (c *bucketCache) Delete(key string) error {
+	err := c.b.delete(key)
+	if err == errBlobNotFound {
+		return ErrCacheMiss
+	}
+	return err
+}
@@ -0,0 +1,317 @@
+// Copyright 2013 M-Lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"testing"
+)
+
+var keyEncodeTests = []*Key{
+	NewKey("Site", "ams01", nil),
+	NewKey("ClientGroup", "2001:48c8:7::", NewKey("string", "rtt", nil)),
+	NewKey("Odd,Kind", "a/b,c d", NewKey("string", "rtt", nil)),
+}
+
+func TestKeyEncode(t *testing.T) {
+	for _, k := range keyEncodeTests {
+		out, err := DecodeKey(k.Encode())
+		if err != nil {
+			t.Fatalf("DecodeKey(%q) = %v", k.Encode(), err)
+		}
+		if !k.Equal(out) {
+			t.Fatalf("DecodeKey(%q) = %v, want %v", k.Encode(), out, k)
+		}
+	}
+}
+
+var testSliverTools = []*SliverTool{
+	&SliverTool{ToolID: "ndt", SiteID: "ams01", ServerID: "mlab1", StatusIPv4: SliverStatusOnline},
+	&SliverTool{ToolID: "ndt", SiteID: "ams02", ServerID: "mlab1", StatusIPv4: SliverStatusOffline},
+	&SliverTool{ToolID: "npad", SiteID: "ams01", ServerID: "mlab2", StatusIPv4: SliverStatusOnline},
+	&SliverTool{ToolID: "ndt", SiteID: "lga01", ServerID: "mlab3", StatusIPv4: SliverStatusOnline},
+}
+
+func testSliverToolKeys() []*Key {
+	keys := make([]*Key, len(testSliverTools))
+	for i, s := range testSliverTools {
+		keys[i] = NewKey("SliverTool", GetSliverToolID(s.ToolID, s.SliceID, s.ServerID, s.SiteID), nil)
+	}
+	return keys
+}
+
+var storeGetAllTests = []struct {
+	q   *Query
+	out []string // Expected SiteIDs in order
+}{
+	{NewQuery("SliverTool").Filter("tool_id =", "ndt").Order("site_id"), []string{"ams01", "ams02", "lga01"}},
+	{NewQuery("SliverTool").Filter("tool_id =", "ndt").Order("-site_id").Limit(2), []string{"lga01", "ams02"}},
+	{NewQuery("SliverTool").Filter("status_ipv4 =", SliverStatusOnline).Filter("site_id <", "b").Order("tool_id"), []string{"ams01", "ams01"}},
+	{NewQuery("SliverTool").Filter("site_id >=", "lga01"), []string{"lga01"}},
+	{NewQuery("Site"), []string{}},
+}
+
+func testStore(t *testing.T, s Store) {
+	keys := testSliverToolKeys()
+	if err := s.PutMulti(keys, testSliverTools); err != nil {
+		t.Fatalf("Store.PutMulti: %v", err)
+	}
+
+	// Get
+	var st SliverTool
+	if err := s.Get(keys[2], &st); err != nil || !reflect.DeepEqual(&st, testSliverTools[2]) {
+		t.Fatalf("Store.Get(%v) = %v, %v, want %v", keys[2], st, err, testSliverTools[2])
+	}
+	if err := s.Get(NewKey("SliverTool", "missing", nil), &st); err != ErrNoSuchEntity {
+		t.Fatalf("Store.Get(missing) = %v, want %v", err, ErrNoSuchEntity)
+	}
+
+	// GetMulti with a missing entity
+	multi := make([]SliverTool, 2)
+	err := s.GetMulti([]*Key{keys[0], NewKey("SliverTool", "missing", nil)}, multi)
+	merr, ok := err.(MultiError)
+	if !ok || merr[0] != nil || merr[1] != ErrNoSuchEntity {
+		t.Fatalf("Store.GetMulti = %v, want MultiError{nil, %v}", err, ErrNoSuchEntity)
+	}
+	if !reflect.DeepEqual(&multi[0], testSliverTools[0]) {
+		t.Fatalf("Store.GetMulti = %v, want %v", multi[0], testSliverTools[0])
+	}
+
+	// GetAll
+	for i, tt := range storeGetAllTests {
+		var slivers []*SliverTool
+		if _, err := s.GetAll(tt.q, &slivers); err != nil {
+			t.Fatalf("Store.GetAll (index %d) = %v", i, err)
+		}
+		out := make([]string, len(slivers))
+		for j, sl := range slivers {
+			out[j] = sl.SiteID
+		}
+		if !reflect.DeepEqual(out, tt.out) {
+			t.Fatalf("Store.GetAll (index %d) = %v, want %v", i, out, tt.out)
+		}
+	}
+
+	// Keys-only queries paged by key
+	all, err := s.GetAll(NewQuery("SliverTool"), nil)
+	if err != nil || len(all) != len(keys) {
+		t.Fatalf("Store.GetAll(keys only) = %v, %v, want %d keys", all, err, len(keys))
+	}
+	var paged []*Key
+	q := NewQuery("SliverTool").Limit(2)
+	for {
+		page, err := s.GetAll(q, nil)
+		if err != nil {
+			t.Fatalf("Store.GetAll(%s >) = %v", KeyField, err)
+		}
+		paged = append(paged, page...)
+		if len(page) < 2 {
+			break
+		}
+		q = NewQuery("SliverTool").Filter(KeyField+" >", page[len(page)-1]).Limit(2)
+	}
+	if !reflect.DeepEqual(paged, all) {
+		t.Fatalf("Store.GetAll paged by key = %v, want %v", paged, all)
+	}
+
+	// Ancestor query
+	parent := NewKey("string", "rtt", nil)
+	if err := s.Put(NewKey("Tool", "ndt", parent), &Tool{ToolID: "ndt"}); err != nil {
+		t.Fatalf("Store.Put: %v", err)
+	}
+	if err := s.Put(NewKey("Tool", "npad", nil), &Tool{ToolID: "npad"}); err != nil {
+		t.Fatalf("Store.Put: %v", err)
+	}
+	ks, err := s.GetAll(NewQuery("Tool").Ancestor(parent), nil)
+	if err != nil || len(ks) != 1 || ks[0].StringID != "ndt" {
+		t.Fatalf("Store.GetAll(Ancestor) = %v, %v, want [ndt]", ks, err)
+	}
+
+	// Transactions
+	errAbort := errors.New("abort")
+	ndt := NewKey("Tool", "ndt", parent)
+	err = s.RunInTransaction(func(tx Store) error {
+		if err := tx.Put(ndt, &Tool{ToolID: "ndt2"}); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	var tool Tool
+	if err != errAbort || s.Get(ndt, &tool) != nil || tool.ToolID != "ndt" {
+		t.Fatalf("Store.RunInTransaction (aborted) = %v, stored %v, want %v and ndt", err, tool, errAbort)
+	}
+	err = s.RunInTransaction(func(tx Store) error {
+		if err := tx.Get(ndt, &tool); err != nil {
+			return err
+		}
+		if err := tx.Delete(ndt); err != nil {
+			return err
+		}
+		if err := tx.Get(ndt, &tool); err != ErrNoSuchEntity {
+			t.Fatalf("Store.Get in transaction after Delete = %v, want %v", err, ErrNoSuchEntity)
+		}
+		return tx.Put(NewKey("Tool", "npad", parent), &Tool{ToolID: "npad"})
+	})
+	if err != nil {
+		t.Fatalf("Store.RunInTransaction = %v", err)
+	}
+	ks, err = s.GetAll(NewQuery("Tool").Ancestor(parent), nil)
+	if err != nil || len(ks) != 1 || ks[0].StringID != "npad" {
+		t.Fatalf("Store.GetAll(Ancestor) after transaction = %v, %v, want [npad]", ks, err)
+	}
+
+	// Delete
+	if err := s.DeleteMulti(keys); err != nil {
+		t.Fatalf("Store.DeleteMulti: %v", err)
+	}
+	if err := s.Get(keys[0], &st); err != ErrNoSuchEntity {
+		t.Fatalf("Store.Get after Delete = %v, want %v", err, ErrNoSuchEntity)
+	}
+}
+
+func testCache(t *testing.T, c Cache) {
+	var out []*SliverTool
+	if err := c.Get("ndt", &out); err != ErrCacheMiss {
+		t.Fatalf("Cache.Get = %v, want %v", err, ErrCacheMiss)
+	}
+	if err := c.Set("ndt", testSliverTools); err != nil {
+		t.Fatalf("Cache.Set: %v", err)
+	}
+	if err := c.Get("ndt", &out); err != nil || !reflect.DeepEqual(out, testSliverTools) {
+		t.Fatalf("Cache.Get = %v, %v, want %v", out, err, testSliverTools)
+	}
+	if err := c.Delete("ndt"); err != nil {
+		t.Fatalf("Cache.Delete: %v", err)
+	}
+	if err := c.Delete("ndt"); err != ErrCacheMiss {
+		t.Fatalf("Cache.Delete = %v, want %v", err, ErrCacheMiss)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+}
+
+func TestMemoryCache(t *testing.T) {
+	testCache(t, NewMemoryCache())
+}
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ns-data-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, s)
+}
+
+func TestFileCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ns-data-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := NewFileCache(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCache(t, c)
+}
+
+func TestGetData(t *testing.T) {
+	c := NewContext(NewMemoryStore(), NewMemoryCache(), nil, nil)
+	key := NewKey("Site", "ams01", nil)
+	site := &Site{SiteID: "ams01", City: "Amsterdam"}
+
+	var out Site
+	if err := GetData(c, "ams01", key, &out); err != ErrNoSuchEntity {
+		t.Fatalf("GetData = %v, want %v", err, ErrNoSuchEntity)
+	}
+	if err := SetData(c, "ams01", key, site); err != nil {
+		t.Fatalf("SetData: %v", err)
+	}
+
+	// Remove from the store to check that the cached value is returned.
+	c.Store().Delete(key)
+	if err := GetData(c, "ams01", key, &out); err != nil || !reflect.DeepEqual(&out, site) {
+		t.Fatalf("GetData = %v, %v, want %v", out, err, site)
+	}
+}
+
+func TestLocalQueue(t *testing.T) {
+	var got url.Values
+	q := NewLocalQueue(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		got = r.PostForm
+		if r.FormValue("fail") != "" {
+			http.Error(w, "failed", http.StatusInternalServerError)
+		}
+	}))
+
+	values := url.Values{"date": []string{"2013-08-01"}}
+	if err := q.Add("rtt-import", "/task", values); err != nil {
+		t.Fatalf("Queue.Add: %v", err)
+	}
+	if !reflect.DeepEqual(got, values) {
+		t.Fatalf("Queue.Add posted %v, want %v", got, values)
+	}
+	if err := q.Add("rtt-import", "/task", url.Values{"fail": []string{"1"}}); err == nil {
+		t.Fatalf("Queue.Add of failing task = nil, want error")
+	}
+}
+
+var sliverWeightTests = []struct {
+	in  *SliverTool
+	out float64
+}{
+	{&SliverTool{}, 1},
+	{&SliverTool{Capacity: 4, Load: 0.25}, 3},
+	{&SliverTool{Capacity: 2, Load: 1.5}, 0},
+	{&SliverTool{Load: -1}, 1},
+}
+
+func TestSliverWeight(t *testing.T) {
+	for _, tt := range sliverWeightTests {
+		if out := tt.in.Weight(); out != tt.out {
+			t.Fatalf("SliverTool.Weight(%+v) = %v, want %v", tt.in, out, tt.out)
+		}
+	}
+}
+
+func TestWeightedRandomSliver(t *testing.T) {
+	if s := WeightedRandomSliver(nil, (*SliverTool).Weight); s != nil {
+		t.Fatalf("WeightedRandomSliver(nil) = %v, want nil", s)
+	}
+	slivers := []*SliverTool{
+		&SliverTool{ServerID: "mlab1", Load: 1},
+		&SliverTool{ServerID: "mlab2"},
+	}
+	for i := 0; i < 100; i++ {
+		if s := WeightedRandomSliver(slivers, (*SliverTool).Weight); s != slivers[1] {
+			t.Fatalf("WeightedRandomSliver = %v, want %v", s, slivers[1])
+		}
+	}
+}
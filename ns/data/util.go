@@ -12,26 +12,23 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-// +build appengine
-
 package data
 
 import (
-	"appengine"
-	"appengine/datastore"
-	"appengine/memcache"
+	"math/rand"
+	"net"
 )
 
-// GetData returns a datastore.Get result and also caches the result into
-// memcache.
-func GetData(c appengine.Context, mcKey string, dsKey *datastore.Key, dst interface{}) error {
-	err := mcGet(c, mcKey, dst)
+// GetData returns a Store.Get result and also caches the result into the
+// Cache.
+func GetData(c Context, mcKey string, dsKey *Key, dst interface{}) error {
+	err := c.Cache().Get(mcKey, dst)
 	switch err {
-	case memcache.ErrCacheMiss:
-		if err := datastore.Get(c, dsKey, dst); err != nil {
+	case ErrCacheMiss:
+		if err := c.Store().Get(dsKey, dst); err != nil {
 			return err
 		}
-		mcSet(c, mcKey, dst)
+		c.Cache().Set(mcKey, dst)
 		return nil
 	case nil:
 		return nil
@@ -39,26 +36,25 @@ func GetData(c appengine.Context, mcKey string, dsKey *datastore.Key, dst interf
 	return err
 }
 
-// SetData puts data into the datastore and also caches the result into
-// memcache.
-func SetData(c appengine.Context, mcKey string, dsKey *datastore.Key, data interface{}) error {
-	if _, err := datastore.Put(c, dsKey, data); err != nil {
+// SetData puts data into the Store and also caches the result into the Cache.
+func SetData(c Context, mcKey string, dsKey *Key, data interface{}) error {
+	if err := c.Store().Put(dsKey, data); err != nil {
 		return err
 	}
-	mcSet(c, mcKey, data)
+	c.Cache().Set(mcKey, data)
 	return nil
 }
 
-// QueryData returns a datastore.Query.GetAll result and also caches the result
-// into memcache.
-func QueryData(c appengine.Context, mcKey string, q *datastore.Query, dst interface{}) error {
-	err := mcGet(c, mcKey, dst)
+// QueryData returns a Store.GetAll result and also caches the result into the
+// Cache.
+func QueryData(c Context, mcKey string, q *Query, dst interface{}) error {
+	err := c.Cache().Get(mcKey, dst)
 	switch err {
-	case memcache.ErrCacheMiss:
-		if _, err := q.GetAll(c, dst); err != nil {
+	case ErrCacheMiss:
+		if _, err := c.Store().GetAll(q, dst); err != nil {
 			return err
 		}
-		mcSet(c, mcKey, dst)
+		c.Cache().Set(mcKey, dst)
 		return nil
 	case nil:
 		return nil
@@ -66,34 +62,108 @@ func QueryData(c appengine.Context, mcKey string, q *datastore.Query, dst interf
 	return err
 }
 
-func mcGet(c appengine.Context, key string, dst interface{}) error {
-	_, err := memcache.Gob.Get(c, key, dst)
-	if err != nil {
-		return err
+// FilterOnline takes a list of SliverTools and returns a list where offline
+// SliverTools are omitted.
+func FilterOnline(slivers []*SliverTool) []*SliverTool {
+	filtered := make([]*SliverTool, 0, len(slivers))
+	for _, s := range slivers {
+		if s.StatusIPv4 == SliverStatusOnline || s.StatusIPv6 == SliverStatusOnline {
+			filtered = append(filtered, s)
+		}
 	}
-	return nil
+	return filtered
 }
 
-func mcSet(c appengine.Context, key string, data interface{}) error {
-	item := &memcache.Item{
-		Key:    key,
-		Object: data,
+// GetAddressFamily returns the address family of an IP.
+func GetAddressFamily(ip net.IP) string {
+	if ip.To4() == nil {
+		return AddressFamilyIPv6
 	}
-	err := memcache.Gob.Set(c, item)
-	if err != nil {
-		return err
+	return AddressFamilyIPv4
+}
+
+// IP returns the SliverTool's IP address string for an address family, or ""
+// if the SliverTool has no address of that family.
+func (s *SliverTool) IP(af string) string {
+	var ip string
+	switch af {
+	case AddressFamilyIPv4:
+		ip = s.SliverIPv4
+	case AddressFamilyIPv6:
+		ip = s.SliverIPv6
 	}
-	return nil
+	if ip == SliverIPOff {
+		return ""
+	}
+	return ip
 }
 
-// FilterOnline takes a list of SliverTools and returns a list where offline
-// SliverTools are omitted.
-func FilterOnline(slivers []*SliverTool) []*SliverTool {
+// IsOnline reports whether a SliverTool is online and has an address for an
+// address family.
+func (s *SliverTool) IsOnline(af string) bool {
+	var status string
+	switch af {
+	case AddressFamilyIPv4:
+		status = s.StatusIPv4
+	case AddressFamilyIPv6:
+		status = s.StatusIPv6
+	}
+	return status == SliverStatusOnline && s.IP(af) != ""
+}
+
+// FilterOnlineWithAddressFamily takes a list of SliverTools and returns a list
+// where SliverTools which are offline or have no address for an address
+// family are omitted.
+func FilterOnlineWithAddressFamily(slivers []*SliverTool, af string) []*SliverTool {
 	filtered := make([]*SliverTool, 0, len(slivers))
 	for _, s := range slivers {
-		if s.StatusIPv4 == SliverStatusOnline || s.StatusIPv6 == SliverStatusOnline {
+		if s.IsOnline(af) {
 			filtered = append(filtered, s)
 		}
 	}
 	return filtered
 }
+
+// Weight returns the relative weight with which a SliverTool should be
+// selected, which is its spare capacity.
+func (s *SliverTool) Weight() float64 {
+	capacity := s.Capacity
+	if capacity <= 0 {
+		capacity = 1
+	}
+	load := s.Load
+	if load < 0 {
+		load = 0
+	} else if load > 1 {
+		load = 1
+	}
+	return capacity * (1 - load)
+}
+
+// WeightedRandomSliver returns a SliverTool selected at random from slivers
+// with probability proportional to weight. If all weights are 0, a SliverTool
+// is selected uniformly. It returns nil if slivers is empty.
+func WeightedRandomSliver(slivers []*SliverTool, weight func(*SliverTool) float64) *SliverTool {
+	if len(slivers) == 0 {
+		return nil
+	}
+	var total float64
+	weights := make([]float64, len(slivers))
+	for i, s := range slivers {
+		if w := weight(s); w > 0 {
+			weights[i] = w
+			total += w
+		}
+	}
+	if total == 0 {
+		return slivers[rand.Intn(len(slivers))]
+	}
+	x := rand.Float64() * total
+	for i, w := range weights {
+		if x < w {
+			return slivers[i]
+		}
+		x -= w
+	}
+	return slivers[len(slivers)-1] // Rounding errors
+}
@@ -12,13 +12,9 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-// +build appengine
-
 package geo
 
 import (
-	"appengine"
-	"appengine/datastore"
 	"errors"
 	"net"
 
@@ -38,22 +34,34 @@ func ipToint64(ip net.IP) int64 {
 	return i
 }
 
-// getLatLon returns the geolocation from maxmind data given the ipaddress
-func getLatLon(c appengine.Context, ipReq string) (float64, float64) {
-	ip := net.ParseIP(ipReq)
+// GetLatLon returns the geolocation from maxmind data given the ipaddress. Only
+// IPv4 addresses are available in the MaxMind data.
+func GetLatLon(c data.Context, ip net.IP) (float64, float64, error) {
+	if ip == nil || ip.To4() == nil {
+		return 0, 0, ErrGeoLocationNotFound
+	}
 	ipNum := ipToint64(ip)
 	// The following will return only one entry from MMLocation
-	q := datastore.NewQuery("MMLocation").Filter("RangeStart <", ipNum).Order("-RangeStart").Limit(1)
+	q := data.NewQuery("MMLocation").Filter("RangeStart <=", ipNum).Order("-RangeStart").Limit(1)
 	var mmLoc []*data.MMLocation
-	_, err := q.GetAll(c, &mmLoc)
+	_, err := c.Store().GetAll(q, &mmLoc)
 	if err != nil {
-		c.Errorf("getLatLon:q.GetAll(..mmLoc) err = %v", err)
-		return 0, 0
+		return 0, 0, err
 	}
 
-	if ipNum > mmLoc[0].RangeEnd {
-		c.Errorf("getLatLon: err %v", ErrGeoLocationNotFound)
+	if len(mmLoc) == 0 || ipNum > mmLoc[0].RangeEnd {
+		return 0, 0, ErrGeoLocationNotFound
+	}
+	return float64(mmLoc[0].Latitude), float64(mmLoc[0].Longitude), nil
+}
+
+// getLatLon returns the geolocation from maxmind data given the ipaddress, or
+// 0, 0 if it is not found.
+func getLatLon(c data.Context, ipReq string) (float64, float64) {
+	lat, lon, err := GetLatLon(c, net.ParseIP(ipReq))
+	if err != nil {
+		c.Errorf("getLatLon: ip %q err %v", ipReq, err)
 		return 0, 0
 	}
-	return float64(mmLoc[0].Latitude), float64(mmLoc[0].Longitude)
+	return lat, lon
 }
@@ -0,0 +1,63 @@
+// Copyright 2013 M-Lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package geo
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	// HeaderCityLatLong is set by App Engine to the "lat,lon" of the city
+	// from which a request originated.
+	HeaderCityLatLong = "X-AppEngine-CityLatLong"
+
+	earthRadiusKm = 6371.0
+)
+
+var (
+	ErrInvalidLatLon = errors.New("Invalid latitude and longitude")
+)
+
+// ParseCityLatLong parses the "lat,lon" value of the X-AppEngine-CityLatLong
+// header.
+func ParseCityLatLong(latLon string) (float64, float64, error) {
+	p := strings.Split(latLon, ",")
+	if len(p) != 2 {
+		return 0, 0, ErrInvalidLatLon
+	}
+	lat, err := strconv.ParseFloat(strings.TrimSpace(p[0]), 64)
+	if err != nil || lat < -90 || lat > 90 {
+		return 0, 0, ErrInvalidLatLon
+	}
+	lon, err := strconv.ParseFloat(strings.TrimSpace(p[1]), 64)
+	if err != nil || lon < -180 || lon > 180 {
+		return 0, 0, ErrInvalidLatLon
+	}
+	return lat, lon, nil
+}
+
+// Distance returns the great-circle distance in kilometres between two points
+// given in degrees, using the haversine formula.
+func Distance(lat1, lon1, lat2, lon2 float64) float64 {
+	toRad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat := toRad(lat2 - lat1)
+	dLon := toRad(lon2 - lon1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRad(lat1))*math.Cos(toRad(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(a)))
+}
@@ -0,0 +1,61 @@
+// Copyright 2013 M-Lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package geo
+
+import (
+	"math"
+	"testing"
+)
+
+var parseCityLatLongTests = []struct {
+	in       string
+	lat, lon float64
+	err      error
+}{
+	{"40.714353,-74.005973", 40.714353, -74.005973, nil},
+	{"52.37, 4.89", 52.37, 4.89, nil},
+	{"0.000000,0.000000", 0, 0, nil},
+	{"", 0, 0, ErrInvalidLatLon},
+	{"40.7", 0, 0, ErrInvalidLatLon},
+	{"abc,4.89", 0, 0, ErrInvalidLatLon},
+	{"91,0", 0, 0, ErrInvalidLatLon},
+}
+
+func TestParseCityLatLong(t *testing.T) {
+	for _, tt := range parseCityLatLongTests {
+		lat, lon, err := ParseCityLatLong(tt.in)
+		if lat != tt.lat || lon != tt.lon || err != tt.err {
+			t.Fatalf("ParseCityLatLong(%q) = %v, %v, %v, want %v, %v, %v", tt.in, lat, lon, err, tt.lat, tt.lon, tt.err)
+		}
+	}
+}
+
+var distanceTests = []struct {
+	lat1, lon1, lat2, lon2 float64
+	out                    float64 // km, within 1%
+}{
+	{40.77, -73.87, 40.77, -73.87, 0},
+	{40.77, -73.87, 52.31, 4.76, 5860},      // LGA to AMS
+	{0, 0, 0, 180, math.Pi * earthRadiusKm}, // Antipodes
+}
+
+func TestDistance(t *testing.T) {
+	for _, tt := range distanceTests {
+		out := Distance(tt.lat1, tt.lon1, tt.lat2, tt.lon2)
+		if math.Abs(out-tt.out) > tt.out*0.01 {
+			t.Fatalf("Distance(%v, %v, %v, %v) = %v, want %v", tt.lat1, tt.lon1, tt.lat2, tt.lon2, out, tt.out)
+		}
+	}
+}
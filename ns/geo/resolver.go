@@ -12,19 +12,13 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-// +build appengine
-
 // The geo package provides the geo resolver
 package geo
 
 import (
-	"appengine"
-	"appengine/datastore"
 	"container/list"
 	"fmt"
 	"net/http"
-	"strconv"
-	"strings"
 
 	"code.google.com/p/iptrie/locmap"
 	"code.google.com/p/mlab-ns2/gae/ns/data"
@@ -40,17 +34,19 @@ const (
 	geoUrl                 = "/geo"
 )
 
-func init() {
-	http.HandleFunc(geoUrl, geo)
-	http.HandleFunc(initIPv4LocationMapUrl, initIPv4LocationMap)
-	//TODO: http.HandleFunc("/initIPv6LocationMap", initIPv6LocationMap)
+// Register registers the geo handlers with mux. newContext is used to create
+// the data.Context with which each request is served.
+func Register(mux *http.ServeMux, newContext data.ContextFunc) {
+	mux.HandleFunc(geoUrl, data.Handler(newContext, geo))
+	mux.HandleFunc(initIPv4LocationMapUrl, data.Handler(newContext, initIPv4LocationMap))
+	//TODO: mux.HandleFunc("/initIPv6LocationMap", initIPv6LocationMap)
 }
 
-func initIPv4LMap(c appengine.Context) error {
-	q := datastore.NewQuery("SliverTool").Filter("status_ipv4 =", "online")
+func initIPv4LMap(c data.Context) error {
+	q := data.NewQuery("SliverTool").Filter("status_ipv4 =", "online")
 	list := list.New()
 	var sliverTools []*data.SliverTool
-	_, err := q.GetAll(c, &sliverTools)
+	_, err := c.Store().GetAll(q, &sliverTools)
 	if err != nil {
 		return err
 	}
@@ -69,8 +65,7 @@ func initIPv4LMap(c appengine.Context) error {
 }
 
 // initIPv4LocationMap initializes a locationMap with ipv4 ipaddress
-func initIPv4LocationMap(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
+func initIPv4LocationMap(c data.Context, w http.ResponseWriter, r *http.Request) {
 	err := initIPv4LMap(c)
 	if err != nil {
 		c.Errorf("initIPv4LocationMap:initIPv4LMap err = %v", err)
@@ -80,23 +75,19 @@ func initIPv4LocationMap(w http.ResponseWriter, r *http.Request) {
 }
 
 // geo returns the ipaddress of the closest sliverTool
-func geo(w http.ResponseWriter, r *http.Request) {
-
-	c := appengine.NewContext(r)
+func geo(c data.Context, w http.ResponseWriter, r *http.Request) {
 	toolID := r.FormValue("tool")
 	if toolID == "" {
 		toolID = "ndt"
 	}
 	header := r.Header
-	latLon := header.Get("X-AppEngine-CityLatLong")
+	latLon := header.Get(HeaderCityLatLong)
 
 	var lat, lon float64
 	if latLon == "" {
-		lat, lon = getLatLon(c, r.RemoteAddr)
+		lat, lon = getLatLon(c, data.RemoteIP(r))
 	} else {
-		p := strings.Split(latLon, ",")
-		lat, _ = strconv.ParseFloat(p[0], 64)
-		lon, _ = strconv.ParseFloat(p[1], 64)
+		lat, lon, _ = ParseCityLatLong(latLon)
 	}
 
 	if LMapIPv4 == nil {
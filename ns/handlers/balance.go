@@ -0,0 +1,123 @@
+// Copyright 2013 M-Lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"code.google.com/p/mlab-ns2/gae/ns/data"
+	"code.google.com/p/mlab-ns2/gae/ns/rtt"
+	"math/rand"
+)
+
+// LoadBalancer spreads clients among Sites with near-equal RTTs and among the
+// SliverTools of a Site.
+type LoadBalancer struct {
+	// RTTTolerance is the RTT in ms within which Sites are treated as
+	// equivalent to the Site with the lowest RTT. 0 always selects the Site
+	// with the lowest RTT.
+	RTTTolerance float64
+
+	// ServerIDWeights scales the weight of SliverTools by server ID, e.g.,
+	// "mlab1". Server IDs which are not present have a weight of 1.
+	ServerIDWeights map[string]float64
+
+	// Metric is the statistic of SiteRTTs by which Sites are ranked. If
+	// empty, rtt.RankingMetric is used.
+	Metric rtt.RTTMetric
+}
+
+// RankingMetric returns the statistic of SiteRTTs by which Sites are ranked.
+func (lb *LoadBalancer) RankingMetric() rtt.RTTMetric {
+	if lb.Metric == "" {
+		return rtt.RankingMetric
+	}
+	return lb.Metric
+}
+
+// DefaultLoadBalancer is the LoadBalancer used by the RTT resolver.
+var DefaultLoadBalancer = &LoadBalancer{
+	RTTTolerance: 5,
+}
+
+// SliverWeight returns the weight with which a SliverTool is selected, which
+// is its spare capacity scaled by the weight of its server ID.
+func (lb *LoadBalancer) SliverWeight(s *data.SliverTool) float64 {
+	w := s.Weight()
+	if sw, ok := lb.ServerIDWeights[s.ServerID]; ok {
+		w *= sw
+	}
+	return w
+}
+
+// siteWeight returns the total weight of the SliverTools of a Site.
+func (lb *LoadBalancer) siteWeight(slivers []*data.SliverTool) float64 {
+	var w float64
+	for _, s := range slivers {
+		w += lb.SliverWeight(s)
+	}
+	return w
+}
+
+// ChooseSliver returns a SliverTool from slivers selected at random by weight.
+func (lb *LoadBalancer) ChooseSliver(slivers []*data.SliverTool) *data.SliverTool {
+	return data.WeightedRandomSliver(slivers, lb.SliverWeight)
+}
+
+// ChooseSites returns up to n SiteRTTs from srs which have SliverTools in
+// siteSlivers, in the order in which they are selected. Each SiteRTT is
+// selected at random by the weight of its SliverTools among the remaining
+// Sites within RTTTolerance of the remaining Site with the lowest RTT by
+// RankingMetric. The result is therefore not necessarily in ascending RTT
+// order, but no SiteRTT precedes one whose RTT is lower by more than
+// RTTTolerance.
+func (lb *LoadBalancer) ChooseSites(srs rtt.SiteRTTs, siteSlivers map[string][]*data.SliverTool, n int) rtt.SiteRTTs {
+	remaining := make(rtt.SiteRTTs, 0, len(srs))
+	for _, sr := range srs {
+		if len(siteSlivers[sr.SiteID]) > 0 {
+			remaining = append(remaining, sr)
+		}
+	}
+	metric := lb.RankingMetric()
+	rtt.SortSiteRTTs(remaining, metric)
+
+	chosen := make(rtt.SiteRTTs, 0, n)
+	for len(chosen) < n && len(remaining) > 0 {
+		// Get the Sites within tolerance of the best remaining Site.
+		best := remaining[0].Value(metric)
+		var group int
+		weights := make([]float64, 0, len(remaining))
+		var total float64
+		for _, sr := range remaining {
+			if sr.Value(metric) > best+lb.RTTTolerance {
+				break
+			}
+			w := lb.siteWeight(siteSlivers[sr.SiteID])
+			weights = append(weights, w)
+			total += w
+			group++
+		}
+
+		// Select a Site by weight, or the best Site if all weights are 0.
+		var idx int
+		if total > 0 {
+			x := rand.Float64() * total
+			for idx = 0; idx < group-1 && x >= weights[idx]; idx++ {
+				x -= weights[idx]
+			}
+		}
+		chosen = append(chosen, remaining[idx])
+		remaining = append(remaining[:idx], remaining[idx+1:]...)
+	}
+	return chosen
+}
@@ -0,0 +1,99 @@
+// Copyright 2013 M-Lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"code.google.com/p/mlab-ns2/gae/ns/data"
+	"code.google.com/p/mlab-ns2/gae/ns/rtt"
+	"math"
+	"reflect"
+	"testing"
+)
+
+var testSiteRTTs = rtt.SiteRTTs{
+	{SiteID: "lga01", RTT: 10},
+	{SiteID: "lga02", RTT: 12},
+	{SiteID: "iad01", RTT: 14},
+	{SiteID: "dfw01", RTT: 40},
+}
+
+var testSiteSlivers = map[string][]*data.SliverTool{
+	"lga01": {{SiteID: "lga01", ServerID: "mlab1", Load: 1}, {SiteID: "lga01", ServerID: "mlab2", Load: 1}},
+	"lga02": {{SiteID: "lga02", ServerID: "mlab1", Capacity: 3}},
+	"iad01": {{SiteID: "iad01", ServerID: "mlab1"}},
+	"dfw01": {{SiteID: "dfw01", ServerID: "mlab1"}},
+}
+
+var chooseSitesTests = []struct {
+	lb  *LoadBalancer
+	n   int
+	out []string
+}{
+	{&LoadBalancer{RTTTolerance: 0}, 2, []string{"lga01", "lga02"}},
+	{&LoadBalancer{RTTTolerance: 0}, 10, []string{"lga01", "lga02", "iad01", "dfw01"}},
+	// lga01 is fully loaded, and iad01 is out of tolerance of lga02.
+	{&LoadBalancer{RTTTolerance: 2}, 1, []string{"lga02"}},
+	{&LoadBalancer{RTTTolerance: 2, ServerIDWeights: map[string]float64{"mlab1": 0}}, 1, []string{"lga01"}},
+}
+
+func TestChooseSites(t *testing.T) {
+	for i, tt := range chooseSitesTests {
+		srs := tt.lb.ChooseSites(testSiteRTTs, testSiteSlivers, tt.n)
+		out := make([]string, len(srs))
+		for j, sr := range srs {
+			out[j] = sr.SiteID
+		}
+		if !reflect.DeepEqual(out, tt.out) {
+			t.Fatalf("ChooseSites (index %d) = %v, want %v", i, out, tt.out)
+		}
+	}
+}
+
+func TestChooseSitesMetric(t *testing.T) {
+	// lga02 has the lowest minimum RTT, and iad01 the lowest mean RTT.
+	srs := rtt.SiteRTTs{
+		{SiteID: "lga02", RTT: 10, Samples: 2, Mean: 30, EWMA: 30},
+		{SiteID: "iad01", RTT: 14, Samples: 2, Mean: 15, EWMA: 15},
+	}
+	for _, tt := range []struct {
+		metric rtt.RTTMetric
+		out    string
+	}{
+		{rtt.RTTMetricMin, "lga02"},
+		{rtt.RTTMetricMean, "iad01"},
+	} {
+		lb := &LoadBalancer{Metric: tt.metric}
+		if out := lb.ChooseSites(srs, testSiteSlivers, 1)[0].SiteID; out != tt.out {
+			t.Fatalf("ChooseSites (metric %s) = %v, want %v", tt.metric, out, tt.out)
+		}
+	}
+}
+
+func TestChooseSitesDistribution(t *testing.T) {
+	const trials = 10000
+	lb := &LoadBalancer{RTTTolerance: 5}
+	count := make(map[string]int)
+	for i := 0; i < trials; i++ {
+		count[lb.ChooseSites(testSiteRTTs, testSiteSlivers, 1)[0].SiteID]++
+	}
+
+	// lga01 has no spare capacity, lga02 has 3 and iad01 has 1.
+	want := map[string]float64{"lga01": 0, "lga02": 0.75, "iad01": 0.25, "dfw01": 0}
+	for siteID, p := range want {
+		if got := float64(count[siteID]) / trials; math.Abs(got-p) > 0.03 {
+			t.Fatalf("ChooseSites selected %s with probability %v, want %v", siteID, got, p)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2013 M-Lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"code.google.com/p/mlab-ns2/gae/ns/data"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+const (
+	FormKeyFormat = "format"
+	FormatJSON    = "json"
+	FormatText    = "text"
+
+	contentTypeJSON = "application/json"
+)
+
+// wantsJSON reports whether a JSON response has been requested, either with
+// the URL parameter 'format' or, if it is absent, with the Accept header.
+func wantsJSON(r *http.Request) bool {
+	switch r.FormValue(FormKeyFormat) {
+	case FormatJSON:
+		return true
+	case FormatText:
+		return false
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType := strings.TrimSpace(strings.Split(accept, ";")[0])
+		if mediaType == contentTypeJSON {
+			return true
+		}
+	}
+	return false
+}
+
+// writeJSON writes v as a JSON response.
+func writeJSON(c data.Context, w http.ResponseWriter, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		c.Errorf("handlers.writeJSON:json.Marshal: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.Write(b)
+}
@@ -0,0 +1,49 @@
+// Copyright 2013 M-Lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The handlers package provides the mlab-ns2 handlers"
+package handlers
+
+import (
+	"code.google.com/p/mlab-ns2/gae/ns/data"
+	"code.google.com/p/mlab-ns2/gae/ns/rtt"
+	"net/http"
+)
+
+// Register registers the mlab-ns2 handlers with mux. newContext is used to
+// create the data.Context with which each request is served.
+//
+// Handlers which depend on App Engine, such as the BigQuery import task, are
+// registered separately on App Engine.
+func Register(mux *http.ServeMux, newContext data.ContextFunc) {
+	handle := func(pattern string, h data.HandlerFunc) {
+		mux.HandleFunc(pattern, data.Handler(newContext, h))
+	}
+
+	handle(URLRTTMain, RTTHandler)
+
+	handle(URLRTTImportDay, rttImportDay)
+	handle(URLRTTImportDaily, rttImportDaily)
+	handle(URLRTTImportBackfill, rttImportBackfill)
+	handle(URLRTTSetLastSuccImportDate, rttSetLastSuccImportDate)
+	handle(rtt.URLTaskImportPut, processTaskRTTCGPut)
+	handle(URLRTTPrune, rttPrune)
+	handle(rtt.URLTaskPrune, processTaskRTTPrune)
+	handle(URLRTTMigrate, rttMigrate)
+	handle(rtt.URLTaskMigrate, processTaskRTTMigrate)
+	handle(URLRTTRecordSliverIPs, rttRecordSliverIPs)
+	handle(URLRTTSeedSliverIPs, rttSeedSliverIPs)
+
+	handle(KsRegistrationHandlerUrl, KsRegistrationHandler)
+}
@@ -0,0 +1,50 @@
+// Copyright 2013 M-Lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build appengine
+
+package handlers
+
+import (
+	"appengine"
+	"code.google.com/p/mlab-ns2/gae/ns/data"
+	"code.google.com/p/mlab-ns2/gae/ns/rtt"
+	"net/http"
+	"time"
+)
+
+func init() {
+	Register(http.DefaultServeMux, data.GAERequestContext)
+	http.HandleFunc(rtt.URLTaskImportDay, processTaskRTTImportDay)
+}
+
+// processTaskRTTImportDay processes a taskqueue task for an import of BigQuery
+// data for a specified date, or a dry run of the import if dryrun is set.
+func processTaskRTTImportDay(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	dateStr := r.FormValue(rtt.FormKeyImportDate)
+	t, err := time.Parse(rtt.DateFormat, dateStr)
+	if err != nil {
+		// Don't return HTTP error since incorrect date cannot be fixed.
+		c.Errorf("handlers.processTaskRTTImportDay:time.Parse: %s", err)
+		return
+	}
+
+	if r.FormValue(rtt.FormKeyDryRun) != "" {
+		rtt.BQDryRunDay(w, r, t)
+		return
+	}
+	rtt.BQImportDay(w, r, t)
+}
@@ -0,0 +1,144 @@
+// Copyright 2013 M-Lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"code.google.com/p/mlab-ns2/gae/ns/data"
+	"errors"
+	"net"
+	"strings"
+)
+
+const (
+	FormKeyPolicy = "policy"
+
+	// Names of built-in Policies.
+	PolicyRTT    = "rtt"
+	PolicyGeo    = "geo"
+	PolicyRandom = "random"
+
+	// DefaultPolicyName is used for tools without a configured Policy. Comma
+	// separated Policy names are chained.
+	DefaultPolicyName = "rtt,geo,random"
+)
+
+var (
+	ErrInvalidPolicy = errors.New("rtt: Unknown server selection policy.")
+)
+
+// Request is a server selection request for a client.
+type Request struct {
+	IP            net.IP // Client IP
+	ToolID        string
+	AddressFamily string // data.AddressFamilyIPv4 or data.AddressFamilyIPv6
+	CityLatLong   string // X-AppEngine-CityLatLong header of the client, if any
+	N             int    // Maximum number of results
+}
+
+// Policy selects SliverTools for a client.
+type Policy interface {
+	// Select returns up to req.N results ranked from slivers, which are the
+	// SliverTools running req.ToolID which are online over
+	// req.AddressFamily. It returns ErrNotEnoughData if the Policy cannot
+	// select any SliverTool.
+	Select(c data.Context, req *Request, slivers []*data.SliverTool) ([]*RTTResult, error)
+}
+
+// ChainPolicy returns the results of the first Policy which does not return
+// ErrNotEnoughData.
+type ChainPolicy []Policy
+
+func (p ChainPolicy) Select(c data.Context, req *Request, slivers []*data.SliverTool) ([]*RTTResult, error) {
+	for _, policy := range p {
+		results, err := policy.Select(c, req, slivers)
+		if err != ErrNotEnoughData {
+			return results, err
+		}
+	}
+	return nil, ErrNotEnoughData
+}
+
+var (
+	policies = map[string]Policy{
+		PolicyRTT:    &RTTPolicy{DefaultLoadBalancer},
+		PolicyGeo:    &GeoPolicy{DefaultLoadBalancer},
+		PolicyRandom: &RandomPolicy{DefaultLoadBalancer},
+	}
+	toolPolicies = make(map[string]Policy)
+)
+
+// RegisterPolicy registers a Policy with a name by which it can be requested.
+// It should be called during initialization.
+func RegisterPolicy(name string, p Policy) {
+	policies[name] = p
+}
+
+// GetPolicy returns the Policy registered with name. If name is a comma
+// separated list of names, their Policies are chained with ChainPolicy.
+func GetPolicy(name string) (Policy, error) {
+	names := strings.Split(name, ",")
+	chain := make(ChainPolicy, len(names))
+	for i, n := range names {
+		p, ok := policies[strings.TrimSpace(n)]
+		if !ok {
+			return nil, ErrInvalidPolicy
+		}
+		chain[i] = p
+	}
+	if len(chain) == 1 {
+		return chain[0], nil
+	}
+	return chain, nil
+}
+
+// SetToolPolicy configures the Policy named name as the default for toolID. It
+// should be called during initialization.
+func SetToolPolicy(toolID, name string) error {
+	p, err := GetPolicy(name)
+	if err != nil {
+		return err
+	}
+	toolPolicies[toolID] = p
+	return nil
+}
+
+// GetToolPolicy returns the Policy configured for toolID, or the default
+// Policy.
+func GetToolPolicy(toolID string) Policy {
+	if p, ok := toolPolicies[toolID]; ok {
+		return p
+	}
+	p, _ := GetPolicy(DefaultPolicyName)
+	return p
+}
+
+// Resolve returns up to req.N SliverTools selected by p from the SliverTools
+// running req.ToolID which are online over req.AddressFamily.
+func Resolve(c data.Context, p Policy, req *Request) ([]*RTTResult, error) {
+	slivers, err := data.GetSliverToolsWithToolID(c, req.ToolID)
+	if err != nil {
+		return nil, err
+	}
+	return p.Select(c, req, data.FilterOnlineWithAddressFamily(slivers, req.AddressFamily))
+}
+
+// groupBySite returns slivers by Site ID.
+func groupBySite(slivers []*data.SliverTool) map[string][]*data.SliverTool {
+	siteSlivers := make(map[string][]*data.SliverTool)
+	for _, s := range slivers {
+		siteSlivers[s.SiteID] = append(siteSlivers[s.SiteID], s)
+	}
+	return siteSlivers
+}
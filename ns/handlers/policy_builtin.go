@@ -0,0 +1,126 @@
+// Copyright 2013 M-Lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"code.google.com/p/mlab-ns2/gae/ns/data"
+	"code.google.com/p/mlab-ns2/gae/ns/geo"
+	"math/rand"
+	"sort"
+)
+
+// siteDistance is the distance from a client to a Site with online Slivers.
+type siteDistance struct {
+	siteID   string
+	distance float64
+}
+
+// siteDistances implements sort.Interface, ordering by ascending distance and
+// then Site ID.
+type siteDistances []siteDistance
+
+func (s siteDistances) Len() int      { return len(s) }
+func (s siteDistances) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s siteDistances) Less(i, j int) bool {
+	if s[i].distance != s[j].distance {
+		return s[i].distance < s[j].distance
+	}
+	return s[i].siteID < s[j].siteID
+}
+
+// GeoPolicy is a Policy which selects Slivers from different Sites in
+// ascending order of distance from the client's geolocation. The client is
+// geolocated by the X-AppEngine-CityLatLong header if available, or otherwise
+// by IP using MaxMind data. Slivers without a location are skipped.
+type GeoPolicy struct {
+	LoadBalancer *LoadBalancer
+}
+
+func (p *GeoPolicy) Select(c data.Context, req *Request, slivers []*data.SliverTool) ([]*RTTResult, error) {
+	var lat, lon float64
+	var err error
+	if req.CityLatLong != "" {
+		lat, lon, err = geo.ParseCityLatLong(req.CityLatLong)
+	} else {
+		lat, lon, err = geo.GetLatLon(c, req.IP)
+	}
+	if err == geo.ErrInvalidLatLon || err == geo.ErrGeoLocationNotFound {
+		c.Infof("handlers.GeoPolicy.Select: %s (ip %s)", err, req.IP)
+		return nil, ErrNotEnoughData
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	siteSlivers := groupBySite(slivers)
+	sites := make(siteDistances, 0, len(siteSlivers))
+	for siteID, ss := range siteSlivers {
+		s := ss[0]
+		if s.Latitude == 0 && s.Longitude == 0 {
+			continue
+		}
+		sites = append(sites, siteDistance{siteID, geo.Distance(lat, lon, s.Latitude, s.Longitude)})
+	}
+	if len(sites) == 0 {
+		return nil, ErrNotEnoughData
+	}
+	sort.Sort(sites)
+
+	results := make([]*RTTResult, 0, req.N)
+	for _, sd := range sites {
+		results = append(results, &RTTResult{
+			SliverTool:    p.LoadBalancer.ChooseSliver(siteSlivers[sd.siteID]),
+			AddressFamily: req.AddressFamily,
+			Method:        MethodGeo,
+		})
+		if len(results) == req.N {
+			break
+		}
+	}
+	return results, nil
+}
+
+// RandomPolicy is a Policy which selects Slivers from different, randomly
+// chosen Sites.
+type RandomPolicy struct {
+	LoadBalancer *LoadBalancer
+}
+
+func (p *RandomPolicy) Select(c data.Context, req *Request, slivers []*data.SliverTool) ([]*RTTResult, error) {
+	siteSlivers := groupBySite(slivers)
+	if len(siteSlivers) == 0 {
+		return nil, ErrNotEnoughData
+	}
+
+	// Sort Site IDs so that the shuffle does not depend on map order.
+	siteIDs := make([]string, 0, len(siteSlivers))
+	for siteID := range siteSlivers {
+		siteIDs = append(siteIDs, siteID)
+	}
+	sort.Strings(siteIDs)
+
+	results := make([]*RTTResult, 0, req.N)
+	for _, i := range rand.Perm(len(siteIDs)) {
+		results = append(results, &RTTResult{
+			SliverTool:    p.LoadBalancer.ChooseSliver(siteSlivers[siteIDs[i]]),
+			AddressFamily: req.AddressFamily,
+			Method:        MethodRandom,
+		})
+		if len(results) == req.N {
+			break
+		}
+	}
+	return results, nil
+}
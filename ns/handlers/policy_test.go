@@ -0,0 +1,106 @@
+// Copyright 2013 M-Lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"code.google.com/p/mlab-ns2/gae/ns/data"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// testPolicy returns its results, or err.
+type testPolicy struct {
+	method string
+	err    error
+}
+
+func (p *testPolicy) Select(c data.Context, req *Request, slivers []*data.SliverTool) ([]*RTTResult, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	return []*RTTResult{&RTTResult{SliverTool: slivers[0], Method: p.method}}, nil
+}
+
+var (
+	errTestPolicy = errors.New("test policy error")
+	testPolicyA   = &testPolicy{method: "a"}
+	testPolicyNo  = &testPolicy{err: ErrNotEnoughData}
+	testPolicyErr = &testPolicy{err: errTestPolicy}
+)
+
+var chainPolicyTests = []struct {
+	chain  ChainPolicy
+	method string
+	err    error
+}{
+	{ChainPolicy{testPolicyA, testPolicyNo}, "a", nil},
+	{ChainPolicy{testPolicyNo, testPolicyA}, "a", nil},
+	{ChainPolicy{testPolicyNo, testPolicyErr, testPolicyA}, "", errTestPolicy},
+	{ChainPolicy{testPolicyNo}, "", ErrNotEnoughData},
+	{ChainPolicy{}, "", ErrNotEnoughData},
+}
+
+func TestChainPolicy(t *testing.T) {
+	slivers := []*data.SliverTool{&data.SliverTool{SiteID: "lga01"}}
+	for i, tt := range chainPolicyTests {
+		results, err := tt.chain.Select(nil, &Request{N: 1}, slivers)
+		var method string
+		if len(results) > 0 {
+			method = results[0].Method
+		}
+		if method != tt.method || err != tt.err {
+			t.Fatalf("ChainPolicy.Select (index %d) = %q, %v, want %q, %v", i, method, err, tt.method, tt.err)
+		}
+	}
+}
+
+var getPolicyTests = []struct {
+	name string
+	out  Policy
+	err  error
+}{
+	{"rtt", policies[PolicyRTT], nil},
+	{"geo, random", ChainPolicy{policies[PolicyGeo], policies[PolicyRandom]}, nil},
+	{"rtt,nearest", nil, ErrInvalidPolicy},
+	{"", nil, ErrInvalidPolicy},
+}
+
+func TestGetPolicy(t *testing.T) {
+	for _, tt := range getPolicyTests {
+		out, err := GetPolicy(tt.name)
+		if !reflect.DeepEqual(out, tt.out) || err != tt.err {
+			t.Fatalf("GetPolicy(%q) = %v, %v, want %v, %v", tt.name, out, err, tt.out, tt.err)
+		}
+	}
+}
+
+func TestSetToolPolicy(t *testing.T) {
+	defer delete(toolPolicies, "npad")
+
+	if err := SetToolPolicy("npad", "nearest"); err != ErrInvalidPolicy {
+		t.Fatalf("SetToolPolicy(npad, nearest) = %v, want %v", err, ErrInvalidPolicy)
+	}
+	if err := SetToolPolicy("npad", PolicyGeo); err != nil {
+		t.Fatalf("SetToolPolicy(npad, geo) = %v", err)
+	}
+	if p := GetToolPolicy("npad"); p != policies[PolicyGeo] {
+		t.Fatalf("GetToolPolicy(npad) = %v, want %v", p, policies[PolicyGeo])
+	}
+	want, _ := GetPolicy(DefaultPolicyName)
+	if p := GetToolPolicy("ndt"); !reflect.DeepEqual(p, want) {
+		t.Fatalf("GetToolPolicy(ndt) = %v, want %v", p, want)
+	}
+}
@@ -12,45 +12,150 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-// +build appengine
-
 package handlers
 
 import (
-	"appengine"
-	"appengine/datastore"
 	"code.google.com/p/mlab-ns2/gae/ns/data"
+	"code.google.com/p/mlab-ns2/gae/ns/geo"
 	"code.google.com/p/mlab-ns2/gae/ns/rtt"
 	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 const (
 	URLRTTMain = "/rtt/"
+
+	FormKeyAddressFamily = "address_family"
+	AddressFamilyAuto    = "auto" // Use the address family of the client's IP
+
+	MaxRTTResults = 50 // Maximum number of ranked results that can be requested
+
+	// Methods by which an RTTResult was selected.
+	MethodRTT    = "rtt"    // Lowest RTT from the client's ClientGroup
+	MethodGeo    = "geo"    // Nearest to the client's geolocation
+	MethodRandom = "random" // Random online Sliver
+
+	// HeaderResolverMethod reports the method of the first result in
+	// responses.
+	HeaderResolverMethod = "X-Resolver-Method"
 )
 
 var (
 	ErrNoToolIDSpecified = errors.New("rtt: No Tool ID specified in request.")
 	ErrNotEnoughData     = errors.New("rtt: The RTT resolver has insufficient data to respond to this query.")
+	ErrInvalidN          = fmt.Errorf("rtt: The number of results must be between 1 and %d.", MaxRTTResults)
+	ErrInvalidIP         = errors.New("rtt: Invalid client IP address.")
+	ErrInvalidAF         = errors.New("rtt: Address family must be one of ipv4, ipv6 or auto.")
 )
 
-func init() {
-	http.HandleFunc(URLRTTMain, RTTHandler)
+// RTTResult is the result of an RTT lookup. It contains the selected
+// SliverTool, the address family it was selected for, the method by which it
+// was selected and, if selected by RTT, the SiteRTT from the client's
+// ClientGroup to its Site.
+type RTTResult struct {
+	SliverTool    *data.SliverTool
+	AddressFamily string
+	Method        string
+	Confidence    float64 // Between 0 and 1 for MethodRTT, see RTTPolicy
+	SiteRTT       rtt.SiteRTT
+	RTT           float64 // RTT of SiteRTT by the ranking metric of the policy
 }
 
-// RTTHandler is a simple handler which uses the URL parameter 'url' or client's
-// IP to find a Sliver with lowest RTT.
-func RTTHandler(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
+// IP returns the address of the selected SliverTool in the address family it
+// was selected for.
+func (res *RTTResult) IP() net.IP {
+	return net.ParseIP(res.SliverTool.IP(res.AddressFamily))
+}
+
+// rttJSONResult is the JSON representation of an RTTResult.
+type rttJSONResult struct {
+	FQDN          string     `json:"fqdn"`
+	IP            string     `json:"ip"`
+	AddressFamily string     `json:"address_family"`
+	IPv4          string     `json:"ipv4,omitempty"`
+	IPv6          string     `json:"ipv6,omitempty"`
+	SiteID        string     `json:"site"`
+	City          string     `json:"city"`
+	Country       string     `json:"country"`
+	Latitude      float64    `json:"latitude"`
+	Longitude     float64    `json:"longitude"`
+	Method        string     `json:"method"`
+	Confidence    float64    `json:"confidence,omitempty"`
+	RTT           float64    `json:"rtt,omitempty"`
+	LastUpdated   *time.Time `json:"last_updated,omitempty"`
+}
+
+// newRTTJSONResult converts an RTTResult into its JSON representation.
+func newRTTJSONResult(res *RTTResult) *rttJSONResult {
+	s := res.SliverTool
+	jr := &rttJSONResult{
+		FQDN:          s.FQDN,
+		IP:            s.IP(res.AddressFamily),
+		AddressFamily: res.AddressFamily,
+		IPv4:          s.IP(data.AddressFamilyIPv4),
+		IPv6:          s.IP(data.AddressFamilyIPv6),
+		SiteID:        s.SiteID,
+		City:          s.City,
+		Country:       s.Country,
+		Latitude:      s.Latitude,
+		Longitude:     s.Longitude,
+		Method:        res.Method,
+	}
+	if res.Method == MethodRTT {
+		jr.Confidence = res.Confidence
+		jr.RTT = res.RTT
+		jr.LastUpdated = &res.SiteRTT.LastUpdated
+	}
+	return jr
+}
 
+// RTTHandler is a simple handler which uses the URL parameter 'url' or client's
+// IP to find a Sliver with lowest RTT. The response is the Sliver's IP, or
+// details of the Sliver and its RTT in JSON if requested with the URL
+// parameter 'format=json' or the Accept header.
+//
+// If the URL parameter 'n' is specified, up to n Slivers from different Sites
+// are returned in the order selected by RTTPolicy, one per line or as a JSON
+// list.
+//
+// The URL parameter 'address_family' selects whether Slivers must be online
+// over ipv4 or ipv6. It defaults to 'auto', the address family of the client's
+// IP.
+//
+// The URL parameter 'policy' selects the server selection Policy, e.g., 'rtt'
+// or 'geo,random', and defaults to the Policy configured for the tool. By
+// default, if there is no RTT data for the client, the nearest Slivers to the
+// client's geolocation are returned instead, or random Slivers if the client
+// cannot be geolocated. The method used is reported in the X-Resolver-Method
+// header and in JSON responses.
+func RTTHandler(c data.Context, w http.ResponseWriter, r *http.Request) {
 	// Get IP to use as client IP.
 	ipStr := r.FormValue("ip")
 	if ipStr == "" {
-		ipStr = r.RemoteAddr
+		ipStr = data.RemoteIP(r)
 	}
 	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		http.Error(w, ErrInvalidIP.Error(), http.StatusBadRequest)
+		c.Errorf("rtt.RTTHandler: %s (%q)", ErrInvalidIP, ipStr)
+		return
+	}
+
+	// Get address family of Slivers to return
+	af := r.FormValue(FormKeyAddressFamily)
+	switch af {
+	case "", AddressFamilyAuto:
+		af = data.GetAddressFamily(ip)
+	case data.AddressFamilyIPv4, data.AddressFamilyIPv6:
+	default:
+		http.Error(w, ErrInvalidAF.Error(), http.StatusBadRequest)
+		c.Errorf("rtt.RTTHandler: %s", ErrInvalidAF)
+		return
+	}
 
 	// Get Tool ID
 	toolID := r.FormValue("tool_id")
@@ -60,14 +165,70 @@ func RTTHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Query RTT resolver.
-	resp, err := RTTResolver(c, toolID, ip)
+	// Get number of results to return
+	n := 1
+	nStr := r.FormValue("n")
+	if nStr != "" {
+		var err error
+		n, err = strconv.Atoi(nStr)
+		if err != nil || n < 1 || n > MaxRTTResults {
+			http.Error(w, ErrInvalidN.Error(), http.StatusBadRequest)
+			c.Errorf("rtt.RTTHandler: %s", ErrInvalidN)
+			return
+		}
+	}
+
+	// Get server selection policy
+	policy := GetToolPolicy(toolID)
+	if name := r.FormValue(FormKeyPolicy); name != "" {
+		var err error
+		policy, err = GetPolicy(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			c.Errorf("rtt.RTTHandler: %s (%q)", err, name)
+			return
+		}
+	}
+
+	req := &Request{
+		IP:            ip,
+		ToolID:        toolID,
+		AddressFamily: af,
+		N:             n,
+	}
+	// The App Engine geolocation header describes the requester, so only use
+	// it if the client IP was not overridden.
+	if r.FormValue("ip") == "" {
+		req.CityLatLong = r.Header.Get(geo.HeaderCityLatLong)
+	}
+
+	// Query resolver.
+	resps, err := Resolve(c, policy, req)
 	switch err {
 	case ErrNotEnoughData:
 		http.Error(w, err.Error(), http.StatusNotFound)
 		c.Errorf("rtt.RTTHandler: %s", err)
 	case nil:
-		fmt.Fprintln(w, resp)
+		w.Header().Set(HeaderResolverMethod, resps[0].Method)
+		if nStr == "" { // Single result requested
+			if wantsJSON(r) {
+				writeJSON(c, w, newRTTJSONResult(resps[0]))
+				return
+			}
+			fmt.Fprintln(w, resps[0].IP())
+			return
+		}
+		if wantsJSON(r) {
+			results := make([]*rttJSONResult, len(resps))
+			for i, resp := range resps {
+				results[i] = newRTTJSONResult(resp)
+			}
+			writeJSON(c, w, results)
+			return
+		}
+		for _, resp := range resps {
+			fmt.Fprintln(w, resp.IP())
+		}
 	default:
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		c.Errorf("rtt.RTTHandler: %s", err)
@@ -75,37 +236,195 @@ func RTTHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // RTTResolver returns a Sliver from a Site with lowest RTT given a client's IP.
-func RTTResolver(c appengine.Context, toolID string, ip net.IP) (net.IP, error) {
-	cgIP := rtt.GetClientGroup(ip).IP
-	rttKey := datastore.NewKey(c, "string", "rtt", 0, nil)
-	key := datastore.NewKey(c, "ClientGroup", cgIP.String(), 0, rttKey)
+// The Sliver must be online over the address family af.
+func RTTResolver(c data.Context, toolID string, ip net.IP, af string) (*RTTResult, error) {
+	results, err := RTTResolverN(c, toolID, ip, af, 1)
+	if err != nil {
+		return nil, err
+	}
+	return results[0], nil
+}
+
+// RTTResolverN returns up to n Slivers from different Sites given a client's IP
+// using the rtt Policy, in the order in which RTTPolicy selects them.
+func RTTResolverN(c data.Context, toolID string, ip net.IP, af string, n int) ([]*RTTResult, error) {
+	req := &Request{
+		IP:            ip,
+		ToolID:        toolID,
+		AddressFamily: af,
+		N:             n,
+	}
+	return Resolve(c, policies[PolicyRTT], req)
+}
+
+// RTTPolicy is a Policy which selects Slivers from different Sites by RTT from
+// the client's ClientGroup, lowest first. Sites with near-equal RTTs and their
+// Slivers are selected by weight using LoadBalancer, so Sites within
+// RTTTolerance of each other may be returned in any order. See
+// LoadBalancer.ChooseSites.
+//
+// If the client's ClientGroup has no usable RTT data, neighbouring ClientGroups
+// in increasingly wide prefixes are searched, and the SiteRTTs of the nearest
+// ones found are combined. The Confidence of such results halves with each bit
+// of prefix distance. Up to MaxNeighbourKeys neighbouring ClientGroups are
+// read from datastore for each client.
+type RTTPolicy struct {
+	LoadBalancer *LoadBalancer
+}
+
+func (p *RTTPolicy) Select(c data.Context, req *Request, slivers []*data.SliverTool) ([]*RTTResult, error) {
+	siteSlivers := groupBySite(slivers)
+	if len(siteSlivers) == 0 {
+		return nil, ErrNotEnoughData
+	}
+
+	budget := MaxNeighbourKeys
+	for d := 0; d <= rtt.MaxNeighbourDistance(req.IP); d++ {
+		cg, err := getNeighbourClientGroup(c, req.IP, d, &budget)
+		if err == ErrNotEnoughData {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// Get up to n error-less Sites and a SliverTool from each Site.
+		srs := p.LoadBalancer.ChooseSites(cg.SiteRTTs, siteSlivers, req.N)
+		if len(srs) == 0 {
+			continue
+		}
+		results := make([]*RTTResult, len(srs))
+		for i, sr := range srs {
+			results[i] = &RTTResult{
+				SliverTool:    p.LoadBalancer.ChooseSliver(siteSlivers[sr.SiteID]),
+				AddressFamily: req.AddressFamily,
+				Method:        MethodRTT,
+				Confidence:    1 / float64(int(1)<<uint(d)),
+				SiteRTT:       sr,
+				RTT:           sr.Value(p.LoadBalancer.RankingMetric()),
+			}
+		}
+		return results, nil
+	}
+	// No valid Site found.
+	return nil, ErrNotEnoughData
+}
+
+// getClientGroup returns the rtt.ClientGroup of a client's IP, as grouped by
+// rtt.ClientGrouping, or the ClientGroup of the IP stored under its legacy
+// name if it has not been migrated yet. See rtt.LegacyClientGroupKey.
+func getClientGroup(c data.Context, ip net.IP) (*rtt.ClientGroup, error) {
+	group := rtt.GroupClient(ip)
+	key := group.Key()
 
 	// Get ClientGroup from datastore.
 	var cg rtt.ClientGroup
-	err := data.GetData(c, MCKey_ClientGroup(cgIP), key, &cg)
+	err := data.GetData(c, MCKey_ClientGroup(group.Name()), key, &cg)
+	if err == data.ErrNoSuchEntity {
+		legacy := rtt.LegacyClientGroupKey(ip)
+		err = data.GetData(c, MCKey_ClientGroup(legacy.StringID), legacy, &cg)
+	}
 	if err != nil {
-		if err == datastore.ErrNoSuchEntity {
+		if err == data.ErrNoSuchEntity {
 			return nil, ErrNotEnoughData
 		}
 		return nil, err
 	}
+	return &cg, nil
+}
 
-	// Get first error-less Site and a random SliverTool from selected Site.
-	var siteID string
-	var sliverTool *data.SliverTool
-	for _, sr := range cg.SiteRTTs {
-		siteID = sr.SiteID
-		sliverTool, err = data.GetRandomSliverFromSite(c, toolID, siteID)
-		if err == nil {
-			return net.ParseIP(sliverTool.SliverIPv4), nil
+// MaxNeighbourKeys is the number of neighbouring ClientGroups which RTTPolicy
+// reads from datastore for a client, which covers all IPv4 neighbours. Wider
+// neighbours are then only found if cached. It should be set during
+// initialization.
+var MaxNeighbourKeys = 64
+
+// getNeighbourClientGroup returns a rtt.ClientGroup combining the SiteRTTs of
+// all ClientGroups at a prefix distance of d bits from the client's IP. See
+// rtt.GetNeighbourClientGroups.
+//
+// The combined ClientGroup, or the lack of one, is cached under the client's
+// prefix and d. Otherwise, the ClientGroups are read from datastore if they
+// are at most *budget, which is reduced by their number, and ErrNotEnoughData
+// is returned if not.
+func getNeighbourClientGroup(c data.Context, ip net.IP, d int, budget *int) (*rtt.ClientGroup, error) {
+	if d == 0 {
+		return getClientGroup(c, ip)
+	}
+
+	prefix := rtt.GetClientGroup(ip)
+	mcKey := MCKey_NeighbourClientGroup(prefix.String(), d)
+	var cached rtt.ClientGroup
+	switch err := c.Cache().Get(mcKey, &cached); err {
+	case nil:
+		// Cached without SiteRTTs if there are no neighbours.
+		if len(cached.SiteRTTs) == 0 {
+			return nil, ErrNotEnoughData
 		}
+		return &cached, nil
+	case data.ErrCacheMiss:
+	default:
+		return nil, err
 	}
-	// No valid Site found.
-	return nil, ErrNotEnoughData
+
+	cgIPs := rtt.GetNeighbourClientGroups(ip, d)
+	if len(cgIPs) > *budget {
+		return nil, ErrNotEnoughData
+	}
+	*budget -= len(cgIPs)
+	keys := make([]*data.Key, len(cgIPs))
+	for i, cgIP := range cgIPs {
+		keys[i] = rtt.ClientGroupKey(&net.IPNet{IP: cgIP, Mask: prefix.Mask})
+	}
+	cgs := make([]rtt.ClientGroup, len(keys))
+	err := c.Store().GetMulti(keys, cgs)
+	found := make([]bool, len(keys))
+	switch err := err.(type) {
+	case nil:
+		for i := range found {
+			found[i] = true
+		}
+	case data.MultiError:
+		for i, e := range err {
+			if e != nil && e != data.ErrNoSuchEntity {
+				return nil, e
+			}
+			found[i] = e == nil
+		}
+	default:
+		return nil, err
+	}
+
+	// Combine SiteRTTs, merging the RTT samples to each Site.
+	combined := rtt.NewClientGroup(prefix.IP)
+	var ok bool
+	for i := range cgs {
+		if !found[i] {
+			continue
+		}
+		cgs[i].Prefix = combined.Prefix
+		if _, err := rtt.MergeClientGroups(combined, &cgs[i]); err != nil {
+			return nil, err
+		}
+		ok = true
+	}
+	c.Cache().Set(mcKey, combined)
+	if !ok {
+		return nil, ErrNotEnoughData
+	}
+	return combined, nil
 }
 
-// MCKey_ClientGroup returns a key for use in memcache for rtt.ClientGroup data.
-func MCKey_ClientGroup(ip net.IP) string {
-	key := fmt.Sprintf("rtt:ClientGroup:%s", ip)
+// MCKey_ClientGroup returns a key for use in memcache for rtt.ClientGroup data
+// of the ClientGroup named name. See rtt.ClientGroup.Name.
+func MCKey_ClientGroup(name string) string {
+	key := fmt.Sprintf("rtt:ClientGroup:%s", name)
 	return key
 }
+
+// MCKey_NeighbourClientGroup returns a key for use in memcache for the
+// combined rtt.ClientGroup of the neighbours at a prefix distance of d bits
+// from the ClientGroup named name. See getNeighbourClientGroup.
+func MCKey_NeighbourClientGroup(name string, d int) string {
+	return fmt.Sprintf("rtt:NeighbourClientGroup:%s:%d", name, d)
+}
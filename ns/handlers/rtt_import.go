@@ -12,13 +12,12 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-// +build appengine
-
 package handlers
 
 import (
-	"appengine"
+	"code.google.com/p/mlab-ns2/gae/ns/data"
 	"code.google.com/p/mlab-ns2/gae/ns/rtt"
+	"errors"
 	"fmt"
 	"net/http"
 	"time"
@@ -26,20 +25,20 @@ import (
 
 const (
 	URLRTTImportDay             = "/admin/rtt/import/day"
+	URLRTTImportBackfill        = "/admin/rtt/import/backfill"
 	URLRTTImportDaily           = "/admin/rtt/import/daily"
 	URLRTTSetLastSuccImportDate = "/admin/rtt/import/setLastSuccessfulDate"
-)
 
-func init() {
-	http.HandleFunc(URLRTTImportDay, rttImportDay)
-	http.HandleFunc(URLRTTImportDaily, rttImportDaily)
-	http.HandleFunc(URLRTTSetLastSuccImportDate, rttSetLastSuccImportDate)
-}
+	FormKeyBackfillStart = "start"
+	FormKeyBackfillEnd   = "end"
+	FormKeyBackfillForce = "force"
+)
 
-// rttImportDay imports bigquery data for a specified day.
-func rttImportDay(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
+var ErrInvalidDateRange = errors.New("End date is before start date.")
 
+// rttImportDay imports bigquery data for a specified day. If dryrun is set,
+// the import only logs the changes it would make. See rtt.DryRunDay.
+func rttImportDay(c data.Context, w http.ResponseWriter, r *http.Request) {
 	dateStr := r.FormValue(rtt.FormKeyImportDate)
 	t, err := time.Parse(rtt.DateFormat, dateStr)
 	if err != nil {
@@ -47,30 +46,92 @@ func rttImportDay(w http.ResponseWriter, r *http.Request) {
 		c.Errorf("handlers.rttImportDay:time.Parse: %v", err)
 		return
 	}
-	addTaskRTTImportDay(w, r, t)
+	if r.FormValue(rtt.FormKeyDryRun) != "" {
+		addTaskRTTDryRunDay(c, w, t)
+		return
+	}
+	addTaskRTTImportDay(c, w, t)
 }
 
 // rttImportDaily is invoked as a daily cronjob to pull 2 day-old information
-// from BigQuery to update the RTT database
-func rttImportDaily(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
-
+// from BigQuery to update the RTT database. The oldest day whose import is
+// incomplete, and has not failed too often, is imported. See
+// rtt.GetNextImportDay.
+func rttImportDaily(c data.Context, w http.ResponseWriter, r *http.Request) {
 	now := time.Now()
 	latest := now.Add(time.Duration(-24 * 2 * time.Hour)) //Reduce time by 2 days
-	next := rtt.GetNextImportDay(c)
+	next, ok, err := rtt.GetNextImportDay(c, latest)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		c.Errorf("handlers.rttImportDaily:rtt.GetNextImportDay: %v", err)
+		return
+	}
 
-	if next.Before(latest) {
-		addTaskRTTImportDay(w, r, next)
+	if ok {
+		addTaskRTTImportDay(c, w, next)
 	} else {
 		c.Infof("handlers.rttImportDaily: Nothing to import.")
 	}
 }
 
+// rttImportBackfill submits an import task for every day from the start to
+// the end date inclusive. The tasks are throttled by the rtt-import queue.
+// Days whose import is complete or in progress according to their
+// ImportRecord are skipped, unless force is set, in which case every day is
+// imported again from the start. An import from the start replaces the RTT
+// samples of any previous import of the day, see rtt.ImportContribution.
+func rttImportBackfill(c data.Context, w http.ResponseWriter, r *http.Request) {
+	start, err := time.Parse(rtt.DateFormat, r.FormValue(FormKeyBackfillStart))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	end, err := time.Parse(rtt.DateFormat, r.FormValue(FormKeyBackfillEnd))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if end.Before(start) {
+		http.Error(w, ErrInvalidDateRange.Error(), http.StatusBadRequest)
+		return
+	}
+	force := r.FormValue(FormKeyBackfillForce) != ""
+
+	var queued, skipped int
+	for t := start; !t.After(end); t = t.Add(rtt.Day) {
+		date := t.Format(rtt.DateFormat)
+		if !force {
+			record, err := rtt.GetImportRecord(c, t)
+			if err != nil && err != data.ErrNoSuchEntity {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				c.Errorf("handlers.rttImportBackfill:rtt.GetImportRecord: %v", err)
+				return
+			}
+			if err == nil && !record.Incomplete() {
+				fmt.Fprintf(w, "%s: skipped (%s)\n", date, record.State)
+				skipped++
+				continue
+			}
+		} else if err := rtt.DeleteImportCheckpoint(c, t); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			c.Errorf("handlers.rttImportBackfill:rtt.DeleteImportCheckpoint: %v", err)
+			return
+		}
+
+		if err := queueRTTImportDay(c, t); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "%s: queued\n", date)
+		queued++
+	}
+	c.Infof("handlers.rttImportBackfill: Queued %d and skipped %d days from %s to %s.",
+		queued, skipped, start.Format(rtt.DateFormat), end.Format(rtt.DateFormat))
+}
+
 // rttSetLastSuccImportDate sets the last successful import date such that an
 // import of all data from the set date can be done via cronjobs.
-func rttSetLastSuccImportDate(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
-
+func rttSetLastSuccImportDate(c data.Context, w http.ResponseWriter, r *http.Request) {
 	dateStr := r.FormValue(rtt.FormKeyImportDate)
 	t, err := time.Parse(rtt.DateFormat, dateStr)
 	if err != nil {
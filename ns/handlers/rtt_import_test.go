@@ -0,0 +1,151 @@
+// Copyright 2013 M-Lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"code.google.com/p/mlab-ns2/gae/ns/data"
+	"code.google.com/p/mlab-ns2/gae/ns/rtt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var rttImportBackfillTests = []struct {
+	query  string
+	status int
+	dates  []string // Dates of submitted import tasks
+}{
+	{"start=2013-08-01&end=2013-08-04", http.StatusOK, []string{"2013-08-01", "2013-08-03", "2013-08-04"}},
+	{"start=2013-08-01&end=2013-08-04&force=1", http.StatusOK, []string{"2013-08-01", "2013-08-02", "2013-08-03", "2013-08-04"}},
+	{"start=2013-08-02&end=2013-08-02", http.StatusOK, nil},
+	{"start=2013-08-04&end=2013-08-01", http.StatusBadRequest, nil},
+	{"start=2013-08-01", http.StatusBadRequest, nil},
+}
+
+func TestRTTImportBackfill(t *testing.T) {
+	for _, tt := range rttImportBackfillTests {
+		var dates []string
+		queue := data.NewLocalQueue(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			dates = append(dates, r.FormValue(rtt.FormKeyImportDate))
+		}))
+		c := data.NewContext(data.NewMemoryStore(), data.NewMemoryCache(), queue, log.New(ioutil.Discard, "", 0))
+
+		// 2013-08-02 is complete and 2013-08-03 failed.
+		rtt.SetImportState(c, time.Date(2013, 8, 2, 0, 0, 0, 0, time.UTC), rtt.ImportStateComplete, nil)
+		rtt.SetImportState(c, time.Date(2013, 8, 3, 0, 0, 0, 0, time.UTC), rtt.ImportStateFailed, nil)
+
+		r, _ := http.NewRequest("GET", URLRTTImportBackfill+"?"+tt.query, nil)
+		w := httptest.NewRecorder()
+		rttImportBackfill(c, w, r)
+		if w.Code != tt.status {
+			t.Fatalf("rttImportBackfill(%s): status = %d, want %d", tt.query, w.Code, tt.status)
+		}
+		if !reflect.DeepEqual(dates, tt.dates) {
+			t.Fatalf("rttImportBackfill(%s) submitted %v, want %v", tt.query, dates, tt.dates)
+		}
+		for _, date := range dates {
+			d, _ := time.Parse(rtt.DateFormat, date)
+			if r, err := rtt.GetImportRecord(c, d); err != nil || r.State != rtt.ImportStateQueued {
+				t.Fatalf("rttImportBackfill(%s): GetImportRecord(%s) = %+v, %v, want %s", tt.query, date, r, err, rtt.ImportStateQueued)
+			}
+		}
+	}
+}
+
+// newTestImportContext returns a Context whose queue runs the import and put
+// tasks synchronously, importing row files from dir.
+func newTestImportContext(t *testing.T, dir string) data.Context {
+	var c data.Context
+	mux := http.NewServeMux()
+	newContext := func(r *http.Request) data.Context { return c }
+	Register(mux, newContext)
+	RegisterFileImport(mux, newContext, dir)
+	c = data.NewContext(data.NewMemoryStore(), data.NewMemoryCache(), data.NewLocalQueue(mux), log.New(ioutil.Discard, "", 0))
+	sliver := &data.SliverTool{ToolID: "ndt", SiteID: "lga01", ServerID: "mlab1", SliverIPv4: "74.63.50.43"}
+	key := data.NewKey("SliverTool", data.GetSliverToolID(sliver.ToolID, sliver.SliceID, sliver.ServerID, sliver.SiteID), nil)
+	if err := c.Store().Put(key, sliver); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rtt.RecordSliverIPs(c, []*data.SliverTool{sliver}, time.Unix(0, 0)); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+const testImportCSV = `log_time,connection_spec_server_ip,paris_traceroute_hop_dest_ip,rtt
+1376828118,74.63.50.43,24.164.161.5,5
+`
+
+// An import which runs before queueRTTImportDay returns is recorded as
+// complete, not as queued.
+func TestRTTImportBackfillRunsImport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rtt-import")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "2013-08-18.csv"), []byte(testImportCSV), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestImportContext(t, dir)
+
+	r, _ := http.NewRequest("GET", URLRTTImportBackfill+"?start=2013-08-18&end=2013-08-18", nil)
+	w := httptest.NewRecorder()
+	rttImportBackfill(c, w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("rttImportBackfill: status = %d, want %d", w.Code, http.StatusOK)
+	}
+	record, err := rtt.GetImportRecord(c, time.Date(2013, 8, 18, 0, 0, 0, 0, time.UTC))
+	if err != nil || record.State != rtt.ImportStateComplete || record.BatchesExpected != 1 || record.BatchesCompleted != 1 {
+		t.Fatalf("GetImportRecord after rttImportBackfill = %+v, %v, want %s with 1 of 1 batches", record, err, rtt.ImportStateComplete)
+	}
+}
+
+// A forced backfill imports the day again, replacing its RTT samples.
+func TestRTTImportBackfillForceReplaces(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rtt-import")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "2013-08-18.csv"), []byte(testImportCSV), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestImportContext(t, dir)
+
+	for i := 0; i < 2; i++ {
+		r, _ := http.NewRequest("GET", URLRTTImportBackfill+"?start=2013-08-18&end=2013-08-18&force=1", nil)
+		w := httptest.NewRecorder()
+		rttImportBackfill(c, w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("rttImportBackfill: status = %d, want %d", w.Code, http.StatusOK)
+		}
+	}
+	key := rtt.NewClientGroup(rtt.GetClientGroup(net.ParseIP("24.164.161.5")).IP).Key()
+	var cg rtt.ClientGroup
+	if err := c.Store().Get(key, &cg); err != nil {
+		t.Fatalf("Store.Get(%s) = %v", key.StringID, err)
+	}
+	if len(cg.SiteRTTs) != 1 || cg.SiteRTTs[0].Samples != 1 {
+		t.Fatalf("ClientGroup after 2 forced backfills = %+v, want 1 sample", cg)
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright 2013 M-Lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"code.google.com/p/mlab-ns2/gae/ns/data"
+	"code.google.com/p/mlab-ns2/gae/ns/rtt"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+const URLRTTMigrate = "/admin/rtt/migrate"
+
+// rttMigrate submits a task which migrates all ClientGroups to the IPv4 and
+// IPv6 prefix sizes given by the v4 and v6 form values, and deletes the
+// migrated ClientGroups if delete is set. See rtt.MigrateClientGroups. The task
+// is added to the import queue so that it does not run during an import.
+func rttMigrate(c data.Context, w http.ResponseWriter, r *http.Request) {
+	v4, v6 := r.FormValue(rtt.FormKeyV4PrefixSize), r.FormValue(rtt.FormKeyV6PrefixSize)
+	if _, _, err := rtt.ParsePrefixSizes(v4, v6); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	values := make(url.Values)
+	values.Set(rtt.FormKeyV4PrefixSize, v4)
+	values.Set(rtt.FormKeyV6PrefixSize, v6)
+	if r.FormValue(rtt.FormKeyRemove) != "" {
+		values.Set(rtt.FormKeyRemove, "1")
+	}
+	c.Infof("handlers: Submitting ClientGroup migration task to /%s and /%s", v4, v6)
+	if err := c.Queue().Add(rtt.TaskQueueNameImport, rtt.URLTaskMigrate, values); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		c.Errorf("handlers.rttMigrate:Queue.Add: %s", err)
+		return
+	}
+	fmt.Fprintf(w, "Submitted ClientGroup migration task to /%s and /%s", v4, v6)
+}
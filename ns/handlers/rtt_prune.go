@@ -0,0 +1,39 @@
+// Copyright 2013 M-Lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"code.google.com/p/mlab-ns2/gae/ns/data"
+	"code.google.com/p/mlab-ns2/gae/ns/rtt"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+const URLRTTPrune = "/admin/rtt/prune"
+
+// rttPrune is invoked as a cronjob to submit a task which removes the SiteRTTs
+// of retired Sites from all ClientGroups. The task is added to the import
+// queue so that it does not run during an import.
+func rttPrune(c data.Context, w http.ResponseWriter, r *http.Request) {
+	c.Infof("handlers: Submitting ClientGroup prune task")
+	err := c.Queue().Add(rtt.TaskQueueNameImport, rtt.URLTaskPrune, make(url.Values))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		c.Errorf("handlers.rttPrune:Queue.Add: %s", err)
+		return
+	}
+	fmt.Fprintf(w, "Submitted ClientGroup prune task")
+}
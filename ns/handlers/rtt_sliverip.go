@@ -0,0 +1,76 @@
+// Copyright 2013 M-Lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"code.google.com/p/mlab-ns2/gae/ns/data"
+	"code.google.com/p/mlab-ns2/gae/ns/rtt"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const URLRTTRecordSliverIPs = "/admin/rtt/sliverips"
+
+// rttRecordSliverIPs is invoked as a cronjob to record the current sliver IPs
+// of SliverTools in the history by which imports resolve the Sites of sliver
+// IPs. See rtt.RecordSliverIPs.
+func rttRecordSliverIPs(c data.Context, w http.ResponseWriter, r *http.Request) {
+	slivers, err := data.GetSliverTools(c)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		c.Errorf("handlers.rttRecordSliverIPs:data.GetSliverTools: %s", err)
+		return
+	}
+	report, err := rtt.RecordSliverIPs(c, slivers, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		c.Errorf("handlers.rttRecordSliverIPs:rtt.RecordSliverIPs: %s", err)
+		return
+	}
+	c.Infof("handlers: Recorded %s", report)
+	fmt.Fprintln(w, report)
+}
+
+const (
+	URLRTTSeedSliverIPs      = "/admin/rtt/sliverips/seed"
+	FormKeySliverIPIntervals = "intervals"
+)
+
+// rttSeedSliverIPs adds the sliver IP assignments given as CSV lines of
+// ip,site_id,from,until in the form value "intervals" to the history, so that
+// data logged before they were first recorded can be imported. See
+// rtt.SeedSliverIPIntervals.
+func rttSeedSliverIPs(c data.Context, w http.ResponseWriter, r *http.Request) {
+	intervals, err := rtt.ParseSliverIPIntervals(strings.NewReader(r.FormValue(FormKeySliverIPIntervals)))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = rtt.SeedSliverIPIntervals(c, intervals)
+	switch err {
+	case nil:
+	case rtt.ErrInvalidSliverIPInterval, rtt.ErrSliverIPOverlap:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		c.Errorf("handlers.rttSeedSliverIPs:rtt.SeedSliverIPIntervals: %s", err)
+		return
+	}
+	c.Infof("handlers: Seeded %d sliver IP intervals", len(intervals))
+	fmt.Fprintf(w, "Seeded %d sliver IP intervals\n", len(intervals))
+}
@@ -12,115 +12,269 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-// +build appengine
-
 package handlers
 
 import (
-	"appengine"
-	"appengine/datastore"
-	"appengine/memcache"
-	"appengine/taskqueue"
+	"code.google.com/p/mlab-ns2/gae/ns/data"
 	"code.google.com/p/mlab-ns2/gae/ns/rtt"
 	"fmt"
-	"net"
 	"net/http"
 	"net/url"
 	"time"
 )
 
-func init() {
-	http.HandleFunc(rtt.URLTaskImportDay, processTaskRTTImportDay)
-	http.HandleFunc(rtt.URLTaskImportPut, processTaskRTTCGPut)
-}
-
 // addTaskRTTImportDay adds a BigQuery import task into taskqueue for a
 // specified date.
-func addTaskRTTImportDay(w http.ResponseWriter, r *http.Request, t time.Time) {
-	c := appengine.NewContext(r)
-
+func addTaskRTTImportDay(c data.Context, w http.ResponseWriter, t time.Time) {
 	date := t.Format(rtt.DateFormat)
+	if err := queueRTTImportDay(c, t); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "Submitted BQ import task for %s", date)
+}
 
-	c.Infof("handlers: Submitting BQ import task for %s", date)
+// addTaskRTTDryRunDay adds a dry-run import task into taskqueue for a specified
+// date. The ImportRecord of the date is not changed.
+func addTaskRTTDryRunDay(c data.Context, w http.ResponseWriter, t time.Time) {
+	date := t.Format(rtt.DateFormat)
+	c.Infof("handlers: Submitting dry-run import task for %s", date)
 
 	values := make(url.Values)
 	values.Add(rtt.FormKeyImportDate, date)
-	task := taskqueue.NewPOSTTask(rtt.URLTaskImportDay, values)
-	_, err := taskqueue.Add(c, task, rtt.TaskQueueNameImport)
+	values.Add(rtt.FormKeyDryRun, "1")
+	err := c.Queue().Add(rtt.TaskQueueNameImport, rtt.URLTaskImportDay, values)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
-		c.Errorf("handlers.addTaskRTTImportDay:taskqueue.Add: %s", err)
+		c.Errorf("handlers.addTaskRTTDryRunDay:Queue.Add: %s", err)
 		return
 	}
-	fmt.Fprintf(w, "Submitted BQ import task for %s", date)
+	fmt.Fprintf(w, "Submitted dry-run import task for %s", date)
 }
 
-// processTaskRTTImportDay processes a taskqueue task for an import of BigQuery
-// data for a specified date.
-func processTaskRTTImportDay(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
+// queueRTTImportDay adds a BigQuery import task into taskqueue for a specified
+// date, which is recorded as queued before the task is added.
+func queueRTTImportDay(c data.Context, t time.Time) error {
+	date := t.Format(rtt.DateFormat)
 
-	dateStr := r.FormValue(rtt.FormKeyImportDate)
-	t, err := time.Parse(rtt.DateFormat, dateStr)
+	c.Infof("handlers: Submitting BQ import task for %s", date)
+
+	values := make(url.Values)
+	values.Add(rtt.FormKeyImportDate, date)
+	err := rtt.QueueImport(c, t, func() error {
+		return c.Queue().Add(rtt.TaskQueueNameImport, rtt.URLTaskImportDay, values)
+	})
 	if err != nil {
-		// Don't return HTTP error since incorrect date cannot be fixed.
-		c.Errorf("handlers.processTaskRTTImportDay:time.Parse: %s", err)
-		return
+		c.Errorf("handlers.queueRTTImportDay:rtt.QueueImport: %s", err)
+		return err
 	}
-
-	rtt.BQImportDay(w, r, t)
+	return nil
 }
 
 // processTaskRTTCGPut processes a taskqueue task for the putting of new
-// ClientGroups into datastore.
-func processTaskRTTCGPut(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
-
-	// Get memcache key to use from POST parameters
-	dataKey := r.FormValue(rtt.FormKeyPutKey)
-	var data []rtt.ClientGroup
-	_, err := memcache.Gob.Get(c, dataKey, &data)
-	if err != nil {
+// ClientGroups into datastore. The staged ClientGroups are merged into the
+// ClientGroups in datastore, and only removed once they have been put. A
+// retried task whose batch has already been put only removes the batch, so
+// that its RTT samples are not merged twice.
+func processTaskRTTCGPut(c data.Context, w http.ResponseWriter, r *http.Request) {
+	// Get batch ID and import date to use from POST parameters
+	batchID := r.FormValue(rtt.FormKeyPutKey)
+	dateStr := r.FormValue(rtt.FormKeyImportDate)
+	if done, err := rtt.ImportBatchCompleted(c, dateStr, batchID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		c.Errorf("handlers.processTaskRTTCGPut:rtt.ImportBatchCompleted: %s", err)
+		return
+	} else if done {
+		c.Infof("handlers: Put batch %s was already put into datastore. (%s)", batchID, dateStr)
+		if err := rtt.RemovePutBatch(c, r.Form); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			c.Errorf("handlers.processTaskRTTCGPut:rtt.RemovePutBatch: %s", err)
+		}
+		return
+	}
+
+	cgs, err := rtt.LoadPutBatch(c, r.Form)
+	if err == rtt.ErrPutBatchNotFound {
 		// Don't return HTTP error since nothing can be done if data
-		// is missing or corrupt. Just log to GAE to see how often this
-		// happens.
-		c.Errorf("handlers.processTaskRTTCGPut:memcache.Get: %s", err)
+		// is missing. Just log to see how often this happens, and fail
+		// the batch so that the day is imported again.
+		c.Errorf("handlers.processTaskRTTCGPut:rtt.LoadPutBatch: %s", err)
+		if err := rtt.CompleteImportBatch(c, dateStr, batchID, err); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			c.Errorf("handlers.processTaskRTTCGPut:rtt.CompleteImportBatch: %s", err)
+		}
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		c.Errorf("handlers.processTaskRTTCGPut:rtt.LoadPutBatch: %s", err)
+		return
+	}
+
+	// Merge the RTT samples of the batch into the ClientGroups in
+	// datastore, which may have changed since the import read them.
+	report, err := rtt.MergeImportBatch(c, rtt.ParseImportContribution(r.Form), cgs)
+	if err == rtt.ErrStaleImportRun {
+		// The day is being imported again, and the batch is neither
+		// merged nor counted by the new import.
+		c.Infof("handlers: Dropping put batch %s. (%s: %s)", batchID, dateStr, err)
+		if err := rtt.RemovePutBatch(c, r.Form); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			c.Errorf("handlers.processTaskRTTCGPut:rtt.RemovePutBatch: %s", err)
+		}
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		c.Errorf("handlers.processTaskRTTCGPut:rtt.MergeImportBatch: %s", err)
+		return
+	}
+	c.Infof("handlers: Merged put batch %s: %s. (%s)", batchID, report, dateStr)
+
+	// ClientGroups which could not be merged fail the batch, so that the
+	// import of the day is reported as failed.
+	if err := rtt.CompleteImportBatch(c, dateStr, batchID, report.Err()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		c.Errorf("handlers.processTaskRTTCGPut:rtt.CompleteImportBatch: %s", err)
 		return
 	}
 
-	// Create lists of keys to use in datastore.PutMulti
-	parentKey := rtt.DatastoreParentKey(c)
-	keys := make([]*datastore.Key, 0, len(data))
-	var key *datastore.Key
-	for _, cg := range data {
-		key = datastore.NewKey(c, "ClientGroup", net.IP(cg.Prefix).String(), 0, parentKey)
-		keys = append(keys, key)
+	// Remove staged CGs
+	if err := rtt.RemovePutBatch(c, r.Form); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		c.Errorf("handlers.processTaskRTTCGPut:rtt.RemovePutBatch: %s", err)
+		return
 	}
+}
 
-	// Put data into datastore
-	_, err = datastore.PutMulti(c, keys, data)
+// processTaskRTTPrune processes a taskqueue task for the pruning of SiteRTTs
+// of Sites which are no longer live from a page of ClientGroups, and submits a
+// task for the next page. See rtt.PruneClientGroups.
+func processTaskRTTPrune(c data.Context, w http.ResponseWriter, r *http.Request) {
+	live, err := rtt.LiveSites(c)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
-		c.Errorf("handlers.processTaskRTTCGPut:datastore.PutMulti: %s", err)
+		c.Errorf("handlers.processTaskRTTPrune:rtt.LiveSites: %s", err)
 		return
 	}
+	report, next, err := rtt.PruneClientGroups(c, live, time.Now(), r.FormValue(rtt.FormKeyPruneStart))
+	if err == rtt.ErrNoLiveSites {
+		// Don't return HTTP error since retrying won't bring Sites back.
+		c.Errorf("handlers.processTaskRTTPrune:rtt.PruneClientGroups: %s", err)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		c.Errorf("handlers.processTaskRTTPrune:rtt.PruneClientGroups: %s (%s)", err, report)
+		return
+	}
+	c.Infof("handlers: Pruned %s", report)
+	fmt.Fprintln(w, report)
 
-	// Remove cached CGs
-	if err := memcache.Delete(c, dataKey); err != nil {
+	if next != "" {
+		values := make(url.Values)
+		values.Set(rtt.FormKeyPruneStart, next)
+		if err := c.Queue().Add(rtt.TaskQueueNameImport, rtt.URLTaskPrune, values); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			c.Errorf("handlers.processTaskRTTPrune:Queue.Add: %s", err)
+		}
+	}
+}
+
+// processTaskRTTMigrate processes a taskqueue task for the migration of a page
+// of ClientGroups to new prefix sizes, and submits a task for the next page.
+// See rtt.MigrateClientGroups.
+func processTaskRTTMigrate(c data.Context, w http.ResponseWriter, r *http.Request) {
+	v4Size, v6Size, err := rtt.ParsePrefixSizes(r.FormValue(rtt.FormKeyV4PrefixSize), r.FormValue(rtt.FormKeyV6PrefixSize))
+	if err != nil {
+		// Don't return HTTP error since incorrect sizes cannot be fixed.
+		c.Errorf("handlers.processTaskRTTMigrate:rtt.ParsePrefixSizes: %s", err)
+		return
+	}
+	remove := r.FormValue(rtt.FormKeyRemove) != ""
+	report, next, err := rtt.MigrateClientGroups(c, v4Size, v6Size, remove, r.FormValue(rtt.FormKeyMigrateStart))
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
-		c.Errorf("handlers.processTaskRTTCGPut:memcache.Delte: %s", err)
+		c.Errorf("handlers.processTaskRTTMigrate:rtt.MigrateClientGroups: %s (%s)", err, report)
 		return
 	}
+	c.Infof("handlers: Migrated ClientGroups to /%d and /%d: %s", v4Size, v6Size, report)
+	fmt.Fprintln(w, report)
 
-	dateStr := r.FormValue(rtt.FormKeyImportDate)
-	c.Infof("handlers: %d ClientGroups were successfully put into datastore. (%s)", len(data), dateStr)
+	if next != "" {
+		values := make(url.Values)
+		values.Set(rtt.FormKeyV4PrefixSize, r.FormValue(rtt.FormKeyV4PrefixSize))
+		values.Set(rtt.FormKeyV6PrefixSize, r.FormValue(rtt.FormKeyV6PrefixSize))
+		if remove {
+			values.Set(rtt.FormKeyRemove, "1")
+		}
+		values.Set(rtt.FormKeyMigrateStart, next)
+		if err := c.Queue().Add(rtt.TaskQueueNameImport, rtt.URLTaskMigrate, values); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			c.Errorf("handlers.processTaskRTTMigrate:Queue.Add: %s", err)
+		}
+	}
+}
+
+// RegisterFileImport registers a handler for rtt.URLTaskImportDay with mux
+// which imports RTT data from the row files in dir instead of BigQuery. Row
+// files are named by date, e.g., 2013-08-18.csv.gz. See rtt.FindRowFile.
+func RegisterFileImport(mux *http.ServeMux, newContext data.ContextFunc, dir string) {
+	mux.HandleFunc(rtt.URLTaskImportDay, data.Handler(newContext, func(c data.Context, w http.ResponseWriter, r *http.Request) {
+		processTaskRTTImportFile(c, w, r, dir)
+	}))
+}
 
-	// Get which date this import is for
+// processTaskRTTImportFile processes a taskqueue task for an import of RTT data
+// from a row file in dir for a specified date, or a dry run of the import if
+// dryrun is set.
+func processTaskRTTImportFile(c data.Context, w http.ResponseWriter, r *http.Request, dir string) {
+	dryRun := r.FormValue(rtt.FormKeyDryRun) != ""
+	dateStr := r.FormValue(rtt.FormKeyImportDate)
 	t, err := time.Parse(rtt.DateFormat, dateStr)
 	if err != nil {
 		// Don't return HTTP error since incorrect date cannot be fixed.
-		c.Errorf("handlers.processTaskRTTCGPut:time.Parse: %s", err)
+		c.Errorf("handlers.processTaskRTTImportFile:time.Parse: %s", err)
+		return
+	}
+
+	path, err := rtt.FindRowFile(dir, t)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		c.Errorf("handlers.processTaskRTTImportFile:rtt.FindRowFile: %s (%s)", err, dateStr)
+		if !dryRun {
+			rtt.SetImportState(c, t, rtt.ImportStateFailed, err)
+		}
+		return
+	}
+	src, closer, err := rtt.OpenRowFile(path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		c.Errorf("handlers.processTaskRTTImportFile:rtt.OpenRowFile: %s", err)
+		if !dryRun {
+			rtt.SetImportState(c, t, rtt.ImportStateFailed, err)
+		}
+		return
+	}
+	defer closer.Close()
+
+	if dryRun {
+		report, err := rtt.DryRunDay(c, src, t)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			c.Errorf("handlers.processTaskRTTImportFile:rtt.DryRunDay: %s", err)
+			return
+		}
+		c.Infof("handlers: Dry run of %s", report)
+		fmt.Fprintln(w, report)
+		return
+	}
+
+	report, err := rtt.ImportDay(c, src, t)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		c.Errorf("handlers.processTaskRTTImportFile:rtt.ImportDay: %s", err)
 		return
 	}
-	rtt.UpdateLastSuccessfulImportDate(c, t)
+	fmt.Fprintln(w, report)
 }
@@ -0,0 +1,155 @@
+// Copyright 2013 M-Lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"code.google.com/p/mlab-ns2/gae/ns/data"
+	"code.google.com/p/mlab-ns2/gae/ns/rtt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProcessTaskRTTCGPutMerges(t *testing.T) {
+	c := data.NewContext(data.NewMemoryStore(), data.NewMemoryCache(), nil, log.New(ioutil.Discard, "", 0))
+	updated := time.Unix(1376828167, 0)
+
+	// One ClientGroup exists, and one is new.
+	old := rtt.NewClientGroup(net.ParseIP("24.164.160.0"))
+	old.SiteRTTs = rtt.SiteRTTs{rtt.NewSiteRTT("lga01", 5, updated), rtt.NewSiteRTT("ams01", 90, updated)}
+	oldKey := old.Key()
+	if err := c.Store().Put(oldKey, old); err != nil {
+		t.Fatal(err)
+	}
+	cg := rtt.NewClientGroup(net.ParseIP("24.164.160.0"))
+	cg.SiteRTTs = rtt.SiteRTTs{rtt.NewSiteRTT("lga01", 10, updated), rtt.NewSiteRTT("dfw01", 40, updated)}
+	cgNew := rtt.NewClientGroup(net.ParseIP("4.2.2.0"))
+	cgNew.SiteRTTs = rtt.SiteRTTs{rtt.NewSiteRTT("lga01", 3, updated)}
+	if err := c.Cache().Set("put", []rtt.ClientGroup{*cg, *cgNew}); err != nil {
+		t.Fatal(err)
+	}
+
+	values := url.Values{rtt.FormKeyPutKey: {"put"}, rtt.FormKeyImportDate: {"2013-08-18"}}
+	r, _ := http.NewRequest("POST", rtt.URLTaskImportPut, strings.NewReader(values.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	processTaskRTTCGPut(c, w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("processTaskRTTCGPut: status = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	var got rtt.ClientGroup
+	if err := c.Store().Get(oldKey, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		siteID  string
+		rtt     float64
+		samples int
+		mean    float64
+	}{{"lga01", 5, 2, 7.5}, {"dfw01", 40, 1, 40}, {"ams01", 90, 1, 90}}
+	if len(got.SiteRTTs) != len(want) {
+		t.Fatalf("ClientGroup 24.164.160.0 = %v, want %v", got.SiteRTTs, want)
+	}
+	for i, sr := range got.SiteRTTs {
+		w := want[i]
+		if sr.SiteID != w.siteID || sr.RTT != w.rtt || sr.Samples != w.samples || sr.Mean != w.mean {
+			t.Fatalf("ClientGroup 24.164.160.0 = %v, want %v", got.SiteRTTs, want)
+		}
+	}
+	if err := c.Store().Get(cgNew.Key(), &got); err != nil {
+		t.Fatalf("ClientGroup 4.2.2.0: %v", err)
+	}
+}
+
+func TestProcessTaskRTTCGPutRetry(t *testing.T) {
+	c := data.NewContext(data.NewMemoryStore(), data.NewMemoryCache(), nil, log.New(ioutil.Discard, "", 0))
+	cg := rtt.NewClientGroup(net.ParseIP("24.164.160.0"))
+	cg.SiteRTTs = rtt.SiteRTTs{rtt.NewSiteRTT("lga01", 10, time.Unix(1376828167, 0))}
+
+	staging, _ := rtt.GetPutStaging(rtt.PutStagingStore)
+	values := url.Values{
+		rtt.FormKeyPutKey:     {"batch"},
+		rtt.FormKeyPutStaging: {rtt.PutStagingStore},
+		rtt.FormKeyImportDate: {"2013-08-18"},
+	}
+	if err := staging.Stage(c, "batch", []rtt.ClientGroup{*cg}, values); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second attempt finds the batch already put, and does not merge
+	// its samples again.
+	for i := 0; i < 2; i++ {
+		r, _ := http.NewRequest("POST", rtt.URLTaskImportPut, strings.NewReader(values.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		processTaskRTTCGPut(c, w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("processTaskRTTCGPut (attempt %d): status = %d, want %d", i+1, w.Code, http.StatusOK)
+		}
+	}
+	if _, err := rtt.LoadPutBatch(c, values); err != rtt.ErrPutBatchNotFound {
+		t.Fatalf("LoadPutBatch after put = %v, want %v", err, rtt.ErrPutBatchNotFound)
+	}
+	if done, err := rtt.ImportBatchCompleted(c, "2013-08-18", "batch"); err != nil || !done {
+		t.Fatalf("ImportBatchCompleted = %v, %v, want true", done, err)
+	}
+	var got rtt.ClientGroup
+	if err := c.Store().Get(cg.Key(), &got); err != nil {
+		t.Fatalf("ClientGroup 24.164.160.0: %v", err)
+	}
+	if len(got.SiteRTTs) != 1 || got.SiteRTTs[0].Samples != 1 {
+		t.Fatalf("ClientGroup 24.164.160.0 = %v, want 1 sample", got.SiteRTTs)
+	}
+}
+
+// A ClientGroup which cannot be merged with the one in datastore does not
+// replace it.
+func TestProcessTaskRTTCGPutMergeError(t *testing.T) {
+	c := data.NewContext(data.NewMemoryStore(), data.NewMemoryCache(), nil, log.New(ioutil.Discard, "", 0))
+	updated := time.Unix(1376828167, 0)
+	cg := rtt.NewClientGroup(net.ParseIP("24.164.160.0"))
+	cg.SiteRTTs = rtt.SiteRTTs{rtt.NewSiteRTT("lga01", 10, updated)}
+	stored := rtt.NewClientGroup(net.ParseIP("24.164.161.0"))
+	stored.SiteRTTs = rtt.SiteRTTs{rtt.NewSiteRTT("ams01", 90, updated)}
+	if err := c.Store().Put(cg.Key(), stored); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Cache().Set("put", []rtt.ClientGroup{*cg}); err != nil {
+		t.Fatal(err)
+	}
+
+	values := url.Values{rtt.FormKeyPutKey: {"put"}, rtt.FormKeyImportDate: {"2013-08-18"}}
+	r, _ := http.NewRequest("POST", rtt.URLTaskImportPut, strings.NewReader(values.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	processTaskRTTCGPut(c, w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("processTaskRTTCGPut: status = %d, want %d", w.Code, http.StatusOK)
+	}
+	var got rtt.ClientGroup
+	if err := c.Store().Get(cg.Key(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.SiteRTTs) != 1 || got.SiteRTTs[0].SiteID != "ams01" {
+		t.Fatalf("ClientGroup 24.164.160.0/22 = %v, want it unchanged", got.SiteRTTs)
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2013 M-Lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"code.google.com/p/mlab-ns2/gae/ns/data"
+	"code.google.com/p/mlab-ns2/gae/ns/rtt"
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestGetClientGroupLegacy(t *testing.T) {
+	c := data.NewContext(data.NewMemoryStore(), data.NewMemoryCache(), nil, log.New(ioutil.Discard, "", 0))
+	ip := net.ParseIP("24.164.161.7")
+	if _, err := getClientGroup(c, ip); err != ErrNotEnoughData {
+		t.Fatalf("getClientGroup(%s) = %v, want %v", ip, err, ErrNotEnoughData)
+	}
+
+	// A ClientGroup which has not been migrated is named by its address.
+	legacy := &rtt.ClientGroup{Prefix: net.ParseIP("24.164.160.0"), SiteRTTs: rtt.SiteRTTs{rtt.NewSiteRTT("lga01", 5, time.Unix(1376828167, 0))}}
+	if err := c.Store().Put(rtt.LegacyClientGroupKey(ip), legacy); err != nil {
+		t.Fatal(err)
+	}
+	cg, err := getClientGroup(c, ip)
+	if err != nil || len(cg.SiteRTTs) != 1 || cg.SiteRTTs[0].SiteID != "lga01" {
+		t.Fatalf("getClientGroup(%s) = %v, %v, want the legacy ClientGroup", ip, cg, err)
+	}
+}
+
+func TestGetNeighbourClientGroupCached(t *testing.T) {
+	c := data.NewContext(data.NewMemoryStore(), data.NewMemoryCache(), nil, log.New(ioutil.Discard, "", 0))
+	ip := net.ParseIP("24.164.161.7") // Neighbours 24.164.164.0/22 at 1 bit, 24.164.168.0/22 and 24.164.172.0/22 at 2
+	neighbour := rtt.NewClientGroup(net.ParseIP("24.164.164.0").To4())
+	neighbour.SiteRTTs = rtt.SiteRTTs{rtt.NewSiteRTT("lga01", 5, time.Unix(1376828167, 0))}
+	if err := c.Store().Put(neighbour.Key(), neighbour); err != nil {
+		t.Fatal(err)
+	}
+
+	// Neighbours beyond the budget are not read.
+	budget := 1
+	if _, err := getNeighbourClientGroup(c, ip, 2, &budget); err != ErrNotEnoughData || budget != 1 {
+		t.Fatalf("getNeighbourClientGroup(%s, 2) = %v, budget %d, want %v, budget 1", ip, err, budget, ErrNotEnoughData)
+	}
+	for i := 0; i < 2; i++ {
+		if cg, err := getNeighbourClientGroup(c, ip, 1, &budget); err != nil || len(cg.SiteRTTs) != 1 || budget != 0 {
+			t.Fatalf("getNeighbourClientGroup(%s, 1) = %v, %v, budget %d, want 1 SiteRTT, budget 0", ip, cg, err, budget)
+		}
+		// Lookups after the first are cached.
+		if err := c.Store().Delete(neighbour.Key()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The lack of neighbours is cached as well.
+	budget = 2
+	if _, err := getNeighbourClientGroup(c, ip, 2, &budget); err != ErrNotEnoughData || budget != 0 {
+		t.Fatalf("getNeighbourClientGroup(%s, 2) = %v, budget %d, want %v, budget 0", ip, err, budget, ErrNotEnoughData)
+	}
+	neighbour = rtt.NewClientGroup(net.ParseIP("24.164.168.0").To4())
+	neighbour.SiteRTTs = rtt.SiteRTTs{rtt.NewSiteRTT("lga01", 5, time.Unix(1376828167, 0))}
+	if err := c.Store().Put(neighbour.Key(), neighbour); err != nil {
+		t.Fatal(err)
+	}
+	budget = 2
+	if _, err := getNeighbourClientGroup(c, ip, 2, &budget); err != ErrNotEnoughData || budget != 2 {
+		t.Fatalf("getNeighbourClientGroup(%s, 2) = %v, budget %d, want %v from the cache", ip, err, budget, ErrNotEnoughData)
+	}
+}
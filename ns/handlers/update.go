@@ -12,15 +12,9 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-// +build appengine
-
-// The handlers package provides the mlab-ns2 handlers"
 package handlers
 
 import (
-	"appengine"
-	"appengine/datastore"
-	"appengine/urlfetch"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -43,14 +37,10 @@ var (
 	ErrInvalidKsSite = errors.New("Invalid data in Site from Ks")
 )
 
-func init() {
-	http.HandleFunc(KsRegistrationHandlerUrl, KsRegistrationHandler)
-}
-
 // getAllKsSites returns a list of all sites from ks
-func getAllKsSites(c appengine.Context) ([]*data.Site, error) {
+func getAllKsSites(c data.Context) ([]*data.Site, error) {
 	var ksSites []*data.Site
-	client := urlfetch.Client(c)
+	client := c.HTTPClient()
 	res, err := client.Get(KsSitesUrl)
 	if err != nil {
 		return nil, err
@@ -87,24 +77,24 @@ func difference(mlabSiteIds, ksSiteIds map[string]int) map[string]int {
 }
 
 // registerSite puts a Site and corresponding SliverTools in the datastore
-func registerSite(c appengine.Context, site *data.Site) ([]*datastore.Key, error) {
+func registerSite(c data.Context, site *data.Site) error {
 
-	key := datastore.NewKey(c, "Site", site.SiteID, 0, nil)
+	key := data.NewKey("Site", site.SiteID, nil)
 	site.When = time.Now()
-	_, err := datastore.Put(c, key, site)
+	err := c.Store().Put(key, site)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	q := datastore.NewQuery("Tool")
+	q := data.NewQuery("Tool")
 	var tools []*data.Tool
-	_, err = q.GetAll(c, &tools)
+	_, err = c.Store().GetAll(q, &tools)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	sliverTools := make([]*data.SliverTool, len(tools)*numServers)
-	slKeys := make([]*datastore.Key, len(tools)*numServers)
+	slKeys := make([]*data.Key, len(tools)*numServers)
 	i := 0
 	for _, tool := range tools {
 		for _, serverID := range serverIDs {
@@ -118,8 +108,8 @@ func registerSite(c appengine.Context, site *data.Site) ([]*datastore.Key, error
 				FQDN:                   fmt.Sprintf("%s.%s.%s.%s.%s", sliceParts[1], sliceParts[0], serverID, site.SiteID, "measurement-lab.org"),
 				ServerPort:             "",
 				HTTPPort:               tool.HTTPPort,
-				SliverIPv4:             "off",
-				SliverIPv6:             "off",
+				SliverIPv4:             data.SliverIPOff,
+				SliverIPv6:             data.SliverIPOff,
 				UpdateRequestTimestamp: site.RegistrationTimestamp,
 				StatusIPv4:             "offline",
 				StatusIPv6:             "offline",
@@ -129,19 +119,17 @@ func registerSite(c appengine.Context, site *data.Site) ([]*datastore.Key, error
 				Country:                site.Country,
 				When:                   time.Now(),
 			}
-			slKey := datastore.NewKey(c, "SliverTool", sliverToolID, 0, nil)
+			slKey := data.NewKey("SliverTool", sliverToolID, nil)
 			slKeys[i] = slKey
 			sliverTools[i] = sliverTool
 			i++
 		}
 	}
-	return datastore.PutMulti(c, slKeys, sliverTools)
+	return c.Store().PutMulti(slKeys, sliverTools)
 }
 
 // KsRegistrationHandler gets Site data from ks and updates the datastore
-func KsRegistrationHandler(w http.ResponseWriter, r *http.Request) {
-
-	c := appengine.NewContext(r)
+func KsRegistrationHandler(c data.Context, w http.ResponseWriter, r *http.Request) {
 	ksSites, err := getAllKsSites(c)
 	if err != nil {
 		c.Errorf("KsRegistrationHandler:getAllKsSites err = %v", err)
@@ -180,7 +168,7 @@ func KsRegistrationHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		_, ok := newSiteIds[site.SiteID]
 		if ok {
-			_, err = registerSite(c, site)
+			err = registerSite(c, site)
 			if err != nil {
 				c.Errorf("KsRegistrationHandler:registerSite err = %v", err)
 			}
@@ -18,13 +18,13 @@ package rtt
 
 import (
 	"appengine"
-	"appengine/datastore"
 	"appengine/urlfetch"
 	"code.google.com/p/golog2bq/log2bq"
 	"code.google.com/p/google-api-go-client/bigquery/v2"
 	"code.google.com/p/mlab-ns2/gae/ns/data"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"time"
 )
@@ -34,7 +34,10 @@ const (
 	BigQueryBillableProjectID = "mlab-ns2"
 )
 
-var ErrNoBigQueryData = errors.New("No BigQuery rows received in response from query.")
+var (
+	ErrNoBigQueryData        = errors.New("No BigQuery rows received in response from query.")
+	ErrBigQueryJobIncomplete = errors.New("rtt: BigQuery job did not complete before the query timed out.")
+)
 
 // bqQueryFormat is the query used to pull RTT data from the M-Lab BigQuery
 // dataset.
@@ -102,20 +105,34 @@ func bqInit(r *http.Request) (*bigquery.Service, error) {
 	return bigquery.New(client)
 }
 
-// BQImportDay queries BigQuery for RTT data from a specific day and stores new
-// data into datastore
-func BQImportDay(w http.ResponseWriter, r *http.Request, t time.Time) {
-	c := appengine.NewContext(r)
-	service, err := bqInit(r)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		c.Errorf("rtt: BQImportDay.bqInit: %s", err)
-		return
-	}
+// bqRowSource is a RowSource which pages through the results of a BigQuery
+// query. After the first page, up to ImportParallelism pages are fetched
+// concurrently by start index. Next returns ErrNoBigQueryData if the query
+// has no results, and ErrBigQueryJobIncomplete if its job did not complete
+// within the query's timeout, so that the import of a day which is not yet
+// available fails instead of completing with no Rows.
+//
+// bqRowSource is a Checkpointer. A resumed bqRowSource reads the remaining
+// results of the checkpointed job instead of rerunning the query. If the
+// results are no longer available, Next returns ErrCheckpointUnavailable
+// rather than rerunning the query from the first row, since the Rows before
+// the checkpoint have already been merged.
+type bqRowSource struct {
+	c           data.Context
+	jobsService *bigquery.JobsService
+	q           *bigquery.QueryRequest
+
+	projID, jobID string
+	rows, totalN  int       // Rows consumed and in total
+	start         int       // Row at which the pages after the first start
+	more          RowSource // Pages after the first
+}
 
+// newBQRowSource returns a RowSource which queries BigQuery for RTT data from
+// a specific day.
+func newBQRowSource(c data.Context, service *bigquery.Service, t time.Time) *bqRowSource {
 	// Format strings to insert into bqQueryFormat
 	tableName := fmt.Sprintf("measurement-lab:m_lab.%.4d_%.2d", t.Year(), t.Month())
-	dateStr := t.Format(DateFormat)
 	startTime, endTime := getDayStartEnd(t)
 
 	// Construct query
@@ -126,145 +143,184 @@ func BQImportDay(w http.ResponseWriter, r *http.Request, t time.Time) {
 		TimeoutMs:     600000,
 		UseQueryCache: true,
 	}
-	c.Debugf("rtt.BQImportDay:bigquery.QueryRequest (%s): %s", dateStr, qText)
+	c.Debugf("rtt.newBQRowSource:bigquery.QueryRequest (%s): %s", t.Format(DateFormat), qText)
 
-	// Make first query to BigQuery
-	jobsService := bigquery.NewJobsService(service)
-	queryCall := jobsService.Query(BigQueryBillableProjectID, q)
-	response, err := queryCall.Do()
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		c.Errorf("rtt.BQImportDay:bigquery.JobsService.Query: %s", err)
-		return
+	return &bqRowSource{
+		c:           c,
+		jobsService: bigquery.NewJobsService(service),
+		q:           q,
 	}
-	c.Infof("rtt: Received %d rows in query response (Total: %d rows).", len(response.Rows), response.TotalRows)
+}
 
-	newCGs := make(map[string]*ClientGroup)
-	sliverTools, err := data.GetSliverTools(c)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		c.Errorf("rtt.BQImportDay:data.GetSliverTools: %s", err)
+func (s *bqRowSource) Next() (Rows, error) {
+	if s.more != nil {
+		rows, err := s.more.Next()
+		s.rows += len(rows)
+		return rows, err
 	}
-	sliverIPMap := makeMapIPStrToSiteID(sliverTools)
-	sliverTools = nil // mark for GC
-	bqProcessQuery(response.Rows, sliverIPMap, newCGs)
 
-	// Cache details from response to use in subsequent requests if any.
-	projID := response.JobReference.ProjectId
-	jobID := response.JobReference.JobId
-	pageToken := response.PageToken
-	n := len(response.Rows)
-	totalN := int(response.TotalRows)
-	response = nil // mark for GC
-
-	// Request for more results if not all results returned.
-	// TODO(seon.wook): Good place to look for optimizations using channels.
-	if n < totalN {
-		// Make further requests
-		getQueryResultsCall := jobsService.GetQueryResults(projID, jobID)
-		var respMore *bigquery.GetQueryResultsResponse
-
-		for n < totalN { // Make requests until total number of rows queried.
-			getQueryResultsCall.MaxResults(MaxBQResponseRows)
-			getQueryResultsCall.PageToken(pageToken)
-
-			respMore, err = getQueryResultsCall.Do()
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				c.Errorf("rtt.BQImportDay:bigquery.JobsGetQueryResponseCall: %s", err)
-				return
-			}
-			pageToken = respMore.PageToken // Update pageToken to get next page.
-
-			n += len(respMore.Rows)
-			c.Infof("rtt: Received %d additional rows. (Total: %d rows)", len(respMore.Rows), n)
-
-			bqProcessQuery(respMore.Rows, sliverIPMap, newCGs)
-			respMore = nil // mark for GC
+	// Read the first page, from the checkpointed job if resumed.
+	var rows Rows
+	var err error
+	if s.jobID != "" {
+		if rows, err = s.resume(); err != nil {
+			s.c.Errorf("rtt.bqRowSource.Next:bqRowSource.resume: %s", err)
+			return nil, ErrCheckpointUnavailable
 		}
+	} else if rows, err = s.query(); err != nil {
+		return nil, err
+	} else if len(rows) == 0 {
+		// A day without rows is not in BigQuery yet, so its import
+		// fails and is retried rather than completing with no data.
+		return nil, ErrNoBigQueryData
 	}
+	s.rows += len(rows)
+	s.start = s.rows
 
-	c.Infof("rtt: Reduced %d rows to %d rows. Merging into datastore.", totalN, len(newCGs))
-
-	if totalN == 0 {
-		http.Error(w, ErrNoBigQueryData.Error(), http.StatusInternalServerError)
-		c.Errorf("rtt.BQImportDay: %s", ErrNoBigQueryData)
-		return
+	// Request for more results if not all results returned.
+	pages := 0
+	if len(rows) > 0 && s.rows < s.totalN {
+		pages = (s.totalN - s.rows + MaxBQResponseRows - 1) / MaxBQResponseRows
 	}
+	s.more = newParallelRowSource(pages, ImportParallelism, s.fetchPage)
 
-	bqMergeWithDatastore(c, dateStr, newCGs)
+	if len(rows) == 0 {
+		return nil, io.EOF
+	}
+	return rows, nil
 }
 
-// bqProcessQuery processes the output of the BigQuery query performed in
-// BQImport and parses the response into data structures.
-func bqProcessQuery(resp []*bigquery.TableRow, sliverIPMap map[string]string, newCGs map[string]*ClientGroup) {
-	rows := simplifyBQResponse(resp)
-	bqMergeIntoClientGroups(rows, sliverIPMap, newCGs)
+func (s *bqRowSource) Close() error {
+	if s.more != nil {
+		return s.more.Close()
+	}
+	return nil
 }
 
-// bqMergeWithDatastore takes a list of ClientGroup generated by bqProcessQuery
-// and merges the new data with existing data in datastore.
-func bqMergeWithDatastore(c appengine.Context, dateStr string, newCGs map[string]*ClientGroup) {
-	chunks := divideIntoDSReadChunks(c, newCGs)
+// query runs the query and returns the first page of its results.
+func (s *bqRowSource) query() (Rows, error) {
+	response, err := s.jobsService.Query(BigQueryBillableProjectID, s.q).Do()
+	if err != nil {
+		return nil, err
+	}
+	if !response.JobComplete {
+		// The rows and total of an incomplete job are not final.
+		return nil, ErrBigQueryJobIncomplete
+	}
+	s.c.Infof("rtt: Received %d rows in query response (Total: %d rows).", len(response.Rows), response.TotalRows)
 
-	var oldCGs []ClientGroup
-	var newCG *ClientGroup
-	var err error
-	var merr []error
-	var ok, changed bool
+	// Cache details from response to use in subsequent requests if any.
+	s.projID = response.JobReference.ProjectId
+	s.jobID = response.JobReference.JobId
+	s.rows = 0
+	s.totalN = int(response.TotalRows)
+	return simplifyBQResponse(response.Rows), nil
+}
 
-	putReq := &putQueueRequest{}
+// resume returns the first page of the results of the checkpointed job which
+// have not been consumed.
+func (s *bqRowSource) resume() (Rows, error) {
+	if s.rows >= s.totalN {
+		return nil, nil
+	}
+	call := s.jobsService.GetQueryResults(s.projID, s.jobID)
+	call.StartIndex(uint64(s.rows))
+	call.MaxResults(MaxBQResponseRows)
+	response, err := call.Do()
+	if err != nil {
+		return nil, err
+	}
+	if len(response.Rows) == 0 {
+		return nil, ErrNoBigQueryData
+	}
+	s.c.Infof("rtt: Resumed BigQuery job %s at row %d. (Total: %d rows)", s.jobID, s.rows, s.totalN)
+	return simplifyBQResponse(response.Rows), nil
+}
 
-	// Process chunk by chunk
-	for _, chunk := range chunks {
-		oldCGs = make([]ClientGroup, chunk.len())
-		err = datastore.GetMulti(c, chunk.keys, oldCGs) // Get existing ClientGroup data
+// fetchPage fetches the page with index i of the rows after the first
+// response. Page i starts at row s.start+i*MaxBQResponseRows. It is a
+// pageFunc.
+func (s *bqRowSource) fetchPage(i int) (Rows, error) {
+	start := s.start + i*MaxBQResponseRows
+	end := start + MaxBQResponseRows
+	if end > s.totalN {
+		end = s.totalN
+	}
 
-		merr, ok = err.(appengine.MultiError)
-		if !ok {
-			// If error not multi, create list of nil errors. This is done to
-			// allow for one loop over all queried ClientGroups below.
-			merr = make([]error, chunk.len())
+	// BigQuery may return fewer rows than requested if the response would
+	// be too large, so request until the whole page has been received.
+	rows := make(Rows, 0, end-start)
+	for start < end {
+		call := s.jobsService.GetQueryResults(s.projID, s.jobID)
+		call.StartIndex(uint64(start))
+		call.MaxResults(int64(end - start))
+		respMore, err := call.Do()
+		if err != nil {
+			return nil, err
 		}
-
-		// Range over all entries in chunk
-		for i, e := range merr {
-			newCG, changed = bqMergeCGWithDS(c, &oldCGs[i], chunk.cgs[i], e)
-			if changed {
-				putReq.add(c, dateStr, chunk.keys[i], newCG)
-			}
+		if len(respMore.Rows) == 0 {
+			return nil, ErrNoBigQueryData
 		}
+		start += len(respMore.Rows)
+		rows = append(rows, simplifyBQResponse(respMore.Rows)...)
 	}
+	s.c.Infof("rtt: Received %d additional rows. (Page %d)", cap(rows), i+1)
+	return rows, nil
+}
 
-	// Process remaining Put operations.
-	putReq.process(c, dateStr)
+func (s *bqRowSource) Checkpoint() RowCheckpoint {
+	return RowCheckpoint{
+		ProjectID: s.projID,
+		JobID:     s.jobID,
+		Rows:      s.rows,
+		TotalRows: s.totalN,
+	}
+}
 
-	c.Infof("rtt: Completed merging in %d rows from BigQuery.", len(newCGs))
+func (s *bqRowSource) Resume(cp RowCheckpoint) error {
+	s.projID = cp.ProjectID
+	s.jobID = cp.JobID
+	s.rows = cp.Rows
+	s.totalN = cp.TotalRows
+	return nil
 }
 
-// bqMergeCGWithDS deals with a response from datastore.Get for the entity
-// ClientGroup
-func bqMergeCGWithDS(c appengine.Context, oldCG, newCG *ClientGroup, err error) (*ClientGroup, bool) {
-	switch err {
-	// No stored entity
-	case datastore.ErrNoSuchEntity:
-		return newCG, true
-	// No error
-	case nil:
-		// If old data is nil for some reason
-		if oldCG.SiteRTTs == nil {
-			return newCG, true
-		}
+// BQImportDay queries BigQuery for RTT data from a specific day and stores new
+// data into datastore
+func BQImportDay(w http.ResponseWriter, r *http.Request, t time.Time) {
+	c := data.NewGAEContext(appengine.NewContext(r))
+	service, err := bqInit(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		c.Errorf("rtt: BQImportDay.bqInit: %s", err)
+		SetImportState(c, t, ImportStateFailed, err)
+		return
+	}
 
-		// Merge new CG with old CG
-		changed, err := MergeClientGroups(oldCG, newCG)
-		if err != nil {
-			c.Errorf("rtt.bqMergeCGWithDS: %s", err)
-		}
-		return oldCG, changed
-	// Unknown error
-	default:
-		c.Errorf("rtt.bqMergeCGWithDS: %s", err)
+	if _, err := ImportDay(c, newBQRowSource(c, service, t), t); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		c.Errorf("rtt.BQImportDay:ImportDay: %s", err)
+		return
+	}
+}
+
+// BQDryRunDay queries BigQuery for RTT data from a specific day and logs the
+// changes its import would make, without writing to datastore. See DryRunDay.
+func BQDryRunDay(w http.ResponseWriter, r *http.Request, t time.Time) {
+	c := data.NewGAEContext(appengine.NewContext(r))
+	service, err := bqInit(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		c.Errorf("rtt.BQDryRunDay:bqInit: %s", err)
+		return
+	}
+
+	report, err := DryRunDay(c, newBQRowSource(c, service, t), t)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		c.Errorf("rtt.BQDryRunDay:DryRunDay: %s", err)
+		return
 	}
-	return oldCG, false
+	c.Infof("rtt: Dry run of %s", report)
+	fmt.Fprintln(w, report)
 }
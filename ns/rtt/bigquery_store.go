@@ -0,0 +1,432 @@
+// Copyright 2013 M-Lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rtt
+
+import (
+	"code.google.com/p/mlab-ns2/gae/ns/data"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+)
+
+const (
+	MaxDSReadPerQuery  = 1000
+	MaxDSWritePerQuery = 300
+
+	// MaxDSWriteBytesPerQuery is the estimated encoded size up to which
+	// ClientGroups are batched into a put task, below the 1MB limit of
+	// memcache values and datastore entities.
+	MaxDSWriteBytesPerQuery = 900 << 10
+
+	// MaxClientGroupBytes is the estimated encoded size above which a
+	// ClientGroup cannot be put into datastore.
+	MaxClientGroupBytes = 1000 << 10
+
+	// Estimated encoding overhead of a ClientGroup and of each of its
+	// SiteRTTs, including property names, excluding variable length
+	// values.
+	clientGroupOverheadBytes = 64
+	siteRTTOverheadBytes     = 64
+)
+
+var (
+	ErrImportAccounting = errors.New("rtt: Not every ClientGroup in the import was accounted for.")
+)
+
+// dsReadChunk is a structure with which new ClientGroup lists can be split into
+// lengths <= MaxDSReadPerQuery such that datastore.GetMulti works.
+type dsReadChunk struct {
+	keys []*data.Key
+	cgs  []*ClientGroup
+}
+
+// len returns the length of the slice *dsReadChunk.keys.
+func (c *dsReadChunk) len() int {
+	return len(c.keys)
+}
+
+// newDSReadChunk returns a new *dsReadChunk with the keys and cgs slices made.
+func newDSReadChunk() *dsReadChunk {
+	return &dsReadChunk{
+		keys: make([]*data.Key, 0, MaxDSReadPerQuery),
+		cgs:  make([]*ClientGroup, 0, MaxDSReadPerQuery),
+	}
+}
+
+// divideIntoDSReadChunks divides GetMulti operations into MaxDSReadPerQuery
+// sized operations to adhere with GAE limits for a given map[string]*ClientGroup.
+func divideIntoDSReadChunks(newcgs map[string]*ClientGroup) []*dsReadChunk {
+	chunks := make([]*dsReadChunk, 0, len(newcgs)/MaxDSReadPerQuery+1)
+	chunk := newDSReadChunk()
+
+	for _, cg := range newcgs {
+		// Add into chunk
+		chunk.keys = append(chunk.keys, cg.Key())
+		chunk.cgs = append(chunk.cgs, cg)
+
+		// Make sure read chunks are only as large as MaxDSReadPerQuery.
+		// Create new chunk if size reached.
+		if chunk.len() == MaxDSReadPerQuery {
+			chunks = append(chunks, chunk)
+			chunk = newDSReadChunk()
+		}
+	}
+
+	// Add final partial chunk.
+	if chunk.len() > 0 {
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+// mergeResult is the outcome of merging a new ClientGroup with datastore.
+type mergeResult int
+
+const (
+	mergeNew       mergeResult = iota // No ClientGroup in datastore
+	mergeChanged                      // ClientGroup in datastore changed by merge
+	mergeUnchanged                    // ClientGroup in datastore unchanged by merge
+	mergeErrored                      // ClientGroup could not be merged or stored
+)
+
+// ImportReport accounts for every ClientGroup from a BigQuery import. Every
+// input ClientGroup is counted exactly once as new, changed, unchanged or
+// errored. New and changed ClientGroups are only counted once their Put has
+// been submitted. Imports which are checkpointed merge ClientGroups with
+// datastore several times, so a ClientGroup may be counted once per merge.
+type ImportReport struct {
+	Date      string
+	Input     int // ClientGroups from BigQuery
+	New       int // ClientGroups not previously in datastore
+	Changed   int // ClientGroups in datastore changed by the merge
+	Unchanged int // ClientGroups in datastore unchanged by the merge
+	Errored   int // ClientGroups which could not be merged or submitted
+	Oversized int // Errored ClientGroups too large to put into datastore
+	Chunks    int // Datastore read chunks
+	Rows      int // Rows read
+	Batches   int // Put tasks submitted
+
+	// Rows whose sliver IP was not assigned to a Site when they were
+	// logged, as far as the SliverIPHistory records
+	Unresolved int
+
+	// Rows rejected by ImportRowFilter
+	OutOfBounds int // RTT beyond MinRTT or MaxRTT
+	TooFast     int // RTT faster than light from the Site
+	Outliers    int // RTT an outlier within its ClientGroup and Site
+}
+
+// count counts n ClientGroups with the merge result res.
+func (r *ImportReport) count(res mergeResult, n int) {
+	switch res {
+	case mergeNew:
+		r.New += n
+	case mergeChanged:
+		r.Changed += n
+	case mergeUnchanged:
+		r.Unchanged += n
+	default:
+		r.Errored += n
+	}
+}
+
+// add adds the counts of o into r.
+func (r *ImportReport) add(o *ImportReport) {
+	r.Input += o.Input
+	r.New += o.New
+	r.Changed += o.Changed
+	r.Unchanged += o.Unchanged
+	r.Errored += o.Errored
+	r.Oversized += o.Oversized
+	r.Chunks += o.Chunks
+	r.Rows += o.Rows
+	r.Batches += o.Batches
+	r.Unresolved += o.Unresolved
+	r.OutOfBounds += o.OutOfBounds
+	r.TooFast += o.TooFast
+	r.Outliers += o.Outliers
+}
+
+// Counted returns the number of ClientGroups which have been accounted for.
+func (r *ImportReport) Counted() int {
+	return r.New + r.Changed + r.Unchanged + r.Errored
+}
+
+// Check returns ErrImportAccounting if not every input ClientGroup has been
+// accounted for exactly once.
+func (r *ImportReport) Check() error {
+	if r.Counted() != r.Input {
+		return ErrImportAccounting
+	}
+	return nil
+}
+
+func (r *ImportReport) String() string {
+	return fmt.Sprintf("%s: %d rows (%d unresolved, %d out of bounds, %d too fast, %d outliers), %d input, %d new, %d changed, %d unchanged, %d errored (%d oversized) in %d chunks and %d put batches",
+		r.Date, r.Rows, r.Unresolved, r.OutOfBounds, r.TooFast, r.Outliers, r.Input, r.New, r.Changed, r.Unchanged, r.Errored, r.Oversized, r.Chunks, r.Batches)
+}
+
+// bqMergeWithDatastore takes a list of ClientGroup generated by
+// bqMergeIntoClientGroups, the contribution ic, and merges the new data with
+// existing data in datastore. It returns an ImportReport accounting for every
+// ClientGroup in newCGs.
+func bqMergeWithDatastore(c data.Context, ic ImportContribution, newCGs map[string]*ClientGroup) *ImportReport {
+	chunks := divideIntoDSReadChunks(newCGs)
+	report := &ImportReport{
+		Date:   ic.Date,
+		Input:  len(newCGs),
+		Chunks: len(chunks),
+	}
+
+	var oldCGs []ClientGroup
+	var err error
+	var res mergeResult
+
+	putReq := &putQueueRequest{report: report}
+
+	// Process chunk by chunk
+	for _, chunk := range chunks {
+		oldCGs = make([]ClientGroup, chunk.len())
+		err = c.Store().GetMulti(chunk.keys, oldCGs) // Get existing ClientGroup data
+
+		var merr data.MultiError
+		switch e := err.(type) {
+		case nil:
+			merr = make(data.MultiError, chunk.len())
+		case data.MultiError:
+			merr = e
+		default:
+			// The whole chunk failed, so nothing can be safely merged.
+			c.Errorf("rtt.bqMergeWithDatastore:Store.GetMulti: %s", err)
+			report.count(mergeErrored, chunk.len())
+			continue
+		}
+
+		// Range over all entries in chunk
+		for i, e := range merr {
+			res = bqMergeCGWithDS(c, ic, &oldCGs[i], chunk.cgs[i], e)
+			if res == mergeNew || res == mergeChanged {
+				putReq.add(c, ic, chunk.keys[i], chunk.cgs[i], res)
+			} else {
+				report.count(res, 1)
+			}
+		}
+	}
+
+	// Process remaining Put operations.
+	putReq.process(c, ic)
+
+	if err := report.Check(); err != nil {
+		c.Errorf("rtt.bqMergeWithDatastore: %s (%s)", err, report)
+	}
+	c.Infof("rtt: Completed merging in %d rows from BigQuery. (%s)", len(newCGs), report)
+	return report
+}
+
+// bqMergeCGWithDS deals with a response from datastore.Get for the entity
+// ClientGroup, and reports the result of merging newCG, the contribution ic,
+// into it. The merge itself is done when newCG is put, see MergeImportBatch,
+// so that the RTT samples of newCG are counted once even if datastore has
+// changed since. oldCG is unchanged if it already contains ic.
+func bqMergeCGWithDS(c data.Context, ic ImportContribution, oldCG, newCG *ClientGroup, err error) mergeResult {
+	switch err {
+	// No stored entity
+	case data.ErrNoSuchEntity:
+		return mergeNew
+	// No error
+	case nil:
+		// If old data is nil for some reason
+		if oldCG.SiteRTTs == nil {
+			return mergeNew
+		}
+
+		if !net.IP(oldCG.Prefix).Equal(net.IP(newCG.Prefix)) || oldCG.ASN != newCG.ASN {
+			c.Errorf("rtt.bqMergeCGWithDS: %s", ErrMergeClientGroup)
+			return mergeErrored
+		}
+		if oldCG.hasImport(ic) {
+			return mergeUnchanged
+		}
+		return mergeChanged
+	// Unknown error
+	default:
+		c.Errorf("rtt.bqMergeCGWithDS: %s", err)
+	}
+	return mergeErrored
+}
+
+// estimateClientGroupSize returns an estimate of the encoded size of a
+// ClientGroup in bytes.
+func estimateClientGroupSize(cg *ClientGroup) int {
+	n := clientGroupOverheadBytes + len(cg.Prefix)
+	for _, sr := range cg.SiteRTTs {
+		n += siteRTTOverheadBytes + len(sr.SiteID) + len(sr.Histogram) + len(sr.Minima)
+	}
+	for _, ref := range cg.Imports {
+		n += len(ref)
+	}
+	for _, name := range cg.Migrated {
+		n += len(name)
+	}
+	return n
+}
+
+// dsWriteChunk is a structure with which new ClientGroup lists can be split
+// into lengths <= MaxDSWritePerQuery and estimated sizes <=
+// MaxDSWriteBytesPerQuery such that datastore.PutMulti works.
+type dsWriteChunk struct {
+	keys  []*data.Key
+	cgs   []ClientGroup
+	res   []mergeResult
+	bytes int // Estimated encoded size of cgs
+}
+
+// len returns the length of the slice *dsWriteChunk.keys.
+func (c *dsWriteChunk) len() int {
+	return len(c.keys)
+}
+
+// newDSWriteChunk returns a new *dsWriteChunk with the keys and cgs slices made.
+func newDSWriteChunk() *dsWriteChunk {
+	return &dsWriteChunk{
+		keys: make([]*data.Key, 0, MaxDSWritePerQuery),
+		cgs:  make([]ClientGroup, 0, MaxDSWritePerQuery),
+		res:  make([]mergeResult, 0, MaxDSWritePerQuery),
+	}
+}
+
+// putQueueRequest keeps track of a queue for datastore.PutMulti requests, as
+// well as the total number of Puts done. Queued ClientGroups are counted in
+// report once their Put has been submitted, or as errored if it could not be.
+type putQueueRequest struct {
+	queue  *dsWriteChunk
+	putN   int
+	report *ImportReport
+}
+
+// add places a newly updated ClientGroup in a PutMulti queue. This queue is
+// later processed by putQueueRequest.process.
+func (r *putQueueRequest) add(c data.Context, ic ImportContribution, k *data.Key, cg *ClientGroup, res mergeResult) {
+	if r.queue == nil || r.queue.keys == nil {
+		r.queue = newDSWriteChunk()
+	}
+
+	// A ClientGroup which is too large to put is reported instead of
+	// failing the batch it would be put with.
+	size := estimateClientGroupSize(cg)
+	if size > MaxClientGroupBytes {
+		c.Errorf("rtt.putQueueRequest.add: ClientGroup %s is too large to put (%d bytes, %d SiteRTTs)", k.StringID, size, len(cg.SiteRTTs))
+		if r.report != nil {
+			r.report.count(mergeErrored, 1)
+			r.report.Oversized++
+		}
+		return
+	}
+
+	// Submit the queue first if the ClientGroup doesn't fit.
+	if r.queue.len() > 0 && r.queue.bytes+size > MaxDSWriteBytesPerQuery {
+		r.process(c, ic)
+	}
+
+	r.queue.keys = append(r.queue.keys, k)
+	r.queue.cgs = append(r.queue.cgs, *cg)
+	r.queue.res = append(r.queue.res, res)
+	r.queue.bytes += size
+
+	if r.queue.len() == MaxDSWritePerQuery {
+		r.process(c, ic)
+	}
+}
+
+// process processes a queue of newly updated ClientGroups. This is done so that
+// up to MaxDSWritePerQuery no. of Puts can be done to reduce the number of queries to
+// datastore and therefore the time taken to Put all changes to datastore.
+func (r *putQueueRequest) process(c data.Context, ic ImportContribution) {
+	if r.queue == nil || r.queue.len() == 0 { // Don't process further if nothing to process
+		return
+	}
+	n := r.queue.len()
+
+	c.Infof("rtt: Submitting put tasks for %v records. (Total: %d rows)", n, r.putN+n)
+
+	err := addTaskClientGroupPut(c, ic, r.queue.cgs)
+	for _, res := range r.queue.res {
+		if err != nil {
+			res = mergeErrored
+		}
+		if r.report != nil {
+			r.report.count(res, 1)
+		}
+	}
+	if err == nil {
+		r.putN += n
+		if r.report != nil {
+			r.report.Batches++
+		}
+	}
+	r.queue = newDSWriteChunk()
+}
+
+// addTaskClientGroupPut receives a list of ClientGroups, the contribution ic,
+// to put into datastore and stages it using ImportPutStaging. It then submits
+// the batch as a taskqueue task.
+func addTaskClientGroupPut(c data.Context, ic ImportContribution, cgs []ClientGroup) error {
+	values := make(url.Values)
+	ic.addValues(values)
+	if err := stagePutBatch(c, newPutBatchID(), cgs, values); err != nil {
+		c.Errorf("rtt.addTaskClientGroupPut:stagePutBatch: %s", err)
+		return err
+	}
+
+	// Submit taskqueue task
+	err := c.Queue().Add(TaskQueueNameImportPut, URLTaskImportPut, values)
+	if err != nil {
+		c.Errorf("rtt.addTaskClientGroupPut:Queue.Add: %s", err)
+		RemovePutBatch(c, values)
+		return err
+	}
+	return nil
+}
+
+// DatastoreParentKey returns a datastore key to use as a parent key for rtt
+// related datastore entries.
+func DatastoreParentKey() *data.Key {
+	return data.NewKey("string", "rtt", nil)
+}
+
+// ClientGroupKey returns the datastore key of the ClientGroup with a prefix,
+// which is named by the prefix in CIDR notation, e.g., 24.164.160.0/22.
+// ClientGroups stored before were named by the prefix address only, see
+// LegacyClientGroupKey.
+func ClientGroupKey(prefix *net.IPNet) *data.Key {
+	return data.NewKey("ClientGroup", prefix.String(), DatastoreParentKey())
+}
+
+// LegacyClientGroupKey returns the datastore key of the ClientGroup of ip
+// stored before ClientGroups were named in CIDR notation, which is named by
+// the address of its prefix of the sizes used then, e.g., 24.164.160.0. Such
+// ClientGroups are found until they are migrated, see MigrateClientGroups.
+func LegacyClientGroupKey(ip net.IP) *data.Key {
+	prefix := getPrefix(ip, legacyV4PrefixSize, legacyV6PrefixSize)
+	return data.NewKey("ClientGroup", prefix.IP.String(), DatastoreParentKey())
+}
+
+// newPutBatchID generates a unique ID for a batch of ClientGroups to put.
+func newPutBatchID() string {
+	ns := time.Now().UnixNano()
+	return fmt.Sprintf("rtt:bqImport:Put:%d", ns)
+}
@@ -0,0 +1,185 @@
+// Copyright 2013 M-Lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rtt
+
+import (
+	"code.google.com/p/mlab-ns2/gae/ns/data"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var divideIntoDSReadChunksTests = []struct {
+	n      int // Number of ClientGroups
+	chunks int
+}{
+	{0, 0},
+	{1, 1},
+	{MaxDSReadPerQuery - 1, 1},
+	{MaxDSReadPerQuery, 1},
+	{MaxDSReadPerQuery + 1, 2},
+	{2*MaxDSReadPerQuery + 500, 3},
+}
+
+// makeTestClientGroups returns n ClientGroups with distinct /22 prefixes.
+func makeTestClientGroups(n int) map[string]*ClientGroup {
+	cgs := make(map[string]*ClientGroup, n)
+	for i := 0; i < n; i++ {
+		ip := net.IPv4(10, byte(i>>6), byte(i<<2), 0).To4()
+		cg := NewClientGroup(ip)
+		cg.SiteRTTs = append(cg.SiteRTTs, NewSiteRTT("abc01", 10, time.Unix(1376828167, 0)))
+		cgs[ip.String()] = cg
+	}
+	return cgs
+}
+
+func TestDivideIntoDSReadChunks(t *testing.T) {
+	for _, tt := range divideIntoDSReadChunksTests {
+		cgs := makeTestClientGroups(tt.n)
+		chunks := divideIntoDSReadChunks(cgs)
+		if len(chunks) != tt.chunks {
+			t.Fatalf("divideIntoDSReadChunks(%d) = %d chunks, want %d", tt.n, len(chunks), tt.chunks)
+		}
+		seen := make(map[string]bool)
+		for _, chunk := range chunks {
+			if chunk.len() == 0 || chunk.len() > MaxDSReadPerQuery || len(chunk.cgs) != chunk.len() {
+				t.Fatalf("divideIntoDSReadChunks(%d): chunk of %d keys, %d ClientGroups", tt.n, chunk.len(), len(chunk.cgs))
+			}
+			for _, k := range chunk.keys {
+				seen[k.StringID] = true
+			}
+		}
+		if len(seen) != tt.n {
+			t.Fatalf("divideIntoDSReadChunks(%d) = %d ClientGroups, want %d", tt.n, len(seen), tt.n)
+		}
+	}
+}
+
+// newTestImportContext returns a Context whose queue runs ClientGroup put
+// tasks, or fails them if fail is set.
+func newTestImportContext(fail bool) data.Context {
+	queue := data.NewLocalQueue(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			http.Error(w, "failed", http.StatusInternalServerError)
+		}
+	}))
+	return data.NewContext(data.NewMemoryStore(), data.NewMemoryCache(), queue, log.New(ioutil.Discard, "", 0))
+}
+
+var bqMergeWithDatastoreTests = []struct {
+	fail bool
+	want ImportReport
+}{
+	{false, ImportReport{Input: MaxDSReadPerQuery + 2, New: MaxDSReadPerQuery, Changed: 1, Unchanged: 1, Chunks: 2, Batches: 4}},
+	{true, ImportReport{Input: MaxDSReadPerQuery + 2, Errored: MaxDSReadPerQuery + 1, Unchanged: 1, Chunks: 2}},
+}
+
+var testImportContribution = ImportContribution{Date: "2013-08-18", Run: "r1"}
+
+func TestBQMergeWithDatastore(t *testing.T) {
+	for _, tt := range bqMergeWithDatastoreTests {
+		c := newTestImportContext(tt.fail)
+		newCGs := makeTestClientGroups(MaxDSReadPerQuery + 2)
+
+		// Store two ClientGroups, the second of which already contains
+		// the contribution.
+		for i, rtt := range []float64{20, 5} {
+			ip := net.IPv4(10, 0, byte(i<<2), 0).To4()
+			cg := NewClientGroup(ip)
+			cg.SiteRTTs = append(cg.SiteRTTs, NewSiteRTT("abc01", rtt, time.Unix(1376828167, 0)))
+			if i == 1 {
+				cg.Imports = []string{cg.Name() + "|2013-08-18|r1|1"}
+			}
+			if err := c.Store().Put(cg.Key(), cg); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		report := bqMergeWithDatastore(c, testImportContribution, newCGs)
+		tt.want.Date = "2013-08-18"
+		if *report != tt.want {
+			t.Fatalf("bqMergeWithDatastore (fail=%v) = %s, want %s", tt.fail, report, &tt.want)
+		}
+		if err := report.Check(); err != nil {
+			t.Fatalf("ImportReport.Check() = %v", err)
+		}
+	}
+}
+
+func TestImportReportCheck(t *testing.T) {
+	r := &ImportReport{Input: 3, New: 1, Unchanged: 1}
+	if err := r.Check(); err != ErrImportAccounting {
+		t.Fatalf("ImportReport.Check() = %v, want %v", err, ErrImportAccounting)
+	}
+	r.count(mergeErrored, 1)
+	if err := r.Check(); err != nil {
+		t.Fatalf("ImportReport.Check() = %v, want nil (%s)", err, r)
+	}
+}
+
+// makeTestClientGroupWithSites returns a ClientGroup with n SiteRTTs.
+func makeTestClientGroupWithSites(i, n int) *ClientGroup {
+	cg := NewClientGroup(net.IPv4(10, 0, byte(i), 0))
+	cg.SiteRTTs = make(SiteRTTs, n)
+	for j := range cg.SiteRTTs {
+		cg.SiteRTTs[j] = SiteRTT{SiteID: fmt.Sprintf("s%04d", j), RTT: 1, LastUpdated: time.Unix(1376828167, 0)}
+	}
+	return cg
+}
+
+func TestPutQueueRequestBatchBytes(t *testing.T) {
+	var batches []int // ClientGroups per put task
+	var c data.Context
+	queue := data.NewLocalQueue(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		cgs, err := LoadPutBatch(c, r.Form)
+		if err != nil {
+			t.Errorf("LoadPutBatch: %v", err)
+		}
+		batches = append(batches, len(cgs))
+	}))
+	c = data.NewContext(data.NewMemoryStore(), data.NewMemoryCache(), queue, log.New(ioutil.Discard, "", 0))
+
+	// Two ClientGroups of just under half the batch size fit in a batch,
+	// and one too large to put is skipped.
+	sites := MaxDSWriteBytesPerQuery/2/(siteRTTOverheadBytes+5) - 1
+	cgs := []*ClientGroup{
+		makeTestClientGroupWithSites(0, sites),
+		makeTestClientGroupWithSites(1, sites),
+		makeTestClientGroupWithSites(2, MaxClientGroupBytes/siteRTTOverheadBytes),
+		makeTestClientGroupWithSites(3, sites),
+		makeTestClientGroupWithSites(4, 1),
+	}
+	report := &ImportReport{Input: len(cgs)}
+	putReq := &putQueueRequest{report: report}
+	for _, cg := range cgs {
+		key := cg.Key()
+		putReq.add(c, testImportContribution, key, cg, mergeNew)
+	}
+	putReq.process(c, testImportContribution)
+
+	if want := []int{2, 2}; !reflect.DeepEqual(batches, want) {
+		t.Fatalf("ClientGroups per put task = %v, want %v", batches, want)
+	}
+	want := &ImportReport{Input: 5, New: 4, Errored: 1, Oversized: 1, Batches: 2}
+	if !reflect.DeepEqual(report, want) {
+		t.Fatalf("putQueueRequest report = %s, want %s", report, want)
+	}
+}
@@ -17,8 +17,8 @@ package rtt
 import (
 	"code.google.com/p/google-api-go-client/bigquery/v2"
 	"code.google.com/p/mlab-ns2/gae/ns/data"
-	"github.com/swook/inssort"
 	"net"
+	"sort"
 	"strconv"
 	"time"
 )
@@ -34,38 +34,38 @@ func getDayStartEnd(t time.Time) (time.Time, time.Time) {
 	return startTime, endTime
 }
 
-// bqRow is an intermediate data structure used to make data from BigQuery more
-// accessible in the data processing and storing stage.
-type bqRow struct {
-	lastUpdated        time.Time
-	serverIP, clientIP net.IP
-	rtt                float64
+// Row is an intermediate data structure used to make RTT data from BigQuery or
+// other RowSources more accessible in the data processing and storing stage.
+type Row struct {
+	LastUpdated        time.Time
+	ServerIP, ClientIP net.IP
+	RTT                float64
 }
 
-// bqRows is a list of bqRow
-type bqRows []*bqRow
+// Rows is a list of Row
+type Rows []*Row
 
 // simplifyBQResponse takes BigQuery response rows and converts the string
 // interface values into appropriate types. For example, rtt string is parsed
 // into float64.
-func simplifyBQResponse(rows []*bigquery.TableRow) bqRows {
-	data := make(bqRows, 0, len(rows))
+func simplifyBQResponse(rows []*bigquery.TableRow) Rows {
+	data := make(Rows, 0, len(rows))
 
-	var newRow *bqRow
+	var newRow *Row
 	var lastUpdatedInt int64
 	var err error
 
 	for _, row := range rows {
-		newRow = &bqRow{}
-		newRow.serverIP = net.ParseIP(row.F[1].V.(string))
-		if newRow.serverIP == nil {
+		newRow = &Row{}
+		newRow.ServerIP = net.ParseIP(row.F[1].V.(string))
+		if newRow.ServerIP == nil {
 			continue
 		}
-		newRow.clientIP = net.ParseIP(row.F[2].V.(string))
-		if newRow.clientIP == nil {
+		newRow.ClientIP = net.ParseIP(row.F[2].V.(string))
+		if newRow.ClientIP == nil {
 			continue
 		}
-		newRow.rtt, err = strconv.ParseFloat(row.F[3].V.(string), 64)
+		newRow.RTT, err = strconv.ParseFloat(row.F[3].V.(string), 64)
 		if err != nil {
 			continue
 		}
@@ -73,7 +73,7 @@ func simplifyBQResponse(rows []*bigquery.TableRow) bqRows {
 		if err != nil {
 			continue
 		}
-		newRow.lastUpdated = time.Unix(lastUpdatedInt, 0)
+		newRow.LastUpdated = time.Unix(lastUpdatedInt, 0)
 		data = append(data, newRow)
 	}
 	return data
@@ -86,10 +86,10 @@ func makeMapIPStrToSiteID(slivers []*data.SliverTool) map[string]string {
 	for _, s := range slivers {
 		// TODO(seon.wook): Consider not branching within loop but using
 		//                  delete after ipToSliver[""] = s.SiteID
-		if s.SliverIPv4 != "" {
+		if s.SliverIPv4 != "" && s.SliverIPv4 != data.SliverIPOff {
 			ipToSliver[s.SliverIPv4] = s.SiteID
 		}
-		if s.SliverIPv6 != "" {
+		if s.SliverIPv6 != "" && s.SliverIPv6 != data.SliverIPOff {
 			ipToSliver[s.SliverIPv6] = s.SiteID
 		}
 	}
@@ -97,90 +97,60 @@ func makeMapIPStrToSiteID(slivers []*data.SliverTool) map[string]string {
 }
 
 // bqMergeIntoClientGroups merges new rows of data into an existing map of
-// ClientGroup IP string to *ClientGroup. This involves the merging of new
-// SiteRTTs with existing SiteRTTs, and the sorting of SiteRTTs to be in
-// ascending RTT order.
-func bqMergeIntoClientGroups(rows bqRows, sliverIPMap map[string]string, newCGs map[string]*ClientGroup) {
-	var clientCGIP net.IP
-	var clientCGIPStr string
+// ClientGroup name to *ClientGroup, grouping clients by ClientGrouping. The
+// server IP of each row is resolved to a Site by sliverIPs at the time of the
+// row. This involves the merging of new SiteRTTs with existing SiteRTTs, and
+// the sorting of SiteRTTs to be in ascending order of RankingMetric.
+func bqMergeIntoClientGroups(rows Rows, sliverIPs SliverIPResolver, newCGs map[string]*ClientGroup) {
+	var clientCGName string
 	var clientCG *ClientGroup
 	var siteID string
-	var oldSR, newSR SiteRTT
-	var oldSRIdx int
-	var changed, ok bool
-	var oldidxrange, idxrange []int
+	var newSR SiteRTT
+	var ok bool
 
-	// Slice of CGs which need to be sorted later on. This is because new
+	// Set of CGs which need to be sorted later on. This is because new
 	// entries are inserted into an existing map and not all entries need
 	// to be sorted.
-	CGsToSort := make(map[string][]int, 0)
+	CGsToSort := make(map[string]bool, 0)
 
 	for _, row := range rows {
 		// Get Site ID from serverIP
-		siteID, ok = sliverIPMap[row.serverIP.String()]
+		siteID, ok = sliverIPs.SiteID(row.ServerIP.String(), row.LastUpdated)
 		if !ok {
 			continue
 		}
 
-		// Get ClientGroup.Prefix from clientIP
-		clientCGIP = GetClientGroup(row.clientIP).IP
-		clientCGIPStr = clientCGIP.String()
-		// Create new ClientGroup if does not exist
-		clientCG, ok = newCGs[clientCGIPStr]
-		if !ok {
-			clientCG = NewClientGroup(clientCGIP)
-			newCGs[clientCGIPStr] = clientCG
+		// Get ClientGroup from clientIP
+		clientCG = GroupClient(row.ClientIP)
+		clientCGName = clientCG.Name()
+		// Add new ClientGroup if does not exist
+		if cg, ok := newCGs[clientCGName]; ok {
+			clientCG = cg
+		} else {
+			newCGs[clientCGName] = clientCG
 		}
 
-		// Find SiteRTT entry
+		// Find SiteRTT entry and merge the new sample into it, or add a
+		// new entry.
+		// NOTE: Can ignore error as error only occurs when oldSR.SiteID
+		//       != newSR.SiteID.
+		newSR = NewSiteRTT(siteID, row.RTT, row.LastUpdated)
 		ok = false // Shows if entry exists
-		for i, sitertt := range clientCG.SiteRTTs {
-			if sitertt.SiteID == siteID {
-				// Found entry
-				oldSRIdx = i
-				oldSR = sitertt
+		for i := range clientCG.SiteRTTs {
+			if clientCG.SiteRTTs[i].SiteID == siteID {
+				MergeSiteRTTs(&clientCG.SiteRTTs[i], &newSR)
 				ok = true
+				break
 			}
 		}
-
-		// Create new entry
-		newSR = SiteRTT{siteID, row.rtt, row.lastUpdated}
-		idxrange = make([]int, 2, 2)
 		if !ok {
-			// No existing entry, add new entry
 			clientCG.SiteRTTs = append(clientCG.SiteRTTs, newSR)
-			changed = true
-			idxrange[1] = len(clientCG.SiteRTTs)
-			idxrange[0] = idxrange[1] - 1
-		} else {
-			// Entry exists, merge with old entry
-			// NOTE: Can ignore error as error only occurs when oldSR.SiteID
-			//       != newSR.SiteID.
-			changed, _ = MergeSiteRTTs(&oldSR, &newSR)
-			if changed {
-				clientCG.SiteRTTs[oldSRIdx] = oldSR
-				idxrange[0] = oldSRIdx
-				idxrange[1] = oldSRIdx + 1
-			}
-		}
-		if changed { // If existing SiteRTTs changed or updated
-			oldidxrange, ok = CGsToSort[clientCGIPStr]
-			if !ok {
-				CGsToSort[clientCGIPStr] = idxrange
-			} else {
-				// Expand index range to include new changes
-				if oldidxrange[0] > idxrange[0] {
-					oldidxrange[0] = idxrange[0]
-				}
-				if oldidxrange[1] < idxrange[1] {
-					oldidxrange[1] = idxrange[1]
-				}
-			}
 		}
+		CGsToSort[clientCGName] = true
 	}
 
-	// Sort ClientGroups' SiteRTTs in ascending RTT order
-	for clientCGIPStr, idxrange := range CGsToSort {
-		inssort.Sort(newCGs[clientCGIPStr].SiteRTTs, idxrange...)
+	// Sort ClientGroups' SiteRTTs in ascending order of RankingMetric
+	for clientCGName = range CGsToSort {
+		sort.Sort(newCGs[clientCGName].SiteRTTs)
 	}
 }
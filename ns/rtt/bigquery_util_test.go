@@ -25,7 +25,7 @@ import (
 
 var simplifyBQResponseTests = []struct {
 	in  []*bigquery.TableRow
-	out bqRows
+	out Rows
 }{
 	{
 		[]*bigquery.TableRow{
@@ -54,14 +54,14 @@ var simplifyBQResponseTests = []struct {
 				},
 			},
 		},
-		bqRows{
-			&bqRow{
+		Rows{
+			&Row{
 				time.Unix(123, 0),
 				net.ParseIP("1.2.3.4"),
 				net.ParseIP("5.6.7.8"),
 				3.21,
 			},
-			&bqRow{
+			&Row{
 				time.Unix(456, 0),
 				net.ParseIP("9.0.1.2"),
 				net.ParseIP("3.4.5.6"),
@@ -72,7 +72,7 @@ var simplifyBQResponseTests = []struct {
 }
 
 func TestSimplifyBQResponse(t *testing.T) {
-	var out bqRows
+	var out Rows
 	for i, tt := range simplifyBQResponseTests {
 		out = simplifyBQResponse(tt.in)
 		if !reflect.DeepEqual(tt.out, out) {
@@ -116,43 +116,43 @@ func TestMakeMapIPStrtoSiteID(t *testing.T) {
 }
 
 var bqMergeIntoClientGroupsTests = []struct {
-	in_rows bqRows
+	in_rows Rows
 	in_cgs  map[string]*ClientGroup
 	out     map[string]*ClientGroup
 }{
 	{
-		bqRows{
-			&bqRow{
+		Rows{
+			&Row{
 				time.Unix(1376828118, 0),
 				net.ParseIP("74.63.50.43"), // lga01
 				net.ParseIP("154.54.36.18"),
 				761.5423380533854,
 			},
-			&bqRow{ // Test sorting of SiteRTTs
+			&Row{ // Test sorting of SiteRTTs
 				time.Unix(1376828646, 0),
 				net.ParseIP("82.116.199.38"), // lca01
 				net.ParseIP("154.54.39.18"),
 				62.007999420166016,
 			},
-			&bqRow{
+			&Row{
 				time.Unix(1376828891, 0),
 				net.ParseIP("82.116.199.38"), // lca01
 				net.ParseIP("90.185.4.231"),
 				88.22200012207031,
 			},
-			&bqRow{
+			&Row{
 				time.Unix(1376828193, 0),
 				net.ParseIP("74.63.50.43"), // lga01
 				net.ParseIP("24.164.163.78"),
 				38.31500116984049,
 			},
-			&bqRow{ // Test merging of existing SiteRTT
+			&Row{ // Test merging of existing SiteRTT
 				time.Unix(1376828167, 0),
 				net.ParseIP("74.63.50.43"), // lga01
 				net.ParseIP("24.164.160.17"),
 				7.705666700998942,
 			},
-			&bqRow{
+			&Row{
 				time.Unix(1376828645, 0),
 				net.ParseIP("38.107.216.10"), // dfw01
 				net.ParseIP("154.54.36.0"),
@@ -160,60 +160,65 @@ var bqMergeIntoClientGroupsTests = []struct {
 			},
 		},
 		map[string]*ClientGroup{
-			"154.54.36.0": &ClientGroup{
-				net.ParseIP("154.54.36.0").To16(),
-				SiteRTTs{
+			"154.54.36.0/22": &ClientGroup{
+				Prefix: net.ParseIP("154.54.36.0").To16(),
+				SiteRTTs: SiteRTTs{
 					SiteRTT{
-						"lca01",
-						62.007999420166016,
-						time.Unix(1376828646, 0),
+						SiteID:      "lca01",
+						RTT:         62.007999420166016,
+						LastUpdated: time.Unix(1376828646, 0),
 					},
 					SiteRTT{
-						"lga01",
-						761.5423380533854,
-						time.Unix(1376828118, 0),
+						SiteID:      "lga01",
+						RTT:         761.5423380533854,
+						LastUpdated: time.Unix(1376828118, 0),
 					},
 				},
 			},
 		},
 		map[string]*ClientGroup{
-			"154.54.36.0": &ClientGroup{
-				net.ParseIP("154.54.36.0").To16(),
-				SiteRTTs{
+			"154.54.36.0/22": &ClientGroup{
+				Prefix: net.ParseIP("154.54.36.0").To16(),
+				SiteRTTs: SiteRTTs{
 					SiteRTT{
-						"lca01",
-						62.007999420166016,
-						time.Unix(1376828646, 0),
+						SiteID:      "lca01",
+						RTT:         62.007999420166016,
+						LastUpdated: time.Unix(1376828646, 0),
+						Samples:     2,
 					},
 					SiteRTT{
-						"lga01",
-						761.5423380533854,
-						time.Unix(1376828118, 0),
+						SiteID:      "lga01",
+						RTT:         761.5423380533854,
+						LastUpdated: time.Unix(1376828118, 0),
+						Samples:     2,
 					},
 					SiteRTT{
-						"dfw01",
-						803.0,
-						time.Unix(1376828645, 0),
+						SiteID:      "dfw01",
+						RTT:         803.0,
+						LastUpdated: time.Unix(1376828645, 0),
+						Samples:     1,
 					},
 				},
 			},
-			"90.185.4.0": &ClientGroup{
-				net.ParseIP("90.185.4.0").To16(),
-				SiteRTTs{
+			"90.185.4.0/22": &ClientGroup{
+				Prefix: net.ParseIP("90.185.4.0").To16(),
+				SiteRTTs: SiteRTTs{
 					SiteRTT{
-						"lca01",
-						88.22200012207031,
-						time.Unix(1376828891, 0),
+						SiteID:      "lca01",
+						RTT:         88.22200012207031,
+						LastUpdated: time.Unix(1376828891, 0),
+						Samples:     1,
 					},
 				},
 			},
-			"24.164.160.0": &ClientGroup{
-				net.ParseIP("24.164.160.0").To16(),
-				SiteRTTs{
-					SiteRTT{
-						"lga01",
-						7.705666700998942,
-						time.Unix(1376828167, 0),
+			"24.164.160.0/22": &ClientGroup{
+				Prefix: net.ParseIP("24.164.160.0").To16(),
+				SiteRTTs: SiteRTTs{
+					SiteRTT{ // Minimum RTT, time of latest sample
+						SiteID:      "lga01",
+						RTT:         7.705666700998942,
+						LastUpdated: time.Unix(1376828193, 0),
+						Samples:     2,
 					},
 				},
 			},
@@ -221,18 +226,38 @@ var bqMergeIntoClientGroupsTests = []struct {
 	},
 }
 
+// copyClientGroups returns a copy of cgs which can be merged into without
+// changing cgs.
+func copyClientGroups(cgs map[string]*ClientGroup) map[string]*ClientGroup {
+	cp := make(map[string]*ClientGroup, len(cgs))
+	for k, cg := range cgs {
+		c := *cg
+		c.SiteRTTs = append(SiteRTTs(nil), cg.SiteRTTs...)
+		cp[k] = &c
+	}
+	return cp
+}
+
 func TestBQMergeIntoClientGroups(t *testing.T) {
 	for i, tt := range bqMergeIntoClientGroupsTests {
-		bqMergeIntoClientGroups(tt.in_rows, makeMapIPStrToSiteIDTests[0].out, tt.in_cgs)
+		cgs := copyClientGroups(tt.in_cgs)
+		bqMergeIntoClientGroups(tt.in_rows, SliverIPMap(makeMapIPStrToSiteIDTests[0].out), cgs)
 
 		// Make all ClientGroup.Prefix 16 bytes long to allow for reflect.DeepEqual comparison.
-		for _, cg := range tt.in_cgs {
+		for _, cg := range cgs {
 			cg.Prefix = net.IP(cg.Prefix).To16()
 		}
 
-		if !reflect.DeepEqual(tt.out, tt.in_cgs) {
+		equal := len(tt.out) == len(cgs)
+		for ipstr, cg := range tt.out {
+			got, ok := cgs[ipstr]
+			if !ok || !equalClientGroups([]ClientGroup{*got}, []ClientGroup{*cg}) {
+				equal = false
+			}
+		}
+		if !equal {
 			t.Errorf("Error in index %d of bqMergeIntoClientGroups. Expected output not attained.", i)
-			for ipstr, cg := range tt.in_cgs {
+			for ipstr, cg := range cgs {
 				t.Errorf("%v: %v", ipstr, cg)
 			}
 		}
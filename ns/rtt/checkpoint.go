@@ -0,0 +1,88 @@
+// Copyright 2013 M-Lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rtt
+
+import (
+	"code.google.com/p/mlab-ns2/gae/ns/data"
+	"errors"
+	"time"
+)
+
+// ErrCheckpointUnavailable is returned by the Next method of a resumed
+// Checkpointer whose RowCheckpoint can no longer be read from.
+var ErrCheckpointUnavailable = errors.New("rtt: Rows of the import checkpoint are no longer available.")
+
+// ImportCheckpointPages is the number of pages of Rows after which an import
+// merges its ClientGroups with datastore and saves an ImportCheckpoint.
+var ImportCheckpointPages = 4
+
+// RowCheckpoint is the position of a RowSource after the last page returned by
+// Next.
+type RowCheckpoint struct {
+	ProjectID string // BigQuery project of the job whose results are read
+	JobID     string // BigQuery job whose results are read
+	Rows      int    // Rows consumed, including invalid rows
+	TotalRows int    // Total rows of the BigQuery job
+}
+
+// Checkpointer is implemented by RowSources which can resume reading from a
+// RowCheckpoint.
+type Checkpointer interface {
+	// Checkpoint returns the position after the last page returned by
+	// Next.
+	Checkpoint() RowCheckpoint
+
+	// Resume continues reading from cp. It must be called before Next,
+	// which returns ErrCheckpointUnavailable if it can't continue from cp.
+	Resume(cp RowCheckpoint) error
+}
+
+// ImportCheckpoint is the saved progress of an import which has not completed.
+// All Rows up to Source have been merged with datastore in Flushes flushes of
+// the import run Run, and Report accounts for them. See ImportContribution.
+type ImportCheckpoint struct {
+	Date    string
+	Run     string
+	Flushes int
+	Source  RowCheckpoint
+	Report  ImportReport
+	Updated time.Time
+}
+
+func importCheckpointKey(dateStr string) *data.Key {
+	return data.NewKey("ImportCheckpoint", dateStr, DatastoreParentKey())
+}
+
+// GetImportCheckpoint returns the ImportCheckpoint of an incomplete import for
+// date t, or data.ErrNoSuchEntity.
+func GetImportCheckpoint(c data.Context, t time.Time) (*ImportCheckpoint, error) {
+	var cp ImportCheckpoint
+	if err := c.Store().Get(importCheckpointKey(t.Format(DateFormat)), &cp); err != nil {
+		return nil, err
+	}
+	return &cp, nil
+}
+
+// PutImportCheckpoint saves the progress of an import.
+func PutImportCheckpoint(c data.Context, cp *ImportCheckpoint) error {
+	cp.Updated = time.Now()
+	return c.Store().Put(importCheckpointKey(cp.Date), cp)
+}
+
+// DeleteImportCheckpoint removes the ImportCheckpoint for date t once its
+// import has completed.
+func DeleteImportCheckpoint(c data.Context, t time.Time) error {
+	return c.Store().Delete(importCheckpointKey(t.Format(DateFormat)))
+}
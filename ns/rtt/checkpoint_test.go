@@ -0,0 +1,180 @@
+// Copyright 2013 M-Lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rtt
+
+import (
+	"code.google.com/p/mlab-ns2/gae/ns/data"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+var (
+	errTestSource     = errors.New("test source failed")
+	errTestCheckpoint = errors.New("test checkpoint failed")
+)
+
+// testCheckpointSource is a Checkpointer RowSource returning one Row per page,
+// which fails when page failAt is read, or when resumed if unavailable is set.
+type testCheckpointSource struct {
+	rows        Rows
+	next        int
+	failAt      int
+	unavailable bool
+	resumed     bool
+}
+
+func (s *testCheckpointSource) Next() (Rows, error) {
+	if s.resumed && s.unavailable {
+		return nil, ErrCheckpointUnavailable
+	}
+	if s.next == s.failAt {
+		return nil, errTestSource
+	}
+	if s.next == len(s.rows) {
+		return nil, io.EOF
+	}
+	s.next++
+	return s.rows[s.next-1 : s.next], nil
+}
+
+func (s *testCheckpointSource) Close() error { return nil }
+
+func (s *testCheckpointSource) Checkpoint() RowCheckpoint {
+	return RowCheckpoint{JobID: "job", Rows: s.next, TotalRows: len(s.rows)}
+}
+
+func (s *testCheckpointSource) Resume(cp RowCheckpoint) error {
+	s.next = cp.Rows
+	s.resumed = true
+	return nil
+}
+
+// failCheckpointStore is a data.Store which fails to put ImportCheckpoints.
+type failCheckpointStore struct {
+	data.Store
+}
+
+func (s failCheckpointStore) Put(key *data.Key, src interface{}) error {
+	if key.Kind == "ImportCheckpoint" {
+		return errTestCheckpoint
+	}
+	return s.Store.Put(key, src)
+}
+
+// newTestCheckpointRows returns n Rows of distinct ClientGroups from a sliver
+// of lga01, which is recorded in c.
+func newTestCheckpointRows(t *testing.T, c data.Context, n int) Rows {
+	recordTestSliverIPs(t, c, &data.SliverTool{ToolID: "ndt", SiteID: "lga01", ServerID: "mlab1", SliverIPv4: "74.63.50.43"})
+	rows := make(Rows, n)
+	for i := range rows {
+		rows[i] = &Row{time.Unix(1376828118, 0), net.ParseIP("74.63.50.43"), net.IPv4(154, byte(50+i), 36, 18), 10}
+	}
+	return rows
+}
+
+func TestImportDayResume(t *testing.T) {
+	defer func(n int) { ImportCheckpointPages = n }(ImportCheckpointPages)
+	ImportCheckpointPages = 2
+
+	c := newTestImportContext(false)
+	rows := newTestCheckpointRows(t, c, 5)
+	date := time.Date(2013, 8, 18, 0, 0, 0, 0, time.UTC)
+
+	// Fail after the first checkpoint.
+	src := &testCheckpointSource{rows: rows, failAt: 3}
+	if _, err := ImportDay(c, NewPrefetchRowSource(src, 2), date); err != errTestSource {
+		t.Fatalf("ImportDay = %v, want %v", err, errTestSource)
+	}
+	cp, err := GetImportCheckpoint(c, date)
+	if err != nil {
+		t.Fatalf("GetImportCheckpoint: %v", err)
+	}
+	want := RowCheckpoint{JobID: "job", Rows: 2, TotalRows: 5}
+	if cp.Source != want || cp.Report.Input != 2 {
+		t.Fatalf("GetImportCheckpoint = %v (%s), want %v with 2 ClientGroups", cp.Source, &cp.Report, want)
+	}
+
+	// Retry, which resumes from the checkpoint.
+	src = &testCheckpointSource{rows: rows, failAt: -1}
+	report, err := ImportDay(c, NewPrefetchRowSource(src, 2), date)
+	if err != nil {
+		t.Fatalf("ImportDay: %v", err)
+	}
+	if report.Input != 5 || report.New != 5 || report.Chunks != 3 {
+		t.Fatalf("ImportDay = %s, want 5 new ClientGroups in 3 chunks", report)
+	}
+	if err := report.Check(); err != nil {
+		t.Fatalf("ImportReport.Check: %v", err)
+	}
+	if _, err := GetImportCheckpoint(c, date); err != data.ErrNoSuchEntity {
+		t.Fatalf("GetImportCheckpoint after import = %v, want %v", err, data.ErrNoSuchEntity)
+	}
+}
+
+// An import whose checkpoint can't be resumed from fails and discards it, so
+// that it starts anew.
+func TestImportDayCheckpointUnavailable(t *testing.T) {
+	defer func(n int) { ImportCheckpointPages = n }(ImportCheckpointPages)
+	ImportCheckpointPages = 2
+
+	c := newTestImportContext(false)
+	rows := newTestCheckpointRows(t, c, 5)
+	date := time.Date(2013, 8, 18, 0, 0, 0, 0, time.UTC)
+
+	src := &testCheckpointSource{rows: rows, failAt: 3}
+	if _, err := ImportDay(c, src, date); err != errTestSource {
+		t.Fatalf("ImportDay = %v, want %v", err, errTestSource)
+	}
+	src = &testCheckpointSource{rows: rows, failAt: -1, unavailable: true}
+	if _, err := ImportDay(c, src, date); err != ErrCheckpointUnavailable {
+		t.Fatalf("ImportDay = %v, want %v", err, ErrCheckpointUnavailable)
+	}
+	if _, err := GetImportCheckpoint(c, date); err != data.ErrNoSuchEntity {
+		t.Fatalf("GetImportCheckpoint after ImportDay = %v, want %v", err, data.ErrNoSuchEntity)
+	}
+
+	src = &testCheckpointSource{rows: rows, failAt: -1, unavailable: true}
+	report, err := ImportDay(c, src, date)
+	if err != nil {
+		t.Fatalf("ImportDay: %v", err)
+	}
+	if report.Rows != 5 || report.Input != 5 {
+		t.Fatalf("ImportDay = %s, want 5 rows and ClientGroups", report)
+	}
+}
+
+func TestImportDayCheckpointPutFails(t *testing.T) {
+	defer func(n int) { ImportCheckpointPages = n }(ImportCheckpointPages)
+	ImportCheckpointPages = 2
+
+	queue := data.NewLocalQueue(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	c := data.NewContext(failCheckpointStore{data.NewMemoryStore()}, data.NewMemoryCache(), queue, log.New(ioutil.Discard, "", 0))
+	rows := newTestCheckpointRows(t, c, 5)
+	date := time.Date(2013, 8, 18, 0, 0, 0, 0, time.UTC)
+
+	src := &testCheckpointSource{rows: rows, failAt: -1}
+	if _, err := ImportDay(c, src, date); err != errTestCheckpoint {
+		t.Fatalf("ImportDay = %v, want %v", err, errTestCheckpoint)
+	}
+	if r, err := GetImportRecord(c, date); err != nil || r.State != ImportStateFailed {
+		t.Fatalf("GetImportRecord = %+v, %v, want %s", r, err, ImportStateFailed)
+	}
+}
@@ -17,10 +17,22 @@ package rtt
 const (
 	URLTaskImportDay = "/admin/tasks/rtt/import/day"
 	URLTaskImportPut = "/admin/tasks/rtt/put"
+	URLTaskPrune     = "/admin/tasks/rtt/prune"
+	URLTaskMigrate   = "/admin/tasks/rtt/migrate"
 
 	TaskQueueNameImport    = "rtt-import"
 	TaskQueueNameImportPut = "rtt-import-put"
 
 	FormKeyImportDate = "date"
+	FormKeyDryRun     = "dryrun"
 	FormKeyPutKey     = "key"
+	FormKeyPutStaging = "staging"
+	FormKeyPutPayload = "payload"
+
+	FormKeyV4PrefixSize = "v4"
+	FormKeyV6PrefixSize = "v6"
+	FormKeyRemove       = "delete"
+
+	FormKeyPruneStart   = "start"
+	FormKeyMigrateStart = "start"
 )
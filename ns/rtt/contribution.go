@@ -0,0 +1,502 @@
+// Copyright 2013 M-Lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rtt
+
+import (
+	"code.google.com/p/mlab-ns2/gae/ns/data"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Form values of put tasks which identify their ImportContribution.
+const (
+	FormKeyImportRun   = "run"
+	FormKeyImportFlush = "flush"
+)
+
+// ErrStaleImportRun is returned by MergeImportBatch for put batches of an
+// import run which has been superseded by a later run of the same day.
+var ErrStaleImportRun = errors.New("rtt: Put batch of a superseded import run.")
+
+// ImportContribution identifies the RTT samples which a put batch of an import
+// contributes to its ClientGroups: those of one flush of ClientGroups to
+// datastore by one run of the import of a day. An import which is started
+// anew, rather than resumed from an ImportCheckpoint, is a new run.
+//
+// The contributions of a run of the import of a day to a ClientGroup are
+// recorded as a ClientGroupDay. A contribution which has already been merged
+// into a ClientGroup is not merged again, and the first contribution of a new
+// run replaces that of previous runs, so that importing a day again does not
+// count its samples twice.
+type ImportContribution struct {
+	Date  string
+	Run   string // Empty for put tasks submitted before runs were recorded
+	Flush int
+}
+
+// newImportRun returns a new unique Run of an ImportContribution.
+func newImportRun() string {
+	return strconv.FormatInt(time.Now().UnixNano(), 36)
+}
+
+// addValues adds the form values of ic to the values of a put task.
+func (ic ImportContribution) addValues(values url.Values) {
+	values.Set(FormKeyImportDate, ic.Date)
+	values.Set(FormKeyImportRun, ic.Run)
+	values.Set(FormKeyImportFlush, strconv.Itoa(ic.Flush))
+}
+
+// ParseImportContribution returns the ImportContribution of a put task with
+// form values values.
+func ParseImportContribution(values url.Values) ImportContribution {
+	flush, _ := strconv.Atoi(values.Get(FormKeyImportFlush))
+	return ImportContribution{
+		Date:  values.Get(FormKeyImportDate),
+		Run:   values.Get(FormKeyImportRun),
+		Flush: flush,
+	}
+}
+
+// ClientGroupDay is the contribution of a run of the import of a day to a
+// ClientGroup. It is named by its importRef, which is listed in
+// ClientGroup.Imports once the ClientGroup contains it.
+//
+// ClientGroupDays are kept apart from their ClientGroup, which is read by
+// every lookup and must stay below MaxClientGroupBytes, although this costs a
+// write of a ClientGroupDay for each ClientGroup changed by an import and up
+// to one entity per ClientGroup for each day within SiteRTTHorizon. They hold
+// only the statistics which are subtracted when the day is imported again,
+// without the candidates for the minimum RTT, see siteRTTStats.sub.
+type ClientGroupDay struct {
+	Date     string
+	SiteRTTs SiteRTTs
+}
+
+// importRef is the name of a ClientGroupDay: the name of its ClientGroup, the
+// date and run of its import, and the set of flushes of the run it contains
+// as a hexadecimal bit set, e.g., 24.164.160.0/22|2013-08-18|hm1c3pxs|5. A
+// ClientGroupDay to which a flush is added is put under a new name, so that
+// the ClientGroup which refers to it changes only once it is put.
+type importRef struct {
+	name, date, run string
+	flushes         *big.Int
+}
+
+func parseImportRef(s string) (importRef, bool) {
+	f := strings.Split(s, "|")
+	if len(f) != 4 {
+		return importRef{}, false
+	}
+	flushes, ok := new(big.Int).SetString(f[3], 16)
+	if !ok {
+		return importRef{}, false
+	}
+	return importRef{f[0], f[1], f[2], flushes}, true
+}
+
+func (r importRef) String() string {
+	return fmt.Sprintf("%s|%s|%s|%x", r.name, r.date, r.run, r.flushes)
+}
+
+// has reports whether the ClientGroupDay of r contains flush.
+func (r importRef) has(flush int) bool {
+	return r.flushes.Bit(flush) == 1
+}
+
+// clientGroupDayKey returns the datastore key of the ClientGroupDay named ref.
+func clientGroupDayKey(ref string) *data.Key {
+	return data.NewKey("ClientGroupDay", ref, DatastoreParentKey())
+}
+
+// importExpired reports whether the samples of the import of dateStr are older
+// than SiteRTTHorizon relative to latest, in which case they are not merged.
+func importExpired(dateStr string, latest time.Time) bool {
+	if SiteRTTHorizon <= 0 {
+		return false
+	}
+	t, err := time.Parse(DateFormat, dateStr)
+	if err != nil {
+		return false
+	}
+	return t.Add(Day).Before(latest.Add(-SiteRTTHorizon))
+}
+
+// latestSample returns the time of the latest sample of cg.
+func (cg *ClientGroup) latestSample() time.Time {
+	var latest time.Time
+	for _, sr := range cg.SiteRTTs {
+		if sr.LastUpdated.After(latest) {
+			latest = sr.LastUpdated
+		}
+	}
+	return latest
+}
+
+// hasImport reports whether cg contains the contribution ic, or need not
+// contain it since it has expired.
+func (cg *ClientGroup) hasImport(ic ImportContribution) bool {
+	if importExpired(ic.Date, cg.latestSample()) {
+		return true
+	}
+	for _, s := range cg.Imports {
+		r, ok := parseImportRef(s)
+		if ok && r.date == ic.Date && r.run == ic.Run && r.has(ic.Flush) {
+			return true
+		}
+	}
+	return false
+}
+
+// importRefs returns the names of the ClientGroupDays of cg for dateStr.
+func (cg *ClientGroup) importRefs(dateStr string) []string {
+	var refs []string
+	for _, s := range cg.Imports {
+		if r, ok := parseImportRef(s); ok && r.date == dateStr {
+			refs = append(refs, s)
+		}
+	}
+	return refs
+}
+
+// addSiteRTTs merges the RTT samples of src into dst, and returns dst.
+func addSiteRTTs(dst, src SiteRTTs) SiteRTTs {
+	idx := make(map[string]int, len(dst))
+	for i, sr := range dst {
+		idx[sr.SiteID] = i
+	}
+	for _, sr := range src {
+		if i, ok := idx[sr.SiteID]; ok {
+			dst[i] = mergeSiteRTTStats(dst[i], sr)
+		} else {
+			idx[sr.SiteID] = len(dst)
+			dst = append(dst, sr)
+		}
+	}
+	return dst
+}
+
+// subtractSiteRTTs subtracts the RTT samples of day, taken on the day starting
+// at from, from srs, and returns srs without the SiteRTTs which have no
+// samples left. See siteRTTStats.sub.
+func subtractSiteRTTs(srs, day SiteRTTs, from time.Time) SiteRTTs {
+	subs := make(map[string]*SiteRTT, len(day))
+	for i := range day {
+		subs[day[i].SiteID] = &day[i]
+	}
+	kept := srs[:0]
+	for _, sr := range srs {
+		if sub, ok := subs[sr.SiteID]; ok {
+			s := sr.stats()
+			s.sub(sub.stats(), from, from.Add(Day))
+			if s.samples == 0 {
+				continue
+			}
+			sr = s.siteRTT(sr.SiteID)
+		}
+		kept = append(kept, sr)
+	}
+	return kept
+}
+
+// importMerge is the outcome of merging an ImportContribution into a
+// ClientGroup.
+type importMerge struct {
+	res     mergeResult
+	day     *ClientGroupDay // The new ClientGroupDay of the ClientGroup, if changed
+	ref     string          // The name of day
+	removed []string        // ClientGroupDays no longer referred to by the ClientGroup
+}
+
+// mergeImport merges newCG, the contribution ic, into cg. days contains the
+// ClientGroupDays of cg for ic.Date by name; those missing from it are not
+// subtracted when they are replaced. The ClientGroupDay of cg which contains
+// ic is returned and must be put before cg is.
+func mergeImport(cg *ClientGroup, days map[string]*ClientGroupDay, newCG *ClientGroup, ic ImportContribution) (*importMerge, error) {
+	if !net.IP(cg.Prefix).Equal(net.IP(newCG.Prefix)) || cg.ASN != newCG.ASN {
+		return nil, ErrMergeClientGroup
+	}
+	m := &importMerge{res: mergeChanged}
+	if cg.hasImport(ic) {
+		m.res = mergeUnchanged
+		return m, nil
+	}
+
+	name := cg.Name()
+	ref := importRef{name, ic.Date, ic.Run, new(big.Int)}
+	day := &ClientGroupDay{Date: ic.Date}
+	latest := cg.latestSample()
+	if t := newCG.latestSample(); t.After(latest) {
+		latest = t
+	}
+	from, _ := time.Parse(DateFormat, ic.Date)
+
+	imports := make([]string, 0, len(cg.Imports)+1)
+	for _, s := range cg.Imports {
+		r, ok := parseImportRef(s)
+		switch {
+		case !ok:
+			continue
+		case r.date == ic.Date && r.run == ic.Run && r.name == name:
+			// Another flush of the same run is added to.
+			ref.flushes.Set(r.flushes)
+			if d := days[s]; d != nil {
+				day.SiteRTTs = append(day.SiteRTTs, d.SiteRTTs...)
+			}
+		case r.date == ic.Date:
+			// The contribution of a previous run is replaced.
+			if d := days[s]; d != nil {
+				cg.SiteRTTs = subtractSiteRTTs(cg.SiteRTTs, d.SiteRTTs, from)
+			}
+		case importExpired(r.date, latest):
+		default:
+			imports = append(imports, s)
+			continue
+		}
+		m.removed = append(m.removed, s)
+	}
+
+	if _, err := MergeClientGroups(cg, newCG); err != nil {
+		return nil, err
+	}
+	day.SiteRTTs = addSiteRTTs(day.SiteRTTs, newCG.SiteRTTs)
+	for i := range day.SiteRTTs {
+		day.SiteRTTs[i].Minima = nil
+	}
+	ref.flushes.SetBit(ref.flushes, ic.Flush, 1)
+	m.day, m.ref = day, ref.String()
+	cg.Imports = append(imports, m.ref)
+	return m, nil
+}
+
+// getClientGroupDays returns the ClientGroupDays named refs by name. Those
+// which do not exist are missing from the result.
+func getClientGroupDays(c data.Context, refs []string) (map[string]*ClientGroupDay, error) {
+	days := make(map[string]*ClientGroupDay, len(refs))
+	for len(refs) > 0 {
+		n := len(refs)
+		if n > MaxDSReadPerQuery {
+			n = MaxDSReadPerQuery
+		}
+		keys := make([]*data.Key, n)
+		for i, ref := range refs[:n] {
+			keys[i] = clientGroupDayKey(ref)
+		}
+		dst := make([]ClientGroupDay, n)
+		err := c.Store().GetMulti(keys, dst)
+		merr, ok := err.(data.MultiError)
+		if err != nil && !ok {
+			return nil, err
+		}
+		for i := range dst {
+			if err != nil && merr[i] != nil {
+				if merr[i] != data.ErrNoSuchEntity {
+					return nil, merr[i]
+				}
+				c.Errorf("rtt.getClientGroupDays: ClientGroupDay %s: %s", refs[i], merr[i])
+				continue
+			}
+			days[refs[i]] = &dst[i]
+		}
+		refs = refs[n:]
+	}
+	return days, nil
+}
+
+// deleteClientGroupDays deletes the ClientGroupDays named refs.
+func deleteClientGroupDays(c data.Context, refs []string) error {
+	keys := make([]*data.Key, len(refs))
+	for i, ref := range refs {
+		keys[i] = clientGroupDayKey(ref)
+	}
+	return c.Store().DeleteMulti(keys)
+}
+
+// ImportBatchReport accounts for the ClientGroups of a put batch merged by
+// MergeImportBatch.
+type ImportBatchReport struct {
+	Put       int // ClientGroups put into datastore
+	Unchanged int // ClientGroups which already contained the batch
+	Errored   int // ClientGroups which could not be merged, and were not put
+	Oversized int // Errored ClientGroups too large to put once merged
+}
+
+func (r *ImportBatchReport) add(o *ImportBatchReport) {
+	r.Put += o.Put
+	r.Unchanged += o.Unchanged
+	r.Errored += o.Errored
+	r.Oversized += o.Oversized
+}
+
+// Err returns an error reporting the errored ClientGroups of r, or nil if
+// there are none.
+func (r *ImportBatchReport) Err() error {
+	if r.Errored == 0 {
+		return nil
+	}
+	return fmt.Errorf("rtt: %d ClientGroups of the put batch could not be merged (%d oversized).", r.Errored, r.Oversized)
+}
+
+func (r *ImportBatchReport) String() string {
+	return fmt.Sprintf("%d put, %d unchanged, %d errored (%d oversized)", r.Put, r.Unchanged, r.Errored, r.Oversized)
+}
+
+// MergeImportBatch merges the ClientGroups of a put batch, which are the
+// contribution ic, into those in datastore and puts them, see
+// ImportContribution. ClientGroups which cannot be merged, or which would be
+// larger than MaxClientGroupBytes once merged, are logged and counted as
+// errored instead of being put. It returns ErrStaleImportRun if ic has been
+// superseded, in which case nothing more is put.
+//
+// The ClientGroups are read, merged and put in transactions, so that
+// concurrent put batches and prunes don't overwrite each other's changes.
+// Each transaction puts up to MaxDSWriteBytesPerQuery of ClientGroups and
+// ClientGroupDays. A batch which fails part way can be merged again, since
+// ClientGroups which contain ic already are unchanged.
+func MergeImportBatch(c data.Context, ic ImportContribution, cgs []ClientGroup) (*ImportBatchReport, error) {
+	report := &ImportBatchReport{}
+	for len(cgs) > 0 {
+		var chunk *ImportBatchReport
+		var n int
+		err := data.RunInTransaction(c, func(tc data.Context) error {
+			var err error
+			chunk, n, err = mergeImportChunk(tc, ic, cgs)
+			return err
+		})
+		if err != nil {
+			return report, err
+		}
+		report.add(chunk)
+		cgs = cgs[n:]
+	}
+	return report, nil
+}
+
+// mergeImportChunk merges a leading chunk of cgs, see MergeImportBatch, and
+// returns the number of ClientGroups of cgs it accounted for. It is run in a
+// transaction.
+func mergeImportChunk(c data.Context, ic ImportContribution, cgs []ClientGroup) (*ImportBatchReport, int, error) {
+	if stale, err := importRunStale(c, ic); err != nil {
+		return nil, 0, err
+	} else if stale {
+		return nil, 0, ErrStaleImportRun
+	}
+
+	// Each ClientGroup may put a ClientGroupDay as well.
+	if len(cgs) > MaxDSWritePerQuery/2 {
+		cgs = cgs[:MaxDSWritePerQuery/2]
+	}
+	keys := make([]*data.Key, len(cgs))
+	for i := range cgs {
+		keys[i] = cgs[i].Key()
+	}
+	oldCGs := make([]ClientGroup, len(cgs))
+	err := c.Store().GetMulti(keys, oldCGs)
+	merr, ok := err.(data.MultiError)
+	if err != nil && !ok {
+		return nil, 0, err
+	}
+	var refs []string
+	for i := range oldCGs {
+		if err != nil && merr[i] != nil {
+			if merr[i] != data.ErrNoSuchEntity {
+				return nil, 0, merr[i]
+			}
+			// A new ClientGroup is merged into an empty one.
+			oldCGs[i] = cgs[i]
+			oldCGs[i].SiteRTTs, oldCGs[i].Imports = nil, nil
+		}
+		refs = append(refs, oldCGs[i].importRefs(ic.Date)...)
+	}
+
+	days, err := getClientGroupDays(c, refs)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	report := &ImportBatchReport{}
+	var putKeys, dayKeys []*data.Key
+	var putCGs []ClientGroup
+	var putDays []ClientGroupDay
+	var removed []string
+	var bytes, n int
+	for ; n < len(cgs); n++ {
+		var m *importMerge
+		if ic.Run == "" {
+			if _, err := MergeClientGroups(&oldCGs[n], &cgs[n]); err != nil {
+				c.Errorf("rtt.MergeImportBatch:MergeClientGroups: %s (%s)", err, keys[n].StringID)
+				report.Errored++
+				continue
+			}
+		} else {
+			m, err = mergeImport(&oldCGs[n], days, &cgs[n], ic)
+			if err != nil {
+				c.Errorf("rtt.MergeImportBatch:mergeImport: %s (%s)", err, keys[n].StringID)
+				report.Errored++
+				continue
+			}
+			if m.res == mergeUnchanged {
+				report.Unchanged++
+				continue
+			}
+		}
+
+		size := estimateClientGroupSize(&oldCGs[n])
+		if size > MaxClientGroupBytes {
+			c.Errorf("rtt.MergeImportBatch: ClientGroup %s is too large to put (%d bytes, %d SiteRTTs)", keys[n].StringID, size, len(oldCGs[n].SiteRTTs))
+			report.Errored++
+			report.Oversized++
+			continue
+		}
+		if m != nil {
+			size += estimateClientGroupSize(&ClientGroup{SiteRTTs: m.day.SiteRTTs})
+		}
+		// The rest of cgs is merged by the next transaction.
+		if len(putKeys) > 0 && bytes+size > MaxDSWriteBytesPerQuery {
+			break
+		}
+		bytes += size
+		if m != nil {
+			dayKeys = append(dayKeys, clientGroupDayKey(m.ref))
+			putDays = append(putDays, *m.day)
+			removed = append(removed, m.removed...)
+		}
+		putKeys = append(putKeys, keys[n])
+		putCGs = append(putCGs, oldCGs[n])
+	}
+
+	if len(dayKeys) > 0 {
+		if err := c.Store().PutMulti(dayKeys, putDays); err != nil {
+			return nil, 0, err
+		}
+	}
+	if len(putKeys) > 0 {
+		if err := c.Store().PutMulti(putKeys, putCGs); err != nil {
+			return nil, 0, err
+		}
+	}
+	if len(removed) > 0 {
+		if err := deleteClientGroupDays(c, removed); err != nil {
+			return nil, 0, err
+		}
+	}
+	report.Put = len(putKeys)
+	return report, n, nil
+}
@@ -0,0 +1,132 @@
+// Copyright 2013 M-Lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rtt
+
+import (
+	"code.google.com/p/mlab-ns2/gae/ns/data"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+var mergeImportBatchTests = []struct {
+	run     string
+	flush   int
+	rtt     float64
+	samples int     // Of the stored SiteRTT afterwards
+	min     float64 // RTT of the stored SiteRTT afterwards
+	days    int     // ClientGroupDays stored afterwards
+}{
+	{"r1", 0, 10, 1, 10, 1},
+	{"r1", 0, 10, 1, 10, 1}, // Retried put task
+	{"r1", 1, 20, 2, 10, 1}, // Next flush of the run
+	{"r2", 0, 30, 1, 30, 1}, // Re-import replaces the day
+	{"r2", 0, 30, 1, 30, 1},
+	{"r2", 2, 40, 2, 30, 1},
+}
+
+func TestMergeImportBatch(t *testing.T) {
+	c := newTestContext()
+	ip := net.ParseIP("24.164.160.0")
+	day := time.Date(2013, 8, 18, 0, 0, 0, 0, time.UTC)
+
+	// A sample of another day is kept by a re-import.
+	cg := NewClientGroup(ip)
+	cg.SiteRTTs = SiteRTTs{NewSiteRTT("lga01", 50, day.Add(-Day))}
+	if err := c.Store().Put(cg.Key(), cg); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, tt := range mergeImportBatchTests {
+		ic := ImportContribution{Date: day.Format(DateFormat), Run: tt.run, Flush: tt.flush}
+		newCG := NewClientGroup(ip)
+		newCG.SiteRTTs = SiteRTTs{NewSiteRTT("lga01", tt.rtt, day.Add(time.Duration(i)*time.Hour))}
+		if _, err := MergeImportBatch(c, ic, []ClientGroup{*newCG}); err != nil {
+			t.Fatalf("MergeImportBatch(%v) = %v", ic, err)
+		}
+
+		var got ClientGroup
+		if err := c.Store().Get(cg.Key(), &got); err != nil {
+			t.Fatal(err)
+		}
+		if len(got.SiteRTTs) != 1 || len(got.Imports) != 1 {
+			t.Fatalf("MergeImportBatch(%v) = %d SiteRTTs, imports %v, want 1 of each", ic, len(got.SiteRTTs), got.Imports)
+		}
+		sr := got.SiteRTTs[0]
+		if sr.Samples != tt.samples+1 || sr.RTT != tt.min {
+			t.Fatalf("MergeImportBatch(%v) = %d samples, RTT %v, want %d, %v", ic, sr.Samples, sr.RTT, tt.samples+1, tt.min)
+		}
+		keys, err := c.Store().GetAll(data.NewQuery("ClientGroupDay"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != tt.days {
+			t.Fatalf("MergeImportBatch(%v): %d ClientGroupDays, want %d", ic, len(keys), tt.days)
+		}
+	}
+}
+
+func TestMergeImportBatchStaleRun(t *testing.T) {
+	c := newTestContext()
+	day := time.Date(2013, 8, 18, 0, 0, 0, 0, time.UTC)
+	if err := startImportRun(c, day, "r2"); err != nil {
+		t.Fatal(err)
+	}
+	cg := NewClientGroup(net.ParseIP("24.164.160.0"))
+	cg.SiteRTTs = SiteRTTs{NewSiteRTT("lga01", 10, day)}
+	ic := ImportContribution{Date: day.Format(DateFormat), Run: "r1"}
+	if _, err := MergeImportBatch(c, ic, []ClientGroup{*cg}); err != ErrStaleImportRun {
+		t.Fatalf("MergeImportBatch(%v) = %v, want %v", ic, err, ErrStaleImportRun)
+	}
+	if err := c.Store().Get(cg.Key(), &ClientGroup{}); err != data.ErrNoSuchEntity {
+		t.Fatalf("Store.Get(%s) = %v, want %v", cg.Key().StringID, err, data.ErrNoSuchEntity)
+	}
+}
+
+func TestMergeImportBatchOversized(t *testing.T) {
+	c := newTestContext()
+	day := time.Date(2013, 8, 18, 0, 0, 0, 0, time.UTC)
+	large := NewClientGroup(net.ParseIP("24.164.160.0"))
+	large.SiteRTTs = SiteRTTs{NewSiteRTT("lga01", 50, day)}
+	large.Migrated = []string{strings.Repeat("x", MaxClientGroupBytes)}
+	if err := c.Store().Put(large.Key(), large); err != nil {
+		t.Fatal(err)
+	}
+
+	var cgs []ClientGroup
+	for _, ip := range []string{"24.164.160.0", "24.164.161.0"} {
+		cg := NewClientGroup(net.ParseIP(ip))
+		cg.SiteRTTs = SiteRTTs{NewSiteRTT("lga01", 10, day)}
+		cgs = append(cgs, *cg)
+	}
+	ic := ImportContribution{Date: day.Format(DateFormat), Run: "r1"}
+	report, err := MergeImportBatch(c, ic, cgs)
+	want := ImportBatchReport{Put: 1, Errored: 1, Oversized: 1}
+	if err != nil || *report != want {
+		t.Fatalf("MergeImportBatch(%v) = %v, %v, want %v", ic, report, err, &want)
+	}
+	if report.Err() == nil {
+		t.Fatalf("ImportBatchReport.Err() = nil, want an error")
+	}
+
+	var got ClientGroup
+	if err := c.Store().Get(large.Key(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Imports) != 0 || got.SiteRTTs[0].Samples != 1 {
+		t.Fatalf("MergeImportBatch(%v) put oversized ClientGroup %s", ic, large.Key().StringID)
+	}
+}
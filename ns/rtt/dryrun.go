@@ -0,0 +1,248 @@
+// Copyright 2013 M-Lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rtt
+
+import (
+	"bytes"
+	"code.google.com/p/mlab-ns2/gae/ns/data"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// DryRunExamples is the number of ClientGroups whose top-ranked Site changed
+// which are listed by a DryRunReport.
+var DryRunExamples = 20
+
+// TopSiteChange is a change of the top-ranked Site of a ClientGroup. From is
+// empty for ClientGroups which are added.
+type TopSiteChange struct {
+	ClientGroup string
+	From, To    string
+}
+
+// SiteDiff counts the changes an import would make for a Site.
+type SiteDiff struct {
+	Gained int // ClientGroups of which the Site would become top-ranked
+	Lost   int // ClientGroups of which the Site would no longer be top-ranked
+	Added  int // ClientGroups which would have a new SiteRTT to the Site
+}
+
+// DryRunReport reports the changes an import would make to the ClientGroups in
+// datastore. See DryRunDay.
+type DryRunReport struct {
+	Import     ImportReport         // Rows read and rejected, and ClientGroups merged
+	TopChanged int                  // ClientGroups whose top-ranked Site would change
+	Examples   []TopSiteChange      // Up to DryRunExamples TopChanged ClientGroups, by name
+	Sites      map[string]*SiteDiff // By SiteID
+}
+
+func (r *DryRunReport) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s: %d rows (%d unresolved, %d out of bounds, %d too fast, %d outliers), %d ClientGroups: %d added, %d changed, %d unchanged, %d errored, %d with a new top-ranked Site",
+		r.Import.Date, r.Import.Rows, r.Import.Unresolved, r.Import.OutOfBounds, r.Import.TooFast, r.Import.Outliers,
+		r.Import.Input, r.Import.New, r.Import.Changed, r.Import.Unchanged, r.Import.Errored, r.TopChanged)
+	for _, ex := range r.Examples {
+		from := ex.From
+		if from == "" {
+			from = "none"
+		}
+		fmt.Fprintf(&buf, "\n%s: %s -> %s", ex.ClientGroup, from, ex.To)
+	}
+	siteIDs := make([]string, 0, len(r.Sites))
+	for siteID := range r.Sites {
+		siteIDs = append(siteIDs, siteID)
+	}
+	sort.Strings(siteIDs)
+	for _, siteID := range siteIDs {
+		d := r.Sites[siteID]
+		fmt.Fprintf(&buf, "\n%s: +%d -%d top-ranked, %d new SiteRTTs", siteID, d.Gained, d.Lost, d.Added)
+	}
+	return buf.String()
+}
+
+// site returns the SiteDiff of siteID in r.
+func (r *DryRunReport) site(siteID string) *SiteDiff {
+	d, ok := r.Sites[siteID]
+	if !ok {
+		d = &SiteDiff{}
+		r.Sites[siteID] = d
+	}
+	return d
+}
+
+// topSiteID returns the ID of the Site of srs with the lowest RankingMetric, or
+// "" if there is none.
+func topSiteID(srs SiteRTTs) string {
+	var top *SiteRTT
+	for i := range srs {
+		if top == nil || srs[i].Value(RankingMetric) < top.Value(RankingMetric) {
+			top = &srs[i]
+		}
+	}
+	if top == nil {
+		return ""
+	}
+	return top.SiteID
+}
+
+// dryRunContribution returns the ImportContribution of a dry run of the import
+// of dateStr, which replaces the day's contribution of any previous run.
+func dryRunContribution(dateStr string) ImportContribution {
+	return ImportContribution{Date: dateStr, Run: "dryrun"}
+}
+
+// diff counts the changes of merging newCG into oldCG, which is nil if there
+// is none. days contains the ClientGroupDays of oldCG which newCG replaces.
+func (r *DryRunReport) diff(name string, oldCG, newCG *ClientGroup, days map[string]*ClientGroupDay) error {
+	var oldTop string
+	oldSites := make(map[string]bool)
+	merged := newCG
+	if oldCG != nil {
+		oldTop = topSiteID(oldCG.SiteRTTs)
+		for _, sr := range oldCG.SiteRTTs {
+			oldSites[sr.SiteID] = true
+		}
+		m, err := mergeImport(oldCG, days, newCG, dryRunContribution(r.Import.Date))
+		if err != nil {
+			return err
+		}
+		if m.res == mergeUnchanged {
+			r.Import.count(mergeUnchanged, 1)
+			return nil
+		}
+		r.Import.count(mergeChanged, 1)
+		merged = oldCG
+	} else {
+		r.Import.count(mergeNew, 1)
+	}
+
+	for _, sr := range merged.SiteRTTs {
+		if !oldSites[sr.SiteID] {
+			r.site(sr.SiteID).Added++
+		}
+	}
+	newTop := topSiteID(merged.SiteRTTs)
+	if newTop == oldTop {
+		return nil
+	}
+	r.TopChanged++
+	r.Examples = append(r.Examples, TopSiteChange{name, oldTop, newTop})
+	if oldTop != "" {
+		r.site(oldTop).Lost++
+	}
+	if newTop != "" {
+		r.site(newTop).Gained++
+	}
+	return nil
+}
+
+// dryRunMerge diffs the merge of newCGs with the ClientGroups in datastore
+// into report, without putting them.
+func dryRunMerge(c data.Context, newCGs map[string]*ClientGroup, report *DryRunReport) {
+	chunks := divideIntoDSReadChunks(newCGs)
+	report.Import.Input += len(newCGs)
+	report.Import.Chunks += len(chunks)
+	for _, chunk := range chunks {
+		oldCGs := make([]ClientGroup, chunk.len())
+		err := c.Store().GetMulti(chunk.keys, oldCGs)
+		merr, ok := err.(data.MultiError)
+		if err != nil && !ok {
+			c.Errorf("rtt.dryRunMerge:Store.GetMulti: %s", err)
+			report.Import.count(mergeErrored, chunk.len())
+			continue
+		}
+		var refs []string
+		for i := range oldCGs {
+			if err == nil || merr[i] == nil {
+				refs = append(refs, oldCGs[i].importRefs(report.Import.Date)...)
+			}
+		}
+		days, derr := getClientGroupDays(c, refs)
+		if derr != nil {
+			c.Errorf("rtt.dryRunMerge:getClientGroupDays: %s", derr)
+			report.Import.count(mergeErrored, chunk.len())
+			continue
+		}
+		for i := range oldCGs {
+			oldCG := &oldCGs[i]
+			if err != nil && merr[i] != nil {
+				if merr[i] != data.ErrNoSuchEntity {
+					c.Errorf("rtt.dryRunMerge:Store.GetMulti: %s", merr[i])
+					report.Import.count(mergeErrored, 1)
+					continue
+				}
+				oldCG = nil
+			}
+			if err := report.diff(chunk.keys[i].StringID, oldCG, chunk.cgs[i], days); err != nil {
+				c.Errorf("rtt.dryRunMerge:DryRunReport.diff: %s", err)
+				report.Import.count(mergeErrored, 1)
+			}
+		}
+	}
+}
+
+// DryRunDay reads all Rows from src and merges them into ClientGroups as
+// ImportDay would, and reports the changes merging those with the
+// ClientGroups in datastore would make, replacing any previous import of the
+// day, without writing anything to datastore. The ImportRecord,
+// ImportCheckpoint and ImportReport of date t are not changed.
+//
+// Unlike ImportDay, all ClientGroups of the day are held in memory until they
+// are merged, so that each ClientGroup is compared against datastore once. As
+// by ImportDay, src is closed once the dry run returns.
+func DryRunDay(c data.Context, src RowSource, t time.Time) (*DryRunReport, error) {
+	sliverIPs, filterer, err := newImportResolvers(c)
+	if err != nil {
+		src.Close()
+		return nil, err
+	}
+	src = NewPrefetchRowSource(filterer.locating(src), ImportParallelism)
+	defer src.Close()
+
+	report := &DryRunReport{
+		Import: ImportReport{Date: t.Format(DateFormat)},
+		Sites:  make(map[string]*SiteDiff),
+	}
+	newCGs := make(map[string]*ClientGroup)
+	for {
+		rows, err := src.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		report.Import.Rows += len(rows)
+		c.Infof("rtt: Received %d rows for a dry run. (Total: %d rows)", len(rows), report.Import.Rows)
+		rows = filterer.filter(rows, &report.Import)
+		bqMergeIntoClientGroups(rows, sliverIPs, newCGs)
+	}
+	dryRunMerge(c, newCGs, report)
+
+	sort.Sort(topSiteChanges(report.Examples))
+	if len(report.Examples) > DryRunExamples {
+		report.Examples = report.Examples[:DryRunExamples]
+	}
+	return report, nil
+}
+
+// topSiteChanges sorts TopSiteChanges by ClientGroup.
+type topSiteChanges []TopSiteChange
+
+func (s topSiteChanges) Len() int           { return len(s) }
+func (s topSiteChanges) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s topSiteChanges) Less(i, j int) bool { return s[i].ClientGroup < s[j].ClientGroup }
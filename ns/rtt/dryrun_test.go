@@ -0,0 +1,80 @@
+// Copyright 2013 M-Lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rtt
+
+import (
+	"bytes"
+	"code.google.com/p/mlab-ns2/gae/ns/data"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const testDryRunCSV = `log_time,connection_spec_server_ip,paris_traceroute_hop_dest_ip,rtt
+1376828118,82.116.199.38,24.164.161.5,5
+1376828118,74.63.50.43,154.54.36.18,30
+1376828118,74.63.50.43,90.185.4.231,0
+1376828118,74.63.50.43,90.185.4.1,40
+`
+
+func TestDryRunDay(t *testing.T) {
+	// The nil queue of the test Context fails any put task.
+	c := newTestContext()
+	recordTestSliverIPs(t, c,
+		&data.SliverTool{ToolID: "ndt", ServerID: "mlab1", SiteID: "lga01", SliverIPv4: "74.63.50.43"},
+		&data.SliverTool{ToolID: "ndt", ServerID: "mlab1", SiteID: "lca01", SliverIPv4: "82.116.199.38"},
+	)
+	for ip, rtt := range map[string]float64{"24.164.160.0": 20, "90.185.4.0": 30} {
+		cg := NewClientGroup(net.ParseIP(ip))
+		cg.SiteRTTs = SiteRTTs{NewSiteRTT("lga01", rtt, time.Unix(1376828000, 0))}
+		if err := c.Store().Put(cg.Key(), cg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	date := time.Date(2013, 8, 18, 0, 0, 0, 0, time.UTC)
+	report, err := DryRunDay(c, NewCSVRowSource(bytes.NewBufferString(testDryRunCSV)), date)
+	if err != nil {
+		t.Fatalf("DryRunDay: %v", err)
+	}
+	want := &DryRunReport{
+		Import:     ImportReport{Date: "2013-08-18", Rows: 4, OutOfBounds: 1, Input: 3, New: 1, Changed: 2, Chunks: 1},
+		TopChanged: 2,
+		Examples: []TopSiteChange{
+			{"154.54.36.0/22", "", "lga01"},
+			{"24.164.160.0/22", "lga01", "lca01"},
+		},
+		Sites: map[string]*SiteDiff{
+			"lca01": {Gained: 1, Added: 1},
+			"lga01": {Gained: 1, Lost: 1, Added: 1},
+		},
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Fatalf("DryRunDay = %s, want %s", report, want)
+	}
+
+	// Nothing is written.
+	var cg ClientGroup
+	if err := c.Store().Get(NewClientGroup(net.ParseIP("24.164.160.0")).Key(), &cg); err != nil || len(cg.SiteRTTs) != 1 {
+		t.Fatalf("ClientGroup 24.164.160.0/22 after DryRunDay = %v, %v, want 1 SiteRTT", cg.SiteRTTs, err)
+	}
+	if err := c.Store().Get(NewClientGroup(net.ParseIP("154.54.36.0")).Key(), &cg); err != data.ErrNoSuchEntity {
+		t.Fatalf("ClientGroup 154.54.36.0/22 after DryRunDay: %v, want %v", err, data.ErrNoSuchEntity)
+	}
+	if _, err := GetImportRecord(c, date); err != data.ErrNoSuchEntity {
+		t.Fatalf("GetImportRecord after DryRunDay: %v, want %v", err, data.ErrNoSuchEntity)
+	}
+}
@@ -0,0 +1,464 @@
+// Copyright 2013 M-Lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rtt
+
+import (
+	"code.google.com/p/mlab-ns2/gae/ns/data"
+	"code.google.com/p/mlab-ns2/gae/ns/geo"
+	"container/list"
+	"math"
+	"net"
+	"sort"
+	"sync"
+)
+
+const (
+	// madScale scales the median absolute deviation of normally distributed
+	// samples to their standard deviation.
+	madScale = 1.4826
+
+	// maxGeoDistanceKm is half of the circumference of the earth, the
+	// furthest any two points are apart.
+	maxGeoDistanceKm = 20038.0
+)
+
+// RowFilter configures the rejection of Rows which are not plausible RTTs
+// between a Site and a client before they are merged into ClientGroups.
+type RowFilter struct {
+	MinRTT float64 // Rows with an RTT in ms of at most MinRTT are rejected
+	MaxRTT float64 // Rows with an RTT in ms above MaxRTT are rejected. 0 for no limit.
+
+	// Rows with an RTT shorter than a round trip at MaxSpeed, in km per ms,
+	// between their Site and the geolocation of their destination, less
+	// GeoSlack km for the error of geolocation, are rejected. 0 to disable.
+	MaxSpeed float64
+	GeoSlack float64
+
+	// Rows whose RTT deviates by more than OutlierMADs scaled median
+	// absolute deviations from the median of the last OutlierWindow RTTs
+	// of the same ClientGroup and Site in the import are rejected.
+	// Deviations are at least OutlierMinSpread ms, so that Rows of
+	// near-equal RTTs are not rejected. Only ClientGroups and Sites with at
+	// least OutlierMinRows Rows so far are filtered, and RTTs are tracked
+	// for up to OutlierMaxGroups of them, beyond which Rows of further
+	// ClientGroups and Sites are not filtered. 0 to disable.
+	OutlierMADs      float64
+	OutlierMinSpread float64
+	OutlierMinRows   int
+	OutlierWindow    int
+	OutlierMaxGroups int
+}
+
+// ImportRowFilter is the RowFilter applied to the Rows of an import.
+// It should be set during initialization.
+var ImportRowFilter = RowFilter{
+	MinRTT:           0,
+	MaxRTT:           5000,
+	MaxSpeed:         200, // Light in fibre
+	GeoSlack:         500,
+	OutlierMADs:      5,
+	OutlierMinSpread: 1,
+	OutlierMinRows:   5,
+	OutlierWindow:    32,
+	OutlierMaxGroups: 50000,
+}
+
+// GeoCacheSize is the number of /24 prefixes whose geolocations are cached
+// during an import. It should be set during initialization.
+var GeoCacheSize = 20000
+
+// GeoLookupParallelism is the number of geolocations looked up concurrently
+// while the Rows of an import are read ahead. It should be set during
+// initialization.
+var GeoLookupParallelism = 8
+
+// Geolocator locates the destination IPs of Rows.
+type Geolocator interface {
+	// Locate returns the latitude and longitude of ip, and reports whether
+	// it is known.
+	Locate(ip net.IP) (float64, float64, bool)
+}
+
+// latLon is a geolocation. ok is false if it is unknown.
+type latLon struct {
+	lat, lon float64
+	ok       bool
+}
+
+// geoPrefetcher is a Geolocator which can look up the geolocations of IPs
+// ahead of calls to Locate.
+type geoPrefetcher interface {
+	prefetch(ips []net.IP)
+}
+
+// cachedLatLon is the geolocation of the /24 prefix key in the cache of an
+// mmGeolocator.
+type cachedLatLon struct {
+	key string
+	loc latLon
+}
+
+// mmGeolocator is a Geolocator of MaxMind data in datastore, see
+// geo.GetLatLon, which caches the geolocations of up to size /24 prefixes,
+// evicting the least recently used. It is safe for concurrent use.
+type mmGeolocator struct {
+	c      data.Context
+	lookup func(prefix net.IP) (float64, float64, error)
+	size   int
+
+	mu    sync.Mutex
+	cache map[string]*list.Element // Of *cachedLatLon, by prefix
+	lru   *list.List               // Most recently used first
+}
+
+func newMMGeolocator(c data.Context) *mmGeolocator {
+	lookup := func(prefix net.IP) (float64, float64, error) {
+		return geo.GetLatLon(c, prefix)
+	}
+	return &mmGeolocator{
+		c:      c,
+		lookup: lookup,
+		size:   GeoCacheSize,
+		cache:  make(map[string]*list.Element),
+		lru:    list.New(),
+	}
+}
+
+// prefix24 returns the /24 prefix of ip, or nil if ip is not an IPv4
+// address.
+func prefix24(ip net.IP) net.IP {
+	ip = ip.To4()
+	if ip == nil {
+		return nil
+	}
+	return ip.Mask(net.CIDRMask(24, 32))
+}
+
+// cached returns the cached geolocation of prefix key, and reports whether
+// there is one.
+func (g *mmGeolocator) cached(key string) (latLon, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	e, ok := g.cache[key]
+	if !ok {
+		return latLon{}, false
+	}
+	g.lru.MoveToFront(e)
+	return e.Value.(*cachedLatLon).loc, true
+}
+
+// add caches the geolocation of prefix key.
+func (g *mmGeolocator) add(key string, loc latLon) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if e, ok := g.cache[key]; ok {
+		e.Value.(*cachedLatLon).loc = loc
+		g.lru.MoveToFront(e)
+		return
+	}
+	g.cache[key] = g.lru.PushFront(&cachedLatLon{key, loc})
+	for g.size > 0 && g.lru.Len() > g.size {
+		e := g.lru.Back()
+		g.lru.Remove(e)
+		delete(g.cache, e.Value.(*cachedLatLon).key)
+	}
+}
+
+// locate looks up and caches the geolocation of prefix, and reports whether
+// the lookup succeeded.
+func (g *mmGeolocator) locate(prefix net.IP) (latLon, bool) {
+	lat, lon, err := g.lookup(prefix)
+	if err != nil && err != geo.ErrGeoLocationNotFound {
+		// Don't cache errors of datastore.
+		g.c.Errorf("rtt.mmGeolocator.locate:geo.GetLatLon: %s", err)
+		return latLon{}, false
+	}
+	loc := latLon{lat, lon, err == nil}
+	g.add(prefix.String(), loc)
+	return loc, true
+}
+
+func (g *mmGeolocator) Locate(ip net.IP) (float64, float64, bool) {
+	prefix := prefix24(ip)
+	if prefix == nil {
+		return 0, 0, false
+	}
+	loc, ok := g.cached(prefix.String())
+	if !ok {
+		loc, _ = g.locate(prefix)
+	}
+	return loc.lat, loc.lon, loc.ok
+}
+
+// prefetch looks up the geolocations of the /24 prefixes of ips which are not
+// cached, GeoLookupParallelism at a time.
+func (g *mmGeolocator) prefetch(ips []net.IP) {
+	seen := make(map[string]bool)
+	sem := make(chan struct{}, GeoLookupParallelism)
+	var wg sync.WaitGroup
+	for _, ip := range ips {
+		prefix := prefix24(ip)
+		if prefix == nil {
+			continue
+		}
+		key := prefix.String()
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		if _, ok := g.cached(key); ok {
+			continue
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(prefix net.IP) {
+			defer wg.Done()
+			g.locate(prefix)
+			<-sem
+		}(prefix)
+	}
+	wg.Wait()
+}
+
+// rttWindow holds the last RTTs of a ClientGroup and Site.
+type rttWindow struct {
+	rtts []float64
+	next int // Index of the oldest RTT once rtts is full
+}
+
+// add adds rtt to w, replacing the oldest RTT if w holds size RTTs.
+func (w *rttWindow) add(rtt float64, size int) {
+	if size <= 0 || len(w.rtts) < size {
+		w.rtts = append(w.rtts, rtt)
+		return
+	}
+	w.rtts[w.next] = rtt
+	w.next = (w.next + 1) % len(w.rtts)
+}
+
+// rowFilterer applies a RowFilter to the Rows of an import. The RTTs by which
+// outliers are rejected accumulate over all Rows it filters.
+type rowFilterer struct {
+	RowFilter
+	sliverIPs SliverIPResolver
+	sites     map[string]*data.Site // By SiteID
+	locate    Geolocator
+	windows   map[string]*rttWindow // By ClientGroup and Site
+}
+
+// newRowFilterer returns a *rowFilterer of f for an import which resolves
+// sliver IPs by sliverIPs.
+func newRowFilterer(c data.Context, f RowFilter, sliverIPs SliverIPResolver) (*rowFilterer, error) {
+	rf := &rowFilterer{RowFilter: f, sliverIPs: sliverIPs}
+	if f.MaxSpeed <= 0 {
+		return rf, nil
+	}
+	sites, _, err := data.GetAllSites(c)
+	if err != nil {
+		return nil, err
+	}
+	rf.sites = make(map[string]*data.Site, len(sites))
+	for _, site := range sites {
+		rf.sites[site.SiteID] = site
+	}
+	rf.locate = newMMGeolocator(c)
+	return rf, nil
+}
+
+// inBounds reports whether rtt is within MinRTT and MaxRTT.
+func (f *rowFilterer) inBounds(rtt float64) bool {
+	return rtt > f.MinRTT && (f.MaxRTT <= 0 || rtt <= f.MaxRTT)
+}
+
+// minRTT returns the shortest RTT in ms possible over a distance of km.
+func (f *rowFilterer) minRTT(km float64) float64 {
+	return 2 * math.Max(0, km-f.GeoSlack) / f.MaxSpeed
+}
+
+// locating returns a RowSource which reads the Rows of src and looks up the
+// geolocations of the destinations which tooFast needs before returning
+// them, so that reading src ahead, see NewPrefetchRowSource, also looks them
+// up ahead. If src is a Checkpointer, so is the returned RowSource.
+func (f *rowFilterer) locating(src RowSource) RowSource {
+	g, ok := f.locate.(geoPrefetcher)
+	if f.MaxSpeed <= 0 || !ok {
+		return src
+	}
+	s := &locatingRowSource{src, f, g}
+	if _, ok := src.(Checkpointer); ok {
+		return checkpointLocatingRowSource{s}
+	}
+	return s
+}
+
+// locatingRowSource is a RowSource which prefetches the geolocations of the
+// Rows it reads, see rowFilterer.locating.
+type locatingRowSource struct {
+	src RowSource
+	f   *rowFilterer
+	geo geoPrefetcher
+}
+
+func (s *locatingRowSource) Next() (Rows, error) {
+	rows, err := s.src.Next()
+	if err != nil {
+		return rows, err
+	}
+	// Rows of RTTs possible over any distance are not checked.
+	slowest := s.f.minRTT(maxGeoDistanceKm)
+	var ips []net.IP
+	for _, row := range rows {
+		if s.f.inBounds(row.RTT) && row.RTT < slowest {
+			ips = append(ips, row.ClientIP)
+		}
+	}
+	s.geo.prefetch(ips)
+	return rows, nil
+}
+
+func (s *locatingRowSource) Close() error {
+	return s.src.Close()
+}
+
+// checkpointLocatingRowSource is a locatingRowSource whose source RowSource
+// is a Checkpointer.
+type checkpointLocatingRowSource struct {
+	*locatingRowSource
+}
+
+func (s checkpointLocatingRowSource) Checkpoint() RowCheckpoint {
+	return s.src.(Checkpointer).Checkpoint()
+}
+
+func (s checkpointLocatingRowSource) Resume(cp RowCheckpoint) error {
+	return s.src.(Checkpointer).Resume(cp)
+}
+
+// tooFast reports whether the RTT of row is shorter than a round trip at
+// MaxSpeed between the Site of row and its destination.
+func (f *rowFilterer) tooFast(row *Row, siteID string) bool {
+	if f.MaxSpeed <= 0 || f.locate == nil || row.RTT >= f.minRTT(maxGeoDistanceKm) {
+		return false
+	}
+	site, ok := f.sites[siteID]
+	if !ok {
+		return false
+	}
+	lat, lon, ok := f.locate.Locate(row.ClientIP)
+	if !ok {
+		return false
+	}
+	return row.RTT < f.minRTT(geo.Distance(site.Latitude, site.Longitude, lat, lon))
+}
+
+// filter returns the Rows of rows which are not rejected, counting rejected
+// Rows, and those whose sliver IP does not resolve to a Site, in report.
+func (f *rowFilterer) filter(rows Rows, report *ImportReport) Rows {
+	kept := make(Rows, 0, len(rows))
+	groups := make(map[string][]int) // Indexes into kept by ClientGroup and Site
+	if f.OutlierMADs > 0 && f.windows == nil {
+		f.windows = make(map[string]*rttWindow)
+	}
+	for _, row := range rows {
+		if !f.inBounds(row.RTT) {
+			report.OutOfBounds++
+			continue
+		}
+		siteID, ok := f.sliverIPs.SiteID(row.ServerIP.String(), row.LastUpdated)
+		if !ok {
+			report.Unresolved++
+			continue
+		}
+		if f.tooFast(row, siteID) {
+			report.TooFast++
+			continue
+		}
+		if f.OutlierMADs > 0 {
+			group := GroupClient(row.ClientIP).Name() + " " + siteID
+			if w := f.window(group); w != nil {
+				w.add(row.RTT, f.OutlierWindow)
+				groups[group] = append(groups[group], len(kept))
+			}
+		}
+		kept = append(kept, row)
+	}
+	if len(groups) == 0 {
+		return kept
+	}
+
+	outlier := make([]bool, len(kept))
+	var n int
+	for group, idxs := range groups {
+		w := f.windows[group]
+		if len(w.rtts) < f.OutlierMinRows {
+			continue
+		}
+		med, mad := medianAbsDeviation(append([]float64(nil), w.rtts...))
+		spread := math.Max(madScale*mad, f.OutlierMinSpread)
+		for _, idx := range idxs {
+			if math.Abs(kept[idx].RTT-med) > f.OutlierMADs*spread {
+				outlier[idx] = true
+				n++
+			}
+		}
+	}
+	if n == 0 {
+		return kept
+	}
+	report.Outliers += n
+	filtered := make(Rows, 0, len(kept)-n)
+	for i, row := range kept {
+		if !outlier[i] {
+			filtered = append(filtered, row)
+		}
+	}
+	return filtered
+}
+
+// window returns the rttWindow of the ClientGroup and Site group, or nil if
+// OutlierMaxGroups are tracked already.
+func (f *rowFilterer) window(group string) *rttWindow {
+	w, ok := f.windows[group]
+	if !ok {
+		if f.OutlierMaxGroups > 0 && len(f.windows) >= f.OutlierMaxGroups {
+			return nil
+		}
+		w = &rttWindow{}
+		f.windows[group] = w
+	}
+	return w
+}
+
+// median returns the median of the sorted values xs.
+func median(xs []float64) float64 {
+	n := len(xs)
+	if n%2 == 1 {
+		return xs[n/2]
+	}
+	return (xs[n/2-1] + xs[n/2]) / 2
+}
+
+// medianAbsDeviation returns the median of xs and the median absolute
+// deviation of xs from it. xs is sorted in place.
+func medianAbsDeviation(xs []float64) (float64, float64) {
+	sort.Float64s(xs)
+	med := median(xs)
+	devs := make([]float64, len(xs))
+	for i, x := range xs {
+		devs[i] = math.Abs(x - med)
+	}
+	sort.Float64s(devs)
+	return med, median(devs)
+}
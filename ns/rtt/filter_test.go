@@ -0,0 +1,218 @@
+// Copyright 2013 M-Lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rtt
+
+import (
+	"code.google.com/p/mlab-ns2/gae/ns/data"
+	"code.google.com/p/mlab-ns2/gae/ns/geo"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testGeolocator locates IPs by their string.
+type testGeolocator map[string][2]float64
+
+func (g testGeolocator) Locate(ip net.IP) (float64, float64, bool) {
+	loc, ok := g[ip.String()]
+	return loc[0], loc[1], ok
+}
+
+func newTestFilterer(f RowFilter) *rowFilterer {
+	return &rowFilterer{
+		RowFilter: f,
+		sliverIPs: SliverIPMap{"74.63.50.43": "lga01", "82.116.199.38": "lca01"},
+		sites: map[string]*data.Site{
+			"lga01": {SiteID: "lga01", Latitude: 40.77, Longitude: -73.87},
+			"lca01": {SiteID: "lca01", Latitude: 34.88, Longitude: 33.63},
+		},
+		locate: testGeolocator{
+			"24.164.160.17": {40.71, -74.01},  // New York
+			"90.185.4.231":  {55.68, 12.57},   // Copenhagen
+			"1.0.4.1":       {-37.81, 144.96}, // Melbourne
+		},
+	}
+}
+
+func testFilterRow(server, client string, rtt float64) *Row {
+	return &Row{time.Unix(1376828167, 0), net.ParseIP(server), net.ParseIP(client), rtt}
+}
+
+var rowFilterBoundsTests = []struct {
+	rtt  float64
+	kept bool
+}{
+	{-1, false},
+	{0, false},
+	{0.1, true},
+	{5000, true},
+	{5000.1, false},
+}
+
+func TestRowFilterBounds(t *testing.T) {
+	f := newTestFilterer(RowFilter{MinRTT: 0, MaxRTT: 5000})
+	for _, tt := range rowFilterBoundsTests {
+		report := &ImportReport{}
+		rows := f.filter(Rows{testFilterRow("74.63.50.43", "24.164.160.17", tt.rtt)}, report)
+		if kept := len(rows) == 1; kept != tt.kept || report.OutOfBounds != len(rows)^1 {
+			t.Fatalf("filter(%v ms) kept %v with %d out of bounds, want %v", tt.rtt, kept, report.OutOfBounds, tt.kept)
+		}
+	}
+}
+
+var rowFilterSpeedTests = []struct {
+	server, client string
+	rtt            float64
+	kept           bool
+}{
+	{"74.63.50.43", "24.164.160.17", 0.5, true}, // Within GeoSlack
+	{"74.63.50.43", "90.185.4.231", 40, false},  // ~6200 km
+	{"74.63.50.43", "90.185.4.231", 70, true},
+	{"82.116.199.38", "1.0.4.1", 100, false}, // ~13700 km
+	{"82.116.199.38", "1.0.4.1", 300, true},
+	{"82.116.199.38", "154.54.36.18", 1, true}, // Not located
+}
+
+func TestRowFilterSpeed(t *testing.T) {
+	f := newTestFilterer(RowFilter{MaxSpeed: 200, GeoSlack: 100})
+	for _, tt := range rowFilterSpeedTests {
+		report := &ImportReport{}
+		rows := f.filter(Rows{testFilterRow(tt.server, tt.client, tt.rtt)}, report)
+		if kept := len(rows) == 1; kept != tt.kept || report.TooFast != len(rows)^1 {
+			t.Fatalf("filter(%s to %s in %v ms) kept %v with %d too fast, want %v", tt.server, tt.client, tt.rtt, kept, report.TooFast, tt.kept)
+		}
+	}
+}
+
+func TestRowFilterUnresolved(t *testing.T) {
+	f := newTestFilterer(RowFilter{})
+	report := &ImportReport{}
+	rows := f.filter(Rows{testFilterRow("38.107.216.10", "1.0.4.1", 1)}, report)
+	if len(rows) != 0 || report.Unresolved != 1 {
+		t.Fatalf("filter(unknown sliver IP) kept %d rows with %d unresolved, want 0, 1", len(rows), report.Unresolved)
+	}
+}
+
+func TestRowFilterOutliers(t *testing.T) {
+	f := newTestFilterer(RowFilter{OutlierMADs: 5, OutlierMinSpread: 1, OutlierMinRows: 5})
+	var rows Rows
+	// The RTTs of 24.164.160.0/22 to lga01 have an outlier each way.
+	for _, rtt := range []float64{0.2, 10, 11, 10.5, 12, 9.5, 10, 900} {
+		rows = append(rows, testFilterRow("74.63.50.43", "24.164.161.1", rtt))
+	}
+	// Too few RTTs to lca01 to reject any.
+	for _, rtt := range []float64{60, 61, 900} {
+		rows = append(rows, testFilterRow("82.116.199.38", "24.164.161.1", rtt))
+	}
+	// Near-equal RTTs are kept despite a zero MAD.
+	for _, rtt := range []float64{30, 30, 30, 30, 30.5} {
+		rows = append(rows, testFilterRow("74.63.50.43", "90.185.4.231", rtt))
+	}
+
+	report := &ImportReport{}
+	kept := f.filter(rows, report)
+	if report.Outliers != 2 || len(kept) != len(rows)-2 {
+		t.Fatalf("filter kept %d of %d rows with %d outliers, want 2 outliers", len(kept), len(rows), report.Outliers)
+	}
+	for _, row := range kept {
+		if row.RTT == 0.2 || row.RTT == 900 && row.ServerIP.Equal(net.ParseIP("74.63.50.43")) {
+			t.Fatalf("filter kept outlier %v", row)
+		}
+	}
+}
+
+var rowFilterOutliersAcrossPagesTests = []struct {
+	client string
+	rtt    float64
+	kept   bool
+}{
+	{"24.164.161.1", 10, true},
+	{"24.164.161.1", 11, true},
+	{"24.164.161.1", 10.5, true},
+	{"24.164.161.1", 900, true}, // Too few RTTs so far
+	{"24.164.161.1", 12, true},
+	{"24.164.161.1", 900, false},
+	{"90.185.4.231", 30, true}, // Beyond OutlierMaxGroups
+	{"90.185.4.231", 30, true},
+	{"90.185.4.231", 30, true},
+	{"90.185.4.231", 30, true},
+	{"90.185.4.231", 30, true},
+	{"90.185.4.231", 900, true},
+}
+
+func TestRowFilterOutliersAcrossPages(t *testing.T) {
+	f := newTestFilterer(RowFilter{OutlierMADs: 5, OutlierMinSpread: 1, OutlierMinRows: 5, OutlierWindow: 5, OutlierMaxGroups: 1})
+	report := &ImportReport{}
+	for i, tt := range rowFilterOutliersAcrossPagesTests {
+		rows := f.filter(Rows{testFilterRow("74.63.50.43", tt.client, tt.rtt)}, report)
+		if kept := len(rows) == 1; kept != tt.kept {
+			t.Fatalf("filter(page %d: %s in %v ms) kept %v, want %v", i, tt.client, tt.rtt, kept, tt.kept)
+		}
+	}
+}
+
+func TestMMGeolocatorPrefetch(t *testing.T) {
+	var mu sync.Mutex
+	lookups := make(map[string]int)
+	g := newMMGeolocator(newTestContext())
+	g.size = 2
+	g.lookup = func(prefix net.IP) (float64, float64, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		lookups[prefix.String()]++
+		if prefix.Equal(net.ParseIP("24.164.161.0")) {
+			return 0, 0, geo.ErrGeoLocationNotFound
+		}
+		return 1, 2, nil
+	}
+
+	g.prefetch([]net.IP{net.ParseIP("1.0.4.1"), net.ParseIP("1.0.4.2"), net.ParseIP("24.164.161.5"), net.ParseIP("2001:db8::1")})
+	if lat, lon, ok := g.Locate(net.ParseIP("1.0.4.9")); lat != 1 || lon != 2 || !ok {
+		t.Fatalf("Locate(1.0.4.9) = %v, %v, %v, want 1, 2, true", lat, lon, ok)
+	}
+	if _, _, ok := g.Locate(net.ParseIP("24.164.161.5")); ok {
+		t.Fatalf("Locate(24.164.161.5) = ok, want not found")
+	}
+	want := map[string]int{"1.0.4.0": 1, "24.164.161.0": 1}
+	if !reflect.DeepEqual(lookups, want) {
+		t.Fatalf("lookups after prefetch = %v, want %v", lookups, want)
+	}
+
+	// The least recently used prefix is evicted.
+	g.prefetch([]net.IP{net.ParseIP("90.185.4.231")})
+	g.Locate(net.ParseIP("1.0.4.1"))
+	want["90.185.4.0"] = 1
+	want["1.0.4.0"] = 2
+	if !reflect.DeepEqual(lookups, want) {
+		t.Fatalf("lookups after eviction = %v, want %v", lookups, want)
+	}
+}
+
+func TestMedianAbsDeviation(t *testing.T) {
+	for _, tt := range []struct {
+		xs       []float64
+		med, mad float64
+	}{
+		{[]float64{3}, 3, 0},
+		{[]float64{1, 2, 3, 4}, 2.5, 1},
+		{[]float64{9, 1, 2, 2, 4, 6, 1}, 2, 1},
+	} {
+		if med, mad := medianAbsDeviation(tt.xs); med != tt.med || mad != tt.mad {
+			t.Fatalf("medianAbsDeviation(%v) = %v, %v, want %v, %v", tt.xs, med, mad, tt.med, tt.mad)
+		}
+	}
+}
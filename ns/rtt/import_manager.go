@@ -12,13 +12,9 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-// +build appengine
-
 package rtt
 
 import (
-	"appengine"
-	"appengine/datastore"
 	"code.google.com/p/mlab-ns2/gae/ns/data"
 	"time"
 )
@@ -31,13 +27,13 @@ type Stats struct {
 	LastSuccessfulImportDate time.Time
 }
 
-// GetLastSuccesfulImportDate returns the last recorded time of a successful
-// bigquery import.
-func GetLastSuccesfulImportDate(c appengine.Context) (time.Time, error) {
-	key := datastore.NewKey(c, "Stats", DSKeyStats, 0, DatastoreParentKey(c))
+// GetLastSuccesfulImportDate returns the date up to which all days are
+// considered imported. Later days are tracked by ImportRecords.
+func GetLastSuccesfulImportDate(c data.Context) (time.Time, error) {
+	key := data.NewKey("Stats", DSKeyStats, DatastoreParentKey())
 	var s Stats
 	err := data.GetData(c, DSKeyStats, key, &s)
-	if err == datastore.ErrNoSuchEntity {
+	if err == data.ErrNoSuchEntity {
 		return EarliestTimewithRTTData, nil
 	} else if err != nil {
 		return s.LastSuccessfulImportDate, err
@@ -45,12 +41,12 @@ func GetLastSuccesfulImportDate(c appengine.Context) (time.Time, error) {
 	return s.LastSuccessfulImportDate, nil
 }
 
-// SetLastSuccesfulImportDate sets a time as the last recorded time of a
-// successful bigquery import.
-func SetLastSuccessfulImportDate(c appengine.Context, t time.Time) error {
-	key := datastore.NewKey(c, "Stats", DSKeyStats, 0, DatastoreParentKey(c))
+// SetLastSuccesfulImportDate sets the date up to which all days are
+// considered imported, regardless of their ImportRecords.
+func SetLastSuccessfulImportDate(c data.Context, t time.Time) error {
+	key := data.NewKey("Stats", DSKeyStats, DatastoreParentKey())
 	var s Stats
-	if err := data.GetData(c, DSKeyStats, key, &s); err != datastore.ErrNoSuchEntity && err != nil {
+	if err := data.GetData(c, DSKeyStats, key, &s); err != data.ErrNoSuchEntity && err != nil {
 		return err
 	}
 	s.LastSuccessfulImportDate = t
@@ -60,30 +56,19 @@ func SetLastSuccessfulImportDate(c appengine.Context, t time.Time) error {
 	return nil
 }
 
-// UpdateLastSuccesfulImportDate sets a time as the last recorded time of a
-// successful bigquery import if the provided time is newer than the recorded
-// time.
-func UpdateLastSuccessfulImportDate(c appengine.Context, t time.Time) error {
-	last, err := GetLastSuccesfulImportDate(c)
-	if err != nil {
-		return err
-	}
-
-	// Don't update if time provided is not newer.
-	if !last.Before(t) {
-		return nil
-	}
-
-	c.Infof("rtt: Updated the last successful date imported to: %s", t)
-	return SetLastSuccessfulImportDate(c, t)
+// PutImportReport stores the ImportReport of a day's bigquery import,
+// replacing any previous report for the same day.
+func PutImportReport(c data.Context, r *ImportReport) error {
+	key := data.NewKey("ImportReport", r.Date, DatastoreParentKey())
+	return c.Store().Put(key, r)
 }
 
-// GetNextImportDay returns the next day for which to perform a bigquery import,
-// calculated by adding a day to the date of the latest successful import.
-func GetNextImportDay(c appengine.Context) time.Time {
-	t, err := GetLastSuccesfulImportDate(c)
-	if err != nil {
-		t = EarliestTimewithRTTData
+// GetImportReport returns the stored ImportReport of a day's bigquery import.
+func GetImportReport(c data.Context, t time.Time) (*ImportReport, error) {
+	key := data.NewKey("ImportReport", t.Format(DateFormat), DatastoreParentKey())
+	var r ImportReport
+	if err := c.Store().Get(key, &r); err != nil {
+		return nil, err
 	}
-	return t.Add(Day)
+	return &r, nil
 }
@@ -0,0 +1,45 @@
+// Copyright 2013 M-Lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rtt
+
+import (
+	"code.google.com/p/mlab-ns2/gae/ns/data"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+)
+
+func newTestContext() data.Context {
+	return data.NewContext(data.NewMemoryStore(), data.NewMemoryCache(), nil, log.New(ioutil.Discard, "", 0))
+}
+
+func TestSetLastSuccessfulImportDate(t *testing.T) {
+	c := newTestContext()
+
+	last, err := GetLastSuccesfulImportDate(c)
+	if err != nil || !last.Equal(EarliestTimewithRTTData) {
+		t.Fatalf("GetLastSuccesfulImportDate = %v, %v, want %v", last, err, EarliestTimewithRTTData)
+	}
+
+	want := time.Date(2013, 8, 2, 0, 0, 0, 0, time.UTC)
+	if err := SetLastSuccessfulImportDate(c, want); err != nil {
+		t.Fatalf("SetLastSuccessfulImportDate(%v) = %v", want, err)
+	}
+	last, err = GetLastSuccesfulImportDate(c)
+	if err != nil || !last.Equal(want) {
+		t.Fatalf("GetLastSuccesfulImportDate = %v, %v, want %v", last, err, want)
+	}
+}
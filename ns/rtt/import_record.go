@@ -0,0 +1,323 @@
+// Copyright 2013 M-Lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rtt
+
+import (
+	"code.google.com/p/mlab-ns2/gae/ns/data"
+	"fmt"
+	"time"
+)
+
+// States of an ImportRecord.
+const (
+	ImportStateQueued   = "queued"   // Import task submitted
+	ImportStateQuerying = "querying" // Reading and merging Rows
+	ImportStateMerging  = "merging"  // Waiting for put batches to complete
+	ImportStateComplete = "complete"
+	ImportStateFailed   = "failed"
+)
+
+// ImportRecordTimeout is the time after which an import which has not updated
+// its ImportRecord is considered to have failed.
+var ImportRecordTimeout = 24 * time.Hour
+
+// MaxImportAttempts is the number of times the import of a day is queued by
+// GetNextImportDay before it is given up on. It should be set during
+// initialization.
+var MaxImportAttempts = 3
+
+// ImportRecord is the state of the import of one day's RTT data.
+type ImportRecord struct {
+	Date             string
+	State            string
+	Rows             int    // Rows read
+	ClientGroups     int    // ClientGroups merged with datastore
+	BatchesExpected  int    // Put batches submitted
+	BatchesCompleted int    // Put batches put into datastore
+	BatchesFailed    int    // Put batches which could not be put
+	Run              string // Run of the latest import, see ImportContribution
+	Attempts         int    // Imports queued since the last complete one
+	Error            string
+	Updated          time.Time
+}
+
+// Incomplete reports whether the import needs to be (re)started, which is
+// the case if it failed or has not been updated within ImportRecordTimeout.
+func (r *ImportRecord) Incomplete() bool {
+	switch r.State {
+	case ImportStateComplete:
+		return false
+	case ImportStateFailed:
+		return true
+	}
+	return time.Since(r.Updated) > ImportRecordTimeout
+}
+
+// importBatch records the outcome of a put batch of an import. It is stored
+// as a child of the ImportRecord so that concurrent put tasks don't overwrite
+// each other's counts.
+type importBatch struct {
+	Error string
+}
+
+func importRecordKey(dateStr string) *data.Key {
+	return data.NewKey("ImportRecord", dateStr, DatastoreParentKey())
+}
+
+// GetImportRecord returns the ImportRecord for date t, or
+// data.ErrNoSuchEntity.
+func GetImportRecord(c data.Context, t time.Time) (*ImportRecord, error) {
+	var r ImportRecord
+	if err := c.Store().Get(importRecordKey(t.Format(DateFormat)), &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// GetImportRecords returns all ImportRecords.
+func GetImportRecords(c data.Context) ([]*ImportRecord, error) {
+	q := data.NewQuery("ImportRecord").Ancestor(DatastoreParentKey())
+	var records []*ImportRecord
+	if _, err := c.Store().GetAll(q, &records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+func putImportRecord(c data.Context, r *ImportRecord) error {
+	r.Updated = time.Now()
+	return c.Store().Put(importRecordKey(r.Date), r)
+}
+
+// getOrNewImportRecord returns the ImportRecord for dateStr or a new one.
+func getOrNewImportRecord(c data.Context, dateStr string) (*ImportRecord, error) {
+	var r ImportRecord
+	err := c.Store().Get(importRecordKey(dateStr), &r)
+	if err == data.ErrNoSuchEntity {
+		return &ImportRecord{Date: dateStr}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// updateImportRecord calls f with the ImportRecord for dateStr, or a new one,
+// and stores it unless f returns an error. It is run in a transaction, since
+// the import and its put tasks update the ImportRecord concurrently.
+func updateImportRecord(c data.Context, dateStr string, f func(tc data.Context, r *ImportRecord) error) error {
+	return data.RunInTransaction(c, func(tc data.Context) error {
+		r, err := getOrNewImportRecord(tc, dateStr)
+		if err != nil {
+			return err
+		}
+		if err := f(tc, r); err != nil {
+			return err
+		}
+		return putImportRecord(tc, r)
+	})
+}
+
+// SetImportState sets the state of the import of date t. If cause is not nil,
+// it is recorded as the error of the import.
+func SetImportState(c data.Context, t time.Time, state string, cause error) error {
+	return updateImportRecord(c, t.Format(DateFormat), func(tc data.Context, r *ImportRecord) error {
+		r.State = state
+		r.Error = ""
+		if cause != nil {
+			r.Error = cause.Error()
+		}
+		return nil
+	})
+}
+
+// startImportRun records run as the run of the import of date t, whose put
+// batches are the only ones merged from then on. See MergeImportBatch.
+func startImportRun(c data.Context, t time.Time, run string) error {
+	return updateImportRecord(c, t.Format(DateFormat), func(tc data.Context, r *ImportRecord) error {
+		r.Run = run
+		return nil
+	})
+}
+
+// importRunStale reports whether a put batch of the import run ic.Run has been
+// superseded by a later run of the import of ic.Date.
+func importRunStale(c data.Context, ic ImportContribution) (bool, error) {
+	if ic.Run == "" {
+		return false, nil
+	}
+	var r ImportRecord
+	err := c.Store().Get(importRecordKey(ic.Date), &r)
+	if err == data.ErrNoSuchEntity {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return r.Run != "" && r.Run != ic.Run, nil
+}
+
+// QueueImport records the import of date t as queued, and counts it as an
+// attempt, and then calls add to submit its task. The state is recorded first
+// since the task may run, and update it, before add returns. If add fails,
+// the ImportRecord is restored.
+func QueueImport(c data.Context, t time.Time, add func() error) error {
+	key := importRecordKey(t.Format(DateFormat))
+	var prev ImportRecord
+	var existed bool
+	err := updateImportRecord(c, t.Format(DateFormat), func(tc data.Context, r *ImportRecord) error {
+		prev, existed = *r, !r.Updated.IsZero()
+		if r.State == ImportStateComplete {
+			r.Attempts = 0
+		}
+		r.Attempts++
+		r.State = ImportStateQueued
+		r.Error = ""
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := add(); err != nil {
+		var rerr error
+		if existed {
+			rerr = c.Store().Put(key, &prev)
+		} else {
+			rerr = c.Store().Delete(key)
+		}
+		if rerr != nil {
+			c.Errorf("rtt.QueueImport:Store: %s", rerr)
+		}
+		return err
+	}
+	return nil
+}
+
+// finishImportRecord records that all Rows of an import have been read and
+// merged as accounted for by report, and that its put batches are pending.
+func finishImportRecord(c data.Context, report *ImportReport) error {
+	return updateImportRecord(c, report.Date, func(tc data.Context, r *ImportRecord) error {
+		r.Rows = report.Rows
+		r.ClientGroups = report.Input
+		r.BatchesExpected = report.Batches
+		r.State = ImportStateMerging
+		r.Error = ""
+		if report.Errored > 0 {
+			r.State = ImportStateFailed
+			r.Error = fmt.Sprintf("rtt: %d ClientGroups could not be merged or submitted.", report.Errored)
+		}
+		return refreshImportRecord(tc, r)
+	})
+}
+
+// CompleteImportBatch records the outcome of the put batch with ID batchID of
+// the import for dateStr. cause is the reason the batch failed, or nil.
+func CompleteImportBatch(c data.Context, dateStr, batchID string, cause error) error {
+	var b importBatch
+	if cause != nil {
+		b.Error = cause.Error()
+	}
+	if err := c.Store().Put(data.NewKey("ImportBatch", batchID, importRecordKey(dateStr)), &b); err != nil {
+		return err
+	}
+	return updateImportRecord(c, dateStr, refreshImportRecord)
+}
+
+// ImportBatchCompleted reports whether the put batch with ID batchID of the
+// import for dateStr has been put into datastore.
+func ImportBatchCompleted(c data.Context, dateStr, batchID string) (bool, error) {
+	var b importBatch
+	err := c.Store().Get(data.NewKey("ImportBatch", batchID, importRecordKey(dateStr)), &b)
+	if err == data.ErrNoSuchEntity {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return b.Error == "", nil
+}
+
+// refreshImportRecord counts the completed and failed put batches of r. An
+// import which is merging completes, or fails, once all its put batches have.
+// It is run by updateImportRecord.
+func refreshImportRecord(c data.Context, r *ImportRecord) error {
+	q := data.NewQuery("ImportBatch").Ancestor(importRecordKey(r.Date))
+	var batches []importBatch
+	if _, err := c.Store().GetAll(q, &batches); err != nil {
+		return err
+	}
+	r.BatchesCompleted, r.BatchesFailed = 0, 0
+	for _, b := range batches {
+		if b.Error == "" {
+			r.BatchesCompleted++
+		} else {
+			r.BatchesFailed++
+			r.Error = b.Error
+		}
+	}
+	if r.State == ImportStateMerging && r.BatchesCompleted+r.BatchesFailed >= r.BatchesExpected {
+		r.State = ImportStateComplete
+		if r.BatchesFailed > 0 {
+			r.State = ImportStateFailed
+		}
+	}
+	return nil
+}
+
+// clearImportBatches removes the recorded put batches of the import for
+// dateStr, so that a retried import counts only its own batches.
+func clearImportBatches(c data.Context, dateStr string) error {
+	q := data.NewQuery("ImportBatch").Ancestor(importRecordKey(dateStr))
+	keys, err := c.Store().GetAll(q, nil)
+	if err != nil {
+		return err
+	}
+	return c.Store().DeleteMulti(keys)
+}
+
+// GetNextImportDay returns the oldest day after the last successful import
+// date and before latest whose import is incomplete, which is the case if it
+// has no ImportRecord or ImportRecord.Incomplete. Days whose import has been
+// attempted MaxImportAttempts times are skipped, so that a day which keeps
+// failing doesn't hold up the days after it; they are imported again by a
+// backfill. ok is false if there is no such day.
+func GetNextImportDay(c data.Context, latest time.Time) (next time.Time, ok bool, err error) {
+	last, err := GetLastSuccesfulImportDate(c)
+	if err != nil {
+		return next, false, err
+	}
+	records, err := GetImportRecords(c)
+	if err != nil {
+		return next, false, err
+	}
+	byDate := make(map[string]*ImportRecord, len(records))
+	for _, r := range records {
+		byDate[r.Date] = r
+	}
+	for t := last.Add(Day); t.Before(latest); t = t.Add(Day) {
+		r, found := byDate[t.Format(DateFormat)]
+		if !found {
+			return t, true, nil
+		}
+		if r.Incomplete() {
+			if r.Attempts >= MaxImportAttempts {
+				c.Errorf("rtt.GetNextImportDay: Skipping %s after %d attempts. (%s)", r.Date, r.Attempts, r.Error)
+				continue
+			}
+			return t, true, nil
+		}
+	}
+	return next, false, nil
+}
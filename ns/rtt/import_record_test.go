@@ -0,0 +1,226 @@
+// Copyright 2013 M-Lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rtt
+
+import (
+	"bytes"
+	"code.google.com/p/mlab-ns2/gae/ns/data"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"testing"
+	"time"
+)
+
+var errTestBatch = errors.New("test batch failed")
+
+// newTestRecordContext returns a Context whose put tasks record their batch
+// with CompleteImportBatch, failing it with errTestBatch if fail is set. If
+// async is set, put tasks are not run.
+func newTestRecordContext(t *testing.T, fail, async bool) data.Context {
+	var c data.Context
+	queue := data.NewLocalQueue(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if async {
+			return
+		}
+		var cause error
+		if fail {
+			cause = errTestBatch
+		}
+		if err := CompleteImportBatch(c, r.FormValue(FormKeyImportDate), r.FormValue(FormKeyPutKey), cause); err != nil {
+			t.Errorf("CompleteImportBatch: %v", err)
+		}
+	}))
+	c = data.NewContext(data.NewMemoryStore(), data.NewMemoryCache(), queue, log.New(ioutil.Discard, "", 0))
+	recordTestSliverIPs(t, c, &data.SliverTool{ToolID: "ndt", SiteID: "lga01", ServerID: "mlab1", SliverIPv4: "74.63.50.43"})
+	return c
+}
+
+var importRecordTests = []struct {
+	fail, async bool
+	state       string
+	completed   int
+	failed      int
+}{
+	{false, false, ImportStateComplete, 1, 0},
+	{true, false, ImportStateFailed, 0, 1},
+	{false, true, ImportStateMerging, 0, 0},
+}
+
+func TestImportRecord(t *testing.T) {
+	date := time.Date(2013, 8, 18, 0, 0, 0, 0, time.UTC)
+	for _, tt := range importRecordTests {
+		c := newTestRecordContext(t, tt.fail, tt.async)
+		if _, err := ImportDay(c, NewCSVRowSource(bytes.NewBufferString(testCSV)), date); err != nil {
+			t.Fatalf("ImportDay: %v", err)
+		}
+		r, err := GetImportRecord(c, date)
+		if err != nil {
+			t.Fatalf("GetImportRecord: %v", err)
+		}
+		if r.State != tt.state || r.Rows != 2 || r.ClientGroups != 1 || r.BatchesExpected != 1 ||
+			r.BatchesCompleted != tt.completed || r.BatchesFailed != tt.failed {
+			t.Fatalf("GetImportRecord (fail=%v, async=%v) = %+v, want %s with %d completed and %d failed batches",
+				tt.fail, tt.async, r, tt.state, tt.completed, tt.failed)
+		}
+		if tt.fail && r.Error != errTestBatch.Error() {
+			t.Fatalf("GetImportRecord (fail=%v).Error = %q, want %q", tt.fail, r.Error, errTestBatch)
+		}
+	}
+}
+
+func TestImportRecordLateBatch(t *testing.T) {
+	c := newTestRecordContext(t, false, true)
+	date := time.Date(2013, 8, 18, 0, 0, 0, 0, time.UTC)
+	if _, err := ImportDay(c, NewCSVRowSource(bytes.NewBufferString(testCSV)), date); err != nil {
+		t.Fatalf("ImportDay: %v", err)
+	}
+	if err := CompleteImportBatch(c, "2013-08-18", "batch", nil); err != nil {
+		t.Fatalf("CompleteImportBatch: %v", err)
+	}
+	r, err := GetImportRecord(c, date)
+	if err != nil || r.State != ImportStateComplete || r.BatchesCompleted != 1 {
+		t.Fatalf("GetImportRecord = %+v, %v, want %s", r, err, ImportStateComplete)
+	}
+}
+
+func TestImportRecordFailedImport(t *testing.T) {
+	c := newTestRecordContext(t, false, false)
+	date := time.Date(2013, 8, 18, 0, 0, 0, 0, time.UTC)
+	src := &testCheckpointSource{rows: testRows, failAt: 0}
+	if _, err := ImportDay(c, src, date); err != errTestSource {
+		t.Fatalf("ImportDay = %v, want %v", err, errTestSource)
+	}
+	r, err := GetImportRecord(c, date)
+	if err != nil || r.State != ImportStateFailed || r.Error != errTestSource.Error() {
+		t.Fatalf("GetImportRecord = %+v, %v, want %s with error %q", r, err, ImportStateFailed, errTestSource)
+	}
+}
+
+var getNextImportDayTests = []struct {
+	records []ImportRecord
+	latest  time.Time
+	next    time.Time
+	ok      bool
+}{
+	{nil, time.Date(2013, 8, 6, 0, 0, 0, 0, time.UTC), time.Date(2013, 8, 2, 0, 0, 0, 0, time.UTC), true},
+	{
+		[]ImportRecord{
+			{Date: "2013-08-02", State: ImportStateComplete},
+			{Date: "2013-08-03", State: ImportStateFailed}, // Failed before a later day succeeded
+			{Date: "2013-08-04", State: ImportStateComplete},
+		},
+		time.Date(2013, 8, 6, 0, 0, 0, 0, time.UTC), time.Date(2013, 8, 3, 0, 0, 0, 0, time.UTC), true,
+	},
+	{
+		[]ImportRecord{
+			{Date: "2013-08-02", State: ImportStateComplete},
+			{Date: "2013-08-03", State: ImportStateMerging},
+			{Date: "2013-08-04", State: ImportStateQueued},
+		},
+		time.Date(2013, 8, 6, 0, 0, 0, 0, time.UTC), time.Date(2013, 8, 5, 0, 0, 0, 0, time.UTC), true,
+	},
+	{
+		[]ImportRecord{
+			{Date: "2013-08-02", State: ImportStateComplete},
+			{Date: "2013-08-03", State: ImportStateComplete},
+		},
+		time.Date(2013, 8, 4, 0, 0, 0, 0, time.UTC), time.Time{}, false,
+	},
+	{
+		[]ImportRecord{
+			{Date: "2013-08-02", State: ImportStateFailed, Attempts: 3}, // Given up on
+			{Date: "2013-08-03", State: ImportStateFailed, Attempts: 2},
+		},
+		time.Date(2013, 8, 6, 0, 0, 0, 0, time.UTC), time.Date(2013, 8, 3, 0, 0, 0, 0, time.UTC), true,
+	},
+}
+
+func TestGetNextImportDay(t *testing.T) {
+	for i, tt := range getNextImportDayTests {
+		c := newTestContext()
+		if err := SetLastSuccessfulImportDate(c, time.Date(2013, 8, 1, 0, 0, 0, 0, time.UTC)); err != nil {
+			t.Fatal(err)
+		}
+		for j := range tt.records {
+			if err := putImportRecord(c, &tt.records[j]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		next, ok, err := GetNextImportDay(c, tt.latest)
+		if err != nil || ok != tt.ok || !next.Equal(tt.next) {
+			t.Fatalf("GetNextImportDay (test %d) = %v, %v, %v, want %v, %v", i, next, ok, err, tt.next, tt.ok)
+		}
+	}
+}
+
+func TestImportRecordIncompleteTimeout(t *testing.T) {
+	r := &ImportRecord{State: ImportStateMerging, Updated: time.Now().Add(-ImportRecordTimeout - time.Hour)}
+	if !r.Incomplete() {
+		t.Fatalf("ImportRecord{%s, updated %v}.Incomplete() = false, want true", r.State, r.Updated)
+	}
+}
+
+func TestQueueImportRestoresRecord(t *testing.T) {
+	c := newTestContext()
+	complete := time.Date(2013, 8, 1, 0, 0, 0, 0, time.UTC)
+	SetImportState(c, complete, ImportStateComplete, nil)
+	errAdd := errors.New("queue unavailable")
+	add := func() error { return errAdd }
+
+	if err := QueueImport(c, complete, add); err != errAdd {
+		t.Fatalf("QueueImport = %v, want %v", err, errAdd)
+	}
+	if r, err := GetImportRecord(c, complete); err != nil || r.State != ImportStateComplete {
+		t.Fatalf("GetImportRecord after failed QueueImport = %+v, %v, want %s", r, err, ImportStateComplete)
+	}
+	none := complete.Add(Day)
+	if err := QueueImport(c, none, add); err != errAdd {
+		t.Fatalf("QueueImport = %v, want %v", err, errAdd)
+	}
+	if _, err := GetImportRecord(c, none); err != data.ErrNoSuchEntity {
+		t.Fatalf("GetImportRecord after failed QueueImport = %v, want %v", err, data.ErrNoSuchEntity)
+	}
+}
+
+func TestQueueImportAttempts(t *testing.T) {
+	c := newTestContext()
+	date := time.Date(2013, 8, 1, 0, 0, 0, 0, time.UTC)
+	add := func() error { return nil }
+	for i, want := range []int{1, 2, 1} {
+		if i == 2 {
+			SetImportState(c, date, ImportStateComplete, nil)
+		}
+		if err := QueueImport(c, date, add); err != nil {
+			t.Fatalf("QueueImport = %v", err)
+		}
+		if r, err := GetImportRecord(c, date); err != nil || r.Attempts != want {
+			t.Fatalf("GetImportRecord after QueueImport %d = %+v, %v, want %d attempts", i+1, r, err, want)
+		}
+	}
+}
+
+func TestImportRecordRowsUnresolved(t *testing.T) {
+	c := newTestContext()
+	date := time.Date(2013, 8, 18, 0, 0, 0, 0, time.UTC)
+	if _, err := ImportDay(c, NewCSVRowSource(bytes.NewBufferString(testCSV)), date); err != ErrRowsUnresolved {
+		t.Fatalf("ImportDay with no sliver IPs = %v, want %v", err, ErrRowsUnresolved)
+	}
+	r, err := GetImportRecord(c, date)
+	if err != nil || r.State != ImportStateFailed {
+		t.Fatalf("GetImportRecord = %+v, %v, want %s", r, err, ImportStateFailed)
+	}
+}
@@ -0,0 +1,274 @@
+// Copyright 2013 M-Lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rtt
+
+import (
+	"code.google.com/p/mlab-ns2/gae/ns/data"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrInvalidPrefixSize  = errors.New("rtt: Invalid ClientGroup prefix size.")
+	ErrInvalidClientGroup = errors.New("rtt: Invalid ClientGroup key.")
+)
+
+// MigrateClientGroupsPage is the number of ClientGroups migrated by each call
+// of MigrateClientGroups. It should be set during initialization.
+var MigrateClientGroupsPage = 3000
+
+// MigrateReport reports the outcome of a migration of ClientGroups to new
+// prefix sizes.
+type MigrateReport struct {
+	Sources int // ClientGroups merged into a ClientGroup of the new sizes
+	Targets int // ClientGroups of the new sizes put
+	Skipped int // Sources already merged into their ClientGroup of the new sizes
+	Coarser int // ClientGroups with shorter prefixes, which cannot be split
+	Deleted int // Sources deleted
+}
+
+func (r *MigrateReport) String() string {
+	return fmt.Sprintf("%d sources into %d targets, %d skipped, %d coarser, %d deleted",
+		r.Sources, r.Targets, r.Skipped, r.Coarser, r.Deleted)
+}
+
+// CheckPrefixSizes returns ErrInvalidPrefixSize if v4Size or v6Size are not
+// valid IPv4 and IPv6 prefix sizes of ClientGroups.
+func CheckPrefixSizes(v4Size, v6Size int) error {
+	if v4Size < 1 || v4Size > 8*net.IPv4len || v6Size < 1 || v6Size > 8*net.IPv6len {
+		return ErrInvalidPrefixSize
+	}
+	return nil
+}
+
+// ParsePrefixSizes returns the IPv4 and IPv6 prefix sizes of ClientGroups
+// named by v4 and v6, or ErrInvalidPrefixSize.
+func ParsePrefixSizes(v4, v6 string) (int, int, error) {
+	v4Size, err4 := strconv.Atoi(v4)
+	v6Size, err6 := strconv.Atoi(v6)
+	if err4 != nil || err6 != nil || CheckPrefixSizes(v4Size, v6Size) != nil {
+		return 0, 0, ErrInvalidPrefixSize
+	}
+	return v4Size, v6Size, nil
+}
+
+// clientGroupKeyPrefix returns the prefix of a ClientGroup named by key. Keys
+// without a prefix size have the prefix sizes used before it was kept.
+func clientGroupKeyPrefix(key *data.Key) (*net.IPNet, error) {
+	if strings.Contains(key.StringID, "/") {
+		_, prefix, err := net.ParseCIDR(key.StringID)
+		if err != nil {
+			return nil, ErrInvalidClientGroup
+		}
+		return prefix, nil
+	}
+	ip := net.ParseIP(key.StringID)
+	if ip == nil {
+		return nil, ErrInvalidClientGroup
+	}
+	return getPrefix(ip, legacyV4PrefixSize, legacyV6PrefixSize), nil
+}
+
+// getClientGroups gets the ClientGroups of keys in MaxDSReadPerQuery sized
+// chunks. ClientGroups which do not exist are not found.
+func getClientGroups(c data.Context, keys []*data.Key) ([]ClientGroup, []bool, error) {
+	cgs := make([]ClientGroup, len(keys))
+	found := make([]bool, len(keys))
+	for i := 0; i < len(keys); i += MaxDSReadPerQuery {
+		j := i + MaxDSReadPerQuery
+		if j > len(keys) {
+			j = len(keys)
+		}
+		err := c.Store().GetMulti(keys[i:j], cgs[i:j])
+		merr, ok := err.(data.MultiError)
+		if err != nil && !ok {
+			return nil, nil, err
+		}
+		for k := i; k < j; k++ {
+			if err != nil && merr[k-i] != nil {
+				if merr[k-i] != data.ErrNoSuchEntity {
+					return nil, nil, merr[k-i]
+				}
+				continue
+			}
+			found[k] = true
+		}
+	}
+	return cgs, found, nil
+}
+
+// MigrateClientGroups re-aggregates up to MigrateClientGroupsPage ClientGroups
+// in datastore, in key order after the ClientGroup named start or from the
+// first if start is empty, into ClientGroups of prefix sizes v4Size and
+// v6Size, merging the SiteRTTs of all ClientGroups within each new prefix. It
+// returns the start of the next page, or "" if all ClientGroups have been
+// migrated. ClientGroups stored before their keys carried the prefix size are
+// migrated to their own prefix size by MigrateClientGroups(c, 22, 56, true).
+//
+// ClientGroups are only migrated to equal or coarser prefixes, since the
+// SiteRTTs of a ClientGroup cannot be split. Finer ClientGroups are built by
+// importing again with the new prefix sizes. ClientGroups of the new sizes
+// which already exist are merged into, and record the ClientGroups merged
+// into them so that a migration may be run again, and so that the sources of
+// a new prefix may be merged by several pages. ClientGroups of an AS, see
+// PrefixGrouper, are not migrated. The migrated ClientGroups are deleted if
+// remove is set, and otherwise coexist with the new ones.
+func MigrateClientGroups(c data.Context, v4Size, v6Size int, remove bool, start string) (*MigrateReport, string, error) {
+	if err := CheckPrefixSizes(v4Size, v6Size); err != nil {
+		return nil, "", err
+	}
+
+	q := data.NewQuery("ClientGroup").Ancestor(DatastoreParentKey()).Limit(MigrateClientGroupsPage)
+	if start != "" {
+		q = q.Filter(data.KeyField+" >", data.NewKey("ClientGroup", start, DatastoreParentKey()))
+	}
+	keys, err := c.Store().GetAll(q, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	var next string
+	if len(keys) == MigrateClientGroupsPage {
+		next = keys[len(keys)-1].StringID
+	}
+
+	// Group the keys of ClientGroups by the new prefix they are within.
+	report := &MigrateReport{}
+	targets := make(map[string]*net.IPNet)
+	sources := make(map[string][]*data.Key)
+	for _, key := range keys {
+		if strings.HasPrefix(key.StringID, "AS") { // Grouped by origin AS
+			continue
+		}
+		prefix, err := clientGroupKeyPrefix(key)
+		if err != nil {
+			c.Errorf("rtt.MigrateClientGroups:clientGroupKeyPrefix: %s (%s)", err, key.StringID)
+			continue
+		}
+		ones, _ := prefix.Mask.Size()
+		target := getPrefix(prefix.IP, v4Size, v6Size)
+		size, _ := target.Mask.Size()
+		if ones < size {
+			report.Coarser++
+			continue
+		}
+		t := target.String()
+		if t == key.StringID {
+			continue
+		}
+		targets[t] = target
+		sources[t] = append(sources[t], key)
+	}
+
+	// Migrate in batches of up to MaxDSWritePerQuery sources, or a single
+	// new prefix with more sources.
+	names := make([]string, 0, len(targets))
+	for t := range targets {
+		names = append(names, t)
+	}
+	sort.Strings(names)
+	for len(names) > 0 {
+		var n, batchSources int
+		for n < len(names) && (n == 0 || batchSources+len(sources[names[n]]) <= MaxDSWritePerQuery) {
+			batchSources += len(sources[names[n]])
+			n++
+		}
+		if err := migrateClientGroups(c, names[:n], targets, sources, remove, report); err != nil {
+			return report, "", err
+		}
+		names = names[n:]
+	}
+	return report, next, nil
+}
+
+// migrateClientGroups merges the ClientGroups of sources into a ClientGroup for
+// each of the new prefixes names, or into the existing one. See
+// MigrateClientGroups.
+func migrateClientGroups(c data.Context, names []string, targets map[string]*net.IPNet, sources map[string][]*data.Key, remove bool, report *MigrateReport) error {
+	var srcKeys []*data.Key
+	tgtKeys := make([]*data.Key, len(names))
+	for i, t := range names {
+		srcKeys = append(srcKeys, sources[t]...)
+		tgtKeys[i] = data.NewKey("ClientGroup", t, DatastoreParentKey())
+	}
+	srcCGs, found, err := getClientGroups(c, srcKeys)
+	if err != nil {
+		return err
+	}
+	tgtCGs, tgtFound, err := getClientGroups(c, tgtKeys)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]*data.Key, 0, len(names))
+	cgs := make([]ClientGroup, 0, len(names))
+	i := 0
+	for j, t := range names {
+		size, _ := targets[t].Mask.Size()
+		cg := &ClientGroup{Prefix: []byte(targets[t].IP), PrefixLen: size}
+		if tgtFound[j] {
+			cg = &tgtCGs[j]
+		}
+		migrated := make(map[string]bool, len(cg.Migrated))
+		for _, name := range cg.Migrated {
+			migrated[name] = true
+		}
+		changed := false
+		for _, key := range sources[t] {
+			if migrated[key.StringID] {
+				report.Skipped++
+			} else if found[i] {
+				srcCGs[i].Prefix = cg.Prefix
+				if _, err := MergeClientGroups(cg, &srcCGs[i]); err != nil {
+					return err
+				}
+				cg.Imports = append(cg.Imports, srcCGs[i].Imports...)
+				cg.Migrated = append(cg.Migrated, key.StringID)
+				report.Sources++
+				changed = true
+			}
+			i++
+		}
+		if changed && len(cg.SiteRTTs) > 0 {
+			keys = append(keys, cg.Key())
+			cgs = append(cgs, *cg)
+		}
+	}
+	if len(keys) > 0 {
+		if err := c.Store().PutMulti(keys, cgs); err != nil {
+			return err
+		}
+		report.Targets += len(keys)
+	}
+
+	if !remove {
+		return nil
+	}
+	for len(srcKeys) > 0 {
+		n := len(srcKeys)
+		if n > MaxDSWritePerQuery {
+			n = MaxDSWritePerQuery
+		}
+		if err := c.Store().DeleteMulti(srcKeys[:n]); err != nil {
+			return err
+		}
+		report.Deleted += n
+		srcKeys = srcKeys[n:]
+	}
+	return nil
+}
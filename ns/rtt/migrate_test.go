@@ -0,0 +1,154 @@
+// Copyright 2013 M-Lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rtt
+
+import (
+	"code.google.com/p/mlab-ns2/gae/ns/data"
+	"net"
+	"testing"
+	"time"
+)
+
+var clientGroupKeyTests = []struct {
+	cg  *ClientGroup
+	key string
+}{
+	{&ClientGroup{Prefix: net.ParseIP("24.164.160.0")}, "24.164.160.0/22"}, // Legacy
+	{&ClientGroup{Prefix: net.ParseIP("24.164.161.0"), PrefixLen: 24}, "24.164.161.0/24"},
+	{&ClientGroup{Prefix: net.ParseIP("2001:4860:4860::")}, "2001:4860:4860::/56"},
+}
+
+func TestClientGroupKey(t *testing.T) {
+	for _, tt := range clientGroupKeyTests {
+		if key := tt.cg.Key(); key.StringID != tt.key || !key.Parent.Equal(DatastoreParentKey()) {
+			t.Fatalf("ClientGroup{%v, %d}.Key() = %v, want %s", net.IP(tt.cg.Prefix), tt.cg.PrefixLen, key, tt.key)
+		}
+	}
+}
+
+// putTestClientGroup puts a ClientGroup with a SiteRTT to lga01 under a key
+// named name.
+func putTestClientGroup(t *testing.T, c data.Context, name string, rtt float64) {
+	ip, _, err := net.ParseCIDR(name)
+	if err != nil {
+		ip = net.ParseIP(name)
+	}
+	cg := &ClientGroup{Prefix: ip, SiteRTTs: SiteRTTs{NewSiteRTT("lga01", rtt, time.Unix(1376828167, 0))}}
+	if err := c.Store().Put(data.NewKey("ClientGroup", name, DatastoreParentKey()), cg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateClientGroupsLegacy(t *testing.T) {
+	c := newTestContext()
+	putTestClientGroup(t, c, "24.164.160.0", 5)
+	putTestClientGroup(t, c, "2001:4860:4860::", 8)
+
+	for i, want := range []MigrateReport{{Sources: 2, Targets: 2, Deleted: 2}, {}} {
+		report, _, err := MigrateClientGroups(c, legacyV4PrefixSize, legacyV6PrefixSize, true, "")
+		if err != nil || *report != want {
+			t.Fatalf("MigrateClientGroups (run %d) = %v, %v, want %v", i+1, report, err, &want)
+		}
+	}
+
+	for _, ip := range []string{"24.164.160.1", "2001:4860:4860::1"} {
+		var cg ClientGroup
+		if err := c.Store().Get(ClientGroupKey(GetClientGroup(net.ParseIP(ip))), &cg); err != nil || len(cg.SiteRTTs) != 1 {
+			t.Fatalf("ClientGroup of %s = %v, %v, want 1 SiteRTT", ip, cg.SiteRTTs, err)
+		}
+	}
+	var cg ClientGroup
+	if err := c.Store().Get(data.NewKey("ClientGroup", "24.164.160.0", DatastoreParentKey()), &cg); err != data.ErrNoSuchEntity {
+		t.Fatalf("Legacy ClientGroup after migration: %v, want %v", err, data.ErrNoSuchEntity)
+	}
+}
+
+func TestMigrateClientGroupsCoarser(t *testing.T) {
+	c := newTestContext()
+	putTestClientGroup(t, c, "24.164.160.0/24", 5)
+	putTestClientGroup(t, c, "24.164.161.0/24", 7)
+	putTestClientGroup(t, c, "24.164.164.0/24", 9)
+	putTestClientGroup(t, c, "24.164.168.0/22", 10) // Already migrated
+	putTestClientGroup(t, c, "24.164.169.0/24", 11)
+	putTestClientGroup(t, c, "24.0.0.0/16", 20) // Cannot be split
+
+	// Sources are merged into the existing 24.164.168.0/22 once.
+	for i, want := range []MigrateReport{{Sources: 4, Targets: 3, Coarser: 1}, {Skipped: 4, Coarser: 1}} {
+		report, _, err := MigrateClientGroups(c, 22, 56, false, "")
+		if err != nil || *report != want {
+			t.Fatalf("MigrateClientGroups (run %d) = %v, %v, want %v", i+1, report, err, &want)
+		}
+	}
+
+	var cg ClientGroup
+	key := ClientGroupKey(&net.IPNet{IP: net.IPv4(24, 164, 160, 0).To4(), Mask: net.CIDRMask(22, 32)})
+	if err := c.Store().Get(key, &cg); err != nil || len(cg.SiteRTTs) != 1 {
+		t.Fatalf("ClientGroup 24.164.160.0/22 = %v, %v, want 1 SiteRTT", cg.SiteRTTs, err)
+	}
+	if sr := cg.SiteRTTs[0]; sr.Samples != 2 || sr.RTT != 5 || cg.PrefixLen != 22 {
+		t.Fatalf("ClientGroup 24.164.160.0/22 = %v, want 2 samples of min 5", cg)
+	}
+	key = ClientGroupKey(&net.IPNet{IP: net.IPv4(24, 164, 168, 0).To4(), Mask: net.CIDRMask(22, 32)})
+	if err := c.Store().Get(key, &cg); err != nil || len(cg.SiteRTTs) != 1 {
+		t.Fatalf("ClientGroup 24.164.168.0/22 = %v, %v, want 1 SiteRTT", cg.SiteRTTs, err)
+	}
+	if sr := cg.SiteRTTs[0]; sr.Samples != 2 || sr.RTT != 10 {
+		t.Fatalf("ClientGroup 24.164.168.0/22 = %v, want 2 samples of min 10", cg)
+	}
+	// The /24 ClientGroups coexist with the /22 ClientGroups.
+	if err := c.Store().Get(data.NewKey("ClientGroup", "24.164.161.0/24", DatastoreParentKey()), &cg); err != nil {
+		t.Fatalf("ClientGroup 24.164.161.0/24: %v", err)
+	}
+}
+
+func TestMigrateClientGroupsPages(t *testing.T) {
+	c := newTestContext()
+	defer func(n int) { MigrateClientGroupsPage = n }(MigrateClientGroupsPage)
+	MigrateClientGroupsPage = 2
+	for i, name := range []string{"24.164.160.0/24", "24.164.161.0/24", "24.164.162.0/24", "24.164.163.0/24"} {
+		putTestClientGroup(t, c, name, float64(5+i))
+	}
+
+	// The sources of 24.164.160.0/22 are merged by two pages.
+	var pages []string
+	report := &MigrateReport{}
+	for start := ""; ; {
+		page, next, err := MigrateClientGroups(c, 22, 56, true, start)
+		if err != nil {
+			t.Fatalf("MigrateClientGroups(%q) = %v, %v", start, page, err)
+		}
+		report.Sources += page.Sources
+		report.Targets += page.Targets
+		report.Deleted += page.Deleted
+		if next == "" {
+			break
+		}
+		pages = append(pages, next)
+		start = next
+	}
+	want := MigrateReport{Sources: 4, Targets: 2, Deleted: 4}
+	if len(pages) != 2 || *report != want {
+		t.Fatalf("MigrateClientGroups = %v in pages after %v, want %v in 3 pages", report, pages, &want)
+	}
+
+	var cg ClientGroup
+	key := ClientGroupKey(&net.IPNet{IP: net.IPv4(24, 164, 160, 0).To4(), Mask: net.CIDRMask(22, 32)})
+	if err := c.Store().Get(key, &cg); err != nil || len(cg.SiteRTTs) != 1 || len(cg.Migrated) != 4 {
+		t.Fatalf("ClientGroup 24.164.160.0/22 = %v, %v, want 1 SiteRTT migrated from 4", cg, err)
+	}
+	if sr := cg.SiteRTTs[0]; sr.Samples != 4 || sr.RTT != 5 {
+		t.Fatalf("ClientGroup 24.164.160.0/22 = %v, want 4 samples of min 5", cg)
+	}
+}
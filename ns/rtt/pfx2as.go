@@ -0,0 +1,211 @@
+// Copyright 2013 M-Lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rtt
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidPfx2as = errors.New("rtt: Invalid pfx2as line.")
+
+// ClientGrouper groups client IPs into ClientGroups.
+type ClientGrouper interface {
+	// Group returns a new ClientGroup, with no SiteRTTs, of ip.
+	Group(ip net.IP) *ClientGroup
+}
+
+// ClientGrouping is the ClientGrouper by which imports group the destinations
+// of traceroutes, and resolvers group clients. It should be set during
+// initialization.
+var ClientGrouping ClientGrouper = FixedPrefixGrouper{}
+
+// GroupClient returns a new ClientGroup of ip using ClientGrouping.
+func GroupClient(ip net.IP) *ClientGroup {
+	return ClientGrouping.Group(ip)
+}
+
+// FixedPrefixGrouper groups clients by prefixes of V4PrefixSize and
+// V6PrefixSize. See GetClientGroup.
+type FixedPrefixGrouper struct{}
+
+func (FixedPrefixGrouper) Group(ip net.IP) *ClientGroup {
+	return NewClientGroup(GetClientGroup(ip).IP)
+}
+
+// PrefixGrouper groups clients by the longest announced prefix which contains
+// them, or by the origin AS of that prefix if ByASN is set. Clients outside of
+// all announced prefixes are grouped by FixedPrefixGrouper.
+type PrefixGrouper struct {
+	Table *PrefixTable
+	ByASN bool
+}
+
+func (g *PrefixGrouper) Group(ip net.IP) *ClientGroup {
+	prefix, asn, ok := g.Table.Lookup(ip)
+	if !ok {
+		return FixedPrefixGrouper{}.Group(ip)
+	}
+	if g.ByASN && asn != 0 {
+		return &ClientGroup{ASN: asn, SiteRTTs: make(SiteRTTs, 0)}
+	}
+	ones, _ := prefix.Mask.Size()
+	return &ClientGroup{
+		Prefix:    []byte(prefix.IP),
+		PrefixLen: ones,
+		SiteRTTs:  make(SiteRTTs, 0),
+	}
+}
+
+// prefixNode is a node of the binary trie of a PrefixTable. The path from the
+// root to a node is the prefix it represents.
+type prefixNode struct {
+	child     [2]*prefixNode
+	asn       uint32
+	announced bool
+}
+
+// PrefixTable is an in-memory longest-prefix-match table of announced
+// prefixes and their origin ASes.
+type PrefixTable struct {
+	v4, v6 prefixNode
+	Len    int // Number of prefixes
+}
+
+// NewPrefixTable returns an empty *PrefixTable.
+func NewPrefixTable() *PrefixTable {
+	return &PrefixTable{}
+}
+
+// root returns the root of the trie of an IP, and the IP in its address
+// family's length.
+func (t *PrefixTable) root(ip net.IP) (*prefixNode, net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &t.v4, ip4
+	}
+	return &t.v6, ip.To16()
+}
+
+// Insert adds a prefix announced by an AS to t, replacing any previous AS of
+// the prefix.
+func (t *PrefixTable) Insert(prefix *net.IPNet, asn uint32) {
+	n, ip := t.root(prefix.IP)
+	ones, _ := prefix.Mask.Size()
+	for i := 0; i < ones; i++ {
+		b := ip[i/8] >> uint(7-i%8) & 1
+		if n.child[b] == nil {
+			n.child[b] = &prefixNode{}
+		}
+		n = n.child[b]
+	}
+	if !n.announced {
+		t.Len++
+	}
+	n.asn, n.announced = asn, true
+}
+
+// Lookup returns the longest prefix in t which contains ip and its origin AS,
+// and reports whether there is one.
+func (t *PrefixTable) Lookup(ip net.IP) (*net.IPNet, uint32, bool) {
+	n, ip := t.root(ip)
+	if ip == nil {
+		return nil, 0, false
+	}
+	var best *prefixNode
+	var bestOnes int
+	for i := 0; n != nil; i++ {
+		if n.announced {
+			best, bestOnes = n, i
+		}
+		if i == 8*len(ip) {
+			break
+		}
+		n = n.child[ip[i/8]>>uint(7-i%8)&1]
+	}
+	if best == nil {
+		return nil, 0, false
+	}
+	mask := net.CIDRMask(bestOnes, 8*len(ip))
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}, best.asn, true
+}
+
+// parseOriginAS returns the first AS of a pfx2as origin, which lists the
+// origins of multi-origin prefixes separated by "_", and AS sets separated by
+// ",".
+func parseOriginAS(s string) (uint32, error) {
+	if i := strings.IndexAny(s, "_,"); i >= 0 {
+		s = s[:i]
+	}
+	asn, err := strconv.ParseUint(s, 10, 32)
+	return uint32(asn), err
+}
+
+// ReadPfx2as reads a RouteViews prefix-to-AS file, which has a line of prefix
+// address, prefix size and origin AS separated by whitespace for each
+// announced prefix, e.g., "1.0.4.0	22	56203".
+func ReadPfx2as(r io.Reader) (*PrefixTable, error) {
+	t := NewPrefixTable()
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		f := strings.Fields(text)
+		if len(f) != 3 {
+			return nil, fmt.Errorf("%s (line %d)", ErrInvalidPfx2as, line)
+		}
+		_, prefix, err := net.ParseCIDR(f[0] + "/" + f[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s (line %d)", ErrInvalidPfx2as, line)
+		}
+		asn, err := parseOriginAS(f[2])
+		if err != nil {
+			return nil, fmt.Errorf("%s (line %d)", ErrInvalidPfx2as, line)
+		}
+		t.Insert(prefix, asn)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// LoadPfx2as reads the RouteViews prefix-to-AS file at path, which is gzipped
+// if it ends in .gz. See ReadPfx2as.
+func LoadPfx2as(path string) (*PrefixTable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	return ReadPfx2as(r)
+}
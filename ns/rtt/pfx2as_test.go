@@ -0,0 +1,105 @@
+// Copyright 2013 M-Lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rtt
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+const testPfx2as = `# RouteViews pfx2as
+24.164.128.0	17	7843
+24.164.160.0	19	11351
+24.164.160.0	20	11351_7843
+90.185.0.0	16	3292,9158
+2001:4860::	32	15169
+`
+
+func newTestPrefixTable(t *testing.T) *PrefixTable {
+	table, err := ReadPfx2as(strings.NewReader(testPfx2as))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return table
+}
+
+func TestReadPfx2asInvalid(t *testing.T) {
+	for _, in := range []string{
+		"24.164.160.0	19",
+		"24.164.160.0	33	11351",
+		"24.164.160.0	19	AS11351",
+	} {
+		if _, err := ReadPfx2as(strings.NewReader(in)); err == nil {
+			t.Fatalf("ReadPfx2as(%q) = nil error, want error", in)
+		}
+	}
+}
+
+var prefixTableLookupTests = []struct {
+	ip     string
+	prefix string
+	asn    uint32
+}{
+	{"24.164.163.78", "24.164.160.0/20", 11351}, // Multi-origin
+	{"24.164.177.1", "24.164.160.0/19", 11351},
+	{"24.164.130.1", "24.164.128.0/17", 7843},
+	{"90.185.4.231", "90.185.0.0/16", 3292}, // AS set
+	{"2001:4860:4860::8888", "2001:4860::/32", 15169},
+	{"154.54.36.18", "", 0},
+	{"2001:db8::1", "", 0},
+}
+
+func TestPrefixTableLookup(t *testing.T) {
+	table := newTestPrefixTable(t)
+	if table.Len != 5 {
+		t.Fatalf("PrefixTable.Len = %d, want 5", table.Len)
+	}
+	for _, tt := range prefixTableLookupTests {
+		prefix, asn, ok := table.Lookup(net.ParseIP(tt.ip))
+		if ok != (tt.prefix != "") || ok && (prefix.String() != tt.prefix || asn != tt.asn) {
+			t.Fatalf("PrefixTable.Lookup(%s) = %v, %d, %v, want %s, %d", tt.ip, prefix, asn, ok, tt.prefix, tt.asn)
+		}
+	}
+}
+
+var prefixGrouperTests = []struct {
+	ip     string
+	byASN  bool
+	name   string
+	maxDst int
+}{
+	{"24.164.163.78", false, "24.164.160.0/20", 0},
+	{"24.164.163.78", true, "AS11351", 0},
+	{"2001:4860:4860::8888", true, "AS15169", 0},
+	{"154.54.36.18", false, "154.54.36.0/22", V4PrefixSize - v4MinNeighbourPrefixSize}, // Not announced
+	{"154.54.36.18", true, "154.54.36.0/22", V4PrefixSize - v4MinNeighbourPrefixSize},
+}
+
+func TestPrefixGrouper(t *testing.T) {
+	table := newTestPrefixTable(t)
+	defer func(g ClientGrouper) { ClientGrouping = g }(ClientGrouping)
+	for _, tt := range prefixGrouperTests {
+		ClientGrouping = &PrefixGrouper{Table: table, ByASN: tt.byASN}
+		ip := net.ParseIP(tt.ip)
+		cg := GroupClient(ip)
+		if name := cg.Name(); name != tt.name || cg.Key().StringID != tt.name {
+			t.Fatalf("PrefixGrouper{ByASN: %v}.Group(%s).Name() = %s, want %s", tt.byASN, tt.ip, name, tt.name)
+		}
+		if d := MaxNeighbourDistance(ip); d != tt.maxDst {
+			t.Fatalf("MaxNeighbourDistance(%s) = %d, want %d", tt.ip, d, tt.maxDst)
+		}
+	}
+}
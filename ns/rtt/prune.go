@@ -0,0 +1,243 @@
+// Copyright 2013 M-Lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rtt
+
+import (
+	"bytes"
+	"code.google.com/p/mlab-ns2/gae/ns/data"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// ErrNoLiveSites is returned by PruneClientGroups if no Site is live, which
+// would remove every SiteRTT.
+var ErrNoLiveSites = errors.New("rtt: No live Sites to prune ClientGroups against.")
+
+// PruneClientGroupsPage is the number of ClientGroups pruned by each call of
+// PruneClientGroups. It should be set during initialization.
+var PruneClientGroupsPage = 3000
+
+// PruneReport reports what a prune of ClientGroups removed.
+type PruneReport struct {
+	ClientGroups int            // ClientGroups examined
+	Changed      int            // ClientGroups put without removed SiteRTTs
+	Deleted      int            // ClientGroups deleted as no SiteRTTs were left
+	Retired      int            // SiteRTTs removed as their Site is not live
+	Expired      int            // SiteRTTs removed by SiteRTTHorizon
+	Sites        map[string]int // Retired SiteRTTs by SiteID
+}
+
+func (r *PruneReport) add(o *PruneReport) {
+	r.ClientGroups += o.ClientGroups
+	r.Changed += o.Changed
+	r.Deleted += o.Deleted
+	r.Retired += o.Retired
+	r.Expired += o.Expired
+	for siteID, n := range o.Sites {
+		r.Sites[siteID] += n
+	}
+}
+
+func (r *PruneReport) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%d ClientGroups, %d changed, %d deleted, %d retired and %d expired SiteRTTs",
+		r.ClientGroups, r.Changed, r.Deleted, r.Retired, r.Expired)
+	siteIDs := make([]string, 0, len(r.Sites))
+	for siteID := range r.Sites {
+		siteIDs = append(siteIDs, siteID)
+	}
+	sort.Strings(siteIDs)
+	for _, siteID := range siteIDs {
+		fmt.Fprintf(&buf, "\n%s: %d", siteID, r.Sites[siteID])
+	}
+	return buf.String()
+}
+
+// LiveSites returns the IDs of Sites which exist and have SliverTools, online
+// or not.
+func LiveSites(c data.Context) (map[string]bool, error) {
+	sites, _, err := data.GetAllSites(c)
+	if err != nil {
+		return nil, err
+	}
+	slivers, err := data.GetSliverTools(c)
+	if err != nil {
+		return nil, err
+	}
+	hasSlivers := make(map[string]bool)
+	for _, s := range slivers {
+		hasSlivers[s.SiteID] = true
+	}
+	live := make(map[string]bool)
+	for _, site := range sites {
+		if hasSlivers[site.SiteID] {
+			live[site.SiteID] = true
+		}
+	}
+	return live, nil
+}
+
+// pruneClientGroup removes the SiteRTTs of cg whose Site is not in live, and
+// those last updated more than SiteRTTHorizon before now, and reports whether
+// any were removed. The ClientGroupDays of cg which have expired, or all of
+// them if no SiteRTTs are left, are removed from cg and returned.
+func pruneClientGroup(cg *ClientGroup, live map[string]bool, now time.Time, report *PruneReport) (bool, []string) {
+	kept := cg.SiteRTTs[:0]
+	for _, sr := range cg.SiteRTTs {
+		if !live[sr.SiteID] {
+			report.Retired++
+			report.Sites[sr.SiteID]++
+			continue
+		}
+		kept = append(kept, sr)
+	}
+	n := len(kept)
+	kept, _ = ExpireSiteRTTs(kept, now)
+	report.Expired += n - len(kept)
+
+	changed := len(kept) != len(cg.SiteRTTs)
+	cg.SiteRTTs = kept
+
+	var removed []string
+	imports := cg.Imports[:0]
+	for _, ref := range cg.Imports {
+		r, ok := parseImportRef(ref)
+		if len(kept) == 0 || !ok || importExpired(r.date, now) {
+			removed = append(removed, ref)
+			continue
+		}
+		imports = append(imports, ref)
+	}
+	cg.Imports = imports
+	return changed || len(removed) > 0, removed
+}
+
+// PruneClientGroups sweeps over up to PruneClientGroupsPage ClientGroups in
+// datastore, in key order after the ClientGroup named start or from the first
+// if start is empty, and removes the SiteRTTs of Sites which are not in live,
+// see LiveSites, and those last updated more than SiteRTTHorizon before now.
+// ClientGroups with no SiteRTTs left are deleted. It returns the start of the
+// next page, or "" if all ClientGroups have been swept.
+//
+// ClientGroups are pruned in transactions, so that the samples of imports put
+// while they are pruned are not lost.
+func PruneClientGroups(c data.Context, live map[string]bool, now time.Time, start string) (*PruneReport, string, error) {
+	if len(live) == 0 {
+		return nil, "", ErrNoLiveSites
+	}
+
+	q := data.NewQuery("ClientGroup").Ancestor(DatastoreParentKey()).Limit(PruneClientGroupsPage)
+	if start != "" {
+		q = q.Filter(data.KeyField+" >", data.NewKey("ClientGroup", start, DatastoreParentKey()))
+	}
+	keys, err := c.Store().GetAll(q, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	var next string
+	if len(keys) == PruneClientGroupsPage {
+		next = keys[len(keys)-1].StringID
+	}
+	report, err := pruneClientGroups(c, keys, live, now)
+	return report, next, err
+}
+
+// pruneClientGroups prunes the ClientGroups of keys. See PruneClientGroups.
+func pruneClientGroups(c data.Context, keys []*data.Key, live map[string]bool, now time.Time) (*PruneReport, error) {
+	report := &PruneReport{Sites: make(map[string]int)}
+	for len(keys) > 0 {
+		var chunk *PruneReport
+		var n int
+		err := data.RunInTransaction(c, func(tc data.Context) error {
+			var err error
+			chunk, n, err = pruneClientGroupsChunk(tc, keys, live, now)
+			return err
+		})
+		if err != nil {
+			return report, err
+		}
+		report.add(chunk)
+		keys = keys[n:]
+	}
+	return report, nil
+}
+
+// pruneClientGroupsChunk prunes the ClientGroups of a leading chunk of keys,
+// which put up to MaxDSWriteBytesPerQuery, and returns the number of keys it
+// pruned. It is run in a transaction.
+func pruneClientGroupsChunk(c data.Context, keys []*data.Key, live map[string]bool, now time.Time) (*PruneReport, int, error) {
+	if len(keys) > MaxDSWritePerQuery {
+		keys = keys[:MaxDSWritePerQuery]
+	}
+	cgs := make([]ClientGroup, len(keys))
+	err := c.Store().GetMulti(keys, cgs)
+	merr, ok := err.(data.MultiError)
+	if err != nil && !ok {
+		return nil, 0, err
+	}
+
+	report := &PruneReport{Sites: make(map[string]int)}
+	var putKeys, delKeys []*data.Key
+	var putCGs []ClientGroup
+	var removed []string
+	var bytes, n int
+	for ; n < len(cgs); n++ {
+		if err != nil && merr[n] != nil {
+			if merr[n] == data.ErrNoSuchEntity { // Deleted since listing
+				continue
+			}
+			return nil, 0, merr[n]
+		}
+		size := estimateClientGroupSize(&cgs[n])
+		// The rest of keys is pruned by the next transaction.
+		if len(putKeys) > 0 && bytes+size > MaxDSWriteBytesPerQuery {
+			break
+		}
+		report.ClientGroups++
+		changed, refs := pruneClientGroup(&cgs[n], live, now, report)
+		if !changed {
+			continue
+		}
+		removed = append(removed, refs...)
+		if len(cgs[n].SiteRTTs) == 0 {
+			delKeys = append(delKeys, keys[n])
+		} else {
+			putKeys = append(putKeys, keys[n])
+			putCGs = append(putCGs, cgs[n])
+			bytes += size
+		}
+	}
+
+	if len(putKeys) > 0 {
+		if err := c.Store().PutMulti(putKeys, putCGs); err != nil {
+			return nil, 0, err
+		}
+		report.Changed = len(putKeys)
+	}
+	if len(delKeys) > 0 {
+		if err := c.Store().DeleteMulti(delKeys); err != nil {
+			return nil, 0, err
+		}
+		report.Deleted = len(delKeys)
+	}
+	if len(removed) > 0 {
+		if err := deleteClientGroupDays(c, removed); err != nil {
+			return nil, 0, err
+		}
+	}
+	return report, n, nil
+}
@@ -0,0 +1,127 @@
+// Copyright 2013 M-Lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rtt
+
+import (
+	"code.google.com/p/mlab-ns2/gae/ns/data"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLiveSites(t *testing.T) {
+	c := newTestContext()
+	// ams01 has no SliverTools, and dfw01 is not a Site.
+	for _, siteID := range []string{"lga01", "ams01"} {
+		if err := c.Store().Put(data.NewKey("Site", siteID, nil), &data.Site{SiteID: siteID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, siteID := range []string{"lga01", "dfw01"} {
+		s := &data.SliverTool{ToolID: "ndt", SliceID: "iupui_ndt", ServerID: "mlab1", SiteID: siteID}
+		key := data.NewKey("SliverTool", data.GetSliverToolID(s.ToolID, s.SliceID, s.ServerID, s.SiteID), nil)
+		if err := c.Store().Put(key, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	live, err := LiveSites(c)
+	if want := map[string]bool{"lga01": true}; err != nil || !reflect.DeepEqual(live, want) {
+		t.Fatalf("LiveSites = %v, %v, want %v", live, err, want)
+	}
+}
+
+func TestPruneClientGroups(t *testing.T) {
+	c := newTestContext()
+	now := time.Unix(1376828167, 0)
+	expired := now.Add(-SiteRTTHorizon - time.Hour)
+	cgSiteRTTs := map[string]SiteRTTs{
+		"24.164.160.0": {NewSiteRTT("lga01", 5, now), NewSiteRTT("ams01", 90, now)}, // Changed
+		"24.164.164.0": {NewSiteRTT("ams01", 90, now)},                              // Deleted
+		"24.164.168.0": {NewSiteRTT("lga01", 5, now)},                               // Unchanged
+		"24.164.172.0": {NewSiteRTT("lga01", 5, expired)},                           // Deleted
+	}
+	for ip, srs := range cgSiteRTTs {
+		cg := NewClientGroup(net.ParseIP(ip))
+		cg.SiteRTTs = srs
+		if err := c.Store().Put(cg.Key(), cg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, _, err := PruneClientGroups(c, nil, now, ""); err != ErrNoLiveSites {
+		t.Fatalf("PruneClientGroups with no live Sites = %v, want %v", err, ErrNoLiveSites)
+	}
+
+	report, next, err := PruneClientGroups(c, map[string]bool{"lga01": true}, now, "")
+	want := &PruneReport{
+		ClientGroups: 4,
+		Changed:      1,
+		Deleted:      2,
+		Retired:      2,
+		Expired:      1,
+		Sites:        map[string]int{"ams01": 2},
+	}
+	if err != nil || next != "" || !reflect.DeepEqual(report, want) {
+		t.Fatalf("PruneClientGroups = %v, %q, %v, want %v", report, next, err, want)
+	}
+
+	for ip, n := range map[string]int{"24.164.160.0": 1, "24.164.164.0": 0, "24.164.168.0": 1, "24.164.172.0": 0} {
+		var cg ClientGroup
+		err := c.Store().Get(ClientGroupKey(GetClientGroup(net.ParseIP(ip))), &cg)
+		if n == 0 && err != data.ErrNoSuchEntity {
+			t.Fatalf("ClientGroup %s: %v, want %v", ip, err, data.ErrNoSuchEntity)
+		}
+		if n > 0 && (err != nil || len(cg.SiteRTTs) != n || cg.SiteRTTs[0].SiteID != "lga01") {
+			t.Fatalf("ClientGroup %s = %v, %v, want [lga01]", ip, cg.SiteRTTs, err)
+		}
+	}
+}
+
+func TestPruneClientGroupsPages(t *testing.T) {
+	defer func(n int) { PruneClientGroupsPage = n }(PruneClientGroupsPage)
+	PruneClientGroupsPage = 2
+
+	c := newTestContext()
+	now := time.Unix(1376828167, 0)
+	for i := 0; i < 5; i++ {
+		cg := NewClientGroup(net.IPv4(24, 164, byte(160+4*i), 0).To4())
+		cg.SiteRTTs = SiteRTTs{NewSiteRTT("lga01", 5, now)}
+		if err := c.Store().Put(cg.Key(), cg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var pages []int
+	start := ""
+	for {
+		report, next, err := PruneClientGroups(c, map[string]bool{"lga01": true}, now, start)
+		if err != nil {
+			t.Fatalf("PruneClientGroups(%q) = %v", start, err)
+		}
+		pages = append(pages, report.ClientGroups)
+		if next == "" {
+			break
+		}
+		if next <= start {
+			t.Fatalf("PruneClientGroups(%q) = next %q, want a later ClientGroup", start, next)
+		}
+		start = next
+	}
+	if want := []int{2, 2, 1}; !reflect.DeepEqual(pages, want) {
+		t.Fatalf("ClientGroups per PruneClientGroups page = %v, want %v", pages, want)
+	}
+}
@@ -0,0 +1,253 @@
+// Copyright 2013 M-Lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rtt
+
+import (
+	"code.google.com/p/mlab-ns2/gae/ns/data"
+	"encoding/json"
+	"errors"
+	"net/url"
+)
+
+// Names of the built-in PutStagings.
+const (
+	PutStagingCache   = "cache"
+	PutStagingStore   = "store"
+	PutStagingPayload = "payload"
+	PutStagingAuto    = "auto"
+)
+
+// MaxPutPayloadBytes is the size of the URL-encoded task payload up to which
+// the auto PutStaging passes put batches in it. Task payloads are limited to
+// 100KB.
+const MaxPutPayloadBytes = 64 << 10
+
+var (
+	ErrPutBatchNotFound  = errors.New("rtt: Staged put batch not found.")
+	ErrUnknownPutStaging = errors.New("rtt: Unknown put staging.")
+)
+
+// PutStaging stores the ClientGroups of a put batch from when its put task
+// is submitted until the task has put them into datastore.
+type PutStaging interface {
+	// Name returns the name with which the PutStaging is registered.
+	Name() string
+
+	// Stage stores cgs for the batch with ID id. It may add form values
+	// to values, which are passed to Load.
+	Stage(c data.Context, id string, cgs []ClientGroup, values url.Values) error
+
+	// Load returns the ClientGroups of a batch, or ErrPutBatchNotFound.
+	Load(c data.Context, id string, values url.Values) ([]ClientGroup, error)
+
+	// Remove removes the ClientGroups of a batch. Removing a batch which
+	// has already been removed is not an error.
+	Remove(c data.Context, id string) error
+}
+
+// putStagings contains the registered PutStagings by name.
+var putStagings = make(map[string]PutStaging)
+
+// RegisterPutStaging registers a PutStaging under its name.
+func RegisterPutStaging(s PutStaging) {
+	putStagings[s.Name()] = s
+}
+
+// GetPutStaging returns the PutStaging registered under name, or
+// ErrUnknownPutStaging.
+func GetPutStaging(name string) (PutStaging, error) {
+	s, ok := putStagings[name]
+	if !ok {
+		return nil, ErrUnknownPutStaging
+	}
+	return s, nil
+}
+
+// ImportPutStaging is the PutStaging used by imports. It should be set during
+// initialization.
+var ImportPutStaging PutStaging
+
+func init() {
+	RegisterPutStaging(cacheStaging{})
+	RegisterPutStaging(storeStaging{})
+	RegisterPutStaging(payloadStaging{})
+	ImportPutStaging = &autoStaging{MaxPutPayloadBytes}
+	RegisterPutStaging(ImportPutStaging)
+}
+
+// stagePutBatch stages cgs using ImportPutStaging and adds the form values
+// with which the put task loads them to values.
+func stagePutBatch(c data.Context, id string, cgs []ClientGroup, values url.Values) error {
+	values.Set(FormKeyPutKey, id)
+	values.Set(FormKeyPutStaging, ImportPutStaging.Name())
+	return ImportPutStaging.Stage(c, id, cgs, values)
+}
+
+// putBatchStaging returns the PutStaging of a put task with form values
+// values. Tasks without a staging were staged in the cache.
+func putBatchStaging(values url.Values) (PutStaging, error) {
+	name := values.Get(FormKeyPutStaging)
+	if name == "" {
+		name = PutStagingCache
+	}
+	return GetPutStaging(name)
+}
+
+// LoadPutBatch returns the ClientGroups of the put task with form values
+// values, or ErrPutBatchNotFound.
+func LoadPutBatch(c data.Context, values url.Values) ([]ClientGroup, error) {
+	s, err := putBatchStaging(values)
+	if err != nil {
+		return nil, err
+	}
+	return s.Load(c, values.Get(FormKeyPutKey), values)
+}
+
+// RemovePutBatch removes the ClientGroups of the put task with form values
+// values once they have been put into datastore.
+func RemovePutBatch(c data.Context, values url.Values) error {
+	s, err := putBatchStaging(values)
+	if err != nil {
+		return err
+	}
+	return s.Remove(c, values.Get(FormKeyPutKey))
+}
+
+// cacheStaging is a PutStaging which stores batches in the cache. Batches may
+// be evicted before they are put.
+type cacheStaging struct{}
+
+func (cacheStaging) Name() string { return PutStagingCache }
+
+func (cacheStaging) Stage(c data.Context, id string, cgs []ClientGroup, values url.Values) error {
+	return c.Cache().Set(id, cgs)
+}
+
+func (cacheStaging) Load(c data.Context, id string, values url.Values) ([]ClientGroup, error) {
+	var cgs []ClientGroup
+	err := c.Cache().Get(id, &cgs)
+	if err == data.ErrCacheMiss {
+		return nil, ErrPutBatchNotFound
+	}
+	return cgs, err
+}
+
+func (cacheStaging) Remove(c data.Context, id string) error {
+	if err := c.Cache().Delete(id); err != nil && err != data.ErrCacheMiss {
+		return err
+	}
+	return nil
+}
+
+// storeStaging is a PutStaging which stores the ClientGroups of a batch as
+// StagedClientGroup entities under a common parent in the Store. They are
+// named as the ClientGroups are in datastore, see ClientGroup.Name.
+type storeStaging struct{}
+
+func (storeStaging) Name() string { return PutStagingStore }
+
+func stagedBatchKey(id string) *data.Key {
+	return data.NewKey("StagedPutBatch", id, DatastoreParentKey())
+}
+
+func (storeStaging) Stage(c data.Context, id string, cgs []ClientGroup, values url.Values) error {
+	parent := stagedBatchKey(id)
+	keys := make([]*data.Key, len(cgs))
+	for i, cg := range cgs {
+		keys[i] = data.NewKey("StagedClientGroup", cg.Name(), parent)
+	}
+	return c.Store().PutMulti(keys, cgs)
+}
+
+func (storeStaging) Load(c data.Context, id string, values url.Values) ([]ClientGroup, error) {
+	q := data.NewQuery("StagedClientGroup").Ancestor(stagedBatchKey(id))
+	var cgs []ClientGroup
+	if _, err := c.Store().GetAll(q, &cgs); err != nil {
+		return nil, err
+	}
+	if len(cgs) == 0 {
+		return nil, ErrPutBatchNotFound
+	}
+	return cgs, nil
+}
+
+func (storeStaging) Remove(c data.Context, id string) error {
+	q := data.NewQuery("StagedClientGroup").Ancestor(stagedBatchKey(id))
+	keys, err := c.Store().GetAll(q, nil)
+	if err != nil {
+		return err
+	}
+	return c.Store().DeleteMulti(keys)
+}
+
+// payloadStaging is a PutStaging which passes batches as JSON in the task
+// payload. It is limited by the maximum task size.
+type payloadStaging struct{}
+
+func (payloadStaging) Name() string { return PutStagingPayload }
+
+func (payloadStaging) Stage(c data.Context, id string, cgs []ClientGroup, values url.Values) error {
+	b, err := json.Marshal(cgs)
+	if err != nil {
+		return err
+	}
+	values.Set(FormKeyPutPayload, string(b))
+	return nil
+}
+
+func (payloadStaging) Load(c data.Context, id string, values url.Values) ([]ClientGroup, error) {
+	payload := values.Get(FormKeyPutPayload)
+	if payload == "" {
+		return nil, ErrPutBatchNotFound
+	}
+	var cgs []ClientGroup
+	if err := json.Unmarshal([]byte(payload), &cgs); err != nil {
+		return nil, err
+	}
+	return cgs, nil
+}
+
+func (payloadStaging) Remove(c data.Context, id string) error { return nil }
+
+// autoStaging is a PutStaging which passes batches in the task payload if the
+// URL-encoded payload, with the other form values of the task, is at most max
+// bytes, and stores them in the Store otherwise.
+type autoStaging struct {
+	max int
+}
+
+func (*autoStaging) Name() string { return PutStagingAuto }
+
+func (s *autoStaging) Stage(c data.Context, id string, cgs []ClientGroup, values url.Values) error {
+	if err := (payloadStaging{}).Stage(c, id, cgs, values); err != nil {
+		return err
+	}
+	if len(values.Encode()) <= s.max {
+		return nil
+	}
+	values.Del(FormKeyPutPayload)
+	return (storeStaging{}).Stage(c, id, cgs, values)
+}
+
+func (s *autoStaging) Load(c data.Context, id string, values url.Values) ([]ClientGroup, error) {
+	if values.Get(FormKeyPutPayload) != "" {
+		return (payloadStaging{}).Load(c, id, values)
+	}
+	return (storeStaging{}).Load(c, id, values)
+}
+
+func (s *autoStaging) Remove(c data.Context, id string) error {
+	return (storeStaging{}).Remove(c, id)
+}
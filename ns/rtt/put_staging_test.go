@@ -0,0 +1,158 @@
+// Copyright 2013 M-Lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rtt
+
+import (
+	"bytes"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// equalClientGroups reports whether a and b contain the same ClientGroups in
+// the same order. SiteRTTs are compared by their minimum RTT, time of update and
+// number of samples.
+func equalClientGroups(a, b []ClientGroup) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i].Prefix, b[i].Prefix) || a[i].ASN != b[i].ASN || len(a[i].SiteRTTs) != len(b[i].SiteRTTs) {
+			return false
+		}
+		for j, sr := range a[i].SiteRTTs {
+			o := b[i].SiteRTTs[j]
+			if sr.SiteID != o.SiteID || sr.RTT != o.RTT || !sr.LastUpdated.Equal(o.LastUpdated) || sr.Samples != o.Samples {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+var putStagingTests = []struct {
+	staging PutStaging
+	removed bool // Whether Load fails after Remove
+}{
+	{cacheStaging{}, true},
+	{storeStaging{}, true},
+	{payloadStaging{}, false},
+	{&autoStaging{MaxPutPayloadBytes}, false}, // Staged in the payload
+	{&autoStaging{1}, true},                   // Staged in the store
+}
+
+func TestPutStaging(t *testing.T) {
+	defer func(s PutStaging) { ImportPutStaging = s }(ImportPutStaging)
+
+	cgs := make([]ClientGroup, 2)
+	for i := range cgs {
+		cg := NewClientGroup(net.IPv4(24, 164, byte(160+i), 0))
+		cg.SiteRTTs = SiteRTTs{
+			NewSiteRTT("lga01", 7.7, time.Unix(1376828167, 0)),
+			NewSiteRTT("ams01", 95.1, time.Unix(1376828167, 0)),
+		}
+		cgs[i] = *cg
+	}
+	for _, tt := range putStagingTests {
+		c := newTestContext()
+		ImportPutStaging = tt.staging
+		values := make(url.Values)
+		if err := stagePutBatch(c, "batch", cgs, values); err != nil {
+			t.Fatalf("%s: stagePutBatch: %v", tt.staging.Name(), err)
+		}
+		got, err := LoadPutBatch(c, values)
+		if err != nil || !equalClientGroups(got, cgs) {
+			t.Fatalf("%s: LoadPutBatch = %v, %v, want %v", tt.staging.Name(), got, err, cgs)
+		}
+
+		// Removing is idempotent.
+		for i := 0; i < 2; i++ {
+			if err := RemovePutBatch(c, values); err != nil {
+				t.Fatalf("%s: RemovePutBatch: %v", tt.staging.Name(), err)
+			}
+		}
+		_, err = LoadPutBatch(c, values)
+		if tt.removed && err != ErrPutBatchNotFound {
+			t.Fatalf("%s: LoadPutBatch after RemovePutBatch = %v, want %v", tt.staging.Name(), err, ErrPutBatchNotFound)
+		}
+	}
+}
+
+// ClientGroups of ASes, which have no Prefix, and of announced prefixes
+// which differ only by their length are staged separately.
+func TestStoreStagingKeysByName(t *testing.T) {
+	prefix := []byte(net.IPv4(24, 164, 160, 0).To4())
+	cgs := []ClientGroup{
+		{ASN: 7018, SiteRTTs: SiteRTTs{NewSiteRTT("lga01", 7.7, time.Unix(1376828167, 0))}},
+		{ASN: 3320, SiteRTTs: SiteRTTs{NewSiteRTT("ams01", 95.1, time.Unix(1376828167, 0))}},
+		{Prefix: prefix, PrefixLen: 22, SiteRTTs: SiteRTTs{NewSiteRTT("lga01", 7.7, time.Unix(1376828167, 0))}},
+		{Prefix: prefix, PrefixLen: 20, SiteRTTs: SiteRTTs{NewSiteRTT("ams01", 95.1, time.Unix(1376828167, 0))}},
+	}
+	c := newTestContext()
+	if err := (storeStaging{}).Stage(c, "batch", cgs, make(url.Values)); err != nil {
+		t.Fatalf("storeStaging.Stage: %v", err)
+	}
+	got, err := (storeStaging{}).Load(c, "batch", nil)
+	if err != nil || len(got) != len(cgs) {
+		t.Fatalf("storeStaging.Load = %v, %v, want %v", got, err, cgs)
+	}
+	byName := make(map[string]ClientGroup)
+	for _, cg := range got {
+		byName[cg.Name()] = cg
+	}
+	for _, cg := range cgs {
+		if g, ok := byName[cg.Name()]; !ok || !equalClientGroups([]ClientGroup{g}, []ClientGroup{cg}) || g.PrefixLen != cg.PrefixLen {
+			t.Fatalf("storeStaging.Load = %v, want %v", got, cgs)
+		}
+	}
+}
+
+// The auto PutStaging compares the size of the URL-encoded task payload, which
+// is larger than the JSON of the batch, with its maximum.
+func TestAutoStagingEncodedSize(t *testing.T) {
+	c := newTestContext()
+	cgs := []ClientGroup{*NewClientGroup(net.ParseIP("24.164.160.0"))}
+	values := make(url.Values)
+	if err := (payloadStaging{}).Stage(c, "batch", cgs, values); err != nil {
+		t.Fatal(err)
+	}
+	max := len(values.Get(FormKeyPutPayload))
+	values = make(url.Values)
+	if err := (&autoStaging{max}).Stage(c, "batch", cgs, values); err != nil {
+		t.Fatalf("autoStaging.Stage: %v", err)
+	}
+	if values.Get(FormKeyPutPayload) != "" {
+		t.Fatalf("autoStaging{%d}.Stage: staged %d bytes in the payload, want the store", max, len(values.Encode()))
+	}
+	if got, err := (storeStaging{}).Load(c, "batch", values); err != nil || !equalClientGroups(got, cgs) {
+		t.Fatalf("storeStaging.Load = %v, %v, want %v", got, err, cgs)
+	}
+}
+
+func TestLoadPutBatchDefaultsToCache(t *testing.T) {
+	c := newTestContext()
+	cgs := []ClientGroup{*NewClientGroup(net.ParseIP("24.164.160.0"))}
+	if err := c.Cache().Set("batch", cgs); err != nil {
+		t.Fatal(err)
+	}
+	got, err := LoadPutBatch(c, url.Values{FormKeyPutKey: {"batch"}})
+	if err != nil || !equalClientGroups(got, cgs) {
+		t.Fatalf("LoadPutBatch without staging = %v, %v, want %v", got, err, cgs)
+	}
+	if _, err := LoadPutBatch(c, url.Values{FormKeyPutKey: {"batch"}, FormKeyPutStaging: {"bogus"}}); err != ErrUnknownPutStaging {
+		t.Fatalf("LoadPutBatch with unknown staging = %v, want %v", err, ErrUnknownPutStaging)
+	}
+}
@@ -0,0 +1,483 @@
+// Copyright 2013 M-Lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rtt
+
+import (
+	"bufio"
+	"code.google.com/p/mlab-ns2/gae/ns/data"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Names of the fields read by file RowSources. They match the columns selected
+// by bqQueryFormat.
+const (
+	FieldLogTime  = "log_time"  // Unix time in seconds
+	FieldServerIP = "server_ip" // M-Lab server IP
+	FieldDestIP   = "dest_ip"   // Traceroute hop IP, towards the client
+	FieldRTT      = "rtt"       // RTT in ms
+
+	// MaxFileRowsPerPage is the number of rows returned by each call to
+	// Next on file RowSources.
+	MaxFileRowsPerPage = 50000
+)
+
+var (
+	ErrUnknownRowFormat = errors.New("rtt: Unknown row file format.")
+	ErrNoRowFile        = errors.New("rtt: No row file found for date.")
+	ErrRowsUnresolved   = errors.New("rtt: No sliver IP of the import resolved to a Site.")
+)
+
+// RowSource provides the RTT data of an import in pages of Rows.
+type RowSource interface {
+	// Next returns the next page of Rows. It returns io.EOF once there are
+	// no more Rows.
+	Next() (Rows, error)
+
+	// Close stops the reading of Rows, including any reading ahead, and
+	// releases the resources of the RowSource. Next must not be called
+	// after Close.
+	Close() error
+}
+
+// ImportDay reads all Rows from src, merges them into ClientGroups and merges
+// those with existing data in datastore. The ImportReport of the import is
+// stored for date t and returned.
+//
+// If src is a Checkpointer, ClientGroups are merged with datastore every
+// ImportCheckpointPages pages and an ImportCheckpoint is saved, from which a
+// failed import of the same day resumes. The import fails if an
+// ImportCheckpoint can't be saved, so that it resumes from the previous one,
+// or if src can't resume from it, so that it starts anew. An import none of
+// whose Rows resolve to a Site fails with ErrRowsUnresolved rather than
+// completing without data.
+//
+// Pages of src are read ahead, see ImportParallelism, along with the
+// geolocations of their destinations by which Rows are filtered. src is
+// closed once the import returns, which stops any reading ahead.
+//
+// The progress of the import is recorded in the ImportRecord for date t.
+func ImportDay(c data.Context, src RowSource, t time.Time) (*ImportReport, error) {
+	report, err := importDay(c, src, t)
+	if err != nil {
+		if err := SetImportState(c, t, ImportStateFailed, err); err != nil {
+			c.Errorf("rtt.ImportDay:SetImportState: %s", err)
+		}
+		return nil, err
+	}
+	return report, nil
+}
+
+// newImportResolvers returns the SliverIPResolver by which an import resolves
+// the Sites of Rows, and the rowFilterer of ImportRowFilter by which it
+// rejects Rows. Sliver IPs are resolved by their history, and at times before
+// their history by the current SliverTools. See SliverIPHistory.
+func newImportResolvers(c data.Context) (SliverIPResolver, *rowFilterer, error) {
+	sliverIPs, err := GetSliverIPHistory(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	sliverTools, err := data.GetSliverTools(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	sliverIPs.Fallback = SliverIPMap(makeMapIPStrToSiteID(sliverTools))
+	filterer, err := newRowFilterer(c, ImportRowFilter, sliverIPs)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sliverIPs, filterer, nil
+}
+
+func importDay(c data.Context, src RowSource, t time.Time) (*ImportReport, error) {
+	dateStr := t.Format(DateFormat)
+
+	sliverIPs, filterer, err := newImportResolvers(c)
+	if err != nil {
+		src.Close()
+		return nil, err
+	}
+	src = NewPrefetchRowSource(filterer.locating(src), ImportParallelism)
+	defer src.Close()
+
+	report := &ImportReport{Date: dateStr}
+	ic := ImportContribution{Date: dateStr}
+	cpr, checkpointed := src.(Checkpointer)
+	resumed := false
+	if checkpointed {
+		cp, err := GetImportCheckpoint(c, t)
+		switch err {
+		case nil:
+			if err := cpr.Resume(cp.Source); err != nil {
+				return nil, err
+			}
+			report = &cp.Report
+			ic.Run, ic.Flush = cp.Run, cp.Flushes
+			resumed = true
+			c.Infof("rtt: Resuming import of %s from row %d. (%s)", dateStr, cp.Source.Rows, report)
+		case data.ErrNoSuchEntity:
+		default:
+			return nil, err
+		}
+	}
+
+	// Put batches of a previous attempt are not counted by a new import.
+	if !resumed {
+		if err := clearImportBatches(c, dateStr); err != nil {
+			return nil, err
+		}
+	}
+	// The contribution of a new run replaces that of previous runs.
+	if ic.Run == "" {
+		ic.Run = newImportRun()
+		if err := startImportRun(c, t, ic.Run); err != nil {
+			return nil, err
+		}
+	}
+	if err := SetImportState(c, t, ImportStateQuerying, nil); err != nil {
+		c.Errorf("rtt.ImportDay:SetImportState: %s", err)
+	}
+
+	newCGs := make(map[string]*ClientGroup)
+	pages := 0
+	for {
+		rows, err := src.Next()
+		if err == io.EOF {
+			break
+		}
+		if err == ErrCheckpointUnavailable {
+			// The import is started anew by its next attempt, whose
+			// run replaces the contribution of this one.
+			if err := DeleteImportCheckpoint(c, t); err != nil {
+				c.Errorf("rtt.ImportDay:DeleteImportCheckpoint: %s", err)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		report.Rows += len(rows)
+		pages++
+		c.Infof("rtt: Received %d rows. (Total: %d rows)", len(rows), report.Rows)
+		rows = filterer.filter(rows, report)
+		bqMergeIntoClientGroups(rows, sliverIPs, newCGs)
+
+		if checkpointed && pages%ImportCheckpointPages == 0 {
+			report.add(bqMergeWithDatastore(c, ic, newCGs))
+			newCGs = make(map[string]*ClientGroup)
+			ic.Flush++
+			cp := &ImportCheckpoint{
+				Date:    dateStr,
+				Run:     ic.Run,
+				Flushes: ic.Flush,
+				Source:  cpr.Checkpoint(),
+				Report:  *report,
+			}
+			if err := PutImportCheckpoint(c, cp); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if report.Rows > 0 && report.Unresolved == report.Rows {
+		// Nothing was merged. The import is started anew by its next
+		// attempt, once the sliver IPs are known.
+		if checkpointed {
+			if err := DeleteImportCheckpoint(c, t); err != nil {
+				c.Errorf("rtt.ImportDay:DeleteImportCheckpoint: %s", err)
+			}
+		}
+		return nil, ErrRowsUnresolved
+	}
+	report.add(bqMergeWithDatastore(c, ic, newCGs))
+	if err := PutImportReport(c, report); err != nil {
+		c.Errorf("rtt.ImportDay:PutImportReport: %s", err)
+	}
+	if checkpointed {
+		if err := DeleteImportCheckpoint(c, t); err != nil {
+			c.Errorf("rtt.ImportDay:DeleteImportCheckpoint: %s", err)
+		}
+	}
+	if err := finishImportRecord(c, report); err != nil {
+		c.Errorf("rtt.ImportDay:finishImportRecord: %s", err)
+	}
+	return report, nil
+}
+
+// newRow parses the string values of a row. It returns nil if any value is
+// invalid, as in simplifyBQResponse.
+func newRow(logTime, serverIP, destIP, rtt string) *Row {
+	row := &Row{
+		ServerIP: net.ParseIP(serverIP),
+		ClientIP: net.ParseIP(destIP),
+	}
+	if row.ServerIP == nil || row.ClientIP == nil {
+		return nil
+	}
+	var err error
+	row.RTT, err = strconv.ParseFloat(rtt, 64)
+	if err != nil {
+		return nil
+	}
+	sec, err := strconv.ParseInt(logTime, 10, 64)
+	if err != nil {
+		return nil
+	}
+	row.LastUpdated = time.Unix(sec, 0)
+	return row
+}
+
+// ndjsonRowSource is a RowSource reading newline delimited JSON objects, as
+// exported by BigQuery.
+type ndjsonRowSource struct {
+	dec  *json.Decoder
+	rows int // Records consumed
+	skip int // Records to skip when resuming
+}
+
+// NewNDJSONRowSource returns a RowSource which reads newline delimited JSON
+// objects with the fields log_time, server_ip, dest_ip and rtt from r. Values
+// may be JSON strings or numbers.
+func NewNDJSONRowSource(r io.Reader) RowSource {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	dec.UseNumber()
+	return &ndjsonRowSource{dec: dec}
+}
+
+// jsonString returns a JSON string or number value as a string.
+func jsonString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	}
+	return ""
+}
+
+func (s *ndjsonRowSource) Next() (Rows, error) {
+	rows := make(Rows, 0)
+	for len(rows) < MaxFileRowsPerPage {
+		var obj map[string]interface{}
+		err := s.dec.Decode(&obj)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		s.rows++
+		if s.rows <= s.skip {
+			continue
+		}
+		row := newRow(jsonString(obj[FieldLogTime]), jsonString(obj[FieldServerIP]),
+			jsonString(obj[FieldDestIP]), jsonString(obj[FieldRTT]))
+		if row != nil {
+			rows = append(rows, row)
+		}
+	}
+	if len(rows) == 0 {
+		return nil, io.EOF
+	}
+	return rows, nil
+}
+
+func (s *ndjsonRowSource) Close() error { return nil }
+
+func (s *ndjsonRowSource) Checkpoint() RowCheckpoint {
+	return RowCheckpoint{Rows: s.rows}
+}
+
+func (s *ndjsonRowSource) Resume(cp RowCheckpoint) error {
+	s.skip = cp.Rows
+	return nil
+}
+
+// csvRowSource is a RowSource reading CSV with a header line.
+type csvRowSource struct {
+	r      *csv.Reader
+	fields []int // Column index of log_time, server_ip, dest_ip and rtt
+	rows   int   // Records consumed, excluding the header
+	skip   int   // Records to skip when resuming
+}
+
+// NewCSVRowSource returns a RowSource which reads CSV from r. The first line
+// must be a header naming the columns, which must include log_time,
+// server_ip, dest_ip and rtt. The BigQuery export names such as
+// connection_spec_server_ip are also accepted.
+func NewCSVRowSource(r io.Reader) RowSource {
+	cr := csv.NewReader(bufio.NewReader(r))
+	cr.FieldsPerRecord = -1
+	return &csvRowSource{r: cr}
+}
+
+// readHeader reads the header line and finds the columns of each field.
+func (s *csvRowSource) readHeader() error {
+	header, err := s.r.Read()
+	if err != nil {
+		return err
+	}
+	names := []string{FieldLogTime, FieldServerIP, FieldDestIP, FieldRTT}
+	s.fields = make([]int, len(names))
+	for i, name := range names {
+		s.fields[i] = -1
+		for col, h := range header {
+			h = strings.TrimSpace(h)
+			if h == name || strings.HasSuffix(h, "_"+name) {
+				s.fields[i] = col
+				break
+			}
+		}
+		if s.fields[i] < 0 {
+			return fmt.Errorf("rtt: CSV header has no %s column", name)
+		}
+	}
+	return nil
+}
+
+func (s *csvRowSource) Next() (Rows, error) {
+	if s.fields == nil {
+		if err := s.readHeader(); err != nil {
+			return nil, err
+		}
+	}
+
+	rows := make(Rows, 0)
+	for len(rows) < MaxFileRowsPerPage {
+		record, err := s.r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		s.rows++
+		if s.rows <= s.skip {
+			continue
+		}
+		v := make([]string, len(s.fields))
+		for i, col := range s.fields {
+			if col < len(record) {
+				v[i] = strings.TrimSpace(record[col])
+			}
+		}
+		if row := newRow(v[0], v[1], v[2], v[3]); row != nil {
+			rows = append(rows, row)
+		}
+	}
+	if len(rows) == 0 {
+		return nil, io.EOF
+	}
+	return rows, nil
+}
+
+func (s *csvRowSource) Close() error { return nil }
+
+func (s *csvRowSource) Checkpoint() RowCheckpoint {
+	return RowCheckpoint{Rows: s.rows}
+}
+
+func (s *csvRowSource) Resume(cp RowCheckpoint) error {
+	s.skip = cp.Rows
+	return nil
+}
+
+// fileRowSource is a RowSource reading from a file, which must be closed.
+type fileRowSource struct {
+	RowSource
+	closers []io.Closer
+}
+
+func (s *fileRowSource) Checkpoint() RowCheckpoint {
+	return s.RowSource.(Checkpointer).Checkpoint()
+}
+
+func (s *fileRowSource) Resume(cp RowCheckpoint) error {
+	return s.RowSource.(Checkpointer).Resume(cp)
+}
+
+func (s *fileRowSource) Close() error {
+	var err error
+	for i := len(s.closers) - 1; i >= 0; i-- {
+		if e := s.closers[i].Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// OpenRowFile returns a RowSource reading from the file at path, whose format
+// is determined by its extension: .ndjson or .json for newline delimited
+// JSON, or .csv, optionally followed by .gz if gzip compressed. The returned
+// io.Closer must be closed once the RowSource has been read.
+func OpenRowFile(path string) (RowSource, io.Closer, error) {
+	name := path
+	gzipped := strings.HasSuffix(name, ".gz")
+	if gzipped {
+		name = strings.TrimSuffix(name, ".gz")
+	}
+	var newSource func(io.Reader) RowSource
+	switch filepath.Ext(name) {
+	case ".ndjson", ".json":
+		newSource = NewNDJSONRowSource
+	case ".csv":
+		newSource = NewCSVRowSource
+	default:
+		return nil, nil, ErrUnknownRowFormat
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	src := &fileRowSource{closers: []io.Closer{f}}
+	var r io.Reader = f
+	if gzipped {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		src.closers = append(src.closers, gz)
+		r = gz
+	}
+	src.RowSource = newSource(r)
+	return src, src, nil
+}
+
+// FindRowFile returns the path of the row file for date t in dir, named by
+// the date and a file extension supported by OpenRowFile, e.g.,
+// 2013-08-18.csv.gz.
+func FindRowFile(dir string, t time.Time) (string, error) {
+	dateStr := t.Format(DateFormat)
+	for _, ext := range []string{".ndjson", ".json", ".csv"} {
+		for _, gz := range []string{"", ".gz"} {
+			path := filepath.Join(dir, dateStr+ext+gz)
+			if _, err := os.Stat(path); err == nil {
+				return path, nil
+			}
+		}
+	}
+	return "", ErrNoRowFile
+}
@@ -0,0 +1,225 @@
+// Copyright 2013 M-Lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rtt
+
+import (
+	"errors"
+	"io"
+)
+
+// errRowSourceClosed is returned by the Next of a closed RowSource.
+var errRowSourceClosed = errors.New("rtt: RowSource closed.")
+
+// ImportParallelism is the number of pages of Rows which are fetched ahead of
+// and concurrently with the merging of Rows into ClientGroups during an
+// import. It bounds the number of pages held in memory. It should be set
+// during initialization.
+var ImportParallelism = 4
+
+// page is a page of Rows or the error which occurred when fetching it, and
+// the RowCheckpoint of its RowSource after it was read.
+type page struct {
+	rows Rows
+	err  error
+	cp   RowCheckpoint
+}
+
+// prefetchRowSource is a RowSource which reads pages from another RowSource
+// ahead of calls to Next.
+type prefetchRowSource struct {
+	src   RowSource
+	depth int
+	pages chan page
+	quit  chan struct{} // Closed once err is set
+	cp    RowCheckpoint // Checkpoint after the last page returned
+	err   error
+}
+
+// NewPrefetchRowSource returns a RowSource which reads up to depth pages from
+// src ahead of calls to Next, so that src can be read while the previous page
+// is processed. Pages are returned in the order read from src. Reading starts
+// on the first call to Next. If src is a Checkpointer, so is the returned
+// RowSource.
+func NewPrefetchRowSource(src RowSource, depth int) RowSource {
+	if depth < 1 {
+		depth = 1
+	}
+	s := &prefetchRowSource{
+		src:   src,
+		depth: depth,
+		quit:  make(chan struct{}),
+	}
+	if _, ok := src.(Checkpointer); ok {
+		return checkpointPrefetchRowSource{s}
+	}
+	return s
+}
+
+// start starts reading pages from s.src.
+func (s *prefetchRowSource) start() {
+	s.pages = make(chan page, s.depth-1)
+	cpr, _ := s.src.(Checkpointer)
+	go func() {
+		defer close(s.pages)
+		for {
+			select {
+			case <-s.quit:
+				return
+			default:
+			}
+			p := page{}
+			p.rows, p.err = s.src.Next()
+			if cpr != nil {
+				p.cp = cpr.Checkpoint()
+			}
+			select {
+			case s.pages <- p:
+			case <-s.quit:
+				return
+			}
+			if p.err != nil {
+				return
+			}
+		}
+	}()
+}
+
+func (s *prefetchRowSource) Next() (Rows, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	if s.pages == nil {
+		s.start()
+	}
+	p, ok := <-s.pages
+	if !ok {
+		p.err = io.EOF
+	}
+	if p.err != nil {
+		s.err = p.err
+		close(s.quit)
+		return p.rows, p.err
+	}
+	s.cp = p.cp
+	return p.rows, nil
+}
+
+// Close stops reading ahead and closes the source RowSource once the page
+// being read from it, if any, has been read.
+func (s *prefetchRowSource) Close() error {
+	if s.err == nil {
+		s.err = errRowSourceClosed
+		close(s.quit)
+	}
+	if s.pages != nil {
+		for _ = range s.pages {
+		}
+	}
+	return s.src.Close()
+}
+
+// checkpointPrefetchRowSource is a prefetchRowSource whose source RowSource
+// is a Checkpointer.
+type checkpointPrefetchRowSource struct {
+	*prefetchRowSource
+}
+
+// Checkpoint returns the RowCheckpoint of the source RowSource after the last
+// page returned by Next, regardless of how many pages have been read ahead.
+func (s checkpointPrefetchRowSource) Checkpoint() RowCheckpoint {
+	return s.cp
+}
+
+func (s checkpointPrefetchRowSource) Resume(cp RowCheckpoint) error {
+	if err := s.src.(Checkpointer).Resume(cp); err != nil {
+		return err
+	}
+	s.cp = cp
+	return nil
+}
+
+// pageFunc fetches the page of Rows with index i.
+type pageFunc func(i int) (Rows, error)
+
+// parallelRowSource is a RowSource which fetches a known number of pages
+// concurrently and returns them in order.
+type parallelRowSource struct {
+	results []chan page
+	sem     chan struct{}
+	quit    chan struct{} // Closed once err is set
+	next    int
+	err     error
+}
+
+// newParallelRowSource returns a RowSource which returns the pages 0 to n-1
+// fetched by fetch in order. Up to parallelism pages are fetched concurrently
+// ahead of calls to Next.
+func newParallelRowSource(n, parallelism int, fetch pageFunc) RowSource {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	s := &parallelRowSource{
+		results: make([]chan page, n),
+		sem:     make(chan struct{}, parallelism),
+		quit:    make(chan struct{}),
+	}
+	for i := range s.results {
+		s.results[i] = make(chan page, 1)
+	}
+	go func() {
+		for i := 0; i < n; i++ {
+			// Wait until fewer than parallelism pages are pending.
+			select {
+			case s.sem <- struct{}{}:
+			case <-s.quit:
+				return
+			}
+			go func(i int, result chan<- page) {
+				rows, err := fetch(i)
+				result <- page{rows: rows, err: err}
+			}(i, s.results[i])
+		}
+	}()
+	return s
+}
+
+func (s *parallelRowSource) Next() (Rows, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	if s.next == len(s.results) {
+		s.err = io.EOF
+		close(s.quit)
+		return nil, s.err
+	}
+	p := <-s.results[s.next]
+	<-s.sem
+	s.results[s.next] = nil // mark for GC
+	s.next++
+	if p.err != nil {
+		s.err = p.err
+		close(s.quit)
+	}
+	return p.rows, p.err
+}
+
+// Close stops fetching pages. Pages being fetched are discarded once fetched.
+func (s *parallelRowSource) Close() error {
+	if s.err == nil {
+		s.err = errRowSourceClosed
+		close(s.quit)
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+// Copyright 2013 M-Lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rtt
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testPage returns a page of one Row identifying page i.
+func testPage(i int) Rows {
+	return Rows{&Row{time.Unix(int64(i), 0), net.IPv4(1, 2, 3, 4), net.IPv4(10, 0, byte(i), 1), float64(i)}}
+}
+
+// testPagesRowSource is a RowSource returning n test pages.
+type testPagesRowSource struct {
+	i, n   int
+	closed bool
+}
+
+func (s *testPagesRowSource) Next() (Rows, error) {
+	if s.i == s.n {
+		return nil, io.EOF
+	}
+	s.i++
+	return testPage(s.i - 1), nil
+}
+
+func (s *testPagesRowSource) Close() error {
+	s.closed = true
+	return nil
+}
+
+func testAllPages(n int) Rows {
+	var rows Rows
+	for i := 0; i < n; i++ {
+		rows = append(rows, testPage(i)...)
+	}
+	return rows
+}
+
+func TestPrefetchRowSource(t *testing.T) {
+	for _, depth := range []int{0, 1, 3, 20} {
+		rows, err := readAllRows(NewPrefetchRowSource(&testPagesRowSource{n: 10}, depth))
+		if err != nil || !reflect.DeepEqual(rows, testAllPages(10)) {
+			t.Fatalf("PrefetchRowSource(depth %d) = %v, %v, want %v", depth, rows, err, testAllPages(10))
+		}
+	}
+}
+
+// A prefetchRowSource closed before its source is exhausted stops reading it
+// ahead and closes it.
+func TestPrefetchRowSourceClose(t *testing.T) {
+	const depth = 3
+	src := &testPagesRowSource{n: 1000}
+	s := NewPrefetchRowSource(src, depth)
+	if _, err := s.Next(); err != nil {
+		t.Fatalf("PrefetchRowSource.Next() = %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("PrefetchRowSource.Close() = %v", err)
+	}
+	if !src.closed || src.i > depth+2 {
+		t.Fatalf("PrefetchRowSource.Close(): source closed %v after %d pages, want closed after <= %d", src.closed, src.i, depth+2)
+	}
+	if _, err := s.Next(); err != errRowSourceClosed {
+		t.Fatalf("PrefetchRowSource.Next() after Close = %v, want %v", err, errRowSourceClosed)
+	}
+}
+
+func TestParallelRowSource(t *testing.T) {
+	const n, parallelism = 50, 4
+	var mu sync.Mutex
+	var pending, maxPending int
+	fetch := func(i int) (Rows, error) {
+		mu.Lock()
+		pending++
+		if pending > maxPending {
+			maxPending = pending
+		}
+		mu.Unlock()
+		time.Sleep(time.Duration(rand.Intn(1000)) * time.Microsecond) // Complete out of order
+		mu.Lock()
+		pending--
+		mu.Unlock()
+		return testPage(i), nil
+	}
+
+	rows, err := readAllRows(newParallelRowSource(n, parallelism, fetch))
+	if err != nil || !reflect.DeepEqual(rows, testAllPages(n)) {
+		t.Fatalf("parallelRowSource = %v, %v, want %v", rows, err, testAllPages(n))
+	}
+	if maxPending > parallelism {
+		t.Fatalf("parallelRowSource fetched %d pages concurrently, want <= %d", maxPending, parallelism)
+	}
+
+	// ClientGroups built from the pages must not depend on fetch order.
+	want := make(map[string]*ClientGroup)
+	bqMergeIntoClientGroups(testAllPages(n), SliverIPMap{"1.2.3.4": "abc01"}, want)
+	got := make(map[string]*ClientGroup)
+	src := newParallelRowSource(n, parallelism, fetch)
+	for {
+		rows, err := src.Next()
+		if err == io.EOF {
+			break
+		}
+		bqMergeIntoClientGroups(rows, SliverIPMap{"1.2.3.4": "abc01"}, got)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("parallelRowSource ClientGroups = %v, want %v", got, want)
+	}
+}
+
+func TestParallelRowSourceError(t *testing.T) {
+	errPage := errors.New("page error")
+	fetch := func(i int) (Rows, error) {
+		if i == 2 {
+			return nil, errPage
+		}
+		return testPage(i), nil
+	}
+	src := newParallelRowSource(10, 3, fetch)
+	for i := 0; i < 2; i++ {
+		if _, err := src.Next(); err != nil {
+			t.Fatalf("parallelRowSource.Next() (page %d) = %v", i, err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := src.Next(); err != errPage {
+			t.Fatalf("parallelRowSource.Next() = %v, want %v", err, errPage)
+		}
+	}
+}
+
+func TestParallelRowSourceClose(t *testing.T) {
+	src := newParallelRowSource(10, 3, func(i int) (Rows, error) { return testPage(i), nil })
+	if _, err := src.Next(); err != nil {
+		t.Fatalf("parallelRowSource.Next() = %v", err)
+	}
+	for i := 0; i < 2; i++ { // Closing is idempotent
+		if err := src.Close(); err != nil {
+			t.Fatalf("parallelRowSource.Close() = %v", err)
+		}
+	}
+	if _, err := src.Next(); err != errRowSourceClosed {
+		t.Fatalf("parallelRowSource.Next() after Close = %v, want %v", err, errRowSourceClosed)
+	}
+}
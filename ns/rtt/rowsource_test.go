@@ -0,0 +1,194 @@
+// Copyright 2013 M-Lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rtt
+
+import (
+	"bytes"
+	"code.google.com/p/mlab-ns2/gae/ns/data"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testRows are the valid rows in testNDJSON and testCSV.
+var testRows = Rows{
+	&Row{time.Unix(1376828118, 0), net.ParseIP("74.63.50.43"), net.ParseIP("154.54.36.18"), 761.5423380533854},
+	&Row{time.Unix(1376828646, 0), net.ParseIP("82.116.199.38"), net.ParseIP("154.54.39.18"), 62.007999420166016},
+}
+
+const testNDJSON = `{"log_time":"1376828118","server_ip":"74.63.50.43","dest_ip":"154.54.36.18","rtt":"761.5423380533854"}
+{"log_time":"1376828200","server_ip":"invalid","dest_ip":"154.54.36.18","rtt":"1"}
+{"log_time":1376828646,"server_ip":"82.116.199.38","dest_ip":"154.54.39.18","rtt":62.007999420166016}
+`
+
+const testCSV = `log_time,connection_spec_server_ip,paris_traceroute_hop_dest_ip,rtt
+1376828118,74.63.50.43,154.54.36.18,761.5423380533854
+1376828200,74.63.50.43,154.54.36.18,
+1376828646,82.116.199.38,154.54.39.18,62.007999420166016
+`
+
+// readAllRows reads all Rows from src.
+func readAllRows(src RowSource) (Rows, error) {
+	var all Rows
+	for {
+		rows, err := src.Next()
+		if err == io.EOF {
+			return all, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, rows...)
+	}
+}
+
+var rowSourceTests = []struct {
+	name      string
+	newSource func(io.Reader) RowSource
+	content   string
+}{
+	{"NDJSON", NewNDJSONRowSource, testNDJSON},
+	{"CSV", NewCSVRowSource, testCSV},
+}
+
+func TestRowSources(t *testing.T) {
+	for _, tt := range rowSourceTests {
+		rows, err := readAllRows(tt.newSource(bytes.NewBufferString(tt.content)))
+		if err != nil {
+			t.Fatalf("%s RowSource: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(rows, testRows) {
+			t.Fatalf("%s RowSource = %v, want %v", tt.name, rows, testRows)
+		}
+	}
+}
+
+func TestRowSourcesResume(t *testing.T) {
+	for _, tt := range rowSourceTests {
+		// Skip the first valid and the invalid record.
+		src := tt.newSource(bytes.NewBufferString(tt.content))
+		if err := src.(Checkpointer).Resume(RowCheckpoint{Rows: 2}); err != nil {
+			t.Fatalf("%s RowSource.Resume: %v", tt.name, err)
+		}
+		rows, err := readAllRows(src)
+		if err != nil {
+			t.Fatalf("%s RowSource: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(rows, testRows[1:]) {
+			t.Fatalf("%s RowSource = %v, want %v", tt.name, rows, testRows[1:])
+		}
+		if cp := src.(Checkpointer).Checkpoint(); cp.Rows != 3 {
+			t.Fatalf("%s RowSource.Checkpoint().Rows = %d, want 3", tt.name, cp.Rows)
+		}
+	}
+}
+
+func TestCSVRowSourceMissingColumn(t *testing.T) {
+	src := NewCSVRowSource(bytes.NewBufferString("log_time,server_ip,rtt\n"))
+	if _, err := src.Next(); err == nil || err == io.EOF {
+		t.Fatalf("CSV RowSource without dest_ip = %v, want error", err)
+	}
+}
+
+// writeRowFile writes content into a file in dir, gzip compressing it if name
+// ends with .gz.
+func writeRowFile(t *testing.T, dir, name, content string) {
+	var buf bytes.Buffer
+	if filepath.Ext(name) == ".gz" {
+		gz := gzip.NewWriter(&buf)
+		gz.Write([]byte(content))
+		gz.Close()
+	} else {
+		buf.WriteString(content)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name), buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+var openRowFileTests = []struct {
+	name    string
+	content string
+	err     error
+}{
+	{"2013-08-18.ndjson", testNDJSON, nil},
+	{"2013-08-19.json.gz", testNDJSON, nil},
+	{"2013-08-20.csv", testCSV, nil},
+	{"2013-08-21.csv.gz", testCSV, nil},
+	{"2013-08-22.tsv", testCSV, ErrUnknownRowFormat},
+}
+
+func TestOpenRowFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rtt-rows")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tt := range openRowFileTests {
+		writeRowFile(t, dir, tt.name, tt.content)
+		date, _ := time.Parse(DateFormat, tt.name[:len(DateFormat)])
+		path, err := FindRowFile(dir, date)
+		if tt.err != nil {
+			if err != ErrNoRowFile {
+				t.Fatalf("FindRowFile(%s) = %v, want %v", tt.name, err, ErrNoRowFile)
+			}
+			path = filepath.Join(dir, tt.name)
+		} else if err != nil || path != filepath.Join(dir, tt.name) {
+			t.Fatalf("FindRowFile(%s) = %q, %v", tt.name, path, err)
+		}
+
+		src, closer, err := OpenRowFile(path)
+		if err != tt.err {
+			t.Fatalf("OpenRowFile(%s) = %v, want %v", tt.name, err, tt.err)
+		}
+		if err != nil {
+			continue
+		}
+		rows, err := readAllRows(src)
+		closer.Close()
+		if err != nil || !reflect.DeepEqual(rows, testRows) {
+			t.Fatalf("OpenRowFile(%s) read %v, %v, want %v", tt.name, rows, err, testRows)
+		}
+	}
+}
+
+func TestImportDay(t *testing.T) {
+	c := newTestImportContext(false)
+	recordTestSliverIPs(t, c,
+		&data.SliverTool{ToolID: "ndt", SiteID: "lga01", ServerID: "mlab1", SliverIPv4: "74.63.50.43"},
+		&data.SliverTool{ToolID: "ndt", SiteID: "lca01", ServerID: "mlab1", SliverIPv4: "82.116.199.38"},
+	)
+
+	date := time.Date(2013, 8, 18, 0, 0, 0, 0, time.UTC)
+	report, err := ImportDay(c, NewCSVRowSource(bytes.NewBufferString(testCSV)), date)
+	if err != nil {
+		t.Fatalf("ImportDay: %v", err)
+	}
+	want := &ImportReport{Date: "2013-08-18", Input: 1, New: 1, Chunks: 1, Rows: 2, Batches: 1}
+	if !reflect.DeepEqual(report, want) {
+		t.Fatalf("ImportDay = %s, want %s", report, want)
+	}
+	stored, err := GetImportReport(c, date)
+	if err != nil || !reflect.DeepEqual(stored, want) {
+		t.Fatalf("GetImportReport = %v, %v, want %s", stored, err, want)
+	}
+}
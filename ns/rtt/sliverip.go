@@ -0,0 +1,340 @@
+// Copyright 2013 M-Lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rtt
+
+import (
+	"code.google.com/p/mlab-ns2/gae/ns/data"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidSliverIPInterval = errors.New("rtt: Invalid sliver IP interval.")
+	ErrSliverIPOverlap         = errors.New("rtt: Sliver IP intervals overlap.")
+)
+
+// SliverIPResolver resolves the sliver IP of a Row to the ID of the Site which
+// the IP was assigned to when the Row was logged.
+type SliverIPResolver interface {
+	// SiteID returns the ID of the Site which ip was assigned to at time t,
+	// and reports whether there was one.
+	SiteID(ip string, t time.Time) (string, bool)
+}
+
+// SliverIPMap is a SliverIPResolver of sliver IP string to Site ID which does
+// not change over time. See makeMapIPStrToSiteID.
+type SliverIPMap map[string]string
+
+func (m SliverIPMap) SiteID(ip string, t time.Time) (string, bool) {
+	siteID, ok := m[ip]
+	return siteID, ok
+}
+
+// SliverIPInterval is the assignment of a sliver IP to a Site during an
+// interval of time.
+type SliverIPInterval struct {
+	IP     string
+	SiteID string
+	From   time.Time // Zero for intervals recorded before seeding was possible
+	Until  time.Time // Zero while still assigned
+}
+
+// contains reports whether t is within iv.
+func (iv *SliverIPInterval) contains(t time.Time) bool {
+	return !t.Before(iv.From) && (iv.Until.IsZero() || t.Before(iv.Until))
+}
+
+// overlaps reports whether iv and o share any time.
+func (iv *SliverIPInterval) overlaps(o *SliverIPInterval) bool {
+	return (o.Until.IsZero() || iv.From.Before(o.Until)) && (iv.Until.IsZero() || o.From.Before(iv.Until))
+}
+
+// key returns the datastore key of iv, which is named by its IP and start.
+func (iv *SliverIPInterval) key() *data.Key {
+	name := fmt.Sprintf("%s@%d", iv.IP, iv.From.Unix())
+	return data.NewKey("SliverIPInterval", name, DatastoreParentKey())
+}
+
+// sliverIPIntervals sorts SliverIPIntervals by IP and start.
+type sliverIPIntervals []SliverIPInterval
+
+func (s sliverIPIntervals) Len() int      { return len(s) }
+func (s sliverIPIntervals) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s sliverIPIntervals) Less(i, j int) bool {
+	if s[i].IP != s[j].IP {
+		return s[i].IP < s[j].IP
+	}
+	return s[i].From.Before(s[j].From)
+}
+
+// SliverIPHistory is a SliverIPResolver of the history of sliver IP
+// assignments. IPs at times before their earliest interval, which includes
+// IPs with no history, are resolved by Fallback, if set, which is usually the
+// current assignments of SliverTools, as their earlier assignments are not
+// known until seeded by SeedSliverIPIntervals.
+type SliverIPHistory struct {
+	intervals map[string][]SliverIPInterval // By IP, in order of From
+	Fallback  SliverIPResolver
+}
+
+// NewSliverIPHistory returns a *SliverIPHistory of intervals.
+func NewSliverIPHistory(intervals []SliverIPInterval) *SliverIPHistory {
+	sorted := make(sliverIPIntervals, len(intervals))
+	copy(sorted, intervals)
+	sort.Sort(sorted)
+	h := &SliverIPHistory{intervals: make(map[string][]SliverIPInterval)}
+	for _, iv := range sorted {
+		h.intervals[iv.IP] = append(h.intervals[iv.IP], iv)
+	}
+	return h
+}
+
+// Len returns the number of IPs with history in h.
+func (h *SliverIPHistory) Len() int {
+	return len(h.intervals)
+}
+
+// SiteID returns the ID of the Site which ip was assigned to at time t. IPs
+// with history before t but no assignment at t are not resolved.
+func (h *SliverIPHistory) SiteID(ip string, t time.Time) (string, bool) {
+	ivs := h.intervals[ip]
+	if len(ivs) == 0 || t.Before(ivs[0].From) {
+		if h.Fallback == nil {
+			return "", false
+		}
+		return h.Fallback.SiteID(ip, t)
+	}
+	for i := len(ivs) - 1; i >= 0; i-- {
+		if ivs[i].contains(t) {
+			return ivs[i].SiteID, true
+		}
+	}
+	return "", false
+}
+
+// getSliverIPIntervals returns all SliverIPIntervals in datastore and their
+// keys.
+func getSliverIPIntervals(c data.Context) ([]SliverIPInterval, []*data.Key, error) {
+	var intervals []SliverIPInterval
+	q := data.NewQuery("SliverIPInterval").Ancestor(DatastoreParentKey())
+	keys, err := c.Store().GetAll(q, &intervals)
+	if err != nil {
+		return nil, nil, err
+	}
+	return intervals, keys, nil
+}
+
+// GetSliverIPHistory returns the SliverIPHistory recorded in datastore. See
+// RecordSliverIPs.
+func GetSliverIPHistory(c data.Context) (*SliverIPHistory, error) {
+	intervals, _, err := getSliverIPIntervals(c)
+	if err != nil {
+		return nil, err
+	}
+	return NewSliverIPHistory(intervals), nil
+}
+
+// SliverIPReport reports the changes to the SliverIPHistory made by a record of
+// the sliver IPs of SliverTools.
+type SliverIPReport struct {
+	IPs    int // Sliver IPs assigned to a Site
+	Opened int // Intervals opened for new assignments
+	Closed int // Intervals closed as their IP was removed or reassigned
+}
+
+func (r *SliverIPReport) String() string {
+	return fmt.Sprintf("%d sliver IPs, %d intervals opened, %d closed", r.IPs, r.Opened, r.Closed)
+}
+
+// RecordSliverIPs records the sliver IPs of slivers at time now in the
+// SliverIPHistory in datastore. The interval of an IP which is no longer
+// assigned to the same Site is closed at now, and a new interval is opened for
+// each new assignment. Assignments before the first record of an IP are not
+// known, and are added by SeedSliverIPIntervals. See SliverIPHistory.
+//
+// Changes between records are only seen at the next record, so RecordSliverIPs
+// should be run frequently.
+func RecordSliverIPs(c data.Context, slivers []*data.SliverTool, now time.Time) (*SliverIPReport, error) {
+	current := makeMapIPStrToSiteID(slivers)
+	intervals, keys, err := getSliverIPIntervals(c)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &SliverIPReport{IPs: len(current)}
+	var putKeys []*data.Key
+	var putIntervals []SliverIPInterval
+	assigned := make(map[string]bool, len(current))
+	for i := range intervals {
+		iv := &intervals[i]
+		if !iv.Until.IsZero() {
+			continue
+		}
+		if siteID, ok := current[iv.IP]; ok && siteID == iv.SiteID {
+			assigned[iv.IP] = true
+			continue
+		}
+		iv.Until = now
+		putKeys = append(putKeys, keys[i])
+		putIntervals = append(putIntervals, *iv)
+		report.Closed++
+	}
+
+	for ip, siteID := range current {
+		if assigned[ip] {
+			continue
+		}
+		iv := SliverIPInterval{IP: ip, SiteID: siteID, From: now}
+		putKeys = append(putKeys, iv.key())
+		putIntervals = append(putIntervals, iv)
+		report.Opened++
+	}
+
+	if err := putSliverIPIntervals(c, putKeys, putIntervals); err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+// putSliverIPIntervals puts intervals under keys in MaxDSWritePerQuery sized
+// chunks.
+func putSliverIPIntervals(c data.Context, keys []*data.Key, intervals []SliverIPInterval) error {
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > MaxDSWritePerQuery {
+			n = MaxDSWritePerQuery
+		}
+		if err := c.Store().PutMulti(keys[:n], intervals[:n]); err != nil {
+			return err
+		}
+		keys, intervals = keys[n:], intervals[n:]
+	}
+	return nil
+}
+
+// parseSliverIPTime parses a time of a seeded SliverIPInterval, which is a
+// date, see DateFormat, or a time in RFC 3339 format.
+func parseSliverIPTime(s string) (time.Time, error) {
+	if t, err := time.Parse(DateFormat, s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// ParseSliverIPIntervals parses CSV lines of ip,site_id,from,until into
+// SliverIPIntervals, e.g., 74.63.50.43,lga01,2013-01-01,2013-08-01. Times are
+// dates, see DateFormat, or in RFC 3339 format.
+func ParseSliverIPIntervals(r io.Reader) ([]SliverIPInterval, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = 4
+	cr.TrimLeadingSpace = true
+	var intervals []SliverIPInterval
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return intervals, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		ip := net.ParseIP(rec[0])
+		from, err := parseSliverIPTime(rec[2])
+		if err != nil || ip == nil {
+			return nil, ErrInvalidSliverIPInterval
+		}
+		until, err := parseSliverIPTime(rec[3])
+		if err != nil {
+			return nil, ErrInvalidSliverIPInterval
+		}
+		intervals = append(intervals, SliverIPInterval{IP: ip.String(), SiteID: strings.TrimSpace(rec[1]), From: from, Until: until})
+	}
+}
+
+// SeedSliverIPIntervals adds intervals of sliver IP assignments from before
+// they were recorded by RecordSliverIPs to the SliverIPHistory in datastore, so
+// that Rows logged during them are resolved. Each interval must have a Site,
+// start and end, and must not overlap the intervals of its IP in datastore or
+// in intervals, or ErrInvalidSliverIPInterval or ErrSliverIPOverlap is
+// returned and nothing is added. An interval recorded with a zero start, which
+// assumed that its assignment held since before the history was recorded,
+// starts at the end of the latest seeded interval of its IP instead.
+func SeedSliverIPIntervals(c data.Context, intervals []SliverIPInterval) error {
+	existing, keys, err := getSliverIPIntervals(c)
+	if err != nil {
+		return err
+	}
+	byIP := make(map[string][]SliverIPInterval)
+	for _, iv := range intervals {
+		if iv.IP == "" || iv.SiteID == "" || iv.From.IsZero() || !iv.From.Before(iv.Until) {
+			return ErrInvalidSliverIPInterval
+		}
+		for _, o := range byIP[iv.IP] {
+			if iv.overlaps(&o) {
+				return ErrSliverIPOverlap
+			}
+		}
+		byIP[iv.IP] = append(byIP[iv.IP], iv)
+	}
+
+	var delKeys, putKeys []*data.Key
+	var putIntervals []SliverIPInterval
+	for i := range existing {
+		iv := &existing[i]
+		seeds, ok := byIP[iv.IP]
+		if !ok {
+			continue
+		}
+		if iv.From.IsZero() {
+			for _, s := range seeds {
+				if s.Until.After(iv.From) {
+					iv.From = s.Until
+				}
+			}
+			if !iv.Until.IsZero() && !iv.From.Before(iv.Until) {
+				return ErrSliverIPOverlap
+			}
+			delKeys = append(delKeys, keys[i])
+			putKeys = append(putKeys, iv.key())
+			putIntervals = append(putIntervals, *iv)
+		}
+		for _, s := range seeds {
+			if iv.overlaps(&s) {
+				return ErrSliverIPOverlap
+			}
+		}
+	}
+	for _, seeds := range byIP {
+		for _, iv := range seeds {
+			putKeys = append(putKeys, iv.key())
+			putIntervals = append(putIntervals, iv)
+		}
+	}
+
+	// The intervals are put before the ones they replace are deleted, so
+	// that a failure leaves them overlapping rather than missing.
+	if err := putSliverIPIntervals(c, putKeys, putIntervals); err != nil {
+		return err
+	}
+	if len(delKeys) > 0 {
+		return c.Store().DeleteMulti(delKeys)
+	}
+	return nil
+}
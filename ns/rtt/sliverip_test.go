@@ -0,0 +1,189 @@
+// Copyright 2013 M-Lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rtt
+
+import (
+	"bytes"
+	"code.google.com/p/mlab-ns2/gae/ns/data"
+	"testing"
+	"time"
+)
+
+var (
+	testSliverIPT1 = time.Date(2013, 8, 1, 0, 0, 0, 0, time.UTC)
+	testSliverIPT2 = time.Date(2013, 9, 1, 0, 0, 0, 0, time.UTC)
+)
+
+var sliverIPHistoryTests = []struct {
+	ip     string
+	t      time.Time
+	siteID string
+}{
+	{"74.63.50.43", testSliverIPT1.Add(-time.Hour), "lga01"},
+	{"74.63.50.43", testSliverIPT1, "dfw01"},
+	{"74.63.50.43", testSliverIPT2, "dfw01"},
+	{"82.116.199.38", testSliverIPT1.Add(-time.Hour), "lca01"},
+	{"82.116.199.38", testSliverIPT1, ""}, // Unassigned
+	{"82.116.199.38", testSliverIPT2, "lca01"},
+	{"38.107.216.10", testSliverIPT1, "nuq01"}, // No history
+	{"154.54.36.18", testSliverIPT1, ""},
+	{"4.71.254.10", testSliverIPT1, "nuq01"}, // Before the history
+	{"4.71.254.10", testSliverIPT2, "atl01"},
+}
+
+func TestSliverIPHistory(t *testing.T) {
+	h := NewSliverIPHistory([]SliverIPInterval{
+		{IP: "82.116.199.38", SiteID: "lca01", From: testSliverIPT2},
+		{IP: "74.63.50.43", SiteID: "dfw01", From: testSliverIPT1},
+		{IP: "74.63.50.43", SiteID: "lga01", Until: testSliverIPT1},
+		{IP: "82.116.199.38", SiteID: "lca01", Until: testSliverIPT1},
+		{IP: "4.71.254.10", SiteID: "atl01", From: testSliverIPT2},
+	})
+	if h.Len() != 3 {
+		t.Fatalf("SliverIPHistory.Len() = %d, want 3", h.Len())
+	}
+	h.Fallback = SliverIPMap{"38.107.216.10": "nuq01", "4.71.254.10": "nuq01", "82.116.199.38": "nuq01"}
+	for _, tt := range sliverIPHistoryTests {
+		siteID, ok := h.SiteID(tt.ip, tt.t)
+		if siteID != tt.siteID || ok != (tt.siteID != "") {
+			t.Fatalf("SliverIPHistory.SiteID(%s, %s) = %s, %v, want %s", tt.ip, tt.t, siteID, ok, tt.siteID)
+		}
+	}
+}
+
+func testSlivers(ipSites ...string) []*data.SliverTool {
+	var slivers []*data.SliverTool
+	for i := 0; i < len(ipSites); i += 2 {
+		slivers = append(slivers, &data.SliverTool{SliverIPv4: ipSites[i], SliverIPv6: data.SliverIPOff, SiteID: ipSites[i+1]})
+	}
+	return slivers
+}
+
+func TestRecordSliverIPs(t *testing.T) {
+	c := newTestContext()
+	records := []struct {
+		slivers []*data.SliverTool
+		t       time.Time
+		want    SliverIPReport
+	}{
+		{testSlivers("74.63.50.43", "lga01", "82.116.199.38", "lca01"), testSliverIPT1.Add(-2 * time.Hour), SliverIPReport{2, 2, 0}},
+		{testSlivers("74.63.50.43", "lga01", "82.116.199.38", "lca01"), testSliverIPT1.Add(-time.Hour), SliverIPReport{2, 0, 0}},
+		{testSlivers("74.63.50.43", "dfw01", "38.107.216.10", "dfw01"), testSliverIPT1, SliverIPReport{2, 2, 2}},
+	}
+	for i, r := range records {
+		report, err := RecordSliverIPs(c, r.slivers, r.t)
+		if err != nil || *report != r.want {
+			t.Fatalf("RecordSliverIPs (record %d) = %v, %v, want %v", i+1, report, err, &r.want)
+		}
+	}
+
+	h, err := GetSliverIPHistory(c)
+	if err != nil {
+		t.Fatalf("GetSliverIPHistory: %v", err)
+	}
+	h.Fallback = SliverIPMap{"74.63.50.43": "dfw01", "38.107.216.10": "dfw01"}
+	for _, tt := range []struct {
+		ip     string
+		t      time.Time
+		siteID string
+	}{
+		{"74.63.50.43", time.Date(2013, 1, 1, 0, 0, 0, 0, time.UTC), "dfw01"}, // Before the first record
+		{"74.63.50.43", testSliverIPT1.Add(-time.Minute), "lga01"},
+		{"74.63.50.43", testSliverIPT2, "dfw01"},
+		{"82.116.199.38", testSliverIPT1.Add(-time.Minute), "lca01"},
+		{"82.116.199.38", testSliverIPT2, ""},
+		{"38.107.216.10", testSliverIPT1.Add(-time.Minute), "dfw01"},
+		{"38.107.216.10", testSliverIPT2, "dfw01"},
+	} {
+		siteID, ok := h.SiteID(tt.ip, tt.t)
+		if siteID != tt.siteID || ok != (tt.siteID != "") {
+			t.Fatalf("SliverIPHistory.SiteID(%s, %s) = %s, %v, want %s", tt.ip, tt.t, siteID, ok, tt.siteID)
+		}
+	}
+}
+
+// recordTestSliverIPs puts slivers and records their sliver IPs as assigned
+// since before any test data.
+func recordTestSliverIPs(t *testing.T, c data.Context, slivers ...*data.SliverTool) {
+	for _, s := range slivers {
+		key := data.NewKey("SliverTool", data.GetSliverToolID(s.ToolID, s.SliceID, s.ServerID, s.SiteID), nil)
+		if err := c.Store().Put(key, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := RecordSliverIPs(c, slivers, time.Unix(0, 0)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+const testSliverIPSeed = `74.63.50.43,lga01,2013-01-01,2013-08-01
+82.116.199.38, lca01, 2013-01-01T00:00:00Z, 2013-08-01T00:00:00Z
+`
+
+var seedSliverIPIntervalsTests = []struct {
+	seed string
+	err  error
+}{
+	{"74.63.50.43,lga01,2013-08-01,2013-01-01\n", ErrInvalidSliverIPInterval},
+	{"74.63.50.43,,2013-01-01,2013-08-01\n", ErrInvalidSliverIPInterval},
+	{"74.63.50.43,lga01,2013-07-01,2013-09-01\n", ErrSliverIPOverlap}, // Overlaps the record
+	{"74.63.50.43,lga01,2013-01-01,2013-03-01\n74.63.50.43,lga01,2013-02-01,2013-04-01\n", ErrSliverIPOverlap},
+	{testSliverIPSeed, nil},
+	{testSliverIPSeed, ErrSliverIPOverlap},
+}
+
+func TestSeedSliverIPIntervals(t *testing.T) {
+	c := newTestContext()
+	if _, err := RecordSliverIPs(c, testSlivers("74.63.50.43", "dfw01"), testSliverIPT1); err != nil {
+		t.Fatal(err)
+	}
+	// A legacy interval recorded as held since before the history.
+	legacy := SliverIPInterval{IP: "82.116.199.38", SiteID: "lca01"}
+	if err := c.Store().Put(legacy.key(), &legacy); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range seedSliverIPIntervalsTests {
+		intervals, err := ParseSliverIPIntervals(bytes.NewBufferString(tt.seed))
+		if err == nil {
+			err = SeedSliverIPIntervals(c, intervals)
+		}
+		if err != tt.err {
+			t.Fatalf("SeedSliverIPIntervals(%q) = %v, want %v", tt.seed, err, tt.err)
+		}
+	}
+
+	h, err := GetSliverIPHistory(c)
+	if err != nil {
+		t.Fatalf("GetSliverIPHistory: %v", err)
+	}
+	for _, tt := range []struct {
+		ip     string
+		t      time.Time
+		siteID string
+	}{
+		{"74.63.50.43", time.Date(2012, 12, 31, 0, 0, 0, 0, time.UTC), ""},
+		{"74.63.50.43", time.Date(2013, 1, 1, 0, 0, 0, 0, time.UTC), "lga01"},
+		{"74.63.50.43", testSliverIPT1, "dfw01"},
+		{"82.116.199.38", time.Date(2012, 12, 31, 0, 0, 0, 0, time.UTC), ""},
+		{"82.116.199.38", time.Date(2013, 1, 1, 0, 0, 0, 0, time.UTC), "lca01"},
+		{"82.116.199.38", testSliverIPT2, "lca01"},
+	} {
+		siteID, ok := h.SiteID(tt.ip, tt.t)
+		if siteID != tt.siteID || ok != (tt.siteID != "") {
+			t.Fatalf("SliverIPHistory.SiteID(%s, %s) = %s, %v, want %s", tt.ip, tt.t, siteID, ok, tt.siteID)
+		}
+	}
+}
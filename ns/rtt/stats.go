@@ -0,0 +1,494 @@
+// Copyright 2013 M-Lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rtt
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+	"time"
+)
+
+// RTTMetric is a statistic of the RTT samples of a SiteRTT by which Sites are
+// ranked.
+type RTTMetric string
+
+const (
+	RTTMetricMin    RTTMetric = "min"
+	RTTMetricMedian RTTMetric = "median"
+	RTTMetricMean   RTTMetric = "mean"
+	RTTMetricEWMA   RTTMetric = "ewma"
+)
+
+var ErrInvalidRTTMetric = errors.New("rtt: Invalid RTT metric.")
+
+// ParseRTTMetric returns the RTTMetric named s, or ErrInvalidRTTMetric.
+func ParseRTTMetric(s string) (RTTMetric, error) {
+	switch m := RTTMetric(s); m {
+	case RTTMetricMin, RTTMetricMedian, RTTMetricMean, RTTMetricEWMA:
+		return m, nil
+	}
+	return "", ErrInvalidRTTMetric
+}
+
+// RankingMetric is the RTTMetric by which SiteRTTs are sorted. It should be
+// set during initialization.
+var RankingMetric = RTTMetricMin
+
+// EWMAHalfLife is the age, relative to the latest sample of a SiteRTT, at
+// which RTT samples count half as much in its EWMA, which therefore follows
+// recent RTTs more closely than its Mean. It should be set during
+// initialization.
+var EWMAHalfLife = 7 * 24 * time.Hour
+
+// RTTHalfLife is the age, relative to the latest sample of a SiteRTT, at which
+// RTT samples count half as much in its Mean and Histogram. The minimum RTT of
+// a SiteRTT is that of its samples taken within RTTHalfLife of the latest one,
+// so that the minimum of samples which are older is replaced by that of newer
+// ones. Zero disables aging. It should be set during initialization.
+var RTTHalfLife = 30 * 24 * time.Hour
+
+// SiteRTTHorizon is the age, relative to the latest sample of a ClientGroup,
+// beyond which SiteRTTs are dropped. Zero disables expiry. It should be set
+// during initialization.
+var SiteRTTHorizon = 180 * 24 * time.Hour
+
+// SiteRTT.Histogram weighs RTT samples in log-spaced buckets. Bucket 0 weighs
+// samples below histogramMin ms, and bucket i > 0 weighs samples from
+// histogramMin*histogramBase^(i-1) ms up to the next bucket. The last bucket
+// also weighs all larger samples. Buckets whose weight has decayed below
+// histogramMinWeight are dropped.
+const (
+	histogramMin       = 0.1
+	histogramBase      = 1.25
+	histogramBuckets   = 56 // Up to ~21s
+	histogramMinWeight = 1e-6
+)
+
+// maxMinima is the number of candidates for the minimum RTT which a SiteRTT
+// keeps in SiteRTT.Minima.
+const maxMinima = 4
+
+// histogramBucket returns the histogram bucket of an RTT.
+func histogramBucket(rtt float64) int {
+	if rtt < histogramMin {
+		return 0
+	}
+	i := int(math.Log(rtt/histogramMin)/math.Log(histogramBase)) + 1
+	if i >= histogramBuckets {
+		return histogramBuckets - 1
+	}
+	return i
+}
+
+// histogramValue returns the RTT which represents the samples of a histogram
+// bucket, its geometric midpoint.
+func histogramValue(i int) float64 {
+	if i == 0 {
+		return histogramMin / 2
+	}
+	return histogramMin * math.Pow(histogramBase, float64(i)-0.5)
+}
+
+// histogramLowerBound returns the lowest RTT of a histogram bucket.
+func histogramLowerBound(i int) float64 {
+	if i == 0 {
+		return 0
+	}
+	return histogramMin * math.Pow(histogramBase, float64(i-1))
+}
+
+// decodeHistogram decodes a SiteRTT.Histogram, which is a list of the buckets
+// with a weight, each a byte of its index followed by its weight as a
+// little-endian float32.
+func decodeHistogram(b []byte) []float64 {
+	weights := make([]float64, histogramBuckets)
+	for ; len(b) >= 5; b = b[5:] {
+		if i := int(b[0]); i < histogramBuckets {
+			weights[i] = float64(math.Float32frombits(binary.LittleEndian.Uint32(b[1:5])))
+		}
+	}
+	return weights
+}
+
+// encodeHistogram encodes bucket weights into a new SiteRTT.Histogram.
+func encodeHistogram(weights []float64) []byte {
+	var b []byte
+	buf := make([]byte, 5)
+	for i, w := range weights {
+		if w < histogramMinWeight {
+			continue
+		}
+		buf[0] = byte(i)
+		binary.LittleEndian.PutUint32(buf[1:], math.Float32bits(float32(w)))
+		b = append(b, buf...)
+	}
+	return b
+}
+
+// decodeCountHistogram decodes the Histogram of a SiteRTT stored before
+// samples were weighted by age, which is a list of uvarint bucket counts
+// without trailing zero counts.
+func decodeCountHistogram(b []byte) []float64 {
+	weights := make([]float64, histogramBuckets)
+	for i := range weights {
+		n, size := binary.Uvarint(b)
+		if size <= 0 {
+			break
+		}
+		weights[i] = float64(n)
+		b = b[size:]
+	}
+	return weights
+}
+
+// rttMin is a candidate for the minimum RTT of a SiteRTT: the minimum RTT of
+// the samples taken at or after t.
+type rttMin struct {
+	rtt float64
+	t   time.Time
+}
+
+// decodeMinima decodes a SiteRTT.Minima, which is a list of rttMins in order
+// of time, each its RTT as a little-endian float64 followed by a varint of
+// its time in Unix nanoseconds.
+func decodeMinima(b []byte) []rttMin {
+	var minima []rttMin
+	for len(b) > 8 {
+		rtt := math.Float64frombits(binary.LittleEndian.Uint64(b))
+		ns, size := binary.Varint(b[8:])
+		if size <= 0 {
+			break
+		}
+		minima = append(minima, rttMin{rtt, time.Unix(0, ns)})
+		b = b[8+size:]
+	}
+	return minima
+}
+
+// encodeMinima encodes rttMins into a new SiteRTT.Minima.
+func encodeMinima(minima []rttMin) []byte {
+	b := make([]byte, 0, len(minima)*(8+binary.MaxVarintLen64))
+	buf := make([]byte, 8+binary.MaxVarintLen64)
+	for _, m := range minima {
+		binary.LittleEndian.PutUint64(buf, math.Float64bits(m.rtt))
+		n := binary.PutVarint(buf[8:], m.t.UnixNano())
+		b = append(b, buf[:8+n]...)
+	}
+	return b
+}
+
+// rttMinsByTime sorts rttMins by time, and those of the same time by RTT.
+type rttMinsByTime []rttMin
+
+func (l rttMinsByTime) Len() int      { return len(l) }
+func (l rttMinsByTime) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l rttMinsByTime) Less(i, j int) bool {
+	if l[i].t.Equal(l[j].t) {
+		return l[i].rtt < l[j].rtt
+	}
+	return l[i].t.Before(l[j].t)
+}
+
+// mergeMinima returns the candidates for the minimum RTT of the samples of a
+// and b taken within RTTHalfLife of latest, the time of the latest sample. A
+// sample is a candidate if no later sample has a lower RTT, so candidates
+// have ascending RTTs and the first is the minimum. The candidates taken
+// earliest are kept, spaced apart so that the minimum remains accurate as
+// they age, and the latest is kept so that there always is one.
+func mergeMinima(a, b []rttMin, latest time.Time) []rttMin {
+	all := make([]rttMin, 0, len(a)+len(b))
+	all = append(append(all, a...), b...)
+	sort.Sort(rttMinsByTime(all))
+
+	var window time.Time
+	if RTTHalfLife > 0 {
+		window = latest.Add(-RTTHalfLife)
+	}
+	var candidates []rttMin
+	for i := len(all) - 1; i >= 0; i-- {
+		m := all[i]
+		if m.t.Before(window) {
+			break
+		}
+		if len(candidates) == 0 || m.rtt < candidates[len(candidates)-1].rtt {
+			candidates = append(candidates, m)
+		}
+	}
+	for i, j := 0, len(candidates)-1; i < j; i, j = i+1, j-1 {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	}
+	if len(candidates) <= 1 {
+		return candidates
+	}
+	if RTTHalfLife <= 0 {
+		return candidates[:1]
+	}
+
+	spacing := RTTHalfLife / (maxMinima - 1)
+	kept := candidates[:1]
+	for _, m := range candidates[1 : len(candidates)-1] {
+		if len(kept) == maxMinima-1 {
+			break
+		}
+		if m.t.Sub(kept[len(kept)-1].t) >= spacing {
+			kept = append(kept, m)
+		}
+	}
+	return append(kept, candidates[len(candidates)-1])
+}
+
+// halfLifeWeight returns the weight of samples which are age older than the
+// latest sample, if samples count half as much at halfLife. A halfLife of zero
+// disables aging.
+func halfLifeWeight(age, halfLife time.Duration) float64 {
+	if halfLife <= 0 || age <= 0 {
+		return 1
+	}
+	return math.Pow(0.5, float64(age)/float64(halfLife))
+}
+
+// siteRTTStats are the statistics of the RTT samples of a SiteRTT in a form in
+// which the samples of other SiteRTTs can be added and subtracted. Weights are
+// relative to the time of the latest sample t.
+type siteRTTStats struct {
+	t        time.Time
+	samples  int
+	w, sum   float64 // Weight and weighted sum of RTTs, see RTTHalfLife
+	ew, esum float64 // Weight and weighted sum of RTTs, see EWMAHalfLife
+	hist     []float64
+	minima   []rttMin
+}
+
+// stats returns the siteRTTStats of sr.
+func (sr *SiteRTT) stats() *siteRTTStats {
+	s := &siteRTTStats{t: sr.LastUpdated, samples: sr.Samples}
+	switch {
+	case sr.Samples == 0:
+		s.samples, s.w, s.ew = 1, 1, 1
+		s.sum, s.esum = sr.RTT, sr.RTT
+		s.hist = make([]float64, histogramBuckets)
+		s.hist[histogramBucket(sr.RTT)] = 1
+	case sr.WeightedSamples == 0:
+		s.w, s.ew = float64(sr.Samples), float64(sr.Samples)
+		s.sum, s.esum = sr.Mean*s.w, sr.EWMA*s.ew
+		s.hist = decodeCountHistogram(sr.Histogram)
+	default:
+		s.w, s.ew = sr.WeightedSamples, sr.EWMASamples
+		s.sum, s.esum = sr.Mean*s.w, sr.EWMA*s.ew
+		s.hist = decodeHistogram(sr.Histogram)
+		s.minima = decodeMinima(sr.Minima)
+	}
+	if len(s.minima) == 0 {
+		s.minima = []rttMin{{sr.RTT, sr.LastUpdated}}
+	}
+	return s
+}
+
+// siteRTT returns a SiteRTT of siteID with the statistics s.
+func (s *siteRTTStats) siteRTT(siteID string) SiteRTT {
+	sr := SiteRTT{
+		SiteID:          siteID,
+		LastUpdated:     s.t,
+		Samples:         s.samples,
+		WeightedSamples: s.w,
+		EWMASamples:     s.ew,
+		Histogram:       encodeHistogram(s.hist),
+		Minima:          encodeMinima(s.minima),
+	}
+	if s.w > 0 {
+		sr.Mean = s.sum / s.w
+	}
+	if s.ew > 0 {
+		sr.EWMA = s.esum / s.ew
+	}
+	if len(s.minima) > 0 {
+		sr.RTT = s.minima[0].rtt
+	} else {
+		// The candidates of the minimum were subtracted. Fall back to
+		// the lowest RTT of the histogram.
+		for i, w := range s.hist {
+			if w >= histogramMinWeight {
+				sr.RTT = math.Max(histogramLowerBound(i), histogramMin)
+				break
+			}
+		}
+	}
+	return sr
+}
+
+// decay returns the weights, by RTTHalfLife and EWMAHalfLife, of samples
+// whose latest sample was taken at t relative to those of s.
+func (s *siteRTTStats) decay(t time.Time) (float64, float64) {
+	age := s.t.Sub(t)
+	return halfLifeWeight(age, RTTHalfLife), halfLifeWeight(age, EWMAHalfLife)
+}
+
+// age makes the weights of s relative to t, which is after s.t, and drops the
+// candidates for the minimum RTT which are no longer within RTTHalfLife.
+func (s *siteRTTStats) age(t time.Time) {
+	if !t.After(s.t) {
+		return
+	}
+	d, de := halfLifeWeight(t.Sub(s.t), RTTHalfLife), halfLifeWeight(t.Sub(s.t), EWMAHalfLife)
+	s.t = t
+	s.w, s.sum = s.w*d, s.sum*d
+	s.ew, s.esum = s.ew*de, s.esum*de
+	for i := range s.hist {
+		s.hist[i] *= d
+	}
+	s.minima = mergeMinima(s.minima, nil, t)
+}
+
+// add adds the samples of o to s.
+func (s *siteRTTStats) add(o *siteRTTStats) {
+	s.age(o.t)
+	d, de := s.decay(o.t)
+	s.samples += o.samples
+	s.w += o.w * d
+	s.sum += o.sum * d
+	s.ew += o.ew * de
+	s.esum += o.esum * de
+	for i, w := range o.hist {
+		s.hist[i] += w * d
+	}
+	s.minima = mergeMinima(s.minima, o.minima, s.t)
+}
+
+// sub subtracts the samples of o, which were taken from from until until and
+// have been added to s, from s. The time of the latest sample of s is kept.
+// If the candidates for the minimum RTT of o had replaced other candidates of
+// s, the minimum RTT of s may be overestimated until samples are added.
+func (s *siteRTTStats) sub(o *siteRTTStats, from, until time.Time) {
+	d, de := s.decay(o.t)
+	s.samples -= o.samples
+	if s.samples <= 0 {
+		*s = siteRTTStats{t: s.t, hist: make([]float64, histogramBuckets)}
+		return
+	}
+	s.w = math.Max(0, s.w-o.w*d)
+	s.sum = math.Max(0, s.sum-o.sum*d)
+	s.ew = math.Max(0, s.ew-o.ew*de)
+	s.esum = math.Max(0, s.esum-o.esum*de)
+	for i, w := range o.hist {
+		s.hist[i] = math.Max(0, s.hist[i]-w*d)
+	}
+	kept := s.minima[:0]
+	for _, m := range s.minima {
+		if m.t.Before(from) || !m.t.Before(until) {
+			kept = append(kept, m)
+		}
+	}
+	s.minima = kept
+}
+
+// NewSiteRTT returns a SiteRTT with a single RTT sample.
+func NewSiteRTT(siteID string, rtt float64, t time.Time) SiteRTT {
+	hist := make([]float64, histogramBuckets)
+	hist[histogramBucket(rtt)] = 1
+	return SiteRTT{
+		SiteID:          siteID,
+		RTT:             rtt,
+		LastUpdated:     t,
+		Samples:         1,
+		WeightedSamples: 1,
+		Mean:            rtt,
+		EWMASamples:     1,
+		EWMA:            rtt,
+		Histogram:       encodeHistogram(hist),
+		Minima:          encodeMinima([]rttMin{{rtt, t}}),
+	}
+}
+
+// Percentile returns an approximation of the RTT below which a fraction q of
+// the weighted samples of sr lie, to within the resolution of its histogram.
+// It is never below the minimum RTT.
+func (sr *SiteRTT) Percentile(q float64) float64 {
+	if sr.Samples == 0 || len(sr.Histogram) == 0 {
+		return sr.RTT
+	}
+	hist := sr.stats().hist
+	var total float64
+	for _, w := range hist {
+		total += w
+	}
+	rank := q * total * (1 - 1e-9)
+	var cum float64
+	for i, w := range hist {
+		cum += w
+		if w > 0 && cum >= rank {
+			return math.Max(histogramValue(i), sr.RTT)
+		}
+	}
+	return sr.RTT
+}
+
+// Value returns the statistic of sr for an RTTMetric.
+func (sr *SiteRTT) Value(m RTTMetric) float64 {
+	if sr.Samples == 0 {
+		return sr.RTT
+	}
+	switch m {
+	case RTTMetricMedian:
+		return sr.Percentile(0.5)
+	case RTTMetricMean:
+		return sr.Mean
+	case RTTMetricEWMA:
+		return sr.EWMA
+	}
+	return sr.RTT
+}
+
+// mergeSiteRTTStats combines the RTT samples of a and b. The samples of
+// either are weighted by their age relative to the latest sample of both, see
+// RTTHalfLife and EWMAHalfLife.
+func mergeSiteRTTStats(a, b SiteRTT) SiteRTT {
+	s := a.stats()
+	s.add(b.stats())
+	return s.siteRTT(a.SiteID)
+}
+
+// ExpireSiteRTTs removes the SiteRTTs of srs which were last updated more than
+// SiteRTTHorizon before t, and reports whether any were removed. The order of
+// the remaining SiteRTTs is kept.
+func ExpireSiteRTTs(srs SiteRTTs, t time.Time) (SiteRTTs, bool) {
+	if SiteRTTHorizon <= 0 {
+		return srs, false
+	}
+	cutoff := t.Add(-SiteRTTHorizon)
+	kept := srs[:0]
+	for _, sr := range srs {
+		if !sr.LastUpdated.Before(cutoff) {
+			kept = append(kept, sr)
+		}
+	}
+	return kept, len(kept) != len(srs)
+}
+
+// siteRTTsByMetric sorts SiteRTTs in ascending order of an RTTMetric.
+type siteRTTsByMetric struct {
+	SiteRTTs
+	metric RTTMetric
+}
+
+func (l siteRTTsByMetric) Less(i, j int) bool {
+	return l.SiteRTTs[i].Value(l.metric) < l.SiteRTTs[j].Value(l.metric)
+}
+
+// SortSiteRTTs sorts SiteRTTs in ascending order of an RTTMetric.
+func SortSiteRTTs(srs SiteRTTs, m RTTMetric) {
+	sort.Stable(siteRTTsByMetric{srs, m})
+}
@@ -0,0 +1,256 @@
+// Copyright 2013 M-Lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rtt
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var parseRTTMetricTests = []struct {
+	in  string
+	out RTTMetric
+	err error
+}{
+	{"min", RTTMetricMin, nil},
+	{"median", RTTMetricMedian, nil},
+	{"mean", RTTMetricMean, nil},
+	{"ewma", RTTMetricEWMA, nil},
+	{"p90", "", ErrInvalidRTTMetric},
+}
+
+func TestParseRTTMetric(t *testing.T) {
+	for _, tt := range parseRTTMetricTests {
+		out, err := ParseRTTMetric(tt.in)
+		if out != tt.out || err != tt.err {
+			t.Fatalf("ParseRTTMetric(%q) = %v, %v, want %v, %v", tt.in, out, err, tt.out, tt.err)
+		}
+	}
+}
+
+func TestHistogramEncoding(t *testing.T) {
+	weights := make([]float64, histogramBuckets)
+	weights[3] = 1
+	weights[20] = 300.5
+	b := encodeHistogram(weights)
+	if out := decodeHistogram(b); !reflect.DeepEqual(out, weights) {
+		t.Fatalf("decodeHistogram(encodeHistogram(%v)) = %v", weights, out)
+	}
+	if len(b) != 10 { // Two buckets of five bytes
+		t.Fatalf("len(encodeHistogram(%v)) = %d, want 10", weights, len(b))
+	}
+
+	// Weights which have decayed to nothing are dropped.
+	weights[3] = histogramMinWeight / 2
+	if b := encodeHistogram(weights); len(b) != 5 {
+		t.Fatalf("len(encodeHistogram(%v)) = %d, want 5", weights, len(b))
+	}
+}
+
+func TestMinimaEncoding(t *testing.T) {
+	minima := []rttMin{{0.5, time.Unix(1376828167, 1)}, {7.25, time.Unix(1376900000, 0)}}
+	out := decodeMinima(encodeMinima(minima))
+	if len(out) != len(minima) {
+		t.Fatalf("decodeMinima(encodeMinima(%v)) = %v", minima, out)
+	}
+	for i, m := range out {
+		if m.rtt != minima[i].rtt || !m.t.Equal(minima[i].t) {
+			t.Fatalf("decodeMinima(encodeMinima(%v)) = %v", minima, out)
+		}
+	}
+}
+
+// newTestSiteRTT returns a SiteRTT with samples rtts, taken a nanosecond apart
+// so that they are not aged.
+func newTestSiteRTT(rtts ...float64) SiteRTT {
+	sr := NewSiteRTT("abc01", rtts[0], time.Unix(1, 0))
+	for i, rtt := range rtts[1:] {
+		MergeSiteRTTs(&sr, &SiteRTT{SiteID: "abc01", RTT: rtt, LastUpdated: time.Unix(1, int64(i+1))})
+	}
+	return sr
+}
+
+var percentileTests = []struct {
+	rtts []float64
+	q    float64
+	out  float64
+}{
+	{[]float64{10}, 0.5, 10},
+	{[]float64{10, 10, 10, 100}, 0.5, 10},
+	{[]float64{10, 10, 10, 100}, 0.9, 100},
+	{[]float64{5, 10, 20, 40, 80, 160, 320, 640, 1280, 2560}, 0.5, 80},
+	{[]float64{5, 10, 20, 40, 80, 160, 320, 640, 1280, 2560}, 0.9, 1280},
+	{[]float64{0.2, 0.21}, 0.5, 0.2}, // Never below the minimum
+	{[]float64{100000}, 0.5, 100000}, // Beyond the last bucket
+}
+
+func TestSiteRTTPercentile(t *testing.T) {
+	for _, tt := range percentileTests {
+		sr := newTestSiteRTT(tt.rtts...)
+		// Percentiles are within the resolution of the histogram.
+		out := sr.Percentile(tt.q)
+		if tt.out < histogramMin*math.Pow(histogramBase, histogramBuckets-1) && math.Abs(out-tt.out) > tt.out*(histogramBase-1) {
+			t.Fatalf("SiteRTT%v.Percentile(%v) = %v, want %v", tt.rtts, tt.q, out, tt.out)
+		}
+		if out < sr.RTT {
+			t.Fatalf("SiteRTT%v.Percentile(%v) = %v, want at least %v", tt.rtts, tt.q, out, sr.RTT)
+		}
+	}
+}
+
+func TestSiteRTTValue(t *testing.T) {
+	sr := newTestSiteRTT(10, 10, 40)
+	if sr.Samples != 3 || sr.RTT != 10 || math.Abs(sr.Mean-20) > 1e-9 {
+		t.Fatalf("newTestSiteRTT(10, 10, 40) = %v, want 3 samples of min 10 and mean 20", sr)
+	}
+	// Samples of about the same time weigh the same in the EWMA.
+	if ewma := 20.0; math.Abs(sr.Value(RTTMetricEWMA)-ewma) > 1e-9 {
+		t.Fatalf("SiteRTT.Value(%s) = %v, want %v", RTTMetricEWMA, sr.Value(RTTMetricEWMA), ewma)
+	}
+	if v := sr.Value(RTTMetricMedian); math.Abs(v-10) > 10*(histogramBase-1) {
+		t.Fatalf("SiteRTT.Value(%s) = %v, want ~10", RTTMetricMedian, v)
+	}
+
+	// SiteRTTs stored before statistics were kept only have a minimum.
+	legacy := SiteRTT{SiteID: "abc01", RTT: 7}
+	for _, m := range []RTTMetric{RTTMetricMin, RTTMetricMedian, RTTMetricMean, RTTMetricEWMA} {
+		if v := legacy.Value(m); v != 7 {
+			t.Fatalf("SiteRTT{RTT: 7}.Value(%s) = %v, want 7", m, v)
+		}
+	}
+}
+
+var mergeSiteRTTsAgingTests = []struct {
+	age      time.Duration // Age of the old samples
+	rtt      float64
+	weighted float64
+	mean     float64
+}{
+	{time.Nanosecond, 5, 3, 10},
+	{RTTHalfLife, 5, 2, 12.5},
+	{2 * RTTHalfLife, 20, 1.5, 15}, // Older minimum replaced
+}
+
+func TestMergeSiteRTTsAging(t *testing.T) {
+	now := time.Unix(1376828167, 0)
+	for _, tt := range mergeSiteRTTsAgingTests {
+		// Two old samples of 5ms, and one new sample of 20ms.
+		old := NewSiteRTT("abc01", 5, now.Add(-tt.age))
+		old2 := NewSiteRTT("abc01", 5, now.Add(-tt.age))
+		MergeSiteRTTs(&old, &old2)
+		sr := NewSiteRTT("abc01", 20, now)
+		MergeSiteRTTs(&sr, &old)
+
+		de := halfLifeWeight(tt.age, EWMAHalfLife)
+		ewma := (2*5*de + 20) / (2*de + 1)
+		want := SiteRTT{SiteID: "abc01", RTT: tt.rtt, LastUpdated: now, Samples: 3, Mean: tt.mean, EWMA: ewma}
+		if !sameStats(sr, want) || math.Abs(sr.WeightedSamples-tt.weighted) > 1e-9 {
+			t.Fatalf("MergeSiteRTTs aged %v = %v, want %v with %v weighted samples", tt.age, sr, want, tt.weighted)
+		}
+	}
+}
+
+// The minimum RTT is that of the samples within RTTHalfLife of the latest.
+func TestMergeSiteRTTsMinimum(t *testing.T) {
+	start := time.Unix(1376828167, 0)
+	sr := NewSiteRTT("abc01", 1, start)
+	for _, tt := range []struct {
+		days int
+		rtt  float64
+		min  float64
+	}{
+		{10, 10, 1},
+		{20, 50, 1},
+		{40, 60, 10}, // 1ms is 40 days old
+		{55, 70, 60}, // 50ms is 35 days old
+		{56, 45, 45},
+		{100, 80, 80},
+	} {
+		s := NewSiteRTT("abc01", tt.rtt, start.Add(time.Duration(tt.days)*Day))
+		MergeSiteRTTs(&sr, &s)
+		if sr.RTT != tt.min {
+			t.Fatalf("SiteRTT minimum after day %d = %v, want %v", tt.days, sr.RTT, tt.min)
+		}
+	}
+}
+
+// Merging daily samples for a year ages out the first day's samples, however
+// few samples each day has.
+func TestMergeSiteRTTsLongHorizon(t *testing.T) {
+	start := time.Unix(1376828167, 0)
+	sr := NewSiteRTT("abc01", 1, start)
+	for day := 1; day <= 365; day++ {
+		s := NewSiteRTT("abc01", 50, start.Add(time.Duration(day)*Day))
+		MergeSiteRTTs(&sr, &s)
+	}
+	if sr.RTT != 50 || sr.Samples != 366 {
+		t.Fatalf("SiteRTT after a year = %v, want a minimum of 50 and 366 samples", sr)
+	}
+	hist := decodeHistogram(sr.Histogram)
+	if w := hist[histogramBucket(1)]; w > 1e-3 {
+		t.Fatalf("Weight of the 1ms sample after a year = %v, want < 0.001", w)
+	}
+	// The weighted samples converge to the sum of the daily weights.
+	want := 1 / (1 - halfLifeWeight(Day, RTTHalfLife))
+	if math.Abs(sr.WeightedSamples-want) > 0.01*want || math.Abs(hist[histogramBucket(50)]-sr.WeightedSamples) > 1e-3*want {
+		t.Fatalf("SiteRTT after a year has %v weighted samples and histogram %v, want ~%v", sr.WeightedSamples, hist, want)
+	}
+	if sr.Mean-50 > 1e-3 || sr.Value(RTTMetricMedian) < 45 {
+		t.Fatalf("SiteRTT after a year has mean %v and median %v, want ~50", sr.Mean, sr.Value(RTTMetricMedian))
+	}
+}
+
+func TestExpireSiteRTTs(t *testing.T) {
+	now := time.Unix(1376828167, 0)
+	srs := SiteRTTs{
+		NewSiteRTT("abc01", 5, now.Add(-SiteRTTHorizon-time.Second)),
+		NewSiteRTT("def01", 10, now.Add(-SiteRTTHorizon)),
+		NewSiteRTT("ghi01", 20, now),
+	}
+	out, expired := ExpireSiteRTTs(srs, now)
+	if !expired || len(out) != 2 || out[0].SiteID != "def01" || out[1].SiteID != "ghi01" {
+		t.Fatalf("ExpireSiteRTTs = %v, %v, want [def01 ghi01], true", out, expired)
+	}
+	if out, expired = ExpireSiteRTTs(out, now); expired || len(out) != 2 {
+		t.Fatalf("ExpireSiteRTTs = %v, %v, want [def01 ghi01], false", out, expired)
+	}
+}
+
+func TestSortSiteRTTs(t *testing.T) {
+	srs := SiteRTTs{
+		{SiteID: "a", RTT: 1, Samples: 2, Mean: 30, EWMA: 5},
+		{SiteID: "b", RTT: 2, Samples: 2, Mean: 20, EWMA: 25},
+		{SiteID: "c", RTT: 3, Samples: 2, Mean: 10, EWMA: 15},
+	}
+	for _, tt := range []struct {
+		metric RTTMetric
+		out    string
+	}{
+		{RTTMetricMin, "abc"},
+		{RTTMetricMean, "cba"},
+		{RTTMetricEWMA, "acb"},
+	} {
+		SortSiteRTTs(srs, tt.metric)
+		var out string
+		for _, sr := range srs {
+			out += sr.SiteID
+		}
+		if out != tt.out {
+			t.Fatalf("SortSiteRTTs(%s) = %s, want %s", tt.metric, out, tt.out)
+		}
+	}
+}
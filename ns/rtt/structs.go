@@ -15,40 +15,92 @@
 package rtt
 
 import (
+	"code.google.com/p/mlab-ns2/gae/ns/data"
+	"fmt"
 	"net"
 	"time"
 )
 
-// ClientGroup contains RTT information aggregated by prefix size.
+// ClientGroup contains RTT information aggregated by prefix size, or by origin
+// AS if grouped by ASN. See ClientGrouper.
 type ClientGroup struct {
-	Prefix   []byte
-	SiteRTTs SiteRTTs
+	Prefix    []byte
+	PrefixLen int    // Zero for ClientGroups stored before it was kept
+	ASN       uint32 // Non-zero for ClientGroups of an AS, which have no Prefix
+	SiteRTTs  SiteRTTs
+	Imports   []string // ClientGroupDays merged into SiteRTTs, see ImportContribution
+	Migrated  []string // ClientGroups merged into this one by MigrateClientGroups
 }
 
 // NewClientGroup returns a new *ClientGroup with a Prefix set using a provided
-// IP.
+// IP, which is a ClientGroup prefix as returned by GetClientGroup.
 func NewClientGroup(ip net.IP) *ClientGroup {
+	ones, _ := GetClientGroup(ip).Mask.Size()
 	return &ClientGroup{
-		Prefix:   []byte(ip),
-		SiteRTTs: make(SiteRTTs, 0),
+		Prefix:    []byte(ip),
+		PrefixLen: ones,
+		SiteRTTs:  make(SiteRTTs, 0),
 	}
 }
 
+// IPNet returns the prefix of cg. ClientGroups without a PrefixLen have the
+// prefix sizes used before it was kept.
+func (cg *ClientGroup) IPNet() *net.IPNet {
+	ip := net.IP(cg.Prefix)
+	if ip4 := ip.To4(); ip4 != nil {
+		ones := cg.PrefixLen
+		if ones == 0 {
+			ones = legacyV4PrefixSize
+		}
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(ones, 8*net.IPv4len)}
+	}
+	ones := cg.PrefixLen
+	if ones == 0 {
+		ones = legacyV6PrefixSize
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(ones, 8*net.IPv6len)}
+}
+
+// Name returns the name of cg, which is its prefix in CIDR notation, e.g.,
+// 24.164.160.0/22, or its AS, e.g., AS7922.
+func (cg *ClientGroup) Name() string {
+	if cg.ASN != 0 {
+		return fmt.Sprintf("AS%d", cg.ASN)
+	}
+	return cg.IPNet().String()
+}
+
+// Key returns the datastore key of cg, which is named by Name.
+func (cg *ClientGroup) Key() *data.Key {
+	return data.NewKey("ClientGroup", cg.Name(), DatastoreParentKey())
+}
+
 // SiteRTT contains information of a ClientGroup's aggregated RTT to a Site.
 // NOTE: RTT is assumed to be bi-directionally equal between nodes. This is not
 // necessarily so.
+//
+// SiteRTTs stored before statistics were kept have no Samples, and are treated
+// as a single sample of RTT. Those stored before samples were weighted by age
+// have no WeightedSamples, and their samples are treated as equally recent.
 type SiteRTT struct {
-	SiteID      string
-	RTT         float64
-	LastUpdated time.Time
+	SiteID          string
+	RTT             float64   // Minimum RTT, see RTTHalfLife
+	LastUpdated     time.Time // Time of the latest sample
+	Samples         int       // Number of RTT samples
+	WeightedSamples float64   // Samples weighted by age, see RTTHalfLife
+	Mean            float64   // Mean RTT, weighted by age
+	EWMASamples     float64   // Samples weighted by age, see EWMAHalfLife
+	EWMA            float64   // Exponentially weighted moving average, see EWMAHalfLife
+	Histogram       []byte    // Encoded log-spaced histogram, see Percentile
+	Minima          []byte    // Encoded candidates for RTT, see RTTHalfLife
 }
 
 // SiteRTTs is a list of RTT data from ClientGroup to Site
 type SiteRTTs []SiteRTT
 
-// Less allows for the sorting of SiteRTTs in a *ClientGroup
+// Less allows for the sorting of SiteRTTs in a *ClientGroup by RankingMetric
 func (l SiteRTTs) Less(i, j int) bool {
-	return l[i].RTT <= l[j].RTT
+	return l[i].Value(RankingMetric) <= l[j].Value(RankingMetric)
 }
 
 // Swap allows for the sorting of SiteRTTs in a *ClientGroup
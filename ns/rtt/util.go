@@ -19,61 +19,149 @@ import (
 	"errors"
 	"net"
 	"sort"
+	"time"
 )
 
 const (
-	v4PrefixSize = 22 // defines the size of the IPv4 group prefix
-	v6PrefixSize = 56 // defines the size of the IPv6 group prefix
+	// The prefix sizes of ClientGroups stored before ClientGroup keys
+	// carried their prefix size.
+	legacyV4PrefixSize = 22
+	legacyV6PrefixSize = 56
+
+	// The largest prefixes searched for neighbouring ClientGroups.
+	v4MinNeighbourPrefixSize = 16
+	v6MinNeighbourPrefixSize = 48
+)
+
+// V4PrefixSize and V6PrefixSize are the sizes of the IPv4 and IPv6 prefixes by
+// which clients are grouped. ClientGroups of different sizes are stored under
+// different keys, see ClientGroupKey. They should be set during
+// initialization.
+var (
+	V4PrefixSize = legacyV4PrefixSize
+	V6PrefixSize = legacyV6PrefixSize
 )
 
 var (
-	v4PrefixMask        = net.CIDRMask(v4PrefixSize, 8*net.IPv4len)
-	v6PrefixMask        = net.CIDRMask(v6PrefixSize, 8*net.IPv6len)
 	ErrMergeSiteRTT     = errors.New("SiteRTT cannot be merged, mismatching Site IDs.")
 	ErrMergeClientGroup = errors.New("ClientGroups cannot be merged, mismatching ClientGroup Prefixes.")
 )
 
+// getPrefix returns a *net.IPNet which represents the subnet of ip with a
+// prefix size of v4Size or v6Size bits, depending on its address family.
+func getPrefix(ip net.IP, v4Size, v6Size int) *net.IPNet {
+	if ip.To4() == nil {
+		mask := net.CIDRMask(v6Size, 8*net.IPv6len)
+		return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+	}
+	mask := net.CIDRMask(v4Size, 8*net.IPv4len)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+}
+
+// prefixSize returns the size of the ClientGroup prefix of ip.
+func prefixSize(ip net.IP) int {
+	if ip.To4() == nil {
+		return V6PrefixSize
+	}
+	return V4PrefixSize
+}
+
 // GetClientGroup returns a *net.IPNet which represents a subnet of prefix
-// size v4PrefixSize in the case of IPv4 addresses.
+// size V4PrefixSize in the case of IPv4 addresses, and V6PrefixSize otherwise.
 func GetClientGroup(ip net.IP) *net.IPNet {
+	return getPrefix(ip, V4PrefixSize, V6PrefixSize)
+}
+
+// MaxNeighbourDistance returns the maximum prefix distance, in bits, at which
+// neighbouring ClientGroups of ip are searched. Neighbours are only searched
+// for clients grouped by GetClientGroup.
+func MaxNeighbourDistance(ip net.IP) int {
+	cg := GroupClient(ip)
+	if cg.ASN != 0 || cg.PrefixLen != prefixSize(ip) {
+		return 0
+	}
+	d := V4PrefixSize - v4MinNeighbourPrefixSize
 	if ip.To4() == nil {
-		return &net.IPNet{IP: ip.Mask(v6PrefixMask), Mask: v6PrefixMask}
+		d = V6PrefixSize - v6MinNeighbourPrefixSize
 	}
-	return &net.IPNet{IP: ip.Mask(v4PrefixMask), Mask: v4PrefixMask}
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// GetNeighbourClientGroups returns the ClientGroup prefixes at a prefix
+// distance of d bits from the ClientGroup of ip. These are the ClientGroups
+// which share the prefix of ip widened by d bits, but not the prefix widened
+// by d-1 bits. A distance of 0 returns only the ClientGroup of ip.
+func GetNeighbourClientGroups(ip net.IP, d int) []net.IP {
+	cg := GetClientGroup(ip)
+	ones, bits := cg.Mask.Size()
+	if d == 0 {
+		return []net.IP{cg.IP}
+	}
+	if d < 0 || d > MaxNeighbourDistance(ip) {
+		return nil
+	}
+
+	// The ClientGroups in the half of the widened prefix which does not
+	// contain ip, i.e., those whose bit at position ones-d differs from ip.
+	wide := cg.IP.Mask(net.CIDRMask(ones-d, bits))
+	flip := ones - d // index of the first differing bit
+	wide[flip/8] |= ^cg.IP[flip/8] & (0x80 >> uint(flip%8))
+	n := 1 << uint(d-1)
+	neighbours := make([]net.IP, 0, n)
+	for i := 0; i < n; i++ {
+		neighbours = append(neighbours, addToPrefix(wide, ones, i))
+	}
+	return neighbours
+}
+
+// addToPrefix returns a copy of ip with n added to its prefix of the given
+// size, such that n = 1 moves to the next prefix.
+func addToPrefix(ip net.IP, size, n int) net.IP {
+	out := make(net.IP, len(ip))
+	copy(out, ip)
+	carry := n
+	bit := size - 1 // least significant bit of the prefix
+	for carry != 0 && bit >= 0 {
+		i, shift := bit/8, uint(7-bit%8)
+		sum := int(out[i]>>shift&1) + carry&1
+		carry >>= 1
+		out[i] = out[i]&^(1<<shift) | byte(sum&1)<<shift
+		carry += sum >> 1
+		bit--
+	}
+	return out
 }
 
 // IsEqualClientGroup checks if two IPs are in the same client group defined
-// by prefix sizes defined by v4PrefixSize and v6PrefixSize.
+// by prefix sizes defined by V4PrefixSize and V6PrefixSize.
 func IsEqualClientGroup(a, b net.IP) bool {
 	ipnet := GetClientGroup(a)
 	return ipnet.Contains(b)
 }
 
-// MergeSiteRTTs merges a new SiteRTT entry into an old SiteRTT entry if the new
-// entry has lower or equal RTT, and also reports whether the merge has caused
-// any changes.
+// MergeSiteRTTs merges the RTT samples of a new SiteRTT entry into an old
+// SiteRTT entry, and also reports whether the merge has caused any changes.
+// It always does, since every SiteRTT holds at least one sample; those stored
+// before statistics were kept count as a single sample of RTT.
 func MergeSiteRTTs(oldSR, newSR *SiteRTT) (bool, error) {
 	if oldSR.SiteID != newSR.SiteID {
 		return false, ErrMergeSiteRTT
 	}
-	if newSR.RTT == oldSR.RTT && oldSR.LastUpdated.Equal(newSR.LastUpdated) {
-		return false, nil
-	}
-	if newSR.RTT <= oldSR.RTT {
-		oldSR.RTT = newSR.RTT
-		oldSR.LastUpdated = newSR.LastUpdated
-		return true, nil
-	}
-	return false, nil
+	*oldSR = mergeSiteRTTStats(*oldSR, *newSR)
+	return true, nil
 }
 
 // MergeClientGroups merges a new list of SiteRTT with an existing list of
-// SiteRTT and sorts it in ascending RTT order. It also reports if the merge has
-// caused any changes.
+// SiteRTT and sorts it in ascending order of RankingMetric. SiteRTTs last
+// updated more than SiteRTTHorizon before the latest sample are dropped. It
+// also reports if the merge has caused any changes.
 // Note: Used for merging new bigquery data with existing datastore data.
 func MergeClientGroups(oldCG, newCG *ClientGroup) (bool, error) {
 	oIP, nIP := net.IP(oldCG.Prefix), net.IP(newCG.Prefix)
-	if !oIP.Equal(nIP) {
+	if !oIP.Equal(nIP) || oldCG.ASN != newCG.ASN {
 		return false, ErrMergeClientGroup
 	}
 
@@ -87,7 +175,7 @@ func MergeClientGroups(oldCG, newCG *ClientGroup) (bool, error) {
 		nRTTs[s.SiteID] = &newCG.SiteRTTs[i]
 	}
 
-	// Keep SiteRTT with lower RTT
+	// Add new SiteRTTs, and merge the samples of existing ones
 	var os *SiteRTT
 	var ok, changed, srChanged bool
 	var err error
@@ -109,8 +197,20 @@ func MergeClientGroups(oldCG, newCG *ClientGroup) (bool, error) {
 
 	// Create new list of SiteRTTs
 	oldCG.SiteRTTs = make(SiteRTTs, 0, len(oRTTs))
+	var latest time.Time
 	for _, s := range oRTTs {
 		oldCG.SiteRTTs = append(oldCG.SiteRTTs, *s)
+		if s.LastUpdated.After(latest) {
+			latest = s.LastUpdated
+		}
+	}
+
+	// Drop SiteRTTs which have not been updated within SiteRTTHorizon of
+	// the latest sample.
+	var expired bool
+	oldCG.SiteRTTs, expired = ExpireSiteRTTs(oldCG.SiteRTTs, latest)
+	if expired {
+		changed = true
 	}
 	sort.Sort(oldCG.SiteRTTs)
 
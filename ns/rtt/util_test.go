@@ -15,7 +15,7 @@
 package rtt
 
 import (
-	"fmt"
+	"math"
 	"net"
 	"reflect"
 	"testing"
@@ -42,6 +42,38 @@ func TestGetClientGroupIPv4(t *testing.T) {
 	}
 }
 
+var getNeighbourClientGroupsTests = []struct {
+	ip  string
+	d   int
+	out []string
+}{
+	{"173.194.36.73", 0, []string{"173.194.36.0"}},
+	{"173.194.36.73", 1, []string{"173.194.32.0"}},
+	{"173.194.36.73", 2, []string{"173.194.40.0", "173.194.44.0"}},
+	{"173.194.44.1", 3, []string{"173.194.48.0", "173.194.52.0", "173.194.56.0", "173.194.60.0"}},
+	{"173.194.44.1", 4, []string{"173.194.0.0", "173.194.4.0", "173.194.8.0", "173.194.12.0", "173.194.16.0", "173.194.20.0", "173.194.24.0", "173.194.28.0"}},
+	{"173.194.252.1", 6, []string{"173.194.0.0", "173.194.4.0", "173.194.8.0", "173.194.12.0", "173.194.16.0", "173.194.20.0", "173.194.24.0", "173.194.28.0",
+		"173.194.32.0", "173.194.36.0", "173.194.40.0", "173.194.44.0", "173.194.48.0", "173.194.52.0", "173.194.56.0", "173.194.60.0",
+		"173.194.64.0", "173.194.68.0", "173.194.72.0", "173.194.76.0", "173.194.80.0", "173.194.84.0", "173.194.88.0", "173.194.92.0",
+		"173.194.96.0", "173.194.100.0", "173.194.104.0", "173.194.108.0", "173.194.112.0", "173.194.116.0", "173.194.120.0", "173.194.124.0"}},
+	{"173.194.36.73", 7, nil},
+	{"2a03:2880:2110:df07::1", 1, []string{"2a03:2880:2110:de00::"}},
+	{"2a03:2880:2110:df07::1", 2, []string{"2a03:2880:2110:dc00::", "2a03:2880:2110:dd00::"}},
+}
+
+func TestGetNeighbourClientGroups(t *testing.T) {
+	for _, tt := range getNeighbourClientGroupsTests {
+		out := GetNeighbourClientGroups(net.ParseIP(tt.ip), tt.d)
+		var outStr []string
+		for _, ip := range out {
+			outStr = append(outStr, ip.String())
+		}
+		if !reflect.DeepEqual(outStr, tt.out) {
+			t.Fatalf("GetNeighbourClientGroups(%v, %d) = %v, want %v", tt.ip, tt.d, outStr, tt.out)
+		}
+	}
+}
+
 var isEqualClientGroupTests = []struct {
 	a  string
 	b  string
@@ -63,132 +95,165 @@ func TestIsEqualClientGroup(t *testing.T) {
 	}
 }
 
+// sameStats reports whether the minimum RTT, time of update, sample count,
+// mean and EWMA of a and b are equal, allowing for rounding.
+func sameStats(a, b SiteRTT) bool {
+	return a.SiteID == b.SiteID && a.RTT == b.RTT && a.LastUpdated.Equal(b.LastUpdated) &&
+		a.Samples == b.Samples && math.Abs(a.Mean-b.Mean) < 1e-9 && math.Abs(a.EWMA-b.EWMA) < 1e-9
+}
+
 var mergeSiteRTTsTests = []struct {
-	oldIn   *SiteRTT
-	newIn   *SiteRTT
-	out     *SiteRTT
+	oldIn   SiteRTT
+	newIn   SiteRTT
+	out     SiteRTT
 	changed bool
 }{
 	// Case with lower RTT in new SiteRTT
 	{
-		&SiteRTT{"abc01", 1.1, time.Unix(1, 0)},
-		&SiteRTT{"abc01", 0.1, time.Unix(1, 1)},
-		&SiteRTT{"abc01", 0.1, time.Unix(1, 1)},
+		NewSiteRTT("abc01", 1.1, time.Unix(1, 0)),
+		NewSiteRTT("abc01", 0.1, time.Unix(1, 1)),
+		SiteRTT{SiteID: "abc01", RTT: 0.1, LastUpdated: time.Unix(1, 1), Samples: 2, Mean: 0.6, EWMA: 0.6},
 		true,
 	},
 	// Case with lower RTT in old SiteRTT
 	{
-		&SiteRTT{"abc01", 0.1, time.Unix(1, 0)},
-		&SiteRTT{"abc01", 1.1, time.Unix(1, 1)},
-		&SiteRTT{"abc01", 0.1, time.Unix(1, 0)},
-		false,
+		NewSiteRTT("abc01", 0.1, time.Unix(1, 0)),
+		NewSiteRTT("abc01", 1.1, time.Unix(1, 1)),
+		SiteRTT{SiteID: "abc01", RTT: 0.1, LastUpdated: time.Unix(1, 1), Samples: 2, Mean: 0.6, EWMA: 0.6},
+		true,
+	},
+	// Case with an older new SiteRTT
+	{
+		NewSiteRTT("abc01", 0.1, time.Unix(1, 1)),
+		NewSiteRTT("abc01", 1.1, time.Unix(1, 0)),
+		SiteRTT{SiteID: "abc01", RTT: 0.1, LastUpdated: time.Unix(1, 1), Samples: 2, Mean: 0.6, EWMA: 0.6},
+		true,
+	},
+	// Case with SiteRTTs stored before statistics were kept, and before
+	// samples were weighted by age
+	{
+		SiteRTT{SiteID: "abc01", RTT: 2, LastUpdated: time.Unix(1, 0)},
+		SiteRTT{SiteID: "abc01", RTT: 4, LastUpdated: time.Unix(1, 1), Samples: 3, Mean: 6, EWMA: 6},
+		SiteRTT{SiteID: "abc01", RTT: 2, LastUpdated: time.Unix(1, 1), Samples: 4, Mean: 5, EWMA: 5},
+		true,
 	},
 }
 
 func TestMergeSiteRTTs(t *testing.T) {
-	var ok bool
-	var err error
-	var newSiteRTTStr string
 	for _, tt := range mergeSiteRTTsTests {
-		newSiteRTTStr = fmt.Sprintf("%v", tt.oldIn)
-		ok, err = MergeSiteRTTs(tt.oldIn, tt.newIn)
-		if err != nil || !reflect.DeepEqual(tt.oldIn, tt.out) || ok != tt.changed {
-			t.Fatalf("MergeSiteRTTs(%s, %v) = %v, %v, want %v, %v", newSiteRTTStr, tt.newIn, tt.oldIn, ok, tt.out, tt.changed)
+		sr := tt.oldIn
+		ok, err := MergeSiteRTTs(&sr, &tt.newIn)
+		if err != nil || !sameStats(sr, tt.out) || ok != tt.changed {
+			t.Fatalf("MergeSiteRTTs(%v, %v) = %v, %v, want %v, %v", tt.oldIn, tt.newIn, sr, ok, tt.out, tt.changed)
 		}
 	}
+	a, b := NewSiteRTT("abc01", 1, time.Unix(1, 0)), NewSiteRTT("def01", 1, time.Unix(1, 0))
+	if _, err := MergeSiteRTTs(&a, &b); err != ErrMergeSiteRTT {
+		t.Fatalf("MergeSiteRTTs(%v, %v) = %v, want %v", a, b, err, ErrMergeSiteRTT)
+	}
 }
 
 var mergeClientGroupsTests = []struct {
-	oldIn   *ClientGroup
-	newIn   *ClientGroup
-	out     *ClientGroup
+	oldIn   []SiteRTT
+	newIn   []SiteRTT
+	out     []SiteRTT // Compared by SiteID, RTT, LastUpdated and Samples
 	changed bool
 }{
 	// Case with new insert and update of old value
 	{
-		&ClientGroup{[]byte{173, 194, 36, 73}, []SiteRTT{
-			SiteRTT{"abc01", 1.1, time.Unix(1, 0)},
-		}},
-		&ClientGroup{[]byte{173, 194, 36, 73}, []SiteRTT{
-			SiteRTT{"abc01", 0.9, time.Unix(3, 0)},
-			SiteRTT{"def01", 4.2, time.Unix(2, 0)},
-		}},
-		&ClientGroup{[]byte{173, 194, 36, 73}, []SiteRTT{
-			SiteRTT{"abc01", 0.9, time.Unix(3, 0)},
-			SiteRTT{"def01", 4.2, time.Unix(2, 0)},
-		}},
+		[]SiteRTT{
+			NewSiteRTT("abc01", 1.1, time.Unix(1, 0)),
+		},
+		[]SiteRTT{
+			NewSiteRTT("abc01", 0.9, time.Unix(3, 0)),
+			NewSiteRTT("def01", 4.2, time.Unix(2, 0)),
+		},
+		[]SiteRTT{
+			SiteRTT{SiteID: "abc01", RTT: 0.9, LastUpdated: time.Unix(3, 0), Samples: 2},
+			SiteRTT{SiteID: "def01", RTT: 4.2, LastUpdated: time.Unix(2, 0), Samples: 1},
+		},
 		true,
 	},
 	// Case with new insert only
 	{
-		&ClientGroup{[]byte{173, 194, 36, 73}, []SiteRTT{
-			SiteRTT{"abc01", 0.9, time.Unix(3, 0)},
-		}},
-		&ClientGroup{[]byte{173, 194, 36, 73}, []SiteRTT{
-			SiteRTT{"def01", 4.2, time.Unix(2, 0)},
-		}},
-		&ClientGroup{[]byte{173, 194, 36, 73}, []SiteRTT{
-			SiteRTT{"abc01", 0.9, time.Unix(3, 0)},
-			SiteRTT{"def01", 4.2, time.Unix(2, 0)},
-		}},
+		[]SiteRTT{
+			NewSiteRTT("abc01", 0.9, time.Unix(3, 0)),
+		},
+		[]SiteRTT{
+			NewSiteRTT("def01", 4.2, time.Unix(2, 0)),
+		},
+		[]SiteRTT{
+			SiteRTT{SiteID: "abc01", RTT: 0.9, LastUpdated: time.Unix(3, 0), Samples: 1},
+			SiteRTT{SiteID: "def01", RTT: 4.2, LastUpdated: time.Unix(2, 0), Samples: 1},
+		},
 		true,
 	},
-	// Update two old values
+	// Update two old values, keeping the lower RTT and the later time
 	{
-		&ClientGroup{[]byte{173, 194, 36, 73}, []SiteRTT{
-			SiteRTT{"abc01", 0.9, time.Unix(3, 0)},
-			SiteRTT{"def01", 4.2, time.Unix(2, 0)},
-		}},
-		&ClientGroup{[]byte{173, 194, 36, 73}, []SiteRTT{
-			SiteRTT{"abc01", 0.7, time.Unix(4, 0)},
-			SiteRTT{"def01", 4.0, time.Unix(5, 0)},
-		}},
-		&ClientGroup{[]byte{173, 194, 36, 73}, []SiteRTT{
-			SiteRTT{"abc01", 0.7, time.Unix(4, 0)},
-			SiteRTT{"def01", 4.0, time.Unix(5, 0)},
-		}},
+		[]SiteRTT{
+			NewSiteRTT("abc01", 0.7, time.Unix(4, 0)),
+			NewSiteRTT("def01", 4.0, time.Unix(5, 0)),
+		},
+		[]SiteRTT{
+			NewSiteRTT("abc01", 0.9, time.Unix(3, 0)),
+			NewSiteRTT("def01", 4.2, time.Unix(6, 0)),
+		},
+		[]SiteRTT{
+			SiteRTT{SiteID: "abc01", RTT: 0.7, LastUpdated: time.Unix(4, 0), Samples: 2},
+			SiteRTT{SiteID: "def01", RTT: 4.0, LastUpdated: time.Unix(6, 0), Samples: 2},
+		},
 		true,
 	},
-	// Resulting in no change
+	// Resorting by a new minimum RTT
 	{
-		&ClientGroup{[]byte{173, 194, 36, 73}, []SiteRTT{
-			SiteRTT{"abc01", 0.7, time.Unix(4, 0)},
-			SiteRTT{"def01", 4.0, time.Unix(5, 0)},
-		}},
-		&ClientGroup{[]byte{173, 194, 36, 73}, []SiteRTT{
-			SiteRTT{"abc01", 0.9, time.Unix(3, 0)},
-			SiteRTT{"def01", 4.2, time.Unix(2, 0)},
-		}},
-		&ClientGroup{[]byte{173, 194, 36, 73}, []SiteRTT{
-			SiteRTT{"abc01", 0.7, time.Unix(4, 0)},
-			SiteRTT{"def01", 4.0, time.Unix(5, 0)},
-		}},
-		false,
+		[]SiteRTT{
+			NewSiteRTT("abc01", 0.7, time.Unix(4, 0)),
+			NewSiteRTT("def01", 4.0, time.Unix(5, 0)),
+		},
+		[]SiteRTT{
+			NewSiteRTT("def01", 0.5, time.Unix(6, 0)),
+		},
+		[]SiteRTT{
+			SiteRTT{SiteID: "def01", RTT: 0.5, LastUpdated: time.Unix(6, 0), Samples: 2},
+			SiteRTT{SiteID: "abc01", RTT: 0.7, LastUpdated: time.Unix(4, 0), Samples: 1},
+		},
+		true,
+	},
+	// Expiry of a SiteRTT not updated within SiteRTTHorizon
+	{
+		[]SiteRTT{
+			NewSiteRTT("abc01", 0.7, time.Unix(4, 0)),
+		},
+		[]SiteRTT{
+			NewSiteRTT("def01", 4.0, time.Unix(5, 0).Add(SiteRTTHorizon)),
+		},
+		[]SiteRTT{
+			SiteRTT{SiteID: "def01", RTT: 4.0, LastUpdated: time.Unix(5, 0).Add(SiteRTTHorizon), Samples: 1},
+		},
+		true,
 	},
 	// No change
 	{
-		&ClientGroup{[]byte{173, 194, 36, 73}, []SiteRTT{
-			SiteRTT{"abc01", 0.7, time.Unix(4, 0)},
-		}},
-		&ClientGroup{[]byte{173, 194, 36, 73}, []SiteRTT{
-			SiteRTT{"abc01", 0.7, time.Unix(4, 0)},
-		}},
-		&ClientGroup{[]byte{173, 194, 36, 73}, []SiteRTT{
-			SiteRTT{"abc01", 0.7, time.Unix(4, 0)},
-		}},
+		[]SiteRTT{
+			NewSiteRTT("abc01", 0.7, time.Unix(4, 0)),
+		},
+		[]SiteRTT{},
+		[]SiteRTT{
+			SiteRTT{SiteID: "abc01", RTT: 0.7, LastUpdated: time.Unix(4, 0), Samples: 1},
+		},
 		false,
 	},
 }
 
 func TestMergeClientGroups(t *testing.T) {
-	var ok bool
-	var err error
-	var newCGStr string
+	prefix := []byte{173, 194, 36, 73}
 	for _, tt := range mergeClientGroupsTests {
-		newCGStr = fmt.Sprintf("%v", tt.oldIn)
-		ok, err = MergeClientGroups(tt.oldIn, tt.newIn)
-		if err != nil || !reflect.DeepEqual(tt.oldIn, tt.out) || ok != tt.changed {
-			t.Fatalf("MergeClientGroups(%s, %v) = %v, %v, want %v, %v", newCGStr, tt.newIn, tt.oldIn, ok, tt.out, tt.changed)
+		oldCG := &ClientGroup{Prefix: prefix, SiteRTTs: append(SiteRTTs(nil), tt.oldIn...)}
+		newCG := &ClientGroup{Prefix: prefix, SiteRTTs: tt.newIn}
+		ok, err := MergeClientGroups(oldCG, newCG)
+		want := []ClientGroup{{Prefix: prefix, SiteRTTs: tt.out}}
+		if err != nil || !equalClientGroups([]ClientGroup{*oldCG}, want) || ok != tt.changed {
+			t.Fatalf("MergeClientGroups(%v, %v) = %v, %v, want %v, %v", tt.oldIn, tt.newIn, oldCG.SiteRTTs, ok, tt.out, tt.changed)
 		}
 	}
 }
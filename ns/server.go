@@ -12,28 +12,38 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-// +build appengine
-
 // The ns package provides the mlab-ns2 functionality.
 package ns
 
 import (
-	"appengine"
+	"code.google.com/p/mlab-ns2/gae/ns/data"
+	"code.google.com/p/mlab-ns2/gae/ns/geo"
+	"code.google.com/p/mlab-ns2/gae/ns/handlers"
 	"net/http"
 )
 
-import _ "appengine/remote_api"
-
 const (
 	URLRoot = "/"
 )
 
-func init() {
-	http.HandleFunc(URLRoot, root)
+// Register registers the root handler with mux. newContext is used to create
+// the data.Context with which each request is served.
+func Register(mux *http.ServeMux, newContext data.ContextFunc) {
+	mux.HandleFunc(URLRoot, data.Handler(newContext, root))
+}
+
+// NewServeMux returns a new *http.ServeMux with all mlab-ns2 handlers which do
+// not depend on App Engine registered. It is used to run mlab-ns2 outside of
+// App Engine.
+func NewServeMux(newContext data.ContextFunc) *http.ServeMux {
+	mux := http.NewServeMux()
+	Register(mux, newContext)
+	handlers.Register(mux, newContext)
+	geo.Register(mux, newContext)
+	return mux
 }
 
-func root(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
+func root(c data.Context, w http.ResponseWriter, r *http.Request) {
 	header := w.Header()
 	header.Set("Access-Control-Allow-Origin", "*")
 	header.Set("Content-Type", "text/html")
@@ -0,0 +1,225 @@
+// Copyright 2013 M-Lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ns
+
+import (
+	"code.google.com/p/mlab-ns2/gae/ns/data"
+	"code.google.com/p/mlab-ns2/gae/ns/geo"
+	"code.google.com/p/mlab-ns2/gae/ns/handlers"
+	"code.google.com/p/mlab-ns2/gae/ns/rtt"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newTestServer returns a server running all standalone handlers against an
+// in-memory store seeded with online ndt SliverTools and one ClientGroup.
+func newTestServer(t *testing.T) (*httptest.Server, data.Context) {
+	c := data.NewContext(data.NewMemoryStore(), data.NewMemoryCache(), nil, log.New(ioutil.Discard, "", 0))
+
+	slivers := []*data.SliverTool{
+		&data.SliverTool{
+			ToolID:     "ndt",
+			SliceID:    "iupui_ndt",
+			SiteID:     "lga01",
+			ServerID:   "mlab1",
+			FQDN:       "ndt.iupui.mlab1.lga01.measurement-lab.org",
+			SliverIPv4: "74.63.50.43",
+			SliverIPv6: "off",
+			StatusIPv4: data.SliverStatusOnline,
+			Latitude:   40.77,
+			Longitude:  -73.87,
+			City:       "New York_NY",
+			Country:    "US",
+		},
+		&data.SliverTool{
+			ToolID:     "ndt",
+			SliceID:    "iupui_ndt",
+			SiteID:     "ams01",
+			ServerID:   "mlab1",
+			FQDN:       "ndt.iupui.mlab1.ams01.measurement-lab.org",
+			SliverIPv4: "213.244.128.164",
+			SliverIPv6: "2001:7f8:1:1::164",
+			StatusIPv4: data.SliverStatusOnline,
+			StatusIPv6: data.SliverStatusOnline,
+			Latitude:   52.31,
+			Longitude:  4.76,
+		},
+	}
+	for _, sliver := range slivers {
+		key := data.NewKey("SliverTool", data.GetSliverToolID(sliver.ToolID, sliver.SliceID, sliver.ServerID, sliver.SiteID), nil)
+		if err := c.Store().Put(key, sliver); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cg := rtt.NewClientGroup(net.ParseIP("24.164.160.0"))
+	cg.SiteRTTs = append(cg.SiteRTTs,
+		rtt.SiteRTT{SiteID: "lga01", RTT: 7.7, LastUpdated: time.Unix(1376828167, 0)},
+		rtt.SiteRTT{SiteID: "dfw01", RTT: 40.2, LastUpdated: time.Unix(1376828167, 0)}, // No SliverTools
+		rtt.SiteRTT{SiteID: "ams01", RTT: 95.1, LastUpdated: time.Unix(1376828167, 0)},
+	)
+	key := cg.Key()
+	if err := c.Store().Put(key, cg); err != nil {
+		t.Fatal(err)
+	}
+
+	cg6 := rtt.NewClientGroup(net.ParseIP("2001:4860:4860::"))
+	cg6.SiteRTTs = append(cg6.SiteRTTs,
+		rtt.SiteRTT{SiteID: "lga01", RTT: 8.1, LastUpdated: time.Unix(1376828167, 0)}, // IPv6 off
+		rtt.SiteRTT{SiteID: "ams01", RTT: 90.3, LastUpdated: time.Unix(1376828167, 0)},
+	)
+	key = cg6.Key()
+	if err := c.Store().Put(key, cg6); err != nil {
+		t.Fatal(err)
+	}
+
+	// 4.2.2.0/24 is located in New York
+	mmLoc := &data.MMLocation{RangeStart: 0x04020200, RangeEnd: 0x040202ff, Latitude: 41, Longitude: -74}
+	if err := c.Store().Put(data.NewKey("MMLocation", "4.2.2.0", nil), mmLoc); err != nil {
+		t.Fatal(err)
+	}
+
+	mux := NewServeMux(func(r *http.Request) data.Context {
+		return c
+	})
+	return httptest.NewServer(mux), c
+}
+
+var serverTests = []struct {
+	path        string
+	cityLatLong string // X-AppEngine-CityLatLong header
+	status      int
+	body        string
+	method      string // X-Resolver-Method header
+}{
+	{"/rtt/?tool_id=ndt&ip=24.164.163.78", "", http.StatusOK, "74.63.50.43\n", handlers.MethodRTT},
+	{"/rtt/?tool_id=ndt&ip=24.164.163.78&n=5", "", http.StatusOK, "74.63.50.43\n213.244.128.164\n", handlers.MethodRTT},
+	{"/rtt/?tool_id=ndt&ip=24.164.163.78&n=1", "", http.StatusOK, "74.63.50.43\n", handlers.MethodRTT},
+	{"/rtt/?tool_id=ndt&ip=24.164.163.78&n=0", "", http.StatusBadRequest, "", ""},
+	{"/rtt/?tool_id=npad&ip=24.164.163.78", "", http.StatusNotFound, handlers.ErrNotEnoughData.Error() + "\n", ""},
+	{"/rtt/?tool_id=ndt&ip=24.164.163.78&address_family=ipv6", "", http.StatusOK, "2001:7f8:1:1::164\n", handlers.MethodRTT},
+	{"/rtt/?tool_id=ndt&ip=24.164.163.78&address_family=auto&n=5", "", http.StatusOK, "74.63.50.43\n213.244.128.164\n", handlers.MethodRTT},
+	{"/rtt/?tool_id=ndt&ip=2001:4860:4860::8888", "", http.StatusOK, "2001:7f8:1:1::164\n", handlers.MethodRTT},
+	{"/rtt/?tool_id=ndt&ip=2001:4860:4860::8888&address_family=ipv4", "", http.StatusOK, "74.63.50.43\n", handlers.MethodRTT},
+	{"/rtt/?tool_id=ndt&ip=24.164.170.1", "", http.StatusOK, "74.63.50.43\n", handlers.MethodRTT}, // Neighbouring ClientGroup
+	{"/rtt/?tool_id=ndt&ip=24.164.163.78&address_family=ipx", "", http.StatusBadRequest, handlers.ErrInvalidAF.Error() + "\n", ""},
+	{"/rtt/?tool_id=ndt&ip=bogus", "", http.StatusBadRequest, handlers.ErrInvalidIP.Error() + "\n", ""},
+
+	// Fallbacks without RTT data
+	{"/rtt/?tool_id=ndt&ip=4.2.2.2&n=5", "", http.StatusOK, "74.63.50.43\n213.244.128.164\n", handlers.MethodGeo},
+	{"/rtt/?tool_id=ndt", "52.37,4.89", http.StatusOK, "213.244.128.164\n", handlers.MethodGeo},
+	{"/rtt/?tool_id=ndt&ip=4.2.2.2", "52.37,4.89", http.StatusOK, "74.63.50.43\n", handlers.MethodGeo}, // Header ignored
+	{"/rtt/?tool_id=ndt&ip=8.8.8.8&address_family=ipv6", "", http.StatusOK, "2001:7f8:1:1::164\n", handlers.MethodRandom},
+
+	// Policies
+	{"/rtt/?tool_id=ndt&ip=24.164.163.78&policy=geo,random&address_family=ipv6", "", http.StatusOK, "2001:7f8:1:1::164\n", handlers.MethodRandom},
+	{"/rtt/?tool_id=ndt&ip=4.2.2.2&policy=rtt", "", http.StatusNotFound, handlers.ErrNotEnoughData.Error() + "\n", ""},
+	{"/rtt/?tool_id=ndt&ip=4.2.2.2&policy=random&address_family=ipv6", "", http.StatusOK, "2001:7f8:1:1::164\n", handlers.MethodRandom},
+	{"/rtt/?tool_id=ndt&ip=24.164.163.78&policy=nearest", "", http.StatusBadRequest, handlers.ErrInvalidPolicy.Error() + "\n", ""},
+
+	{"/admin/rtt/import/setLastSuccessfulDate?date=2013-08-01", "", http.StatusOK, "", ""},
+}
+
+func TestServer(t *testing.T) {
+	ts, c := newTestServer(t)
+	defer ts.Close()
+
+	for _, tt := range serverTests {
+		req, _ := http.NewRequest("GET", ts.URL+tt.path, nil)
+		if tt.cityLatLong != "" {
+			req.Header.Set(geo.HeaderCityLatLong, tt.cityLatLong)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET %s: %v", tt.path, err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Fatalf("GET %s: status = %d, want %d", tt.path, resp.StatusCode, tt.status)
+		}
+		if tt.body != "" && string(body) != tt.body {
+			t.Fatalf("GET %s: body = %q, want %q", tt.path, body, tt.body)
+		}
+		if method := resp.Header.Get(handlers.HeaderResolverMethod); method != tt.method {
+			t.Fatalf("GET %s: %s = %q, want %q", tt.path, handlers.HeaderResolverMethod, method, tt.method)
+		}
+	}
+
+	last, err := rtt.GetLastSuccesfulImportDate(c)
+	if err != nil || !last.Equal(time.Date(2013, 8, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("GetLastSuccesfulImportDate = %v, %v, want 2013-08-01", last, err)
+	}
+}
+
+var serverRTTJSONTests = []struct {
+	path       string
+	accept     string
+	confidence float64
+}{
+	{"/rtt/?tool_id=ndt&ip=24.164.163.78&format=json", "", 1},
+	{"/rtt/?tool_id=ndt&ip=24.164.163.78", "text/html;q=0.9, application/json", 1},
+	{"/rtt/?tool_id=ndt&ip=24.164.170.1&format=json", "", 0.25}, // Prefix distance of 2 bits
+}
+
+func TestServerRTTJSON(t *testing.T) {
+	ts, _ := newTestServer(t)
+	defer ts.Close()
+
+	want := map[string]interface{}{
+		"fqdn":           "ndt.iupui.mlab1.lga01.measurement-lab.org",
+		"ip":             "74.63.50.43",
+		"address_family": "ipv4",
+		"ipv4":           "74.63.50.43",
+		"site":           "lga01",
+		"city":           "New York_NY",
+		"country":        "US",
+		"latitude":       40.77,
+		"longitude":      -73.87,
+		"method":         "rtt",
+		"rtt":            7.7,
+		"last_updated":   time.Unix(1376828167, 0).Format(time.RFC3339),
+	}
+	for _, tt := range serverRTTJSONTests {
+		req, _ := http.NewRequest("GET", ts.URL+tt.path, nil)
+		if tt.accept != "" {
+			req.Header.Set("Accept", tt.accept)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET %s: %v", tt.path, err)
+		}
+		want["confidence"] = tt.confidence
+		var got map[string]interface{}
+		err = json.NewDecoder(resp.Body).Decode(&got)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("GET %s: %v", tt.path, err)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+			t.Fatalf("GET %s: Content-Type = %q, want application/json", tt.path, ct)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("GET %s = %v, want %v", tt.path, got, want)
+		}
+	}
+}